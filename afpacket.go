@@ -1,23 +1,230 @@
+//go:build linux
+// +build linux
+
 package gourmet
 
 import (
+	"fmt"
+	"io/ioutil"
 	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/google/gopacket"
 	"github.com/google/gopacket/afpacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
 )
 
-func newAfpacketSensor(c *Config) (*afpacket.TPacket, error) {
-	if c.Bpf != "" {
-		log.Println("[*] Warning: filter option will not be applied when using afpacket sensor")
+// afpacketFanout is the fanout mode of the rings of an interface. Packets are spread by the hash of
+// their flow, which is the same in both directions, and fragments are reassembled before they are
+// hashed so that they reach the ring of their flow.
+const afpacketFanout = afpacket.FanoutHash | afpacket.FanoutHashWithDefrag
+
+// errCaptureTimeout is returned by packet sources that poll when nothing was captured within the
+// poll timeout
+var errCaptureTimeout = afpacket.ErrTimeout
+
+// newAfpacketSensor opens a TPacket ring on the interface, whose frames have the link type.
+//
+// The block timeout is how long the kernel waits before handing a partially filled block of the
+// ring to Gourmet, so it bounds the capture latency of packets under low traffic. Lower values
+// reduce latency at the cost of more wakeups. The poll timeout is how long a read waits for the
+// next block. By default reads block until traffic arrives, which costs no CPU on an idle link but
+// means timed out TCP connections are only reaped when the next packet is read. With a poll timeout,
+// reads return periodically and the reaper runs on every timeout as well, so idle connections are
+// flushed at most one poll timeout after the reap interval elapses. Unlike libpcap, afpacket has no
+// immediate mode, and the block timeout serves the same purpose.
+//
+// Every frame of the ring is large enough for a packet of the snapshot length, so the ring takes
+// up the block size times the number of blocks, 64 MiB with the defaults, or more when frames
+// larger than a block are needed. The frame size is the snapshot length rounded up to a power of
+// two, which keeps jumbo frames intact with any snapshot length of at least 9018 bytes. With
+// ring_size_mb, the ring has as many blocks as fit in that many MiB instead.
+func newAfpacketSensor(c *Config, iface string, linkType layers.LinkType) (*afpacket.TPacket, error) {
+	// the filter is compiled before the ring is opened, so that an invalid filter does not take the
+	// memory of a ring
+	var instructions []bpf.RawInstruction
+	if expr := c.effectiveBpf(iface); expr != "" {
+		var err error
+		instructions, err = compileRawFilter(expr, linkType, c.SnapLen)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bpf filter %q for interface %s: %s", expr, iface, err)
+		}
 	}
 	if c.Promiscuous == true {
 		log.Println("[*] Warning: promiscuous mode not supported when using afpacket sensor")
 	}
-	tPacket, err := afpacket.NewTPacket(
-		afpacket.OptFrameSize(c.SnapLen),
-		afpacket.OptInterface(c.Interface))
+	frameSize, blockSize := afpacketRingSize(c.SnapLen)
+	numBlocks := afpacketNumBlocks(c.RingSizeMB, blockSize)
+	options := []interface{}{
+		afpacket.OptFrameSize(frameSize),
+		afpacket.OptBlockSize(blockSize),
+		afpacket.OptNumBlocks(numBlocks),
+		afpacket.OptInterface(iface),
+	}
+	if c.AfpacketPollTimeout > 0 {
+		options = append(options, afpacket.OptPollTimeout(time.Millisecond*time.Duration(c.AfpacketPollTimeout)))
+	}
+	if c.AfpacketBlockTimeout > 0 {
+		options = append(options, afpacket.OptBlockTimeout(time.Millisecond*time.Duration(c.AfpacketBlockTimeout)))
+	}
+	tPacket, err := afpacket.NewTPacket(options...)
 	if err != nil {
 		return nil, err
 	}
+	if instructions != nil {
+		err = tPacket.SetBPF(instructions)
+		if err != nil {
+			tPacket.Close()
+			return nil, fmt.Errorf("unable to set the bpf filter of interface %s: %s", iface, err)
+		}
+	}
+	log.Printf("[*] afpacket ring on %s uses %d MiB for frames of %d bytes",
+		iface, blockSize*numBlocks>>20, frameSize)
 	return tPacket, nil
 }
+
+// newAfpacketSensors opens the rings to capture on the interface. With fanout_workers above 1, that
+// many rings join a PACKET_FANOUT group, which spreads the packets of the interface over them so
+// that each is read by its own capture loop, and capture scales beyond the core that reads a single
+// ring. Every ring takes the memory of a single one. group is the ID of the fanout group, which must
+// differ between the interfaces of the sensor and from the groups of other processes.
+func newAfpacketSensors(c *Config, iface string, linkType layers.LinkType, group uint16) ([]gopacket.ZeroCopyPacketDataSource, error) {
+	workers := c.FanoutWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	var rings []gopacket.ZeroCopyPacketDataSource
+	for i := 0; i < workers; i++ {
+		tPacket, err := newAfpacketSensor(c, iface, linkType)
+		if err == nil && workers > 1 {
+			err = tPacket.SetFanout(afpacketFanout, group)
+			if err != nil {
+				tPacket.Close()
+				err = fmt.Errorf("unable to join fanout group %d: %s", group, err)
+			}
+		}
+		if err != nil {
+			for _, ring := range rings {
+				ring.(*afpacket.TPacket).Close()
+			}
+			return nil, err
+		}
+		rings = append(rings, tPacket)
+	}
+	return rings, nil
+}
+
+// interfaceLinkType returns the link type of the frames that AF_PACKET sockets capture on the
+// interface, from the ARPHRD type of the interface. Interfaces without a link layer, such as tun
+// devices and PPP links, deliver bare IP packets.
+func interfaceLinkType(iface string) (layers.LinkType, error) {
+	data, err := ioutil.ReadFile(filepath.Join("/sys/class/net", iface, "type"))
+	if err != nil {
+		return 0, fmt.Errorf("unable to read the link type of interface %s: %s", iface, err)
+	}
+	arphrd, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, fmt.Errorf("unable to read the link type of interface %s: %s", iface, err)
+	}
+	switch arphrd {
+	case unix.ARPHRD_ETHER, unix.ARPHRD_LOOPBACK:
+		return layers.LinkTypeEthernet, nil
+	case unix.ARPHRD_NONE, unix.ARPHRD_PPP:
+		return layers.LinkTypeRaw, nil
+	}
+	return 0, fmt.Errorf("interface %s has link type %d, which is not supported", iface, arphrd)
+}
+
+// afpacketNumBlocks returns the number of blocks of a ring of ringSizeMB MiB, or the default number
+// if it is 0. A ring has at least one block.
+func afpacketNumBlocks(ringSizeMB, blockSize int) int {
+	if ringSizeMB <= 0 {
+		return afpacket.DefaultNumBlocks
+	}
+	numBlocks := (ringSizeMB << 20) / blockSize
+	if numBlocks < 1 {
+		numBlocks = 1
+	}
+	return numBlocks
+}
+
+// afpacketRingSize returns the frame and block size of the ring for the snapshot length. The block
+// size must be a multiple of the frame size, which holds for powers of two.
+func afpacketRingSize(snapLen int) (frameSize, blockSize int) {
+	frameSize = afpacket.DefaultFrameSize
+	for frameSize < snapLen {
+		frameSize <<= 1
+	}
+	blockSize = afpacket.DefaultBlockSize
+	if blockSize < frameSize {
+		blockSize = frameSize
+	}
+	return frameSize, blockSize
+}
+
+// strippedVLAN returns the ID of the VLAN tag that the NIC stripped from a frame captured with
+// afpacket, which is only in the ancillary data of the capture.
+func strippedVLAN(data interface{}) (int, bool) {
+	stripped, ok := data.(afpacket.AncillaryVLAN)
+	return stripped.VLAN, ok
+}
+
+// ringDrops returns how many packets the kernel dropped from the rings of an afpacket or AF_XDP
+// source.
+func ringDrops(source interface{}) (uint64, error) {
+	switch src := source.(type) {
+	case *afpacket.TPacket:
+		stats, statsV3, err := src.SocketStats()
+		if err != nil {
+			return 0, err
+		}
+		return uint64(stats.Drops() + statsV3.Drops()), nil
+	case *xdpSource:
+		return src.drops()
+	}
+	return 0, errNoDrops
+}
+
+// mapsRing reports whether a packet source reads from rings that are unmapped when it is closed,
+// which afpacket and AF_XDP sources do.
+func mapsRing(source interface{}) bool {
+	switch source.(type) {
+	case *afpacket.TPacket, *xdpSource:
+		return true
+	}
+	return false
+}
+
+// ringFilter compiles a BPF filter for an afpacket source whose frames have the link type, and
+// returns the function that sets it on the source. It returns nil for other sources.
+func ringFilter(source interface{}, expr string, linkType layers.LinkType, snapLen int) (func() error, error) {
+	tPacket, ok := source.(*afpacket.TPacket)
+	if !ok {
+		return nil, nil
+	}
+	instructions, err := compileRawFilter(expr, linkType, snapLen)
+	if err != nil {
+		return nil, err
+	}
+	return func() error { return tPacket.SetBPF(instructions) }, nil
+}
+
+// compileRawFilter compiles a BPF filter for frames of the link type into the instructions that
+// sockets take, for packet sources that libpcap does not filter.
+func compileRawFilter(expr string, linkType layers.LinkType, snapLen int) ([]bpf.RawInstruction, error) {
+	instructions, err := pcap.CompileBPFFilter(filterLinkType(linkType), snapLen, expr)
+	if err != nil {
+		return nil, err
+	}
+	raw := make([]bpf.RawInstruction, len(instructions))
+	for i, ins := range instructions {
+		raw[i] = bpf.RawInstruction{Op: ins.Code, Jt: ins.Jt, Jf: ins.Jf, K: ins.K}
+	}
+	return raw, nil
+}
@@ -0,0 +1,46 @@
+//go:build !linux
+// +build !linux
+
+package gourmet
+
+import (
+	"errors"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// errCaptureTimeout is never returned on platforms without afpacket, whose packet sources block
+var errCaptureTimeout = errors.New("capture timed out")
+
+// newAfpacketSensors fails on platforms other than Linux, which have no AF_PACKET sockets.
+func newAfpacketSensors(c *Config, iface string, linkType layers.LinkType, group uint16) ([]gopacket.ZeroCopyPacketDataSource, error) {
+	return nil, errors.New("afpacket is only available on Linux. Use libpcap instead")
+}
+
+// newXDPSensor fails on platforms other than Linux, which have no AF_XDP sockets.
+func newXDPSensor(c *Config, iface string) (gopacket.ZeroCopyPacketDataSource, error) {
+	return nil, errors.New("afxdp is only available on Linux. Use libpcap instead")
+}
+
+func strippedVLAN(data interface{}) (int, bool) {
+	return 0, false
+}
+
+func ringDrops(source interface{}) (uint64, error) {
+	return 0, errNoDrops
+}
+
+func mapsRing(source interface{}) bool {
+	return false
+}
+
+// interfaceLinkType fails on platforms other than Linux, whose interfaces are only captured on with
+// libpcap.
+func interfaceLinkType(iface string) (layers.LinkType, error) {
+	return 0, errors.New("afpacket is only available on Linux. Use libpcap instead")
+}
+
+func ringFilter(source interface{}, expr string, linkType layers.LinkType, snapLen int) (func() error, error) {
+	return nil, nil
+}
@@ -0,0 +1,22 @@
+//go:build linux
+// +build linux
+
+package gourmet
+
+import (
+	"testing"
+)
+
+func TestAfpacketRingSize(t *testing.T) {
+	// a standard frame, a jumbo frame with its Ethernet header, and the default snapshot length
+	for _, snapLen := range []int{1514, 9018, 65535, 262144} {
+		frameSize, blockSize := afpacketRingSize(snapLen)
+		if frameSize < snapLen {
+			t.Errorf("snapshot length %d: frames of %d bytes truncate packets", snapLen, frameSize)
+		}
+		if blockSize%frameSize != 0 {
+			t.Errorf("snapshot length %d: blocks of %d bytes do not hold whole frames of %d bytes",
+				snapLen, blockSize, frameSize)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+//go:build linux
+// +build linux
+
+package gourmet
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/asavie/xdp"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/afpacket"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// xdpFrameSize is the size of a frame of the UMEM, which the kernel limits to a page
+	xdpFrameSize = 4096
+	xdpNumFrames = 4096
+	xdpRingSize  = 2048
+	// xdpPollTimeout is how many milliseconds a read waits for packets, after which idle connections
+	// are reaped and shutdown is checked
+	xdpPollTimeout = 100
+)
+
+// xdpSource captures packets from an interface with AF_XDP sockets, which hand frames from the
+// driver to Gourmet without passing them through the network stack. Gourmet attaches an XDP
+// program that redirects every packet of the interface to one socket per receive queue, so the
+// packets are not seen by the network stack of the host while the sensor runs, which suits a
+// dedicated capture interface and requires afxdp_redirect. The program is detached when the source
+// is closed, which happens on shutdown and when the sensor fails to start, but stays attached if the
+// process is killed, until it is removed with ip link set dev <interface> xdp off. Frames are limited to xdpFrameSize bytes, so jumbo frames are not
+// captured. Like afpacket, AF_XDP does not apply BPF filters and is always promiscuous.
+type xdpSource struct {
+	iface   string
+	ifindex int
+	program *xdp.Program
+	sockets []*xdp.Socket
+	pollFds []unix.PollFd
+	// next is the socket that is read first on the next batch, which keeps the queues from starving
+	// each other
+	next    int
+	current *xdp.Socket
+	pending []xdp.Desc
+}
+
+// newXDPSensor attaches the redirect program to the interface and opens a socket on each of its
+// receive queues. It fails on kernels or drivers without AF_XDP support, and on interfaces that
+// already run an XDP program, which is left untouched, as it may be one left by a sensor that was
+// killed.
+func newXDPSensor(c *Config, iface string) (*xdpSource, error) {
+	if c.effectiveBpf(iface) != "" {
+		log.Println("[*] Warning: filter option will not be applied when using afxdp sensor")
+	}
+	link, err := netlink.LinkByName(iface)
+	if err != nil {
+		return nil, err
+	}
+	if attrs := link.Attrs(); attrs.Xdp != nil && attrs.Xdp.Attached {
+		return nil, fmt.Errorf("an XDP program is already attached to the interface, remove it with ip link set dev %s xdp off if it was left by a sensor", iface)
+	}
+	xs := &xdpSource{
+		iface:   iface,
+		ifindex: link.Attrs().Index,
+	}
+	queues := rxQueues(iface)
+	xs.program, err = xdp.NewProgram(queues)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load XDP program: %s", err)
+	}
+	err = xs.program.Attach(xs.ifindex)
+	if err != nil {
+		xs.program.Close()
+		return nil, fmt.Errorf("failed to attach XDP program: %s", err)
+	}
+	options := &xdp.SocketOptions{
+		NumFrames:              xdpNumFrames,
+		FrameSize:              xdpFrameSize,
+		FillRingNumDescs:       xdpRingSize,
+		CompletionRingNumDescs: 64,
+		RxRingNumDescs:         xdpRingSize,
+		TxRingNumDescs:         64,
+	}
+	for queue := 0; queue < queues; queue++ {
+		xsk, err := xdp.NewSocket(xs.ifindex, queue, options)
+		if err == nil {
+			err = xs.program.Register(queue, xsk.FD())
+		}
+		if err != nil {
+			xs.Close()
+			return nil, fmt.Errorf("failed to open AF_XDP socket on queue %d: %s", queue, err)
+		}
+		xs.sockets = append(xs.sockets, xsk)
+		xs.pollFds = append(xs.pollFds, unix.PollFd{Fd: int32(xsk.FD()), Events: unix.POLLIN})
+	}
+	log.Printf("[*] AF_XDP on %s uses %d sockets of %d MiB", iface, queues, xdpNumFrames*xdpFrameSize>>20)
+	log.Printf("[!] WARNING: every packet of %s is redirected to Gourmet, and the host receives none until the sensor exits. "+
+		"If the sensor is killed, run ip link set dev %s xdp off to give the interface back to the host", iface, iface)
+	return xs, nil
+}
+
+// rxQueues returns the number of receive queues of the interface, or 1 if it cannot be determined.
+func rxQueues(iface string) int {
+	entries, err := ioutil.ReadDir(fmt.Sprintf("/sys/class/net/%s/queues", iface))
+	if err != nil {
+		return 1
+	}
+	var queues int
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), "rx-") {
+			queues++
+		}
+	}
+	if queues == 0 {
+		return 1
+	}
+	return queues
+}
+
+// ZeroCopyReadPacketData returns the next received frame. The frame is only valid until the next
+// call, when the frames of a consumed batch are given back to the kernel. It returns
+// afpacket.ErrTimeout if nothing was received within the poll timeout.
+func (xs *xdpSource) ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	var ci gopacket.CaptureInfo
+	for len(xs.pending) == 0 {
+		for _, xsk := range xs.sockets {
+			if n := xsk.NumFreeFillSlots(); n > 0 {
+				xsk.Fill(xsk.GetDescs(n))
+			}
+		}
+		if xs.receive() {
+			break
+		}
+		n, err := unix.Poll(xs.pollFds, xdpPollTimeout)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return nil, ci, err
+		}
+		if n == 0 {
+			return nil, ci, afpacket.ErrTimeout
+		}
+		xs.receive()
+	}
+	frame := xs.current.GetFrame(xs.pending[0])
+	xs.pending = xs.pending[1:]
+	ci.Timestamp = time.Now()
+	ci.CaptureLength = len(frame)
+	ci.Length = len(frame)
+	return frame, ci, nil
+}
+
+// receive takes the received frames of the first socket that has any, starting from next.
+func (xs *xdpSource) receive() bool {
+	for i := range xs.sockets {
+		xsk := xs.sockets[(xs.next+i)%len(xs.sockets)]
+		if n := xsk.NumReceived(); n > 0 {
+			xs.current = xsk
+			xs.pending = xsk.Receive(n)
+			xs.next = (xs.next + i + 1) % len(xs.sockets)
+			return true
+		}
+	}
+	return false
+}
+
+// drops returns the frames dropped by the kernel because the sockets could not keep up.
+func (xs *xdpSource) drops() (uint64, error) {
+	var drops uint64
+	for _, xsk := range xs.sockets {
+		stats, err := xsk.Stats()
+		if err != nil {
+			return 0, err
+		}
+		drops += stats.KernelStats.Rx_dropped + stats.KernelStats.Rx_ring_full
+	}
+	return drops, nil
+}
+
+// Close detaches the program from the interface, which hands its packets back to the network stack,
+// and closes the sockets.
+func (xs *xdpSource) Close() {
+	err := xs.program.Detach(xs.ifindex)
+	if err != nil {
+		log.Printf("[!] Failed to detach XDP program from %s: %s", xs.iface, err)
+	}
+	for queue, xsk := range xs.sockets {
+		xs.program.Unregister(queue)
+		xsk.Close()
+	}
+	xs.program.Close()
+}
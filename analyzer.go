@@ -1,90 +1,737 @@
 package gourmet
 
 import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"math"
 	"os"
 	"os/exec"
-	"os/user"
+	"path"
 	"path/filepath"
 	"plugin"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 
 	mapset "github.com/deckarep/golang-set"
+	"github.com/google/gopacket"
 )
 
 var (
-	registeredAnalyzers []Analyzer
-	resolvedGraph       analyzerGraph
+	// registeredAnalyzers is replaced as a whole when analyzers are reloaded, and is read through
+	// currentAnalyzers
+	registeredAnalyzers []*registeredAnalyzer
+	// analyzersLock is held for reading while a connection is analyzed, so that analyzers replaced by
+	// a reload are only closed once no connection is using them
+	analyzersLock sync.RWMutex
 )
 
+func currentAnalyzers() []*registeredAnalyzer {
+	analyzersLock.RLock()
+	defer analyzersLock.RUnlock()
+	return registeredAnalyzers
+}
+
+func setRegisteredAnalyzers(analyzers []*registeredAnalyzer) {
+	analyzersLock.Lock()
+	registeredAnalyzers = analyzers
+	countPacketAnalyzers(analyzers)
+	analyzersLock.Unlock()
+}
+
+// packetAnalyzerCount is the number of registered analyzers that implement PacketAnalyzer, so that
+// packets are only handed to the analyzers when some of them want packets
+var packetAnalyzerCount int32
+
+func countPacketAnalyzers(analyzers []*registeredAnalyzer) {
+	var count int32
+	for _, ra := range analyzers {
+		if ra.packetAnalyzer != nil {
+			count++
+		}
+	}
+	atomic.StoreInt32(&packetAnalyzerCount, count)
+}
+
+// analyzePacket hands a packet to every registered PacketAnalyzer.
+func analyzePacket(packet gopacket.Packet) {
+	analyzersLock.RLock()
+	defer analyzersLock.RUnlock()
+	for _, ra := range registeredAnalyzers {
+		if ra.packetAnalyzer != nil {
+			ra.packetAnalyzer.AnalyzePacket(packet)
+		}
+	}
+}
+
+// registeredAnalyzer is a loaded Analyzer along with the settings that the framework applies to it
+type registeredAnalyzer struct {
+	name     string
+	analyzer Analyzer
+	// packetAnalyzer is the analyzer if it also implements PacketAnalyzer
+	packetAnalyzer PacketAnalyzer
+	sampleRate     float64
+	localities     map[string]bool
+	namespace      string
+	// source identifies what the analyzer was built from, and config is its section of the config.
+	// An analyzer is only replaced on reload when either of them changes.
+	source string
+	config interface{}
+	// deps are the names of the analyzers whose results the analyzer needs, from its depends_on
+	// argument and its DependsOn method
+	deps []string
+	// warnedEmptyKey is only accessed from the goroutine that analyzes connections
+	warnedEmptyKey bool
+}
+
+// appliesTo reports whether the connection has one of the localities the analyzer is restricted to.
+// Analyzers without a locality restriction, or connections without a locality, always apply.
+func (ra *registeredAnalyzer) appliesTo(c *Connection) bool {
+	if len(ra.localities) == 0 || c.Locality == "" {
+		return true
+	}
+	return ra.localities[c.Locality]
+}
+
+// sampled reports whether the analyzer should run on the connection. The decision only depends on
+// the connection UID and the analyzer name, so it is the same for both directions of a connection
+// and independent between analyzers.
+func (ra *registeredAnalyzer) sampled(c *Connection) bool {
+	if ra.sampleRate >= 1 {
+		return true
+	}
+	h := fnv.New64a()
+	uid := make([]byte, 8)
+	binary.BigEndian.PutUint64(uid, c.uid)
+	h.Write(uid)
+	h.Write([]byte(ra.name))
+	return float64(h.Sum64())/math.MaxUint64 < ra.sampleRate
+}
+
+// Result is the outcome of an Analyzer for a connection. Key must return a stable, non-empty
+// identifier, which is the key of the result in the Analyzers map of the connection. Results with an
+// empty key are skipped, or keyed by the name of their analyzer if the empty_result_key config is
+// name, and a warning is logged once per analyzer.
 type Result interface {
 	Key() string
 }
 
+// Behaviors for results whose Key is empty
+const (
+	emptyKeySkip = "skip"
+	emptyKeyName = "name"
+)
+
+// emptyKeyUsesName is set when results with an empty key are keyed by the name of their analyzer
+var emptyKeyUsesName bool
+
+func setEmptyResultKey(behavior string) error {
+	switch behavior {
+	case "", emptyKeySkip:
+		emptyKeyUsesName = false
+	case emptyKeyName:
+		emptyKeyUsesName = true
+	default:
+		return fmt.Errorf("invalid empty_result_key %s. Must be skip or name", behavior)
+	}
+	return nil
+}
+
+// keyedResult is handed to the result store in place of a result with an empty key, under the name
+// of its analyzer.
+type keyedResult struct {
+	Result
+	key string
+}
+
+func (kr *keyedResult) Key() string {
+	return kr.key
+}
+
+func (kr *keyedResult) MarshalJSON() ([]byte, error) {
+	return json.Marshal(kr.Result)
+}
+
+// keyResult returns the result to store for a result with an empty key, or nil if it is skipped.
+func (ra *registeredAnalyzer) keyResult(result Result) Result {
+	key := path.Base(ra.name)
+	if !ra.warnedEmptyKey {
+		ra.warnedEmptyKey = true
+		if emptyKeyUsesName {
+			log.Printf("[!] Warning: analyzer %s returned a result with an empty key. Storing its results under %s", ra.name, key)
+		} else {
+			log.Printf("[!] Warning: analyzer %s returned a result with an empty key. Skipping its results", ra.name)
+		}
+	}
+	if !emptyKeyUsesName {
+		return nil
+	}
+	return &keyedResult{Result: result, key: key}
+}
+
+// Analyzer is implemented by every Gourmet analyzer plugin. Filter decides whether the analyzer is
+// interested in a Connection, and Analyze is only called on the connections it accepted. Analyze may
+// return a nil Result with a nil error when there is nothing to record for the connection. Analyzers
+// that hold resources can implement io.Closer, and are closed once the sensor has shut down, or once
+// they have been replaced or removed by a reload.
 type Analyzer interface {
 	Filter(c *Connection) bool
 	Analyze(c *Connection) (Result, error)
 }
 
+// PacketAnalyzer can be implemented by an Analyzer to also receive the packets that the sensor
+// captures, for traffic that does not map to connections, such as ARP spoofing, DHCP, or scans.
+// AnalyzePacket is called with every packet, after IP fragments are reassembled and before the
+// packet is tracked, with the capture info of the packet in its metadata. Packets are processed
+// concurrently, so AnalyzePacket must be safe for concurrent use, and it must be fast, as it holds up
+// the processing of the packet. Sampling and locality do not apply to packets, and analyzers running
+// in a separate process do not receive them.
+type PacketAnalyzer interface {
+	AnalyzePacket(packet gopacket.Packet)
+}
+
+// Dependent can be implemented by an Analyzer that reads the results of other analyzers, such as one
+// that looks for stolen credentials in the transactions of the http analyzer. DependsOn returns the
+// names of those analyzers as they are configured, which are added to the depends_on argument of the
+// analyzer and must be in the analyzers config as well. An analyzer runs after the analyzers it
+// depends on, and only on the connections that each of them returned a result for, so with the
+// default result store their results are always in the Analyzers map of the connection when Analyze
+// is called.
+type Dependent interface {
+	DependsOn() []string
+}
+
+// Configurable can be implemented by an Analyzer that takes settings, such as thresholds, API keys,
+// or allowlists, from its section of the analyzers config. Init is called once, after the analyzer
+// is loaded and before it sees any connection, with the section marshaled as YAML. The arguments
+// that Gourmet applies itself, like depends_on and sample_rate, are removed from it, and an analyzer
+// without settings receives an empty map. An error from Init stops the sensor from starting.
+type Configurable interface {
+	Init(config []byte) error
+}
+
+// initAnalyzer hands an analyzer its section of the config, if it takes any settings.
+func initAnalyzer(name string, a Analyzer, config interface{}) error {
+	configurable, ok := a.(Configurable)
+	if !ok {
+		return nil
+	}
+	settings, err := analyzerSettings(config)
+	if err != nil {
+		return err
+	}
+	err = configurable.Init(settings)
+	if err != nil {
+		return fmt.Errorf("failed to initialize %s: %s", name, err)
+	}
+	return nil
+}
+
+// Versioned can be implemented by a Result, or by the Analyzer that returns it, to state the version
+// of the result's schema. The version is logged in the _meta section of the connection under the key
+// of the result, so that consumers can tell the shapes of a result apart as its analyzer evolves. A
+// version on the Result takes precedence over one on the Analyzer. Analyzers should change the
+// version whenever fields of their result are renamed, removed, or change meaning.
+type Versioned interface {
+	Version() string
+}
+
+// resultVersion returns the schema version of a result, or an empty string if it is unversioned.
+func resultVersion(analyzer Analyzer, result Result) string {
+	if v, ok := result.(Versioned); ok {
+		return v.Version()
+	}
+	if v, ok := analyzer.(Versioned); ok {
+		return v.Version()
+	}
+	return ""
+}
+
+// Namespaced can be implemented by a Result, or by the Analyzer that returns it, to place the result
+// under a namespace of the Analyzers map instead of at its top level. A result with the key http in
+// the namespace protocols is logged as "Analyzers": {"protocols": {"http": ...}}, and is referred to
+// as protocols.http in _meta and by result stores. The namespace argument of an analyzer in the
+// config takes precedence over both. Results without a namespace are keyed flat, as before.
+type Namespaced interface {
+	Namespace() string
+}
+
+// resultNamespace returns the namespace of a result, or an empty string if it is keyed flat.
+func resultNamespace(analyzer Analyzer, result Result) string {
+	if n, ok := result.(Namespaced); ok {
+		return n.Namespace()
+	}
+	if n, ok := analyzer.(Namespaced); ok {
+		return n.Namespace()
+	}
+	return ""
+}
+
+// namespacedResult is handed to the result store in place of a result that has a namespace. Its key
+// is the namespace and the key of the result, separated by a dot.
+type namespacedResult struct {
+	Result
+	namespace string
+}
+
+func (nr *namespacedResult) Key() string {
+	return nr.namespace + "." + nr.Result.Key()
+}
+
+// MarshalJSON encodes the result itself, so that result stores that encode what they are handed
+// write the same document as for a result without a namespace.
+func (nr *namespacedResult) MarshalJSON() ([]byte, error) {
+	return json.Marshal(nr.Result)
+}
+
+// namespaceCollision returns an error if the result would replace a namespace of the Analyzers map
+// of the connection, or be placed in a namespace whose name is the key of a result.
+func namespaceCollision(c *Connection, analyzer string, result Result) error {
+	if nr, ok := result.(*namespacedResult); ok {
+		existing, found := c.Analyzers[nr.namespace]
+		if _, namespace := existing.(map[string]interface{}); found && !namespace {
+			return fmt.Errorf("result %s of analyzer %s collides with the result of key %s", nr.Key(), analyzer, nr.namespace)
+		}
+		return nil
+	}
+	if _, namespace := c.Analyzers[result.Key()].(map[string]interface{}); namespace {
+		return fmt.Errorf("result %s of analyzer %s collides with the namespace %s", result.Key(), analyzer, result.Key())
+	}
+	return nil
+}
+
 // This function needs some major refactoring...
-func newAnalyzers(links map[string]interface{}, skipUpdate bool) (err error) {
-	usr, err := user.Current()
+func newAnalyzers(links map[string]interface{}) (err error) {
+	graph, err := resolveAnalyzers(links)
 	if err != nil {
 		return err
 	}
-	homeDir := usr.HomeDir
-	pluginsDir := filepath.Join(homeDir, ".gourmet/plugins/")
-	var analyzerFiles []string
-	for _, analyzer := range resolvedGraph {
-		pluginDir := filepath.Join(pluginsDir, analyzer.name)
-		mainPath := filepath.Join(pluginDir, "main.go")
-		exists, err := dirExists(pluginDir)
-		if err != nil {
-			return err
+	analyzers, err := loadAnalyzers(graph, links, nil)
+	if err != nil {
+		return err
+	}
+	setRegisteredAnalyzers(analyzers)
+	return nil
+}
+
+// loadAnalyzers builds and initializes the analyzers of the resolved graph, in dependency order.
+// Plugins must have been installed with `gourmet plugin install`. An analyzer of previous whose
+// source and section of the config are unchanged is carried over as it is, along with its state.
+// Nothing is registered here, so that the running analyzers are untouched if any of them fails.
+func loadAnalyzers(graph analyzerGraph, links map[string]interface{}, previous []*registeredAnalyzer) (analyzers []*registeredAnalyzer, err error) {
+	pluginsDir, err := PluginsDir()
+	if err != nil {
+		return nil, err
+	}
+	previousByName := make(map[string]*registeredAnalyzer)
+	for _, ra := range previous {
+		previousByName[ra.name] = ra
+	}
+	// analyzers created here are closed again if a later one fails to load
+	defer func() {
+		if err == nil {
+			return
 		}
-		if !exists {
-			fmt.Printf("[*] Installing %s\n", analyzer.name)
-			err = exec.Command("git", "clone", fmt.Sprintf("https://%s", analyzer.name), pluginDir).Run()
-			if err != nil {
-				return fmt.Errorf("failed to install %s: %s", analyzer.name, err.Error())
+		for _, ra := range analyzers {
+			if previousByName[ra.name] != ra {
+				closeAnalyzer(ra)
 			}
-		} else if !skipUpdate {
-			fmt.Printf("[*] Updating %s\n", analyzer.name)
-			err = exec.Command("git", "-C", pluginDir, "pull").Run()
 		}
-		_, err = os.Stat(mainPath)
+		analyzers = nil
+	}()
+	for _, analyzer := range graph {
+		name := analyzer.name
+		transport, err := analyzerTransport(name, links[name])
 		if err != nil {
-			return err
+			return analyzers, err
 		}
-		analyzerFiles = append(analyzerFiles, mainPath)
-		setAnalyzerConfig(analyzer.name, links[analyzer.name])
-	}
-	if len(analyzerFiles) > 0 {
-		for _, analyzerFile := range analyzerFiles {
-			folderName := filepath.Dir(analyzerFile)
-			fmt.Printf("[*] Building %s\n", filepath.Base(filepath.Dir(analyzerFile)))
-			out, err := exec.Command("go", "build", "-buildmode=plugin", "-o",
-				fmt.Sprintf("%s/main.so", filepath.Dir(analyzerFile)), analyzerFile).CombinedOutput()
+		analyzerFile := ""
+		source := builtinSource
+		revision, checksum, err := analyzerPin(name, links[name])
+		if err != nil {
+			return analyzers, err
+		}
+		if _, ok := builtinAnalyzers[name]; ok {
+			if transport != analyzerTransportPlugin {
+				return analyzers, fmt.Errorf("built-in analyzer %s cannot run in a separate process", name)
+			}
+			if revision != "" || checksum != "" {
+				return analyzers, fmt.Errorf("built-in analyzer %s cannot be pinned", name)
+			}
+		} else {
+			analyzerFile, err = installedAnalyzer(pluginsDir, name)
 			if err != nil {
-				return fmt.Errorf("failed to build %s: %s", analyzerFile, string(out))
+				return analyzers, err
 			}
-			p, err := plugin.Open(fmt.Sprintf("%s/main.so", folderName))
+			err = verifyPlugin(pluginsDir, name, revision, checksum)
 			if err != nil {
-				return err
+				return analyzers, err
 			}
-			newAnalyzerFunc, err := p.Lookup("NewAnalyzer")
+			source, err = analyzerSource(analyzerFile, transport)
 			if err != nil {
-				return fmt.Errorf("Failed lookup of NewAnalyzer in %s: %s", analyzerFile, err.Error())
+				return analyzers, err
 			}
-			analyzerFunc, ok := newAnalyzerFunc.(func() Analyzer)
-			if !ok {
-				return fmt.Errorf("NewAnalyzer in %s does not return an Analyzer interface", analyzerFile)
+		}
+		if prev, ok := previousByName[name]; ok && prev.source == source && reflect.DeepEqual(prev.config, links[name]) {
+			analyzers = append(analyzers, prev)
+			continue
+		}
+		var a Analyzer
+		if newBuiltin, ok := builtinAnalyzers[name]; ok {
+			a = newBuiltin()
+		} else if transport == analyzerTransportProcess {
+			a, err = buildProcessAnalyzer(name, analyzerFile)
+		} else if transport == analyzerTransportGRPC {
+			a, err = buildGRPCAnalyzer(name, analyzerFile)
+		} else {
+			a, err = buildPluginAnalyzer(analyzerFile)
+		}
+		if err != nil {
+			return analyzers, err
+		}
+		ra := &registeredAnalyzer{
+			name:     name,
+			analyzer: a,
+			source:   source,
+			config:   links[name],
+		}
+		if pa, ok := a.(PacketAnalyzer); ok {
+			ra.packetAnalyzer = pa
+		}
+		// the analyzer is registered before it is initialized, so that it is closed if it fails
+		analyzers = append(analyzers, ra)
+		err = initAnalyzer(name, a, links[name])
+		if err != nil {
+			return analyzers, err
+		}
+		ra.sampleRate, err = analyzerSampleRate(name, links[name])
+		if err != nil {
+			return analyzers, err
+		}
+		ra.localities, err = analyzerLocalities(name, links[name])
+		if err != nil {
+			return analyzers, err
+		}
+		ra.namespace, err = analyzerNamespace(name, links[name])
+		if err != nil {
+			return analyzers, err
+		}
+		ra.deps = analyzer.deps
+		if dependent, ok := a.(Dependent); ok {
+			ra.deps = append(append([]string(nil), ra.deps...), dependent.DependsOn()...)
+		}
+	}
+	return orderAnalyzers(analyzers)
+}
+
+// orderAnalyzers sorts the analyzers so that every analyzer comes after those it depends on, which
+// the resolved graph only does for the dependencies of the config, and not for those the analyzers
+// declare themselves.
+func orderAnalyzers(analyzers []*registeredAnalyzer) ([]*registeredAnalyzer, error) {
+	byName := make(map[string]*registeredAnalyzer)
+	for _, ra := range analyzers {
+		byName[ra.name] = ra
+	}
+	var graph analyzerGraph
+	for _, ra := range analyzers {
+		for _, dep := range ra.deps {
+			if _, ok := byName[dep]; !ok {
+				return analyzers, fmt.Errorf("analyzer %s depends on %s, which is not in the analyzers config", ra.name, dep)
 			}
-			analyzer := analyzerFunc()
-			registeredAnalyzers = append(registeredAnalyzers, analyzer)
 		}
+		graph = append(graph, &node{name: ra.name, deps: ra.deps})
 	}
-	return nil
+	resolved, err := resolveGraph(graph)
+	if err != nil {
+		return analyzers, fmt.Errorf("failed to order analyzers by their dependencies: %s", err)
+	}
+	ordered := make([]*registeredAnalyzer, 0, len(analyzers))
+	for _, n := range resolved {
+		ordered = append(ordered, byName[n.name])
+	}
+	return ordered, nil
+}
+
+// ready reports whether every analyzer that the analyzer depends on returned a result for the
+// connection, given the names of the analyzers that did.
+func (ra *registeredAnalyzer) ready(analyzed map[string]bool) bool {
+	for _, dep := range ra.deps {
+		if !analyzed[dep] {
+			return false
+		}
+	}
+	return true
+}
+
+// builtinSource is the source of every built-in analyzer
+const builtinSource = "builtin"
+
+// analyzerSource identifies what an analyzer is built from, which is its transport and a hash of its
+// main.go.
+func analyzerSource(analyzerFile, transport string) (string, error) {
+	hash, err := fileHash(analyzerFile)
+	if err != nil {
+		return "", err
+	}
+	return transport + ":" + hash, nil
+}
+
+func fileHash(name string) (string, error) {
+	checksum, err := fileSHA256(name)
+	if err != nil {
+		return "", err
+	}
+	return checksum[:16], nil
+}
+
+// fileSHA256 returns the hex SHA-256 checksum of a file.
+func fileSHA256(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// closeAnalyzers closes every analyzer that implements io.Closer, once the sensor has stopped and no
+// more connections will be analyzed.
+func closeAnalyzers() {
+	for _, ra := range currentAnalyzers() {
+		closeAnalyzer(ra)
+	}
+}
+
+func closeAnalyzer(ra *registeredAnalyzer) {
+	closer, ok := ra.analyzer.(io.Closer)
+	if !ok {
+		return
+	}
+	err := closer.Close()
+	if err != nil {
+		log.Printf("[!] Failed to close analyzer %s: %s", ra.name, err)
+	}
+}
+
+// loadedPlugins maps the path of every plugin opened by the process to its NewAnalyzer function. A Go
+// plugin cannot be unloaded or opened twice, so a plugin is built to a file named after the hash of
+// its source, and a source that was already opened creates its analyzers from the loaded plugin.
+var loadedPlugins = make(map[string]func() Analyzer)
+
+func buildPluginAnalyzer(analyzerFile string) (Analyzer, error) {
+	hash, err := fileHash(analyzerFile)
+	if err != nil {
+		return nil, err
+	}
+	soPath := filepath.Join(filepath.Dir(analyzerFile), fmt.Sprintf("main-%s.so", hash))
+	if analyzerFunc, ok := loadedPlugins[soPath]; ok {
+		return analyzerFunc(), nil
+	}
+	fmt.Printf("[*] Building %s\n", filepath.Base(filepath.Dir(analyzerFile)))
+	out, err := exec.Command("go", "build", "-buildmode=plugin", "-o", soPath, analyzerFile).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build %s: %s", analyzerFile, string(out))
+	}
+	p, err := plugin.Open(soPath)
+	if err != nil {
+		return nil, err
+	}
+	newAnalyzerFunc, err := p.Lookup("NewAnalyzer")
+	if err != nil {
+		return nil, fmt.Errorf("Failed lookup of NewAnalyzer in %s: %s", analyzerFile, err.Error())
+	}
+	analyzerFunc, ok := newAnalyzerFunc.(func() Analyzer)
+	if !ok {
+		return nil, fmt.Errorf("NewAnalyzer in %s does not return an Analyzer interface", analyzerFile)
+	}
+	loadedPlugins[soPath] = analyzerFunc
+	return analyzerFunc(), nil
+}
+
+// buildProcessAnalyzer builds the analyzer as an executable that serves the out-of-process analyzer
+// protocol.
+func buildProcessAnalyzer(name, analyzerFile string) (Analyzer, error) {
+	fmt.Printf("[*] Building %s as a separate process\n", filepath.Base(filepath.Dir(analyzerFile)))
+	binPath, err := buildAnalyzerExecutable(analyzerFile, "main")
+	if err != nil {
+		return nil, err
+	}
+	return newProcessAnalyzer(name, binPath), nil
+}
+
+// buildGRPCAnalyzer builds the analyzer as an executable that serves the Analyzer service over gRPC.
+func buildGRPCAnalyzer(name, analyzerFile string) (Analyzer, error) {
+	fmt.Printf("[*] Building %s as a gRPC plugin\n", filepath.Base(filepath.Dir(analyzerFile)))
+	binPath, err := buildAnalyzerExecutable(analyzerFile, "main-grpc")
+	if err != nil {
+		return nil, err
+	}
+	return newGRPCAnalyzer(name, binPath), nil
+}
+
+// buildAnalyzerExecutable builds the analyzer as an executable next to its main.go.
+func buildAnalyzerExecutable(analyzerFile, binName string) (string, error) {
+	binPath := filepath.Join(filepath.Dir(analyzerFile), binName)
+	out, err := exec.Command("go", "build", "-o", binPath, analyzerFile).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("failed to build %s: %s", analyzerFile, string(out))
+	}
+	return binPath, nil
+}
+
+// Transports that analyzers run over, which are set with the transport argument of an analyzer
+const (
+	analyzerTransportPlugin  = "plugin"
+	analyzerTransportProcess = "process"
+	analyzerTransportGRPC    = "grpc"
+)
+
+// analyzerTransport returns the transport argument of an analyzer, which runs it in a separate
+// process instead of loading it as a Go plugin. The process argument is kept as another way to set
+// the process transport.
+func analyzerTransport(name string, config interface{}) (string, error) {
+	configMap, ok := config.(map[string]interface{})
+	if !ok {
+		return analyzerTransportPlugin, nil
+	}
+	transport := analyzerTransportPlugin
+	if t, ok := configMap["transport"]; ok {
+		transport, ok = t.(string)
+		if !ok || (transport != analyzerTransportPlugin && transport != analyzerTransportProcess && transport != analyzerTransportGRPC) {
+			return "", fmt.Errorf("transport for %s must be plugin, process, or grpc", name)
+		}
+	}
+	process, ok := configMap["process"]
+	if !ok {
+		return transport, nil
+	}
+	isolated, ok := process.(bool)
+	if !ok {
+		return "", fmt.Errorf("process for %s must be true or false", name)
+	}
+	if !isolated {
+		return transport, nil
+	}
+	if transport != analyzerTransportPlugin && transport != analyzerTransportProcess {
+		return "", fmt.Errorf("process cannot be set for %s, whose transport is %s", name, transport)
+	}
+	return analyzerTransportProcess, nil
+}
+
+// analyzerSampleRate returns the sample_rate argument of an analyzer, which is the fraction of
+// connections that the analyzer runs on. Analyzers without a sample_rate run on every connection.
+func analyzerSampleRate(name string, config interface{}) (float64, error) {
+	configMap, ok := config.(map[string]interface{})
+	if !ok {
+		return 1, nil
+	}
+	rate, ok := configMap["sample_rate"]
+	if !ok {
+		return 1, nil
+	}
+	sampleRate, ok := rate.(float64)
+	if !ok || sampleRate < 0 || sampleRate > 1 {
+		return 0, fmt.Errorf("sample_rate for %s must be a number between 0 and 1", name)
+	}
+	return sampleRate, nil
+}
+
+// analyzerLocalities returns the locality argument of an analyzer, which restricts it to
+// connections with one of the listed localities.
+func analyzerLocalities(name string, config interface{}) (map[string]bool, error) {
+	configMap, ok := config.(map[string]interface{})
+	if !ok {
+		return nil, nil
+	}
+	locality, ok := configMap["locality"]
+	if !ok {
+		return nil, nil
+	}
+	localityList, ok := locality.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("locality for %s is not a list", name)
+	}
+	localities := make(map[string]bool)
+	for _, l := range localityList {
+		switch l {
+		case LocalityInternal, LocalityExternal, LocalityOutbound, LocalityInbound:
+			localities[l.(string)] = true
+		default:
+			return nil, fmt.Errorf("locality list value %v for %s must be internal, external, outbound, or inbound", l, name)
+		}
+	}
+	return localities, nil
+}
+
+// analyzerNamespace returns the namespace argument of an analyzer, which overrides the namespace its
+// results declare.
+func analyzerNamespace(name string, config interface{}) (string, error) {
+	configMap, ok := config.(map[string]interface{})
+	if !ok {
+		return "", nil
+	}
+	ns, ok := configMap["namespace"]
+	if !ok {
+		return "", nil
+	}
+	namespace, ok := ns.(string)
+	if !ok || namespace == "" || strings.Contains(namespace, ".") {
+		return "", fmt.Errorf("namespace for %s must be a non-empty string without dots", name)
+	}
+	return namespace, nil
+}
+
+// analyzerPin returns the revision and sha256 arguments of an analyzer, which pin a plugin to a git
+// tag or commit, and to a SHA-256 checksum of its main.go.
+func analyzerPin(name string, config interface{}) (revision, checksum string, err error) {
+	configMap, ok := config.(map[string]interface{})
+	if !ok {
+		return "", "", nil
+	}
+	if r, ok := configMap["revision"]; ok {
+		revision, ok = r.(string)
+		if !ok || revision == "" {
+			return "", "", fmt.Errorf("revision for %s must be a git tag or commit", name)
+		}
+	}
+	if c, ok := configMap["sha256"]; ok {
+		checksum, ok = c.(string)
+		if !ok || len(checksum) != sha256.Size*2 {
+			return "", "", fmt.Errorf("sha256 for %s must be the hex SHA-256 checksum of its main.go", name)
+		}
+		checksum = strings.ToLower(checksum)
+	}
+	return revision, checksum, nil
+}
+
+// resolveAnalyzers orders the analyzers of the config by their dependencies.
+func resolveAnalyzers(links map[string]interface{}) (analyzerGraph, error) {
+	var workingGraph analyzerGraph
+	for k, v := range links {
+		analyzerNode, err := createAnalyzerNode(k, v)
+		if err != nil {
+			return nil, fmt.Errorf("unable to process analyzer config: %s", err)
+		}
+		workingGraph = append(workingGraph, analyzerNode)
+	}
+	resolved, err := resolveGraph(workingGraph)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build dependency graph for analyzers: %s", err)
+	}
+	return resolved, nil
 }
 
 func createAnalyzerNode(name string, config interface{}) (*node, error) {
@@ -159,7 +806,7 @@ type node struct {
 type analyzerGraph []*node
 
 // Resolves the dependency graph
-func resolveGraph(graph analyzerGraph) error {
+func resolveGraph(graph analyzerGraph) (analyzerGraph, error) {
 	// A map containing the node names and the actual node object
 	nodeNames := make(map[string]*node)
 	// A map containing the nodes and their dependencies
@@ -191,7 +838,7 @@ func resolveGraph(graph analyzerGraph) error {
 			for name := range nodeDependencies {
 				g = append(g, nodeNames[name])
 			}
-			return errors.New("circular dependency or missing dependency found")
+			return nil, errors.New("circular dependency or missing dependency found")
 		}
 		// Remove the ready nodes and add them to the resolved graph
 		for name := range readySet.Iter() {
@@ -205,6 +852,5 @@ func resolveGraph(graph analyzerGraph) error {
 			nodeDependencies[name] = diff
 		}
 	}
-	resolvedGraph = resolved
-	return nil
+	return resolved, nil
 }
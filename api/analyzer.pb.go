@@ -0,0 +1,399 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// source: analyzer.proto
+
+package api
+
+import (
+	context "context"
+	fmt "fmt"
+	proto "github.com/golang/protobuf/proto"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+	math "math"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the proto package it is being compiled against.
+// A compilation error at this line likely means your copy of the
+// proto package needs to be updated.
+const _ = proto.ProtoPackageIsVersion3 // please upgrade the proto package
+
+// FilterRequest is a connection without its payloads.
+type FilterRequest struct {
+	// The connection as a JSON object, as it is logged
+	ConnectionJson       []byte   `protobuf:"bytes,1,opt,name=connection_json,json=connectionJson,proto3" json:"connection_json,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *FilterRequest) Reset()         { *m = FilterRequest{} }
+func (m *FilterRequest) String() string { return proto.CompactTextString(m) }
+func (*FilterRequest) ProtoMessage()    {}
+func (*FilterRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_fadbb7eccb91f143, []int{0}
+}
+
+func (m *FilterRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_FilterRequest.Unmarshal(m, b)
+}
+func (m *FilterRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_FilterRequest.Marshal(b, m, deterministic)
+}
+func (m *FilterRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_FilterRequest.Merge(m, src)
+}
+func (m *FilterRequest) XXX_Size() int {
+	return xxx_messageInfo_FilterRequest.Size(m)
+}
+func (m *FilterRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_FilterRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_FilterRequest proto.InternalMessageInfo
+
+func (m *FilterRequest) GetConnectionJson() []byte {
+	if m != nil {
+		return m.ConnectionJson
+	}
+	return nil
+}
+
+// FilterResponse tells whether the connection should be analyzed.
+type FilterResponse struct {
+	Analyze              bool     `protobuf:"varint,1,opt,name=analyze,proto3" json:"analyze,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *FilterResponse) Reset()         { *m = FilterResponse{} }
+func (m *FilterResponse) String() string { return proto.CompactTextString(m) }
+func (*FilterResponse) ProtoMessage()    {}
+func (*FilterResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_fadbb7eccb91f143, []int{1}
+}
+
+func (m *FilterResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_FilterResponse.Unmarshal(m, b)
+}
+func (m *FilterResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_FilterResponse.Marshal(b, m, deterministic)
+}
+func (m *FilterResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_FilterResponse.Merge(m, src)
+}
+func (m *FilterResponse) XXX_Size() int {
+	return xxx_messageInfo_FilterResponse.Size(m)
+}
+func (m *FilterResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_FilterResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_FilterResponse proto.InternalMessageInfo
+
+func (m *FilterResponse) GetAnalyze() bool {
+	if m != nil {
+		return m.Analyze
+	}
+	return false
+}
+
+// AnalyzeRequest is a connection to analyze, with its payloads.
+type AnalyzeRequest struct {
+	// The connection as a JSON object, as it is logged
+	ConnectionJson       []byte   `protobuf:"bytes,1,opt,name=connection_json,json=connectionJson,proto3" json:"connection_json,omitempty"`
+	Payload              []byte   `protobuf:"bytes,2,opt,name=payload,proto3" json:"payload,omitempty"`
+	ClientPayload        []byte   `protobuf:"bytes,3,opt,name=client_payload,json=clientPayload,proto3" json:"client_payload,omitempty"`
+	ServerPayload        []byte   `protobuf:"bytes,4,opt,name=server_payload,json=serverPayload,proto3" json:"server_payload,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *AnalyzeRequest) Reset()         { *m = AnalyzeRequest{} }
+func (m *AnalyzeRequest) String() string { return proto.CompactTextString(m) }
+func (*AnalyzeRequest) ProtoMessage()    {}
+func (*AnalyzeRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_fadbb7eccb91f143, []int{2}
+}
+
+func (m *AnalyzeRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_AnalyzeRequest.Unmarshal(m, b)
+}
+func (m *AnalyzeRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_AnalyzeRequest.Marshal(b, m, deterministic)
+}
+func (m *AnalyzeRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_AnalyzeRequest.Merge(m, src)
+}
+func (m *AnalyzeRequest) XXX_Size() int {
+	return xxx_messageInfo_AnalyzeRequest.Size(m)
+}
+func (m *AnalyzeRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_AnalyzeRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_AnalyzeRequest proto.InternalMessageInfo
+
+func (m *AnalyzeRequest) GetConnectionJson() []byte {
+	if m != nil {
+		return m.ConnectionJson
+	}
+	return nil
+}
+
+func (m *AnalyzeRequest) GetPayload() []byte {
+	if m != nil {
+		return m.Payload
+	}
+	return nil
+}
+
+func (m *AnalyzeRequest) GetClientPayload() []byte {
+	if m != nil {
+		return m.ClientPayload
+	}
+	return nil
+}
+
+func (m *AnalyzeRequest) GetServerPayload() []byte {
+	if m != nil {
+		return m.ServerPayload
+	}
+	return nil
+}
+
+// AnalyzeResponse is the result of an analyzer for a connection. A response without a key means that
+// the analyzer did not record anything for the connection.
+type AnalyzeResponse struct {
+	Key       string `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
+	Version   string `protobuf:"bytes,2,opt,name=version,proto3" json:"version,omitempty"`
+	Namespace string `protobuf:"bytes,3,opt,name=namespace,proto3" json:"namespace,omitempty"`
+	// The result as a JSON value, as it is logged
+	ResultJson           []byte   `protobuf:"bytes,4,opt,name=result_json,json=resultJson,proto3" json:"result_json,omitempty"`
+	Error                string   `protobuf:"bytes,5,opt,name=error,proto3" json:"error,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *AnalyzeResponse) Reset()         { *m = AnalyzeResponse{} }
+func (m *AnalyzeResponse) String() string { return proto.CompactTextString(m) }
+func (*AnalyzeResponse) ProtoMessage()    {}
+func (*AnalyzeResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_fadbb7eccb91f143, []int{3}
+}
+
+func (m *AnalyzeResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_AnalyzeResponse.Unmarshal(m, b)
+}
+func (m *AnalyzeResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_AnalyzeResponse.Marshal(b, m, deterministic)
+}
+func (m *AnalyzeResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_AnalyzeResponse.Merge(m, src)
+}
+func (m *AnalyzeResponse) XXX_Size() int {
+	return xxx_messageInfo_AnalyzeResponse.Size(m)
+}
+func (m *AnalyzeResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_AnalyzeResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_AnalyzeResponse proto.InternalMessageInfo
+
+func (m *AnalyzeResponse) GetKey() string {
+	if m != nil {
+		return m.Key
+	}
+	return ""
+}
+
+func (m *AnalyzeResponse) GetVersion() string {
+	if m != nil {
+		return m.Version
+	}
+	return ""
+}
+
+func (m *AnalyzeResponse) GetNamespace() string {
+	if m != nil {
+		return m.Namespace
+	}
+	return ""
+}
+
+func (m *AnalyzeResponse) GetResultJson() []byte {
+	if m != nil {
+		return m.ResultJson
+	}
+	return nil
+}
+
+func (m *AnalyzeResponse) GetError() string {
+	if m != nil {
+		return m.Error
+	}
+	return ""
+}
+
+func init() {
+	proto.RegisterType((*FilterRequest)(nil), "gourmet.FilterRequest")
+	proto.RegisterType((*FilterResponse)(nil), "gourmet.FilterResponse")
+	proto.RegisterType((*AnalyzeRequest)(nil), "gourmet.AnalyzeRequest")
+	proto.RegisterType((*AnalyzeResponse)(nil), "gourmet.AnalyzeResponse")
+}
+
+func init() { proto.RegisterFile("analyzer.proto", fileDescriptor_fadbb7eccb91f143) }
+
+var fileDescriptor_fadbb7eccb91f143 = []byte{
+	// 334 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x94, 0x92, 0xcf, 0x4a, 0xc3, 0x40,
+	0x10, 0xc6, 0x89, 0xb5, 0x7f, 0x32, 0xda, 0x54, 0x16, 0xd1, 0x50, 0x04, 0x25, 0x50, 0x2a, 0x1e,
+	0x52, 0xd0, 0x8b, 0x82, 0x17, 0x3d, 0x78, 0xf0, 0x24, 0x39, 0x7a, 0x29, 0xdb, 0x38, 0xd4, 0xd4,
+	0x74, 0x37, 0xce, 0x6e, 0x0a, 0xf5, 0xea, 0x1b, 0xf8, 0x06, 0xbe, 0xa9, 0x64, 0x77, 0xd3, 0x50,
+	0x7a, 0xf2, 0xb6, 0xdf, 0x97, 0xdf, 0xec, 0x7c, 0x93, 0x59, 0x08, 0xb8, 0xe0, 0xf9, 0xfa, 0x0b,
+	0x29, 0x2e, 0x48, 0x6a, 0xc9, 0xba, 0x73, 0x59, 0xd2, 0x12, 0x75, 0x74, 0x0b, 0xfd, 0xa7, 0x2c,
+	0xd7, 0x48, 0x09, 0x7e, 0x96, 0xa8, 0x34, 0x1b, 0xc3, 0x20, 0x95, 0x42, 0x60, 0xaa, 0x33, 0x29,
+	0xa6, 0x0b, 0x25, 0x45, 0xe8, 0x5d, 0x78, 0x97, 0x87, 0x49, 0xd0, 0xd8, 0xcf, 0x4a, 0x8a, 0xe8,
+	0x0a, 0x82, 0xba, 0x52, 0x15, 0x52, 0x28, 0x64, 0x21, 0x74, 0x5d, 0x1b, 0x53, 0xd2, 0x4b, 0x6a,
+	0x19, 0xfd, 0x7a, 0x10, 0x3c, 0xd8, 0xf3, 0x7f, 0xfb, 0x54, 0xb7, 0x16, 0x7c, 0x9d, 0x4b, 0xfe,
+	0x16, 0xee, 0x19, 0xa0, 0x96, 0x6c, 0x04, 0x41, 0x9a, 0x67, 0x28, 0xf4, 0xb4, 0x06, 0x5a, 0x06,
+	0xe8, 0x5b, 0xf7, 0xa5, 0xc1, 0x14, 0xd2, 0x0a, 0x69, 0x83, 0xed, 0x5b, 0xcc, 0xba, 0x0e, 0x8b,
+	0x7e, 0x3c, 0x18, 0x6c, 0x32, 0xba, 0x89, 0x8e, 0xa0, 0xf5, 0x81, 0x6b, 0x13, 0xcc, 0x4f, 0xaa,
+	0x63, 0x95, 0x66, 0x85, 0xa4, 0x32, 0x29, 0x4c, 0x1a, 0x3f, 0xa9, 0x25, 0x3b, 0x03, 0x5f, 0xf0,
+	0x25, 0xaa, 0x82, 0xa7, 0x68, 0x82, 0xf8, 0x49, 0x63, 0xb0, 0x73, 0x38, 0x20, 0x54, 0x65, 0xae,
+	0xed, 0xa8, 0x36, 0x01, 0x58, 0xcb, 0x8c, 0x79, 0x0c, 0x6d, 0x24, 0x92, 0x14, 0xb6, 0x4d, 0xa9,
+	0x15, 0xd7, 0xdf, 0x1e, 0xf4, 0x5c, 0x28, 0x62, 0x77, 0xd0, 0xb1, 0x7f, 0x9c, 0x9d, 0xc4, 0x6e,
+	0x7f, 0xf1, 0xd6, 0xf2, 0x86, 0xa7, 0x3b, 0xbe, 0x1b, 0xe4, 0x1e, 0xba, 0xee, 0x1a, 0xd6, 0x30,
+	0xdb, 0x1b, 0x19, 0x86, 0xbb, 0x1f, 0x6c, 0xf5, 0xe3, 0xf8, 0x75, 0x34, 0xcf, 0xf4, 0x7b, 0x39,
+	0x8b, 0x53, 0xb9, 0x9c, 0x38, 0xaa, 0x20, 0xb9, 0xc0, 0x54, 0xd7, 0x72, 0xc2, 0x8b, 0x6c, 0xd6,
+	0x31, 0xaf, 0xeb, 0xe6, 0x6f, 0x00, 0x2f, 0x84, 0xc6, 0xd1, 0x6f, 0x02, 0x00, 0x00,
+}
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConn
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion4
+
+// AnalyzerClient is the client API for Analyzer service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://godoc.org/google.golang.org/grpc#ClientConn.NewStream.
+type AnalyzerClient interface {
+	// Filter reports whether the analyzer wants a connection, before its payloads are sent.
+	Filter(ctx context.Context, in *FilterRequest, opts ...grpc.CallOption) (*FilterResponse, error)
+	// Analyze runs the analyzer on a connection.
+	Analyze(ctx context.Context, in *AnalyzeRequest, opts ...grpc.CallOption) (*AnalyzeResponse, error)
+}
+
+type analyzerClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewAnalyzerClient(cc *grpc.ClientConn) AnalyzerClient {
+	return &analyzerClient{cc}
+}
+
+func (c *analyzerClient) Filter(ctx context.Context, in *FilterRequest, opts ...grpc.CallOption) (*FilterResponse, error) {
+	out := new(FilterResponse)
+	err := c.cc.Invoke(ctx, "/gourmet.Analyzer/Filter", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *analyzerClient) Analyze(ctx context.Context, in *AnalyzeRequest, opts ...grpc.CallOption) (*AnalyzeResponse, error) {
+	out := new(AnalyzeResponse)
+	err := c.cc.Invoke(ctx, "/gourmet.Analyzer/Analyze", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// AnalyzerServer is the server API for Analyzer service.
+type AnalyzerServer interface {
+	// Filter reports whether the analyzer wants a connection, before its payloads are sent.
+	Filter(context.Context, *FilterRequest) (*FilterResponse, error)
+	// Analyze runs the analyzer on a connection.
+	Analyze(context.Context, *AnalyzeRequest) (*AnalyzeResponse, error)
+}
+
+// UnimplementedAnalyzerServer can be embedded to have forward compatible implementations.
+type UnimplementedAnalyzerServer struct {
+}
+
+func (*UnimplementedAnalyzerServer) Filter(ctx context.Context, req *FilterRequest) (*FilterResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Filter not implemented")
+}
+func (*UnimplementedAnalyzerServer) Analyze(ctx context.Context, req *AnalyzeRequest) (*AnalyzeResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Analyze not implemented")
+}
+
+func RegisterAnalyzerServer(s *grpc.Server, srv AnalyzerServer) {
+	s.RegisterService(&_Analyzer_serviceDesc, srv)
+}
+
+func _Analyzer_Filter_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FilterRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AnalyzerServer).Filter(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/gourmet.Analyzer/Filter",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AnalyzerServer).Filter(ctx, req.(*FilterRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Analyzer_Analyze_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AnalyzeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AnalyzerServer).Analyze(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/gourmet.Analyzer/Analyze",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AnalyzerServer).Analyze(ctx, req.(*AnalyzeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var _Analyzer_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "gourmet.Analyzer",
+	HandlerType: (*AnalyzerServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Filter",
+			Handler:    _Analyzer_Filter_Handler,
+		},
+		{
+			MethodName: "Analyze",
+			Handler:    _Analyzer_Analyze_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "analyzer.proto",
+}
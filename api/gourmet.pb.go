@@ -0,0 +1,450 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// source: gourmet.proto
+
+package api
+
+import (
+	context "context"
+	fmt "fmt"
+	proto "github.com/golang/protobuf/proto"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+	math "math"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the proto package it is being compiled against.
+// A compilation error at this line likely means your copy of the
+// proto package needs to be updated.
+const _ = proto.ProtoPackageIsVersion3 // please upgrade the proto package
+
+// SubscribeRequest selects the connections of a subscription. A connection matches when it matches
+// every filter that is set, and a filter with several values matches any of them.
+type SubscribeRequest struct {
+	// IP addresses, either of which the source or destination of the connection must be
+	Ips []string `protobuf:"bytes,1,rep,name=ips,proto3" json:"ips,omitempty"`
+	// Ports, either of which the source or destination port of the connection must be
+	Ports []uint32 `protobuf:"varint,2,rep,packed,name=ports,proto3" json:"ports,omitempty"`
+	// Analyzer result keys, in the form key or namespace.key, one of which the connection must have
+	Analyzers []string `protobuf:"bytes,3,rep,name=analyzers,proto3" json:"analyzers,omitempty"`
+	// Whether preliminary records are streamed as well as final ones
+	IncludePreliminary   bool     `protobuf:"varint,4,opt,name=include_preliminary,json=includePreliminary,proto3" json:"include_preliminary,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *SubscribeRequest) Reset()         { *m = SubscribeRequest{} }
+func (m *SubscribeRequest) String() string { return proto.CompactTextString(m) }
+func (*SubscribeRequest) ProtoMessage()    {}
+func (*SubscribeRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_f51cb0e9d3fedf88, []int{0}
+}
+
+func (m *SubscribeRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_SubscribeRequest.Unmarshal(m, b)
+}
+func (m *SubscribeRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_SubscribeRequest.Marshal(b, m, deterministic)
+}
+func (m *SubscribeRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_SubscribeRequest.Merge(m, src)
+}
+func (m *SubscribeRequest) XXX_Size() int {
+	return xxx_messageInfo_SubscribeRequest.Size(m)
+}
+func (m *SubscribeRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_SubscribeRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_SubscribeRequest proto.InternalMessageInfo
+
+func (m *SubscribeRequest) GetIps() []string {
+	if m != nil {
+		return m.Ips
+	}
+	return nil
+}
+
+func (m *SubscribeRequest) GetPorts() []uint32 {
+	if m != nil {
+		return m.Ports
+	}
+	return nil
+}
+
+func (m *SubscribeRequest) GetAnalyzers() []string {
+	if m != nil {
+		return m.Analyzers
+	}
+	return nil
+}
+
+func (m *SubscribeRequest) GetIncludePreliminary() bool {
+	if m != nil {
+		return m.IncludePreliminary
+	}
+	return false
+}
+
+// Connection is a logged connection. The fields mirror those of the JSON log, and the analyzer
+// results, whose shape depends on each analyzer, are encoded as a JSON object.
+type Connection struct {
+	TimestampUnixNano    int64    `protobuf:"varint,1,opt,name=timestamp_unix_nano,json=timestampUnixNano,proto3" json:"timestamp_unix_nano,omitempty"`
+	Uid                  uint64   `protobuf:"varint,2,opt,name=uid,proto3" json:"uid,omitempty"`
+	SourceIp             string   `protobuf:"bytes,3,opt,name=source_ip,json=sourceIp,proto3" json:"source_ip,omitempty"`
+	SourcePort           uint32   `protobuf:"varint,4,opt,name=source_port,json=sourcePort,proto3" json:"source_port,omitempty"`
+	DestinationIp        string   `protobuf:"bytes,5,opt,name=destination_ip,json=destinationIp,proto3" json:"destination_ip,omitempty"`
+	DestinationPort      uint32   `protobuf:"varint,6,opt,name=destination_port,json=destinationPort,proto3" json:"destination_port,omitempty"`
+	TransportType        string   `protobuf:"bytes,7,opt,name=transport_type,json=transportType,proto3" json:"transport_type,omitempty"`
+	Duration             float64  `protobuf:"fixed64,8,opt,name=duration,proto3" json:"duration,omitempty"`
+	OrigBytes            uint64   `protobuf:"varint,9,opt,name=orig_bytes,json=origBytes,proto3" json:"orig_bytes,omitempty"`
+	RespBytes            uint64   `protobuf:"varint,10,opt,name=resp_bytes,json=respBytes,proto3" json:"resp_bytes,omitempty"`
+	OrigPackets          uint64   `protobuf:"varint,11,opt,name=orig_packets,json=origPackets,proto3" json:"orig_packets,omitempty"`
+	RespPackets          uint64   `protobuf:"varint,12,opt,name=resp_packets,json=respPackets,proto3" json:"resp_packets,omitempty"`
+	State                string   `protobuf:"bytes,13,opt,name=state,proto3" json:"state,omitempty"`
+	ConnState            string   `protobuf:"bytes,14,opt,name=conn_state,json=connState,proto3" json:"conn_state,omitempty"`
+	History              string   `protobuf:"bytes,15,opt,name=history,proto3" json:"history,omitempty"`
+	Service              string   `protobuf:"bytes,16,opt,name=service,proto3" json:"service,omitempty"`
+	Locality             string   `protobuf:"bytes,17,opt,name=locality,proto3" json:"locality,omitempty"`
+	Interface            string   `protobuf:"bytes,18,opt,name=interface,proto3" json:"interface,omitempty"`
+	Tags                 []string `protobuf:"bytes,19,rep,name=tags,proto3" json:"tags,omitempty"`
+	Preliminary          bool     `protobuf:"varint,20,opt,name=preliminary,proto3" json:"preliminary,omitempty"`
+	AnalyzersJson        []byte   `protobuf:"bytes,21,opt,name=analyzers_json,json=analyzersJson,proto3" json:"analyzers_json,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *Connection) Reset()         { *m = Connection{} }
+func (m *Connection) String() string { return proto.CompactTextString(m) }
+func (*Connection) ProtoMessage()    {}
+func (*Connection) Descriptor() ([]byte, []int) {
+	return fileDescriptor_f51cb0e9d3fedf88, []int{1}
+}
+
+func (m *Connection) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Connection.Unmarshal(m, b)
+}
+func (m *Connection) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Connection.Marshal(b, m, deterministic)
+}
+func (m *Connection) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Connection.Merge(m, src)
+}
+func (m *Connection) XXX_Size() int {
+	return xxx_messageInfo_Connection.Size(m)
+}
+func (m *Connection) XXX_DiscardUnknown() {
+	xxx_messageInfo_Connection.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Connection proto.InternalMessageInfo
+
+func (m *Connection) GetTimestampUnixNano() int64 {
+	if m != nil {
+		return m.TimestampUnixNano
+	}
+	return 0
+}
+
+func (m *Connection) GetUid() uint64 {
+	if m != nil {
+		return m.Uid
+	}
+	return 0
+}
+
+func (m *Connection) GetSourceIp() string {
+	if m != nil {
+		return m.SourceIp
+	}
+	return ""
+}
+
+func (m *Connection) GetSourcePort() uint32 {
+	if m != nil {
+		return m.SourcePort
+	}
+	return 0
+}
+
+func (m *Connection) GetDestinationIp() string {
+	if m != nil {
+		return m.DestinationIp
+	}
+	return ""
+}
+
+func (m *Connection) GetDestinationPort() uint32 {
+	if m != nil {
+		return m.DestinationPort
+	}
+	return 0
+}
+
+func (m *Connection) GetTransportType() string {
+	if m != nil {
+		return m.TransportType
+	}
+	return ""
+}
+
+func (m *Connection) GetDuration() float64 {
+	if m != nil {
+		return m.Duration
+	}
+	return 0
+}
+
+func (m *Connection) GetOrigBytes() uint64 {
+	if m != nil {
+		return m.OrigBytes
+	}
+	return 0
+}
+
+func (m *Connection) GetRespBytes() uint64 {
+	if m != nil {
+		return m.RespBytes
+	}
+	return 0
+}
+
+func (m *Connection) GetOrigPackets() uint64 {
+	if m != nil {
+		return m.OrigPackets
+	}
+	return 0
+}
+
+func (m *Connection) GetRespPackets() uint64 {
+	if m != nil {
+		return m.RespPackets
+	}
+	return 0
+}
+
+func (m *Connection) GetState() string {
+	if m != nil {
+		return m.State
+	}
+	return ""
+}
+
+func (m *Connection) GetConnState() string {
+	if m != nil {
+		return m.ConnState
+	}
+	return ""
+}
+
+func (m *Connection) GetHistory() string {
+	if m != nil {
+		return m.History
+	}
+	return ""
+}
+
+func (m *Connection) GetService() string {
+	if m != nil {
+		return m.Service
+	}
+	return ""
+}
+
+func (m *Connection) GetLocality() string {
+	if m != nil {
+		return m.Locality
+	}
+	return ""
+}
+
+func (m *Connection) GetInterface() string {
+	if m != nil {
+		return m.Interface
+	}
+	return ""
+}
+
+func (m *Connection) GetTags() []string {
+	if m != nil {
+		return m.Tags
+	}
+	return nil
+}
+
+func (m *Connection) GetPreliminary() bool {
+	if m != nil {
+		return m.Preliminary
+	}
+	return false
+}
+
+func (m *Connection) GetAnalyzersJson() []byte {
+	if m != nil {
+		return m.AnalyzersJson
+	}
+	return nil
+}
+
+func init() {
+	proto.RegisterType((*SubscribeRequest)(nil), "gourmet.SubscribeRequest")
+	proto.RegisterType((*Connection)(nil), "gourmet.Connection")
+}
+
+func init() { proto.RegisterFile("gourmet.proto", fileDescriptor_f51cb0e9d3fedf88) }
+
+var fileDescriptor_f51cb0e9d3fedf88 = []byte{
+	// 547 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x5c, 0x93, 0x41, 0x6f, 0xd3, 0x3e,
+	0x18, 0xc6, 0x95, 0x65, 0xdd, 0x9a, 0xb7, 0xcb, 0xd6, 0xb9, 0xfb, 0x4b, 0xfe, 0x0f, 0x10, 0x61,
+	0xd2, 0x44, 0xb8, 0x74, 0x08, 0xce, 0x5c, 0xc6, 0x69, 0x1c, 0x50, 0x49, 0xe1, 0xc2, 0x25, 0x72,
+	0xd3, 0x97, 0xce, 0xa3, 0xb1, 0x8d, 0xed, 0xa0, 0x85, 0x6f, 0xc0, 0x07, 0xe1, 0x7b, 0x22, 0xdb,
+	0x49, 0x5a, 0x71, 0xf3, 0xf3, 0x7b, 0x9e, 0x3c, 0x71, 0xe2, 0xd7, 0x90, 0x6e, 0x64, 0xa3, 0x6b,
+	0xb4, 0x73, 0xa5, 0xa5, 0x95, 0xe4, 0xb8, 0x93, 0x57, 0xbf, 0x23, 0x98, 0x2e, 0x9b, 0x95, 0xa9,
+	0x34, 0x5f, 0x61, 0x81, 0x3f, 0x1a, 0x34, 0x96, 0x4c, 0x21, 0xe6, 0xca, 0xd0, 0x28, 0x8b, 0xf3,
+	0xa4, 0x70, 0x4b, 0x72, 0x01, 0x23, 0x25, 0xb5, 0x35, 0xf4, 0x20, 0x8b, 0xf3, 0xb4, 0x08, 0x82,
+	0x3c, 0x85, 0x84, 0x09, 0xb6, 0x6d, 0x7f, 0xa1, 0x36, 0x34, 0xf6, 0xe9, 0x1d, 0x20, 0x37, 0x30,
+	0xe3, 0xa2, 0xda, 0x36, 0x6b, 0x2c, 0x95, 0xc6, 0x2d, 0xaf, 0xb9, 0x60, 0xba, 0xa5, 0x87, 0x59,
+	0x94, 0x8f, 0x0b, 0xd2, 0x59, 0x8b, 0x9d, 0x73, 0xf5, 0x67, 0x04, 0xf0, 0x5e, 0x0a, 0x81, 0x95,
+	0xe5, 0x52, 0x90, 0x39, 0xcc, 0x2c, 0xaf, 0xd1, 0x58, 0x56, 0xab, 0xb2, 0x11, 0xfc, 0xb1, 0x14,
+	0x4c, 0x48, 0x1a, 0x65, 0x51, 0x1e, 0x17, 0xe7, 0x83, 0xf5, 0x45, 0xf0, 0xc7, 0x8f, 0x4c, 0x48,
+	0xb7, 0xeb, 0x86, 0xaf, 0xe9, 0x41, 0x16, 0xe5, 0x87, 0x85, 0x5b, 0x92, 0x27, 0x90, 0x18, 0xd9,
+	0xe8, 0x0a, 0x4b, 0xae, 0x68, 0x9c, 0x45, 0x79, 0x52, 0x8c, 0x03, 0xb8, 0x53, 0xe4, 0x39, 0x4c,
+	0x3a, 0xd3, 0x7d, 0x8c, 0xdf, 0x56, 0x5a, 0x40, 0x40, 0x0b, 0xa9, 0x2d, 0xb9, 0x86, 0xd3, 0x35,
+	0x1a, 0xcb, 0x05, 0x73, 0xdb, 0x71, 0x15, 0x23, 0x5f, 0x91, 0xee, 0xd1, 0x3b, 0x45, 0x5e, 0xc1,
+	0x74, 0x3f, 0xe6, 0xcb, 0x8e, 0x7c, 0xd9, 0xd9, 0x1e, 0xef, 0x1b, 0xad, 0x66, 0xc2, 0xb8, 0x4c,
+	0x69, 0x5b, 0x85, 0xf4, 0x38, 0x34, 0x0e, 0xf4, 0x73, 0xab, 0x90, 0x5c, 0xc2, 0x78, 0xdd, 0x68,
+	0xff, 0x18, 0x1d, 0x67, 0x51, 0x1e, 0x15, 0x83, 0x26, 0xcf, 0x00, 0xa4, 0xe6, 0x9b, 0x72, 0xd5,
+	0x5a, 0x34, 0x34, 0xf1, 0xdf, 0x9a, 0x38, 0x72, 0xeb, 0x80, 0xb3, 0x35, 0x1a, 0xd5, 0xd9, 0x10,
+	0x6c, 0x47, 0x82, 0xfd, 0x02, 0x4e, 0xfc, 0xd3, 0x8a, 0x55, 0xdf, 0xd1, 0x1a, 0x3a, 0xf1, 0x81,
+	0x89, 0x63, 0x8b, 0x80, 0x5c, 0xc4, 0x37, 0xf4, 0x91, 0x93, 0x10, 0x71, 0xac, 0x8f, 0x5c, 0xc0,
+	0xc8, 0x58, 0x66, 0x91, 0xa6, 0x7e, 0xf7, 0x41, 0xb8, 0x57, 0x57, 0x52, 0x88, 0x32, 0x58, 0xa7,
+	0xde, 0x4a, 0x1c, 0x59, 0x7a, 0x9b, 0xc2, 0xf1, 0x3d, 0x37, 0x56, 0xea, 0x96, 0x9e, 0x79, 0xaf,
+	0x97, 0xce, 0x31, 0xa8, 0x7f, 0xf2, 0x0a, 0xe9, 0x34, 0x38, 0x9d, 0x74, 0x3f, 0x62, 0x2b, 0x2b,
+	0xb6, 0xe5, 0xb6, 0xa5, 0xe7, 0xe1, 0xf8, 0x7a, 0xed, 0x66, 0x8f, 0x0b, 0x8b, 0xfa, 0x1b, 0xab,
+	0x90, 0x92, 0xf0, 0xb6, 0x01, 0x10, 0x02, 0x87, 0x96, 0x6d, 0x0c, 0x9d, 0xf9, 0xa1, 0xf4, 0x6b,
+	0x92, 0xc1, 0x64, 0x7f, 0x0e, 0x2f, 0xfc, 0x1c, 0xee, 0x23, 0x77, 0x3e, 0xc3, 0xf8, 0x96, 0x0f,
+	0x46, 0x0a, 0xfa, 0x5f, 0x16, 0xe5, 0x27, 0x45, 0x3a, 0xd0, 0x0f, 0x46, 0x8a, 0x37, 0x9f, 0x60,
+	0xba, 0x1b, 0xd3, 0xa5, 0xd5, 0xc8, 0x6a, 0xf2, 0x0e, 0x92, 0xe1, 0x1a, 0x91, 0xff, 0xe7, 0xfd,
+	0x6d, 0xfb, 0xf7, 0x6a, 0x5d, 0xce, 0x06, 0x6b, 0x57, 0xf1, 0x3a, 0xba, 0x7d, 0xf9, 0xf5, 0x7a,
+	0xc3, 0xed, 0x7d, 0xb3, 0x9a, 0x57, 0xb2, 0xbe, 0xe9, 0x22, 0x4a, 0xcb, 0x07, 0xac, 0x6c, 0x2f,
+	0x6f, 0x98, 0xe2, 0xab, 0x23, 0x7f, 0x7f, 0xdf, 0xfe, 0x1d, 0x00, 0x0a, 0x4f, 0xa5, 0x56, 0xd0,
+	0x03, 0x00, 0x00,
+}
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConn
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion4
+
+// ConnectionStreamClient is the client API for ConnectionStream service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://godoc.org/google.golang.org/grpc#ClientConn.NewStream.
+type ConnectionStreamClient interface {
+	// Subscribe streams every connection that matches the request, from the time of the call on.
+	Subscribe(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (ConnectionStream_SubscribeClient, error)
+}
+
+type connectionStreamClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewConnectionStreamClient(cc *grpc.ClientConn) ConnectionStreamClient {
+	return &connectionStreamClient{cc}
+}
+
+func (c *connectionStreamClient) Subscribe(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (ConnectionStream_SubscribeClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_ConnectionStream_serviceDesc.Streams[0], "/gourmet.ConnectionStream/Subscribe", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &connectionStreamSubscribeClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type ConnectionStream_SubscribeClient interface {
+	Recv() (*Connection, error)
+	grpc.ClientStream
+}
+
+type connectionStreamSubscribeClient struct {
+	grpc.ClientStream
+}
+
+func (x *connectionStreamSubscribeClient) Recv() (*Connection, error) {
+	m := new(Connection)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ConnectionStreamServer is the server API for ConnectionStream service.
+type ConnectionStreamServer interface {
+	// Subscribe streams every connection that matches the request, from the time of the call on.
+	Subscribe(*SubscribeRequest, ConnectionStream_SubscribeServer) error
+}
+
+// UnimplementedConnectionStreamServer can be embedded to have forward compatible implementations.
+type UnimplementedConnectionStreamServer struct {
+}
+
+func (*UnimplementedConnectionStreamServer) Subscribe(req *SubscribeRequest, srv ConnectionStream_SubscribeServer) error {
+	return status.Errorf(codes.Unimplemented, "method Subscribe not implemented")
+}
+
+func RegisterConnectionStreamServer(s *grpc.Server, srv ConnectionStreamServer) {
+	s.RegisterService(&_ConnectionStream_serviceDesc, srv)
+}
+
+func _ConnectionStream_Subscribe_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(SubscribeRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ConnectionStreamServer).Subscribe(m, &connectionStreamSubscribeServer{stream})
+}
+
+type ConnectionStream_SubscribeServer interface {
+	Send(*Connection) error
+	grpc.ServerStream
+}
+
+type connectionStreamSubscribeServer struct {
+	grpc.ServerStream
+}
+
+func (x *connectionStreamSubscribeServer) Send(m *Connection) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+var _ConnectionStream_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "gourmet.ConnectionStream",
+	HandlerType: (*ConnectionStreamServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Subscribe",
+			Handler:       _ConnectionStream_Subscribe_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "gourmet.proto",
+}
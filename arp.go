@@ -0,0 +1,74 @@
+package gourmet
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// ARPEvent is a lightweight record logged for every ARP request or reply when ARP tracking is
+// enabled. Because ARP is not IP traffic, it is logged separately from connections.
+//
+// Conflict is set when the sender IP was previously bound to a different MAC address, which is a
+// common sign of ARP spoofing or a rogue device. PreviousMAC then holds the MAC address that the
+// IP was bound to before this event.
+type ARPEvent struct {
+	Timestamp   time.Time
+	Operation   string
+	SenderIP    string
+	SenderMAC   string
+	TargetIP    string
+	TargetMAC   string
+	Conflict    bool   `json:",omitempty"`
+	PreviousMAC string `json:",omitempty"`
+}
+
+// arpTracker remembers the last MAC address seen for each IP address on the local segment.
+type arpTracker struct {
+	mutex    sync.Mutex
+	bindings map[string]string
+}
+
+func newARPTracker() *arpTracker {
+	return &arpTracker{
+		bindings: make(map[string]string),
+	}
+}
+
+func arpOperation(op uint16) string {
+	switch op {
+	case layers.ARPRequest:
+		return "request"
+	case layers.ARPReply:
+		return "reply"
+	}
+	return "unknown"
+}
+
+// observe records the IP to MAC binding announced by the sender of an ARP packet and returns the
+// event to log for it.
+func (at *arpTracker) observe(arp *layers.ARP, timestamp time.Time) *ARPEvent {
+	event := &ARPEvent{
+		Timestamp: timestamp,
+		Operation: arpOperation(arp.Operation),
+		SenderIP:  formatIP(net.IP(arp.SourceProtAddress)),
+		SenderMAC: net.HardwareAddr(arp.SourceHwAddress).String(),
+		TargetIP:  formatIP(net.IP(arp.DstProtAddress)),
+		TargetMAC: net.HardwareAddr(arp.DstHwAddress).String(),
+	}
+	// ARP probes are sent from 0.0.0.0 and do not announce a binding
+	if net.IP(arp.SourceProtAddress).IsUnspecified() {
+		return event
+	}
+	at.mutex.Lock()
+	previous, ok := at.bindings[event.SenderIP]
+	if ok && previous != event.SenderMAC {
+		event.Conflict = true
+		event.PreviousMAC = previous
+	}
+	at.bindings[event.SenderIP] = event.SenderMAC
+	at.mutex.Unlock()
+	return event
+}
@@ -0,0 +1,102 @@
+package gourmet
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const bogonTag = "bogon"
+
+// defaultBogons are the IPv4 and IPv6 ranges that are reserved or not allocated for use on the
+// internet, following the IANA special-purpose address registries. Multicast is left out, since it
+// is routinely seen on local networks. The list can be replaced with the bogon_list option, which
+// takes a file in the same format, when IANA allocations change.
+const defaultBogons = `
+# IPv4
+0.0.0.0/8
+10.0.0.0/8
+100.64.0.0/10
+127.0.0.0/8
+169.254.0.0/16
+172.16.0.0/12
+192.0.0.0/24
+192.0.2.0/24
+192.168.0.0/16
+198.18.0.0/15
+198.51.100.0/24
+203.0.113.0/24
+240.0.0.0/4
+# IPv6
+::/128
+::1/128
+64:ff9b:1::/48
+100::/64
+2001:2::/48
+2001:10::/28
+2001:db8::/32
+3fff::/20
+fc00::/7
+fec0::/10
+`
+
+// readNetworks reads a newline delimited list of IP addresses and CIDR blocks into a trie, where
+// every network maps to the line it was read from. Blank lines and lines starting with # are ignored,
+// and the other lines that are not networks are returned separately.
+func readNetworks(r io.Reader) (networks *ipTrie, others []string, err error) {
+	networks = newIPTrie()
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ipNet, err := parseNetwork(line)
+		if err != nil {
+			others = append(others, line)
+			continue
+		}
+		networks.insert(ipNet, line)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	return networks, others, nil
+}
+
+// loadBogons returns the bundled bogon list, or the list in the file if one is given.
+func loadBogons(file string) (*ipTrie, error) {
+	var r io.Reader = strings.NewReader(defaultBogons)
+	if file != "" {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	bogons, others, err := readNetworks(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(others) > 0 {
+		return nil, fmt.Errorf("invalid IP address or CIDR block %q in bogon list %s", others[0], file)
+	}
+	return bogons, nil
+}
+
+// tagBogons tags the connection if one of its endpoints is in a bogon range. Endpoints inside the
+// configured local networks are expected to use private ranges and are not considered bogons.
+func (c *Connection) tagBogons(bogons, localNets *ipTrie) {
+	for _, ip := range []string{c.SourceIP, c.DestinationIP} {
+		if localNets != nil && localNets.contains(ip) {
+			continue
+		}
+		if bogons.contains(ip) {
+			c.addTag(bogonTag)
+			return
+		}
+	}
+}
@@ -0,0 +1,12 @@
+package gourmet
+
+// builtinAnalyzers are the analyzers that ship with Gourmet, by the name they are configured under.
+// They are enabled by listing their name in the analyzers section of the config, take the same
+// framework arguments as plugins, and receive their section through Init if they are Configurable,
+// but they are neither installed nor built, and cannot run in a separate process.
+var builtinAnalyzers = map[string]func() Analyzer{
+	dnsAnalyzerName:  func() Analyzer { return &dnsAnalyzer{} },
+	httpAnalyzerName: func() Analyzer { return &httpAnalyzer{} },
+	sshAnalyzerName:  func() Analyzer { return &sshAnalyzer{} },
+	tlsAnalyzerName:  func() Analyzer { return &tlsAnalyzer{} },
+}
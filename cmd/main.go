@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"os"
+	"path"
 	"runtime"
 
 	"github.com/ghodss/yaml"
@@ -14,77 +16,446 @@ import (
 )
 
 var (
-	flagConfig = flag.String("c", "config.yml", "Gourmet configuration file")
+	flagConfig  = flag.String("c", "config.yml", "Gourmet configuration file")
+	flagDaemon  = flag.Bool("daemon", false, "Run as a system service, as service_mode does")
+	flagPidFile = flag.String("pidfile", "", "File to write the process ID to in service mode, overriding pid_file")
 )
 
 func main() {
 	var c *gourmet.Config
 	var err error
 	flag.Parse()
+	if flag.Arg(0) == "plugin" {
+		err = runPluginCommand(flag.Args()[1:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	c, err = parseConfigFile(*flagConfig)
 	if err != nil {
 		log.Fatal(err)
 	}
+	applyFlags(c)
 	if c.MaxCores != 0 && c.MaxCores < runtime.NumCPU() {
 		runtime.GOMAXPROCS(c.MaxCores)
 	} else if c.MaxCores != 0 {
 		fmt.Println(fmt.Errorf("[!] Warning: max_cores argument is invalid. Using %d cores instead", runtime.NumCPU()))
 	}
 
-	setDefaults(c)
+	c.SetDefaults()
 	err = validateConfig(c)
 	if err != nil {
 		log.Fatal(err)
 	}
+	c.Reload = func() (*gourmet.Config, error) {
+		return reloadConfig(*flagConfig)
+	}
 	gourmet.Start(c)
 }
 
-func parseConfigFile(cf string) (c *gourmet.Config, err error) {
-	c = &gourmet.Config{}
-	contents, err := ioutil.ReadFile(cf)
+// reloadConfig reads the config file again when the sensor reloads it on SIGHUP, with the defaults
+// and checks applied at startup.
+func reloadConfig(cf string) (*gourmet.Config, error) {
+	c, err := parseConfigFile(cf)
 	if err != nil {
 		return nil, err
 	}
-	err = yaml.Unmarshal(contents, c)
+	applyFlags(c)
+	c.SetDefaults()
+	err = validateConfig(c)
 	if err != nil {
 		return nil, err
 	}
-	return c, err
+	return c, nil
 }
 
-func setDefaults(c *gourmet.Config) {
-	if c.SnapLen == 0 {
-		c.SnapLen = 262144
+// applyFlags applies the command line flags that override settings of the config file.
+func applyFlags(c *gourmet.Config) {
+	if *flagDaemon {
+		c.ServiceMode = true
 	}
-	if c.LogFile == "" {
-		c.LogFile = "gourmet.log"
+	if *flagPidFile != "" {
+		c.PidFile = *flagPidFile
 	}
-	if c.InterfaceType == "" {
-		c.InterfaceType = "libpcap"
+}
+
+func parseConfigFile(cf string) (c *gourmet.Config, err error) {
+	c = &gourmet.Config{ConfigFile: cf}
+	contents, err := ioutil.ReadFile(cf)
+	if err != nil {
+		return nil, err
+	}
+	err = yaml.Unmarshal(contents, c)
+	if err != nil {
+		return nil, err
 	}
+	return c, err
 }
 
 func validateConfig(c *gourmet.Config) (err error) {
-	if err = validateInterface(c.Interface); err != nil {
+	if c.InterfaceType == "pcapfile" {
+		if err = validatePcapFile(c); err != nil {
+			return err
+		}
+	} else if c.InterfacePattern != "" {
+		if err = validateInterfacePattern(c); err != nil {
+			return err
+		}
+	} else if err = validateInterfaces(c); err != nil {
+		return err
+	}
+	if err = validateRemote(c); err != nil {
 		return err
 	}
 	if err = validateSnapshotLength(c.SnapLen); err != nil {
 		return err
 	}
+	if err = validateInterfaceBpf(c); err != nil {
+		return err
+	}
+	if err = validateBpf(c); err != nil {
+		return err
+	}
+	if err = validatePortProtocols(c); err != nil {
+		return err
+	}
+	if err = validateAfpacketTimeouts(c); err != nil {
+		return err
+	}
+	if err = validateAfpacketFanout(c); err != nil {
+		return err
+	}
+	if err = validateAfxdp(c); err != nil {
+		return err
+	}
+	if err = validateHealth(c); err != nil {
+		return err
+	}
+	if err = validateLogRotation(c); err != nil {
+		return err
+	}
+	if err = validateTimeouts(c); err != nil {
+		return err
+	}
+	if err = validateConnectionLimit(c); err != nil {
+		return err
+	}
+	if c.StatsInterval < 0 {
+		return errors.New("stats_interval must not be negative")
+	}
+	if err = validateAnalyzerWorkers(c); err != nil {
+		return err
+	}
+	if err = validateLogSampling(c); err != nil {
+		return err
+	}
+	if err = validateFileExtraction(c); err != nil {
+		return err
+	}
+	if err = validatePcapRing(c); err != nil {
+		return err
+	}
+	if c.SkipUpdate {
+		log.Println("[*] Warning: skip_update is deprecated and has no effect. Plugins are only updated with gourmet plugin update")
+	}
+	if c.CommunityIDSeed < 0 || c.CommunityIDSeed > 65535 {
+		return fmt.Errorf("invalid community_id_seed %d. Must be between 0 and 65535", c.CommunityIDSeed)
+	}
+	if err = validateService(c); err != nil {
+		return err
+	}
+	if c.ControlAddress != "" && c.ControlToken == "" {
+		log.Println("[*] Warning: control_token is not set, so the filter cannot be changed and the sensor cannot be shut down over the control server")
+	}
 	return nil
 }
 
+// validateInterface checks that libpcap can capture on the interface, which on Windows may be named
+// by the GUID or the friendly name of its Npcap device as well. When it cannot, the error lists the
+// interfaces that can be captured on.
 func validateInterface(iface string) error {
-	devices, err := pcap.FindAllDevs()
-	if err != nil {
-		log.Fatal(err)
+	_, err := gourmet.LookupCaptureDevice(iface)
+	return err
+}
+
+func validatePcapFile(c *gourmet.Config) error {
+	if c.PcapFile == "" {
+		return errors.New("pcap_file must be set when the interface type is pcapfile")
+	}
+	if _, err := os.Stat(c.PcapFile); err != nil {
+		return fmt.Errorf("unable to read pcap_file: %s", err)
+	}
+	if len(c.InterfaceBpf) > 0 {
+		return errors.New("interface_bpf does not apply to pcapfile. Use bpf instead")
+	}
+	return nil
+}
+
+func validateInterfaces(c *gourmet.Config) error {
+	if len(c.Interfaces) > 0 && c.Interface != "" {
+		log.Println("[*] Warning: interface is ignored when interfaces is set")
+	}
+	if c.InterfaceRescan != 0 {
+		log.Println("[*] Warning: interface_rescan is only applied when interface_pattern is set")
+	}
+	seen := make(map[string]bool)
+	for _, iface := range c.CaptureInterfaces() {
+		if seen[iface] {
+			return fmt.Errorf("interface %s is listed more than once", iface)
+		}
+		seen[iface] = true
+		if c.InterfaceType == "ssh" {
+			// remote interfaces are checked by tcpdump on the remote host
+			continue
+		}
+		if err := validateInterface(iface); err != nil {
+			return fmt.Errorf("%s: %s", iface, err)
+		}
+	}
+	return nil
+}
+
+func validateInterfacePattern(c *gourmet.Config) error {
+	if c.InterfaceType != "libpcap" {
+		return errors.New("interface_pattern is only supported with the libpcap interface type")
+	}
+	if _, err := path.Match(c.InterfacePattern, ""); err != nil {
+		return fmt.Errorf("invalid interface_pattern %s: %s", c.InterfacePattern, err)
+	}
+	if c.Interface != "" || len(c.Interfaces) > 0 {
+		log.Println("[*] Warning: interface and interfaces are ignored when interface_pattern is set")
+	}
+	if c.InterfaceRescan < 0 {
+		return errors.New("interface_rescan must be a positive number of seconds")
+	}
+	return nil
+}
+
+func validateRemote(c *gourmet.Config) error {
+	if c.InterfaceType != "ssh" {
+		if c.Remote != "" || c.RemoteUser != "" || c.RemoteKey != "" {
+			log.Println("[*] Warning: remote, remote_user, and remote_key are only applied when using the ssh interface type")
+		}
+		return nil
+	}
+	if c.Remote == "" {
+		return errors.New("remote must be set to the host to capture on when the interface type is ssh")
+	}
+	if c.RemoteKey != "" {
+		if _, err := os.Stat(c.RemoteKey); err != nil {
+			return fmt.Errorf("unable to read remote_key: %s", err)
+		}
+	}
+	return nil
+}
+
+func validateInterfaceBpf(c *gourmet.Config) error {
+	for iface := range c.InterfaceBpf {
+		captured := false
+		for _, captureIface := range c.CaptureInterfaces() {
+			if iface == captureIface {
+				captured = true
+			}
+		}
+		if !captured {
+			return fmt.Errorf("interface_bpf is set for %s, which is not a capture interface", iface)
+		}
 	}
-	for _, device := range devices {
-		if device.Name == iface {
+	return nil
+}
+
+// validateBpf compiles the BPF filter of every capture interface, or of the capture file, for its
+// link type and the snapshot length, so that an invalid filter is reported before capture starts.
+func validateBpf(c *gourmet.Config) error {
+	if c.InterfaceType == "pcapfile" {
+		if c.Bpf == "" {
 			return nil
 		}
+		handle, err := pcap.OpenOffline(c.PcapFile)
+		if err != nil {
+			return fmt.Errorf("unable to open pcap_file: %s", err)
+		}
+		linkType := handle.LinkType()
+		handle.Close()
+		_, err = pcap.CompileBPFFilter(linkType, c.SnapLen, c.Bpf)
+		if err != nil {
+			return fmt.Errorf("invalid bpf filter %q for capture file %s (link type %s): %s", c.Bpf, c.PcapFile, linkType, err)
+		}
+		return nil
 	}
-	return errors.New("specified network interface does not exist")
+	for _, iface := range c.CaptureInterfaces() {
+		setting, bpf := "bpf", c.Bpf
+		if ifaceBpf, ok := c.InterfaceBpf[iface]; ok {
+			setting, bpf = "interface_bpf", ifaceBpf
+		}
+		if bpf == "" {
+			continue
+		}
+		err := gourmet.CheckFilter(c, iface, bpf)
+		if err != nil {
+			return fmt.Errorf("invalid %s filter %q for interface %s: %s", setting, bpf, iface, err)
+		}
+	}
+	return nil
+}
+
+func validatePortProtocols(c *gourmet.Config) error {
+	for port, protocol := range c.PortProtocols {
+		if port < 1 || port > 65535 {
+			return fmt.Errorf("port_protocols port %d is not a valid port", port)
+		}
+		if protocol == "" {
+			return fmt.Errorf("port_protocols protocol for port %d is empty", port)
+		}
+		if !gourmet.KnownService(c, protocol) {
+			return fmt.Errorf("port_protocols protocol %q for port %d is neither a detected service nor a configured analyzer", protocol, port)
+		}
+	}
+	return nil
+}
+
+func validateAfpacketTimeouts(c *gourmet.Config) error {
+	if c.AfpacketPollTimeout < 0 {
+		return errors.New("afpacket_poll_timeout must be 0 to block until packets arrive, or a positive number of milliseconds")
+	}
+	if c.AfpacketBlockTimeout < 0 {
+		return errors.New("afpacket_block_timeout must be 0 for the default, or a positive number of milliseconds")
+	}
+	if (c.AfpacketPollTimeout > 0 || c.AfpacketBlockTimeout > 0) && c.InterfaceType != "afpacket" && c.InterfaceType != "afxdp" {
+		log.Println("[*] Warning: afpacket timeouts are only applied when using afpacket sensor, or afxdp falling back to it")
+	}
+	return nil
+}
+
+func validateAfpacketFanout(c *gourmet.Config) error {
+	if c.FanoutWorkers < 1 || c.FanoutWorkers > 64 {
+		return errors.New("fanout_workers must be between 1 and 64")
+	}
+	if c.RingSizeMB < 0 {
+		return errors.New("ring_size_mb must be 0 for the default, or a positive number of MiB")
+	}
+	if (c.FanoutWorkers > 1 || c.RingSizeMB > 0) && c.InterfaceType != "afpacket" && c.InterfaceType != "afxdp" {
+		log.Println("[*] Warning: fanout_workers and ring_size_mb are only applied when using afpacket sensor, or afxdp falling back to it")
+	}
+	return nil
+}
+
+func validateAfxdp(c *gourmet.Config) error {
+	if c.InterfaceType == "afxdp" && !c.AfxdpRedirect {
+		return errors.New("afxdp takes every packet of the interface away from the host, set afxdp_redirect to true to use it on a dedicated capture interface")
+	}
+	if c.AfxdpRedirect && c.InterfaceType != "afxdp" {
+		log.Println("[*] Warning: afxdp_redirect is only applied when using afxdp sensor")
+	}
+	return nil
+}
+
+func validateHealth(c *gourmet.Config) error {
+	if c.HealthMaxIdle < 0 {
+		return errors.New("health_max_idle must be a positive number of seconds")
+	}
+	if c.HealthMaxIdle > 0 && c.HealthAddr == "" {
+		log.Println("[*] Warning: health_max_idle is only applied when health_addr is set")
+	}
+	return nil
+}
+
+func validateLogRotation(c *gourmet.Config) error {
+	if c.LogMaxSize < 0 || c.LogMaxAge < 0 || c.LogMaxBackups < 0 {
+		return errors.New("log_max_size, log_max_age, and log_max_backups must not be negative")
+	}
+	if c.LogMaxSize == 0 && (c.LogMaxAge > 0 || c.LogMaxBackups > 0 || c.LogCompress) {
+		log.Println("[*] Warning: log_max_age, log_max_backups, and log_compress are only applied when log_max_size is set")
+	}
+	if c.LogMaxSize > 0 && c.LogPartition != "" {
+		log.Println("[*] Warning: log_max_size is not applied to partitioned logs")
+	}
+	return nil
+}
+
+func validateTimeouts(c *gourmet.Config) error {
+	if c.ShutdownTimeout < 0 {
+		return errors.New("shutdown_timeout must not be negative")
+	}
+	if c.TCPEstablishedTimeout < 0 || c.TCPHalfOpenTimeout < 0 || c.UDPTimeout < 0 || c.ICMPTimeout < 0 {
+		return errors.New("tcp_established_timeout, tcp_half_open_timeout, udp_timeout, and icmp_timeout must not be negative")
+	}
+	if c.ICMPTimeout > 0 && !c.TrackICMP && !c.TrackICMPv6 {
+		log.Println("[*] Warning: icmp_timeout is only applied when track_icmp or track_icmpv6 is set")
+	}
+	return nil
+}
+
+func validateConnectionLimit(c *gourmet.Config) error {
+	if c.MaxConnections < 0 {
+		return errors.New("max_connections must not be negative")
+	}
+	if c.ConnectionEviction != "lru" && c.ConnectionEviction != "oldest" {
+		return errors.New("connection_eviction must be lru or oldest")
+	}
+	return nil
+}
+
+func validateAnalyzerWorkers(c *gourmet.Config) error {
+	if c.AnalyzerWorkers < 0 || c.AnalyzerQueueSize < 0 {
+		return errors.New("analyzer_workers and analyzer_queue_size must not be negative")
+	}
+	return nil
+}
+
+func validateLogSampling(c *gourmet.Config) error {
+	if c.LogSampleRate < 0 || c.LogMinBytes < 0 || c.LogRateLimit < 0 {
+		return errors.New("log_sample_rate, log_min_bytes, and log_rate_limit must not be negative")
+	}
+	return nil
+}
+
+func validateFileExtraction(c *gourmet.Config) error {
+	if c.ExtractMaxBytes < 0 {
+		return errors.New("extract_max_bytes must not be negative")
+	}
+	if c.ExtractMaxTotalBytes < 0 {
+		return errors.New("extract_max_total_bytes must not be negative")
+	}
+	if c.ExtractDir == "" && (len(c.ExtractProtocols) > 0 || len(c.ExtractMIMETypes) > 0) {
+		log.Println("[*] Warning: extract_protocols and extract_mime_types are only applied when extract_dir is set")
+	}
+	for _, p := range c.ExtractProtocols {
+		if p != "http" && p != "ftp" && p != "smb" {
+			return fmt.Errorf("invalid extract_protocols %s. Must be http, ftp, or smb", p)
+		}
+	}
+	return nil
+}
+
+func validatePcapRing(c *gourmet.Config) error {
+	if c.PcapRingFileSize < 1 {
+		return errors.New("pcap_ring_file_size must be a positive number of MB")
+	}
+	if c.PcapRingFiles < 1 {
+		return errors.New("pcap_ring_files must be a positive number of files")
+	}
+	if c.PcapRingFormat != "pcap" && c.PcapRingFormat != "pcapng" {
+		return fmt.Errorf("invalid pcap_ring_format %s. Must be pcap or pcapng", c.PcapRingFormat)
+	}
+	if c.PcapRingDir == "" && (c.PcapRingFileSize != 100 || c.PcapRingFiles != 10 || c.PcapRingFormat != "pcap") {
+		log.Println("[*] Warning: pcap_ring_file_size, pcap_ring_files, and pcap_ring_format are only applied when pcap_ring_dir is set")
+	}
+	return nil
+}
+
+func validateService(c *gourmet.Config) error {
+	if c.ServiceLog != "journald" && c.ServiceLog != "syslog" && c.ServiceLog != "stderr" {
+		return fmt.Errorf("invalid service_log %s. Must be journald, syslog, or stderr", c.ServiceLog)
+	}
+	if runtime.GOOS == "windows" && c.ServiceMode && c.ServiceLog != "stderr" {
+		return errors.New("service_log must be stderr on Windows, which has neither journald nor syslog")
+	}
+	if !c.ServiceMode && (c.ServiceLog != "journald" || c.PidFile != "") {
+		log.Println("[*] Warning: service_log and pid_file are only applied in service mode")
+	}
+	return nil
 }
 
 func validateSnapshotLength(snapLen int) error {
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/gourmetproject/gourmet"
+)
+
+const pluginUsage = `usage: gourmet plugin <command> [arguments]
+
+commands:
+  install <repo>[@<revision>]   clone an analyzer plugin, such as github.com/user/analyzer,
+                                at its latest commit or at a tag or commit
+  list                          list the installed plugins and their versions
+  update <name>[@<revision>]    pull the latest commit of an installed plugin, or check out a
+                                tag or commit
+  remove <name>                 delete an installed plugin`
+
+// runPluginCommand runs a `gourmet plugin` subcommand with its arguments.
+func runPluginCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New(pluginUsage)
+	}
+	command, args := args[0], args[1:]
+	switch command {
+	case "list":
+		if len(args) != 0 {
+			return errors.New(pluginUsage)
+		}
+		return listPlugins()
+	case "install", "update", "remove":
+		if len(args) != 1 {
+			return errors.New(pluginUsage)
+		}
+	default:
+		return errors.New(pluginUsage)
+	}
+	switch command {
+	case "install":
+		p, err := gourmet.InstallPlugin(args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("[*] Installed %s %s\n", p.Name, p.Version)
+	case "update":
+		p, err := gourmet.UpdatePlugin(args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("[*] Updated %s to %s\n", p.Name, p.Version)
+	case "remove":
+		err := gourmet.RemovePlugin(args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("[*] Removed %s\n", args[0])
+	}
+	return nil
+}
+
+func listPlugins() error {
+	plugins, err := gourmet.ListPlugins()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tVERSION\tCOMMIT\tUPDATED")
+	for _, p := range plugins {
+		commit := p.Commit
+		if len(commit) > 12 {
+			commit = commit[:12]
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", p.Name, p.Version, commit, p.UpdatedAt.Format("2006-01-02 15:04"))
+	}
+	return w.Flush()
+}
@@ -0,0 +1,102 @@
+package gourmet
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"net"
+)
+
+// communityIDVersion prefixes the Community IDs of version 1 of the spec
+const communityIDVersion = "1:"
+
+// IANA numbers of the transports that Community IDs are computed for
+const (
+	ianaICMP   = 1
+	ianaTCP    = 6
+	ianaUDP    = 17
+	ianaICMPv6 = 58
+)
+
+// icmpCounterparts map the types of ICMP messages that are answered to the types of their answers,
+// and back, so that both directions of an exchange hash to the same Community ID
+var (
+	icmpCounterparts = map[int]int{
+		8: 0, 0: 8, // echo
+		13: 14, 14: 13, // timestamp
+		15: 16, 16: 15, // information
+		10: 9, 9: 10, // router solicitation and advertisement
+		17: 18, 18: 17, // address mask
+	}
+	icmpv6Counterparts = map[int]int{
+		128: 129, 129: 128, // echo
+		130: 131, 131: 130, // multicast listener query and report
+		133: 134, 134: 133, // router solicitation and advertisement
+		135: 136, 136: 135, // neighbor solicitation and advertisement
+		139: 140, 140: 139, // node information query and response
+		144: 145, 145: 144, // home agent address discovery
+	}
+)
+
+// setCommunityID sets the CommunityID of a TCP, UDP, or ICMP connection, which is the version 1
+// Community ID of its flow with the seed, as computed by Zeek, Suricata, and Elastic. Its
+// endpoints are hashed in a fixed order, so both directions of a flow have the same ID. ICMP
+// messages hash their type and code in place of ports, with the type of the answer standing in for
+// the code of messages that are answered.
+func (c *Connection) setCommunityID(seed uint16) {
+	src, dst := communityIDAddress(c.SourceIP), communityIDAddress(c.DestinationIP)
+	if src == nil || dst == nil || len(src) != len(dst) {
+		return
+	}
+	srcPort, dstPort := c.SourcePort, c.DestinationPort
+	oneWay := false
+	var proto uint8
+	switch c.TransportType {
+	case "tcp":
+		proto = ianaTCP
+	case "udp":
+		proto = ianaUDP
+	case icmpTransport, icmpv6Transport:
+		proto = ianaICMP
+		counterparts := icmpCounterparts
+		if c.TransportType == icmpv6Transport {
+			proto, counterparts = ianaICMPv6, icmpv6Counterparts
+		}
+		if counterpart, ok := counterparts[srcPort]; ok {
+			dstPort = counterpart
+		} else {
+			oneWay = true
+		}
+	default:
+		return
+	}
+	if !oneWay {
+		order := bytes.Compare(src, dst)
+		if order > 0 || (order == 0 && srcPort > dstPort) {
+			src, dst = dst, src
+			srcPort, dstPort = dstPort, srcPort
+		}
+	}
+	h := sha1.New()
+	binary.Write(h, binary.BigEndian, seed)
+	h.Write(src)
+	h.Write(dst)
+	// the transport is followed by a byte of padding
+	h.Write([]byte{proto, 0})
+	binary.Write(h, binary.BigEndian, uint16(srcPort))
+	binary.Write(h, binary.BigEndian, uint16(dstPort))
+	c.CommunityID = communityIDVersion + base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// communityIDAddress returns the bytes of an address of a connection, 4 for IPv4 and 16 for IPv6.
+func communityIDAddress(address string) net.IP {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
@@ -1,8 +1,6 @@
 package gourmet
 
 import (
-	"fmt"
-
 	"github.com/ghodss/yaml"
 )
 
@@ -10,37 +8,234 @@ import (
 // these fields have a default value, except for InterfaceType. For a list of default values and
 // which values are allowed for each field, consult the web documentation at docs.gourmetproject.io
 type Config struct {
-	InterfaceType string `json:"type"`
-	Interface     string
-	Promiscuous   bool
-	MaxCores      int `json:"max_cores"`
-	ConnTimeout   int `json:"connection_timeout"`
-	SnapLen       int `json:"snapshot_length"`
-	Bpf           string
-	LogFile       string `json:"log_file"`
-	SkipUpdate    bool   `json:"skip_update"`
-	Analyzers     map[string]interface{}
+	InterfaceType         string `json:"type"`
+	Interface             string
+	Promiscuous           bool
+	MaxCores              int `json:"max_cores"`
+	ConnTimeout           int `json:"connection_timeout"`
+	ShutdownTimeout       int `json:"shutdown_timeout"`
+	SnapLen               int `json:"snapshot_length"`
+	Bpf                   string
+	InterfaceBpf          map[string]string `json:"interface_bpf"`
+	LogFile               string            `json:"log_file"`
+	SkipUpdate            bool              `json:"skip_update"` // deprecated, plugins are only updated by gourmet plugin update
+	StageTiming           bool              `json:"stage_timing"`
+	Summary               bool
+	SummaryFile           string                   `json:"summary_file"`
+	PortProtocols         map[int]string           `json:"port_protocols"`
+	TrackARP              bool                     `json:"track_arp"`
+	IncludePayload        bool                     `json:"include_payload"`
+	MaxPayloadBytes       int                      `json:"max_payload_bytes"`
+	IPFIXCollector        string                   `json:"ipfix_collector"`
+	IPFIXTemplateRefresh  int                      `json:"ipfix_template_refresh"`
+	PacketTiming          bool                     `json:"packet_timing"`
+	LocalNetworks         []string                 `json:"local_networks"`
+	UIDMode               string                   `json:"uid_mode"`
+	UIDSeed               uint64                   `json:"uid_seed"`
+	MaxAnalyzerResults    int                      `json:"max_analyzer_results"`
+	StateDumpFile         string                   `json:"state_dump_file"`
+	ReassembleDirections  string                   `json:"reassemble_directions"`
+	IntelFeed             string                   `json:"intel_feed"`
+	IntelRefresh          int                      `json:"intel_refresh"`
+	TimestampTolerance    int                      `json:"timestamp_tolerance"`
+	SniffContentType      bool                     `json:"sniff_content_type"`
+	EmitOrder             string                   `json:"emit_order"`
+	EmitWindow            int                      `json:"emit_window"`
+	PayloadSpillThreshold int                      `json:"payload_spill_threshold"`
+	PayloadSpillDir       string                   `json:"payload_spill_dir"`
+	AfpacketPollTimeout   int                      `json:"afpacket_poll_timeout"`
+	AfpacketBlockTimeout  int                      `json:"afpacket_block_timeout"`
+	BogonDetection        bool                     `json:"bogon_detection"`
+	BogonList             string                   `json:"bogon_list"`
+	UIDFormat             string                   `json:"uid_format"`
+	MemoryBudgetMB        int                      `json:"memory_budget_mb"`
+	PreliminaryBytes      int                      `json:"preliminary_bytes"`
+	IPFormat              string                   `json:"ip_format"`
+	MergeWindow           int                      `json:"merge_window"`
+	MergeBy               string                   `json:"merge_by"`
+	IncludeInterfaceIndex bool                     `json:"include_interface_index"`
+	TrackQUIC             bool                     `json:"track_quic"`
+	TrackPMTU             bool                     `json:"track_pmtu"`
+	RotateHook            string                   `json:"rotate_hook"`
+	HealthAddr            string                   `json:"health_addr"`
+	HealthMaxIdle         int                      `json:"health_max_idle"`
+	EmptyResultKey        string                   `json:"empty_result_key"`
+	LogPartition          string                   `json:"log_partition"`
+	PayloadEntropy        bool                     `json:"payload_entropy"`
+	EntropyBytes          int                      `json:"entropy_bytes"`
+	ConnectionShards      int                      `json:"connection_shards"`
+	ProcessAttribution    bool                     `json:"process_attribution"`
+	PcapFile              string                   `json:"pcap_file"`
+	Interfaces            []string                 `json:"interfaces"`
+	InterfacePattern      string                   `json:"interface_pattern"`
+	InterfaceRescan       int                      `json:"interface_rescan"`
+	MetricsAddress        string                   `json:"metrics_address"`
+	Outputs               []map[string]interface{} `json:"outputs"`
+	TrackICMP             bool                     `json:"track_icmp"`
+	TrackICMPv6           bool                     `json:"track_icmpv6"`
+	LogMaxSize            int                      `json:"log_max_size"`
+	LogMaxAge             int                      `json:"log_max_age"`
+	LogMaxBackups         int                      `json:"log_max_backups"`
+	LogCompress           bool                     `json:"log_compress"`
+	TCPEstablishedTimeout int                      `json:"tcp_established_timeout"`
+	TCPHalfOpenTimeout    int                      `json:"tcp_half_open_timeout"`
+	UDPTimeout            int                      `json:"udp_timeout"`
+	ICMPTimeout           int                      `json:"icmp_timeout"`
+	AnalyzerWorkers       int                      `json:"analyzer_workers"`
+	AnalyzerQueueSize     int                      `json:"analyzer_queue_size"`
+	Remote                string                   `json:"remote"`
+	RemoteUser            string                   `json:"remote_user"`
+	RemoteKey             string                   `json:"remote_key"`
+	GeoIPDatabases        []string                 `json:"geoip_databases"`
+	LogSampleRate         int                      `json:"log_sample_rate"`
+	LogMinBytes           int                      `json:"log_min_bytes"`
+	LogRateLimit          int                      `json:"log_rate_limit"`
+	ExtractDir            string                   `json:"extract_dir"`
+	ExtractMaxBytes       int                      `json:"extract_max_bytes"`
+	ExtractMaxTotalBytes  int64                    `json:"extract_max_total_bytes"`
+	ExtractProtocols      []string                 `json:"extract_protocols"`
+	ExtractMIMETypes      []string                 `json:"extract_mime_types"`
+	MaxConnections        int                      `json:"max_connections"`
+	ConnectionEviction    string                   `json:"connection_eviction"`
+	VLANTrunk             bool                     `json:"vlan_trunk"`
+	DecapsulateTunnels    bool                     `json:"decapsulate_tunnels"`
+	StatsInterval         int                      `json:"stats_interval"`
+	ControlAddress        string                   `json:"control_address"`
+	ControlToken          string                   `json:"control_token"`
+	IntelFeeds            []string                 `json:"intel_feeds"`
+	FanoutWorkers         int                      `json:"fanout_workers"`
+	RingSizeMB            int                      `json:"ring_size_mb"`
+	AfxdpRedirect         bool                     `json:"afxdp_redirect"`
+	PcapRingDir           string                   `json:"pcap_ring_dir"`
+	PcapRingFileSize      int                      `json:"pcap_ring_file_size"`
+	PcapRingFiles         int                      `json:"pcap_ring_files"`
+	PcapRingFormat        string                   `json:"pcap_ring_format"`
+	CommunityID           bool                     `json:"community_id"`
+	CommunityIDSeed       int                      `json:"community_id_seed"`
+	ServiceMode           bool                     `json:"service_mode"`
+	ServiceLog            string                   `json:"service_log"`
+	PidFile               string                   `json:"pid_file"`
+	Analyzers             map[string]interface{}
+	// ConfigFile is the file the config was read from, which the analyzers section is read again from
+	// when analyzers are reloaded
+	ConfigFile string `json:"-"`
+	// Reload reads the config again when it is reloaded on SIGHUP, with the defaults and checks that
+	// were applied at startup. If it is not set, the config file is read as it is.
+	Reload func() (*Config, error) `json:"-"`
 }
 
-var (
-	analyzerConfigs = make(map[string]interface{})
-)
+// SetDefaults gives the settings that are not set their default values, as gourmet does for its
+// config file.
+func (c *Config) SetDefaults() {
+	if c.SnapLen == 0 {
+		c.SnapLen = 262144
+	}
+	if c.LogFile == "" {
+		c.LogFile = "gourmet.log"
+	}
+	if c.InterfaceType == "" {
+		c.InterfaceType = "libpcap"
+	}
+	if c.ShutdownTimeout == 0 {
+		c.ShutdownTimeout = 5
+	}
+	if c.MaxPayloadBytes == 0 {
+		c.MaxPayloadBytes = 4096
+	}
+	if c.MaxAnalyzerResults == 0 {
+		c.MaxAnalyzerResults = 64
+	}
+	if c.TimestampTolerance == 0 {
+		c.TimestampTolerance = 100
+	}
+	if c.ReassembleDirections == "" {
+		c.ReassembleDirections = "both"
+	}
+	if c.EmitOrder == "" {
+		c.EmitOrder = "end"
+	}
+	if c.EmitWindow == 0 {
+		c.EmitWindow = 10
+	}
+	if c.AnalyzerQueueSize == 0 {
+		c.AnalyzerQueueSize = 1024
+	}
+	if c.ExtractMaxBytes == 0 {
+		c.ExtractMaxBytes = 104857600
+	}
+	if c.ExtractMaxTotalBytes == 0 {
+		c.ExtractMaxTotalBytes = 10737418240
+	}
+	if c.ConnectionEviction == "" {
+		c.ConnectionEviction = "lru"
+	}
+	if c.FanoutWorkers == 0 {
+		c.FanoutWorkers = 1
+	}
+	if c.PcapRingFileSize == 0 {
+		c.PcapRingFileSize = 100
+	}
+	if c.PcapRingFiles == 0 {
+		c.PcapRingFiles = 10
+	}
+	if c.PcapRingFormat == "" {
+		c.PcapRingFormat = "pcap"
+	}
+	if c.ServiceLog == "" {
+		c.ServiceLog = "journald"
+	}
+}
+
+// CaptureInterfaces returns the interfaces to capture on, which are Interfaces if it is set, and
+// Interface otherwise. Packets of every interface are tracked in the same connection table, and
+// when there are several, connections are tagged with the interface they were first seen on.
+func (c *Config) CaptureInterfaces() []string {
+	if len(c.Interfaces) > 0 {
+		return c.Interfaces
+	}
+	return []string{c.Interface}
+}
+
+// IntelSources returns the files and URLs of the intel feeds to load, which are IntelFeeds, and
+// IntelFeed if it is set.
+func (c *Config) IntelSources() []string {
+	if c.IntelFeed == "" {
+		return c.IntelFeeds
+	}
+	return append([]string{c.IntelFeed}, c.IntelFeeds...)
+}
 
-// GetAnalyzerConfig does a map lookup based on the analyzer's name. If the analyzer exists, then
-// the configuration is returned as marshaled YAML bytes. It is the job of the analyzer to unmarshal
-// these bytes back into the desired data structure for analyzer configuration.
-func getAnalyzerConfig(key string) ([]byte, error) {
-	val, ok := analyzerConfigs[key]
+// effectiveBpf returns the BPF filter that applies to the given interface. A filter set for the
+// interface in InterfaceBpf overrides the global Bpf filter. With vlan_trunk, the filter also matches
+// frames with one or two VLAN tags.
+func (c *Config) effectiveBpf(iface string) string {
+	bpf, ok := c.InterfaceBpf[iface]
 	if !ok {
-		return nil, fmt.Errorf("analyzer %s does not exist", key)
+		bpf = c.Bpf
 	}
-	return yaml.Marshal(val)
+	if c.VLANTrunk && bpf != "" {
+		return vlanFilter(bpf)
+	}
+	return bpf
 }
 
-// SetAnalyzerConfig saves an analyzer configuration in the global Gourmet map. The config parameter
-// is an arbitrary interface because Gourmet does not know each analyzer's config, and it is up to
-// the analyzer to unmarshal the bytes returned by GetAnalyzerConfig and perform input validation.
-// This design will most definitely change in the future.
-func setAnalyzerConfig(key string, config interface{}) {
-	analyzerConfigs[key] = config
+// frameworkArguments are the arguments of an analyzer that Gourmet applies itself, which are not
+// passed on to the analyzer
+var frameworkArguments = []string{"depends_on", "process", "transport", "sample_rate", "locality", "namespace", "revision", "sha256"}
+
+// analyzerSettings returns the section of an analyzer as marshaled YAML bytes, without the framework
+// arguments. The section is an arbitrary interface because Gourmet does not know each analyzer's
+// config, and it is the job of the analyzer to unmarshal these bytes back into the desired data
+// structure for analyzer configuration and perform input validation.
+func analyzerSettings(config interface{}) ([]byte, error) {
+	settings := make(map[string]interface{})
+	if configMap, ok := config.(map[string]interface{}); ok {
+		for k, v := range configMap {
+			settings[k] = v
+		}
+	}
+	for _, arg := range frameworkArguments {
+		delete(settings, arg)
+	}
+	return yaml.Marshal(settings)
 }
@@ -1,7 +1,14 @@
 package gourmet
 
 import (
-	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
 	"time"
 )
 
@@ -11,29 +18,328 @@ import (
 //
 // A Connection is given to each Analyzer. The Result returned from an Analyzer is added to the
 // Analyzers map for that Connection object. Once all Analyzers have been run against the Connection,
-// it is marshaled as a JSON object into raw bytes and written to the log file.
+// it is marshaled as a JSON object into raw bytes and written to the log file. The Payload is not
+// logged, unless payloads are explicitly included in the Config, in which case a bounded prefix of
+// the data sent by each side is logged as ClientPayloadBase64 and ServerPayloadBase64.
+// PayloadTruncated is then set if either prefix is shorter than the data of its side, or if the
+// snapshot length cut packets of the connection short.
+//
+// The Payload of a TCP connection is its reassembled stream, ordered and without retransmitted or
+// overlapping data, with the data of both directions interleaved in the order it was reassembled.
+// ClientPayload and ServerPayload hold the data sent by each side on its own. For UDP, the client is
+// the sender of the datagram, so ServerPayload is empty, unless udp_timeout groups the datagrams of
+// a flow into one connection. The client is then the sender of the first datagram, the payload holds
+// the datagrams of both directions one after the other, and datagram boundaries are not kept.
+//
+// Connections are tracked over IPv4 and IPv6 alike, including fragmented datagrams and IPv6 packets
+// with extension headers. When track_icmp or track_icmpv6 is enabled, every ICMP or ICMPv6 message
+// is logged as a connection of TransportType icmp or icmp6, with the message type as SourcePort and
+// its code as DestinationPort, and the messages of an exchange are grouped into one connection when
+// icmp_timeout is set. ICMP describes the messages, with their payload sizes.
+//
+// PayloadComplete is only true when the payload holds every byte of the reassembled directions, from
+// the start of the connection to its end. It is false if a packet was truncated by the snapshot
+// length, data is missing from the reassembled stream, the connection was picked up mid-stream or
+// timed out before it closed, or only one direction of it was captured.
+//
+// PayloadEntropy is the Shannon entropy of the reassembled payload in bits per byte, computed over
+// the first entropy_bytes bytes when payload_entropy is enabled. Values close to 8 suggest encrypted
+// or compressed data. It is unset for connections without payload.
+//
+// When preliminary records are enabled, a TCP connection is logged twice. A record with Preliminary
+// set is emitted as soon as the configured number of payload bytes has been reassembled, with the
+// analyzer results for that partial payload, and a final record without Preliminary is emitted when
+// the connection closes. Both carry the same UID, and the final record supersedes the preliminary
+// one in every field, so consumers that only want one record per connection should drop preliminary
+// records, and alerting consumers can act on the preliminary record and update on the final one.
+// Preliminary records are not counted in the summary and are not exported as flows.
+//
+// OrigBytes and RespBytes count the bytes of the transport layer, headers included, of every packet
+// sent by the client and by the server, and OrigPackets and RespPackets count those packets. They are
+// counted as packets are captured, whether or not their payload is reassembled, so retransmissions
+// are counted too. The segments that trail the close of a TCP connection, such as the last ACK, are
+// not, as the connection is logged once both directions are closed.
+//
+// State is the state a TCP connection was in when it was logged: SYN_SENT, SYN_RECEIVED,
+// ESTABLISHED, FIN_WAIT once one side sent a FIN, CLOSED once both did, or RESET. It is tracked from
+// the flags of both directions. ConnState summarizes the connection with the conn_state codes of
+// Zeek, such as SF, REJ, or S0, and History lists the events of the connection in the order they
+// were first seen, with the history letters of Zeek.
+//
+// Enrichments holds what the sensor looked up about the endpoints once the connection closed, such
+// as their location and autonomous system when geoip_databases is set.
+//
+// VLANs are the IDs of the 802.1Q tags of the first packet of the connection, outermost first, so a
+// QinQ frame has two. The tag that a NIC strips from frames captured with afpacket is included.
+// Tunnel holds the outer endpoints of the GRE, VXLAN, or Geneve tunnel that the connection was
+// carried in, when tunnels are decapsulated.
+//
+// Files lists the files transferred over the connection when extract_dir is set, with the paths
+// they were stored at, before the connection is handed to the analyzers.
+//
+// DroppedResults lists the keys of the Analyzers map that were dropped because the connection had
+// more than max_analyzer_results of them.
 type Connection struct {
-	Timestamp       time.Time
-	UID             uint64
-	SourceIP        string
-	SourcePort      int
-	DestinationIP   string
-	DestinationPort int
-	TransportType   string
-	Duration        float64
-	State           string        `json:",omitempty"`
-	Payload         *bytes.Buffer `json:"-"`
-	Analyzers       map[string]interface{}
-}
-
-func (c *Connection) analyze() error {
-	for _, analyzer := range registeredAnalyzers {
-		if analyzer.Filter(c) {
-			result, err := analyzer.Analyze(c)
+	Timestamp           time.Time
+	UID                 string
+	SourceIP            string
+	SourcePort          int
+	DestinationIP       string
+	DestinationPort     int
+	TransportType       string
+	Duration            float64
+	OrigBytes           uint64
+	RespBytes           uint64
+	OrigPackets         uint64
+	RespPackets         uint64
+	State               string  `json:",omitempty"`
+	ConnState           string  `json:",omitempty"`
+	History             string  `json:",omitempty"`
+	Service             string  `json:",omitempty"`
+	CommunityID         string  `json:",omitempty"`
+	Locality            string  `json:",omitempty"`
+	ContentType         string  `json:",omitempty"`
+	Payload             Payload `json:"-"`
+	ClientPayload       Payload `json:"-"`
+	ServerPayload       Payload `json:"-"`
+	ClientPayloadBase64 string  `json:",omitempty"`
+	ServerPayloadBase64 string  `json:",omitempty"`
+	PayloadTruncated    bool    `json:",omitempty"`
+	Asymmetric          bool    `json:",omitempty"`
+	PayloadComplete     bool
+	Preliminary         bool             `json:",omitempty"`
+	MergedCount         int              `json:",omitempty"`
+	MergedBytes         uint64           `json:",omitempty"`
+	InterfaceIndex      int              `json:",omitempty"`
+	Interface           string           `json:",omitempty"`
+	VLANs               []int            `json:",omitempty"`
+	Tunnel              *Tunnel          `json:",omitempty"`
+	ServerName          string           `json:",omitempty"`
+	Handshake           string           `json:",omitempty"`
+	SYNData             bool             `json:",omitempty"`
+	ResetBy             string           `json:",omitempty"`
+	ResetAfter          float64          `json:",omitempty"`
+	ResetWithData       bool             `json:",omitempty"`
+	PayloadEntropy      float64          `json:",omitempty"`
+	ProcessID           int              `json:",omitempty"`
+	ProcessName         string           `json:",omitempty"`
+	MaxPayloadSize      int              `json:",omitempty"`
+	PathMTU             int              `json:",omitempty"`
+	OrigTiming          *PacketTiming    `json:",omitempty"`
+	RespTiming          *PacketTiming    `json:",omitempty"`
+	Tags                []string         `json:",omitempty"`
+	IntelMatches        []IntelMatch     `json:",omitempty"`
+	Enrichments         *Enrichments     `json:",omitempty"`
+	Files               []*ExtractedFile `json:",omitempty"`
+	Capture             *CaptureLocation `json:",omitempty"`
+	ICMP                *ICMP            `json:",omitempty"`
+	DroppedResults      []string         `json:",omitempty"`
+	Analyzers           map[string]interface{}
+	ResultVersions      map[string]string `json:"_meta,omitempty"`
+	// counters used by flow exporters
+	tcpFlags         uint8
+	transportBytes   uint64
+	transportPackets uint64
+	// uid is the UID of the connection, which UID holds as it is written to the log
+	uid uint64
+	// set when the UID was already assigned for the preliminary record of the connection
+	uidAssigned bool
+	// set when log sampling dropped the connection before it was analyzed
+	unlogged bool
+	// snapTruncated is set when a packet of the connection was cut short by the snapshot length
+	snapTruncated bool
+	// resultKeys holds the keys of the Analyzers map in the order the analyzers stored them
+	resultKeys []string
+	// icmpID is the identifier of ICMP echo messages, and -1 for other ICMP messages
+	icmpID int
+}
+
+// sniffContentType detects the content type of a payload from its first bytes. It returns an empty
+// string when there is no payload or the detection is inconclusive.
+func sniffContentType(head []byte) string {
+	if len(head) == 0 {
+		return ""
+	}
+	contentType := http.DetectContentType(head)
+	if contentType == "application/octet-stream" {
+		return ""
+	}
+	return contentType
+}
+
+// addTag adds a tag to the connection, unless the connection already has it.
+func (c *Connection) addTag(tag string) {
+	for _, t := range c.Tags {
+		if t == tag {
+			return
+		}
+	}
+	c.Tags = append(c.Tags, tag)
+}
+
+// capAnalyzerResults limits the size of the Analyzers map, which protects the log from a misbehaving
+// analyzer that writes many keys. When the map is too large it logs every key, so the culprit can be
+// identified, and keeps the keys in the order the analyzers run, followed by the keys that were not
+// stored by an analyzer in sorted order. The keys it drops are recorded in DroppedResults.
+func (c *Connection) capAnalyzerResults(max int) {
+	if max <= 0 || len(c.Analyzers) <= max {
+		return
+	}
+	var keys, others []string
+	listed := make(map[string]bool)
+	for _, key := range c.resultKeys {
+		if _, ok := c.Analyzers[key]; ok && !listed[key] {
+			keys = append(keys, key)
+			listed[key] = true
+		}
+	}
+	for key := range c.Analyzers {
+		if !listed[key] {
+			others = append(others, key)
+		}
+	}
+	sort.Strings(others)
+	keys = append(keys, others...)
+	c.DroppedResults = append(c.DroppedResults, keys[max:]...)
+	log.Printf("[!] Warning: connection %s has %d analyzer results, more than the maximum of %d. Keys: %s. Dropping: %s",
+		c.UID, len(keys), max, strings.Join(keys, ", "), strings.Join(keys[max:], ", "))
+	for _, key := range keys[max:] {
+		delete(c.Analyzers, key)
+		for versioned := range c.ResultVersions {
+			if versioned == key || strings.HasPrefix(versioned, key+".") {
+				delete(c.ResultVersions, versioned)
+			}
+		}
+	}
+}
+
+// isNilResult reports whether an analyzer returned no result, either as a nil interface or as a nil
+// pointer of its result type.
+func isNilResult(result Result) bool {
+	if result == nil {
+		return true
+	}
+	v := reflect.ValueOf(result)
+	return v.Kind() == reflect.Ptr && v.IsNil()
+}
+
+// encodePayload stores up to maxBytes of each direction of the payload as base64 so that they are
+// written to the log. PayloadTruncated is set if a direction was longer than maxBytes, or if packets
+// of the connection were truncated by the snapshot length.
+func (c *Connection) encodePayload(maxBytes int) {
+	c.PayloadTruncated = c.snapTruncated
+	c.ClientPayloadBase64 = c.encodeDirection(c.ClientPayload, maxBytes)
+	c.ServerPayloadBase64 = c.encodeDirection(c.ServerPayload, maxBytes)
+}
+
+// encodeDirection returns up to maxBytes of a direction of the payload as base64, and sets
+// PayloadTruncated if the direction was longer.
+func (c *Connection) encodeDirection(direction Payload, maxBytes int) string {
+	if direction == nil || direction.Len() == 0 {
+		return ""
+	}
+	payload, err := ioutil.ReadAll(io.LimitReader(direction.Reader(), int64(maxBytes)))
+	if err != nil {
+		log.Println(err)
+	}
+	if direction.Len() > maxBytes {
+		c.PayloadTruncated = true
+	}
+	return base64.StdEncoding.EncodeToString(payload)
+}
+
+// releasePayload removes the temporary file backing the payload, if it was spilled to disk.
+func (c *Connection) releasePayload() {
+	if pb, ok := c.Payload.(*payloadBuffer); ok {
+		pb.close()
+	}
+}
+
+// Localities of a connection relative to the configured local networks
+const (
+	LocalityInternal = "internal"
+	LocalityExternal = "external"
+	LocalityOutbound = "outbound"
+	LocalityInbound  = "inbound"
+)
+
+// setLocality classifies the connection by whether its originator and responder are inside the
+// local networks. An outbound connection was originated by a local host towards an external one,
+// and an inbound connection by an external host towards a local one.
+func (c *Connection) setLocality(localNets *ipTrie) {
+	srcLocal := localNets.contains(c.SourceIP)
+	dstLocal := localNets.contains(c.DestinationIP)
+	switch {
+	case srcLocal && dstLocal:
+		c.Locality = LocalityInternal
+	case srcLocal:
+		c.Locality = LocalityOutbound
+	case dstLocal:
+		c.Locality = LocalityInbound
+	default:
+		c.Locality = LocalityExternal
+	}
+}
+
+// forceService sets the Service of the connection from the configured port overrides, checking the
+// destination port before the source port. Connections on unlisted ports are left untouched.
+func (c *Connection) forceService(portProtocols map[int]string) {
+	if service, ok := portProtocols[c.DestinationPort]; ok {
+		c.Service = service
+		return
+	}
+	if service, ok := portProtocols[c.SourcePort]; ok {
+		c.Service = service
+	}
+}
+
+// analyze runs the registered analyzers on the connection, recording their execution time and
+// errors in the metrics.
+func (c *Connection) analyze(metrics *sensorMetrics) error {
+	analyzersLock.RLock()
+	defer analyzersLock.RUnlock()
+	// analyzed holds the names of the analyzers that returned a result, which the analyzers that
+	// depend on them wait for
+	analyzed := make(map[string]bool)
+	for _, ra := range registeredAnalyzers {
+		if !ra.sampled(c) || !ra.appliesTo(c) || !ra.ready(analyzed) {
+			continue
+		}
+		if ra.analyzer.Filter(c) {
+			start := metrics.start()
+			result, err := ra.analyzer.Analyze(c)
+			metrics.observeAnalyzer(ra.name, start, err)
 			if err != nil {
 				return err
 			}
-			c.Analyzers[result.Key()] = result
+			// a nil result means the analyzer has nothing to record for this connection
+			if isNilResult(result) {
+				continue
+			}
+			version := resultVersion(ra.analyzer, result)
+			if result.Key() == "" {
+				if result = ra.keyResult(result); result == nil {
+					continue
+				}
+			}
+			namespace := ra.namespace
+			if namespace == "" {
+				namespace = resultNamespace(ra.analyzer, result)
+			}
+			if namespace != "" {
+				result = &namespacedResult{Result: result, namespace: namespace}
+			}
+			err = namespaceCollision(c, ra.name, result)
+			if err != nil {
+				return err
+			}
+			resultStore.Store(c, result, version)
+			if nr, ok := result.(*namespacedResult); ok {
+				c.resultKeys = append(c.resultKeys, nr.namespace)
+			} else {
+				c.resultKeys = append(c.resultKeys, result.Key())
+			}
+			analyzed[ra.name] = true
 		}
 	}
 	return nil
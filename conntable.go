@@ -0,0 +1,141 @@
+package gourmet
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Policies that choose the connections evicted from a full connection table
+const (
+	evictLRU    = "lru"
+	evictOldest = "oldest"
+)
+
+// connectionLimit bounds the number of connections tracked at once, so that a flood of new
+// connections, such as a SYN flood, cannot grow the connection table until the sensor runs out of
+// memory. The TCP streams and the UDP and ICMP flows are each held to max_connections. Once a table
+// is full, the least recently seen connections are evicted to make room, or the oldest ones with the
+// oldest policy. Evicted connections are logged as they are. A nil connectionLimit never evicts.
+type connectionLimit struct {
+	max    int
+	oldest bool
+	// batch is how many connections are evicted past the limit, so that a flood does not sort the
+	// table for every new connection
+	batch int
+	// evicting is set while streams are evicted, so that concurrent packets do not evict them again
+	evicting int32
+	summary  *runSummary
+}
+
+func newConnectionLimit(config *Config, summary *runSummary) (*connectionLimit, error) {
+	if config.MaxConnections <= 0 {
+		return nil, nil
+	}
+	cl := &connectionLimit{
+		max:     config.MaxConnections,
+		batch:   config.MaxConnections/100 + 1,
+		summary: summary,
+	}
+	switch config.ConnectionEviction {
+	case "", evictLRU:
+	case evictOldest:
+		cl.oldest = true
+	default:
+		return nil, fmt.Errorf("invalid connection_eviction %s. Must be lru or oldest", config.ConnectionEviction)
+	}
+	return cl, nil
+}
+
+// excess returns how many connections to evict from a table holding open of them, or 0 if the table
+// is not full.
+func (cl *connectionLimit) excess(open int) int {
+	if cl == nil || open <= cl.max {
+		return 0
+	}
+	return open - cl.max + cl.batch
+}
+
+// evictStreams makes room in the TCP connection table once it holds more than max_connections
+// streams. Least recently seen streams are flushed and closed through their assemblers, which frees
+// them, and the oldest streams are closed one by one through their assembler, as the assembler can
+// only flush streams by how long they have been idle.
+func (tsf *tcpStreamFactory) evictStreams() {
+	cl := tsf.limit
+	n := cl.excess(int(atomic.LoadInt64(&tsf.open)))
+	if n == 0 || !atomic.CompareAndSwapInt32(&cl.evicting, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&cl.evicting, 0)
+	var times []time.Time
+	for _, sh := range tsf.shards {
+		sh.mutex.Lock()
+		for ts := range sh.streams {
+			if cl.oldest {
+				times = append(times, ts.startTime)
+			} else {
+				times = append(times, ts.lastSeen)
+			}
+		}
+		sh.mutex.Unlock()
+	}
+	if len(times) == 0 {
+		return
+	}
+	if n > len(times) {
+		n = len(times)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+	// streams up to and including the cutoff are evicted
+	cutoff := times[n-1].Add(time.Nanosecond)
+	evicted := 0
+	if !cl.oldest {
+		evicted = tsf.flushOlderThan(cutoff)
+	} else {
+		for _, sh := range tsf.shards {
+			sh.mutex.Lock()
+			var oldest []*tcpStream
+			for ts := range sh.streams {
+				if evicted+len(oldest) < n && ts.startTime.Before(cutoff) {
+					oldest = append(oldest, ts)
+				}
+			}
+			for _, ts := range oldest {
+				sh.closeStream(ts)
+			}
+			sh.mutex.Unlock()
+			evicted += len(oldest)
+		}
+	}
+	cl.summary.addEvictions(evicted)
+}
+
+// evictFlows removes flows from the table once it holds more than max_connections of them, and
+// returns their connections to be emitted. It must be called with the mutex of the table held.
+func (ft *flowTable) evictFlows() []*Connection {
+	n := ft.limit.excess(ft.open)
+	if n == 0 {
+		return nil
+	}
+	flows := make([]*datagramFlow, 0, ft.open)
+	for key, flow := range ft.flows {
+		if key == flow.keys[0] {
+			flows = append(flows, flow)
+		}
+	}
+	if ft.limit.oldest {
+		sort.Slice(flows, func(i, j int) bool { return flows[i].connection.Timestamp.Before(flows[j].connection.Timestamp) })
+	} else {
+		sort.Slice(flows, func(i, j int) bool { return flows[i].lastSeen.Before(flows[j].lastSeen) })
+	}
+	if n > len(flows) {
+		n = len(flows)
+	}
+	evicted := make([]*Connection, 0, n)
+	for _, flow := range flows[:n] {
+		evicted = append(evicted, ft.remove(flow))
+	}
+	ft.limit.summary.addEvictions(n)
+	return evicted
+}
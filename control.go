@@ -0,0 +1,259 @@
+package gourmet
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// controlMaxBody bounds the requests that the control server reads
+	controlMaxBody = 1 << 16
+	// controlConnections is how many connections /connections returns without a limit
+	controlConnections = 1000
+)
+
+// controlServer lets operators and fleet management tools inspect and change a running sensor over
+// HTTP. /filter returns the BPF filter of the packet sources on GET, and replaces it with the body
+// of a PUT or POST, so capture can be narrowed during an incident without restarting the sensor and
+// losing the connections it tracks. /status, /stats, and /connections return the state of the
+// sensor, its counters since it started, and its open connections as JSON, and a POST to /shutdown
+// shuts it down gracefully. Requests that change the sensor must carry the control_token as a bearer
+// token, and requests sent by web pages of another origin are rejected, so that a browser on the
+// host cannot be used to reach the server.
+type controlServer struct {
+	sensor   *sensor
+	listener net.Listener
+	// token authorizes the requests that change the sensor, which are refused if it is empty
+	token  string
+	closed int32
+}
+
+func newControlServer(s *sensor, addr, token string) (*controlServer, error) {
+	if addr == "" {
+		return nil, nil
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for control requests on %s: %s", addr, err)
+	}
+	return &controlServer{
+		sensor:   s,
+		listener: listener,
+		token:    token,
+	}, nil
+}
+
+// serve answers control requests until the server is closed.
+func (cs *controlServer) serve() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/filter", cs.filter)
+	mux.HandleFunc("/status", cs.status)
+	mux.HandleFunc("/stats", cs.stats)
+	mux.HandleFunc("/connections", cs.connections)
+	mux.HandleFunc("/shutdown", cs.shutdown)
+	err := http.Serve(cs.listener, sameOrigin(mux))
+	if err != nil && atomic.LoadInt32(&cs.closed) == 0 {
+		log.Printf("[!] Control server stopped: %s", err)
+	}
+}
+
+func (cs *controlServer) close() {
+	atomic.StoreInt32(&cs.closed, 1)
+	cs.listener.Close()
+}
+
+func (cs *controlServer) filter(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		fmt.Fprintln(w, cs.sensor.currentFilter())
+	case http.MethodPut, http.MethodPost:
+		if !cs.authorized(w, r) {
+			return
+		}
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, controlMaxBody))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		expr := strings.TrimSpace(string(body))
+		err = cs.sensor.setFilter(expr)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("[*] Capture filter changed to %q", expr)
+		fmt.Fprintln(w, expr)
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// SensorStatus is the state of a running sensor, as returned by the /status endpoint of the control
+// server. State is starting until capture started, then capturing, and stopping once the sensor is
+// shutting down.
+type SensorStatus struct {
+	State       string
+	Started     time.Time
+	Uptime      float64
+	Type        string
+	Interfaces  []string `json:",omitempty"`
+	CaptureFile string   `json:",omitempty"`
+	RemoteHost  string   `json:",omitempty"`
+	Filter      string
+	Outputs     string
+	Analyzers   []string
+	// LastPacket is when the last packet was read, and is not set before the first one
+	LastPacket *time.Time `json:",omitempty"`
+}
+
+func (cs *controlServer) status(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	s := cs.sensor
+	status := &SensorStatus{
+		State:     "starting",
+		Started:   s.started,
+		Uptime:    time.Since(s.started).Seconds(),
+		Type:      s.config.InterfaceType,
+		Filter:    s.currentFilter(),
+		Analyzers: []string{},
+	}
+	switch {
+	case atomic.LoadInt32(&s.stopping) != 0:
+		status.State = "stopping"
+	case atomic.LoadInt32(&s.capturing) != 0:
+		status.State = "capturing"
+	}
+	switch s.config.InterfaceType {
+	case "pcapfile":
+		status.CaptureFile = s.config.PcapFile
+	case "ssh":
+		status.RemoteHost = s.config.Remote
+		status.Interfaces = s.config.CaptureInterfaces()
+	default:
+		status.Interfaces = s.config.CaptureInterfaces()
+		if s.config.InterfacePattern != "" {
+			status.Interfaces = []string{}
+			for _, src := range s.captureSources() {
+				status.Interfaces = append(status.Interfaces, src.name)
+			}
+		}
+	}
+	s.outputsMutex.RLock()
+	status.Outputs = describeOutputs(s.outputs)
+	s.outputsMutex.RUnlock()
+	for _, ra := range currentAnalyzers() {
+		status.Analyzers = append(status.Analyzers, ra.name)
+	}
+	if atomic.LoadUint64(&s.summary.packets) > 0 {
+		last := time.Unix(0, atomic.LoadInt64(&s.lastPacket))
+		status.LastPacket = &last
+	}
+	writeJSON(w, status)
+}
+
+// stats returns a stats record that covers the time since the sensor started.
+func (cs *controlServer) stats(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, cs.sensor.stats(cs.sensor.startCounters, cs.sensor.currentCounters()))
+}
+
+// connections returns the newest open connections of the sensor, oldest first: as many as the limit
+// parameter asks for, or controlConnections.
+func (cs *controlServer) connections(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	limit := controlConnections
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			http.Error(w, "limit must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	states := cs.sensor.newestStates(limit)
+	if states == nil {
+		states = []streamState{}
+	}
+	writeJSON(w, states)
+}
+
+// shutdown shuts the sensor down gracefully, as an interrupt does. The response is sent before the
+// connections are flushed.
+func (cs *controlServer) shutdown(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) || !cs.authorized(w, r) {
+		return
+	}
+	log.Printf("[*] Shutdown requested over the control server by %s", r.RemoteAddr)
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintln(w, "shutting down")
+	cs.sensor.requestShutdown()
+}
+
+// authorized reports whether the request carries the control token, and answers it with 401, or 403
+// if no token is set, otherwise.
+func (cs *controlServer) authorized(w http.ResponseWriter, r *http.Request) bool {
+	if cs.token == "" {
+		http.Error(w, "set control_token to change the sensor over the control server", http.StatusForbidden)
+		return false
+	}
+	auth := r.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") &&
+		subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(cs.token)) == 1 {
+		return true
+	}
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	http.Error(w, "invalid control token", http.StatusUnauthorized)
+	return false
+}
+
+// sameOrigin rejects requests with an Origin header for another host than the one requested, which
+// browsers send along with requests made by scripts of other sites. Tools such as curl send none.
+func sameOrigin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if origin := r.Header.Get("Origin"); origin != "" {
+			u, err := url.Parse(origin)
+			if err != nil || u.Host != r.Host {
+				http.Error(w, "cross-origin requests are not allowed", http.StatusForbidden)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allowMethod reports whether the request has the method, and answers it with 405 otherwise.
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	body, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(body, '\n'))
+}
@@ -0,0 +1,63 @@
+package gourmet
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// decodeDrainTimeout bounds how long DecodePackets waits for reassembled streams to be emitted
+const decodeDrainTimeout = time.Second
+
+// DecodePackets runs raw packets of the given link type through packet decoding and connection
+// tracking, and returns the connections that result from them. Analyzers are not run and nothing is
+// logged. Packets that fail to decode are skipped and reported in the returned error, and a panic in
+// the decoders or the TCP reassembly is returned as an error instead of crashing the caller. This
+// makes DecodePackets a suitable target for fuzzing the parts of Gourmet that parse untrusted
+// network data.
+func DecodePackets(linkType layers.LinkType, packets ...[]byte) (connections []*Connection, err error) {
+	s, err := newSensor(&Config{})
+	if err != nil {
+		return nil, err
+	}
+	defer s.streamFactory.ticker.Stop()
+	var mutex sync.Mutex
+	go func() {
+		for c := range s.connections {
+			mutex.Lock()
+			connections = append(connections, c)
+			mutex.Unlock()
+			atomic.AddInt64(&s.inFlight, -1)
+		}
+	}()
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic while decoding packets: %v", r)
+		}
+	}()
+	for i, data := range packets {
+		packet := gopacket.NewPacket(data, linkType, gopacket.DecodeStreamsAsDatagrams)
+		if errLayer := packet.ErrorLayer(); errLayer != nil {
+			if err == nil {
+				err = fmt.Errorf("failed to decode packet %d: %s", i, errLayer.Error())
+			}
+			continue
+		}
+		ci := packet.Metadata().CaptureInfo
+		if ci.Timestamp.IsZero() {
+			ci.Timestamp = time.Unix(int64(i), 0)
+		}
+		s.processNewPacket(packet, ci)
+	}
+	if abandoned, _ := s.drain(decodeDrainTimeout); abandoned > 0 {
+		return nil, fmt.Errorf("timed out waiting for %d connections", abandoned)
+	}
+	close(s.connections)
+	mutex.Lock()
+	defer mutex.Unlock()
+	return connections, err
+}
@@ -0,0 +1,197 @@
+package gourmet
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/ip4defrag"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	// fragmentTimeout is how long the fragments of an incomplete datagram are kept
+	fragmentTimeout = 30 * time.Second
+	// ipv6MaxFragments bounds the fragments kept for a single IPv6 datagram, so that a flood of tiny
+	// fragments cannot grow the memory of the sensor without bound
+	ipv6MaxFragments = 256
+	ipv6MaxDatagram  = 65535
+)
+
+// defragmenter reassembles fragmented IPv4 and IPv6 datagrams, which are common when jumbo frames
+// are split on their way to the sensor, so that the transport layer of a fragmented datagram can be
+// tracked. gopacket only ships an IPv4 defragmenter, so IPv6 fragments are reassembled here.
+type defragmenter struct {
+	ipv4  *ip4defrag.IPv4Defragmenter
+	mutex sync.Mutex
+	ipv6  map[ipv6FragmentKey]*ipv6Datagram
+}
+
+type ipv6FragmentKey struct {
+	src, dst [net.IPv6len]byte
+	id       uint32
+}
+
+// ipv6Datagram holds the fragments of an incomplete IPv6 datagram
+type ipv6Datagram struct {
+	// header is the IPv6 header of the first fragment, and nextHeader the protocol of the
+	// fragmentable part
+	header     *layers.IPv6
+	nextHeader layers.IPProtocol
+	fragments  []ipv6Fragment
+	received   int
+	// total is the length of the fragmentable part, or -1 until the last fragment arrived
+	total    int
+	lastSeen time.Time
+}
+
+type ipv6Fragment struct {
+	offset int
+	data   []byte
+}
+
+func newDefragmenter() *defragmenter {
+	return &defragmenter{
+		ipv4: ip4defrag.NewIPv4Defragmenter(),
+		ipv6: make(map[ipv6FragmentKey]*ipv6Datagram),
+	}
+}
+
+// defragment returns the packet unchanged if it is not a fragment. For a fragment, it returns the
+// reassembled datagram once all of its fragments have arrived, and false before that.
+func (d *defragmenter) defragment(packet gopacket.Packet) (gopacket.Packet, bool) {
+	if frag, ok := packet.Layer(layers.LayerTypeIPv6Fragment).(*layers.IPv6Fragment); ok {
+		return d.defragmentIPv6(packet, frag)
+	}
+	ip4, ok := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	if !ok || (ip4.Flags&layers.IPv4MoreFragments == 0 && ip4.FragOffset == 0) {
+		return packet, true
+	}
+	whole, err := d.ipv4.DefragIPv4(ip4)
+	if err != nil {
+		log.Printf("[!] Dropping IPv4 fragment from %s to %s: %s", ip4.SrcIP, ip4.DstIP, err)
+		return nil, false
+	}
+	if whole == nil {
+		return nil, false
+	}
+	// the defragmenter does not fix the length and checksum of the reassembled header
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	err = gopacket.SerializeLayers(buf, opts, whole, gopacket.Payload(whole.Payload))
+	if err != nil {
+		log.Printf("[!] Failed to rebuild defragmented datagram from %s to %s: %s", ip4.SrcIP, ip4.DstIP, err)
+		return nil, false
+	}
+	return gopacket.NewPacket(buf.Bytes(), layers.LayerTypeIPv4, gopacket.DecodeStreamsAsDatagrams), true
+}
+
+// defragmentIPv6 adds a fragment to its datagram, and returns the datagram once it is complete.
+// Following RFC 5722, a datagram with overlapping fragments is dropped rather than reassembled, as
+// overlaps are only ever used to evade inspection. Extension headers in the unfragmentable part,
+// such as hop-by-hop options, are not carried over to the reassembled datagram.
+func (d *defragmenter) defragmentIPv6(packet gopacket.Packet, frag *layers.IPv6Fragment) (gopacket.Packet, bool) {
+	ip6, ok := packet.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+	if !ok {
+		return nil, false
+	}
+	data := frag.LayerPayload()
+	offset := int(frag.FragmentOffset) * 8
+	end := offset + len(data)
+	if end > ipv6MaxDatagram || (frag.MoreFragments && len(data)%8 != 0) {
+		log.Printf("[!] Dropping malformed IPv6 fragment from %s to %s", ip6.SrcIP, ip6.DstIP)
+		return nil, false
+	}
+	key := ipv6FragmentKey{id: frag.Identification}
+	copy(key.src[:], ip6.SrcIP.To16())
+	copy(key.dst[:], ip6.DstIP.To16())
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	dg, ok := d.ipv6[key]
+	if !ok {
+		dg = &ipv6Datagram{total: -1}
+		d.ipv6[key] = dg
+	}
+	if reason := dg.add(offset, data, frag.MoreFragments); reason != "" {
+		delete(d.ipv6, key)
+		log.Printf("[!] Dropping IPv6 datagram from %s to %s: %s", ip6.SrcIP, ip6.DstIP, reason)
+		return nil, false
+	}
+	if offset == 0 {
+		dg.header = ip6
+		dg.nextHeader = frag.NextHeader
+	}
+	dg.lastSeen = time.Now()
+	// fragments never overlap, so every byte has arrived once as many bytes as the total have
+	if dg.total < 0 || dg.received != dg.total {
+		return nil, false
+	}
+	delete(d.ipv6, key)
+	payload := make([]byte, dg.total)
+	for _, f := range dg.fragments {
+		copy(payload[f.offset:], f.data)
+	}
+	header := *dg.header
+	header.NextHeader = dg.nextHeader
+	header.HopByHop = nil
+	buf := gopacket.NewSerializeBuffer()
+	err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, &header, gopacket.Payload(payload))
+	if err != nil {
+		log.Printf("[!] Failed to rebuild defragmented datagram from %s to %s: %s", ip6.SrcIP, ip6.DstIP, err)
+		return nil, false
+	}
+	return gopacket.NewPacket(buf.Bytes(), layers.LayerTypeIPv6, gopacket.DecodeStreamsAsDatagrams), true
+}
+
+// add records a fragment of the datagram, and returns why the datagram must be dropped, if it must.
+func (dg *ipv6Datagram) add(offset int, data []byte, more bool) string {
+	end := offset + len(data)
+	for _, f := range dg.fragments {
+		if offset < f.offset+len(f.data) && f.offset < end {
+			return "overlapping fragments"
+		}
+	}
+	if !more {
+		if dg.total >= 0 && dg.total != end {
+			return "conflicting last fragments"
+		}
+		dg.total = end
+	}
+	if dg.total >= 0 && (end > dg.total || dg.received+len(data) > dg.total) {
+		return "fragment beyond the end of the datagram"
+	}
+	if len(dg.fragments) >= ipv6MaxFragments {
+		return "too many fragments"
+	}
+	dg.fragments = append(dg.fragments, ipv6Fragment{offset, append([]byte(nil), data...)})
+	dg.received += len(data)
+	return ""
+}
+
+// discardIPv6OlderThan drops the incomplete IPv6 datagrams last added to before t.
+func (d *defragmenter) discardIPv6OlderThan(t time.Time) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for key, dg := range d.ipv6 {
+		if dg.lastSeen.Before(t) {
+			delete(d.ipv6, key)
+		}
+	}
+}
+
+// discardStale drops incomplete datagrams whose fragments stopped arriving, until quit is closed.
+func (d *defragmenter) discardStale(quit <-chan struct{}) {
+	ticker := time.NewTicker(fragmentTimeout)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+		}
+		d.ipv4.DiscardOlderThan(time.Now().Add(-fragmentTimeout))
+		d.discardIPv6OlderThan(time.Now().Add(-fragmentTimeout))
+	}
+}
@@ -0,0 +1,148 @@
+package gourmet
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// jumboMTU is the MTU of the jumbo frames of the tests, and fragmentMTU that of the link that the
+// datagrams are fragmented for when they are split.
+const (
+	jumboMTU    = 9000
+	fragmentMTU = 1500
+)
+
+// recordingOutput keeps the payloads of the connections written to it.
+type recordingOutput struct {
+	mutex       sync.Mutex
+	connections []*Connection
+	server      []string
+}
+
+func (ro *recordingOutput) Write(c *Connection) error {
+	ro.mutex.Lock()
+	defer ro.mutex.Unlock()
+	ro.connections = append(ro.connections, c)
+	ro.server = append(ro.server, string(c.ServerPayload.Bytes()))
+	return nil
+}
+
+// jumboCapture returns a capture of a connection whose server answers with segments that fill jumbo
+// frames, and the data that the server sent. With split, the datagrams of the segments are
+// fragmented for a link with a standard MTU, as when a NIC or driver on the way splits them.
+func jumboCapture(t *testing.T, split bool) ([]byte, string) {
+	var buf bytes.Buffer
+	w := pcapgo.NewWriter(&buf)
+	err := w.WriteFileHeader(65536, layers.LinkTypeEthernet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := testStart
+	var id uint16
+	writeFrame := func(ip *layers.IPv4, payload []byte) {
+		eth := &layers.Ethernet{
+			SrcMAC:       net.HardwareAddr{0, 0, 0, 0, 0, 1},
+			DstMAC:       net.HardwareAddr{0, 0, 0, 0, 0, 2},
+			EthernetType: layers.EthernetTypeIPv4,
+		}
+		frame := gopacket.NewSerializeBuffer()
+		opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+		err := gopacket.SerializeLayers(frame, opts, eth, ip, gopacket.Payload(payload))
+		if err == nil {
+			at = at.Add(time.Millisecond)
+			err = w.WritePacket(gopacket.CaptureInfo{
+				Timestamp:     at,
+				CaptureLength: len(frame.Bytes()),
+				Length:        len(frame.Bytes()),
+			}, frame.Bytes())
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	send := func(s testSegment) {
+		src, dst := net.ParseIP(s.src).To4(), net.ParseIP(s.dst).To4()
+		ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: src, DstIP: dst}
+		_, tcp, _, err := decodeSegment(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the segment is serialized again for the checksum over the addresses of the datagram
+		tcp.SetNetworkLayerForChecksum(ip)
+		segment := gopacket.NewSerializeBuffer()
+		opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+		err = gopacket.SerializeLayers(segment, opts, tcp, gopacket.Payload(s.payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := segment.Bytes()
+		id++
+		if !split || len(data) <= fragmentMTU-20 {
+			ip.Id = id
+			writeFrame(ip, data)
+			return
+		}
+		// fragments carry multiples of 8 bytes, but the last
+		const fragmentBytes = (fragmentMTU - 20) &^ 7
+		for offset := 0; offset < len(data); offset += fragmentBytes {
+			end := offset + fragmentBytes
+			fragment := *ip
+			fragment.Id = id
+			fragment.FragOffset = uint16(offset / 8)
+			if end < len(data) {
+				fragment.Flags = layers.IPv4MoreFragments
+			} else {
+				end = len(data)
+			}
+			writeFrame(&fragment, data[offset:end])
+		}
+	}
+	// every segment of the server fills a jumbo frame
+	const segmentBytes = jumboMTU - 20 - 20
+	data := string(bytes.Repeat([]byte("0123456789abcdef"), 3*segmentBytes/16+1)[:3*segmentBytes])
+	send(segment(handshakeClient, 1000, 0, "S", ""))
+	send(segment(handshakeServer, 5000, 1001, "SA", ""))
+	send(segment(handshakeClient, 1001, 5001, "A", ""))
+	send(segment(handshakeClient, 1001, 5001, "PA", "GET / HTTP/1.1\r\n\r\n"))
+	for i := 0; i < 3; i++ {
+		send(segment(handshakeServer, uint32(5001+i*segmentBytes), 1019, "A", data[i*segmentBytes:(i+1)*segmentBytes]))
+	}
+	send(segment(handshakeClient, 1019, uint32(5001+len(data)), "FA", ""))
+	send(segment(handshakeServer, uint32(5001+len(data)), 1020, "FA", ""))
+	send(segment(handshakeClient, 1020, uint32(5002+len(data)), "A", ""))
+	return buf.Bytes(), data
+}
+
+func TestJumboFrames(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		split bool
+	}{
+		{"whole", false},
+		{"split into fragments", true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			capture, data := jumboCapture(t, test.split)
+			config := Config{InterfaceType: "pcapfile"}
+			config.SetDefaults()
+			output := &recordingOutput{}
+			replay(t, &config, capture, output)
+			if len(output.connections) != 1 {
+				t.Fatalf("expected 1 connection, got %d", len(output.connections))
+			}
+			if c := output.connections[0]; !c.PayloadComplete {
+				t.Errorf("expected the payload of the connection to be complete")
+			}
+			if output.server[0] != data {
+				t.Errorf("expected %d bytes of server payload, got %d", len(data), len(output.server[0]))
+			}
+		})
+	}
+}
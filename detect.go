@@ -0,0 +1,180 @@
+package gourmet
+
+import (
+	"bytes"
+	"io"
+	"strings"
+
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	// detectPeekBytes bounds how much of each direction is read to identify the protocol of a
+	// connection. The signatures only look at the first message of either side, and 512 bytes hold a
+	// DNS query of classic size.
+	detectPeekBytes = 512
+
+	smtpService = "smtp"
+	ftpService  = "ftp"
+)
+
+// protocolSignature identifies an application protocol from the first bytes that the client and
+// the server of a connection sent. Either may be empty.
+type protocolSignature struct {
+	service   string
+	transport string
+	match     func(client, server []byte) bool
+}
+
+// protocolSignatures are checked in order, and the first that matches names the service of the
+// connection. Protocols where the server speaks first are checked last, as their greetings are the
+// least distinctive.
+var protocolSignatures = []protocolSignature{
+	{tlsAnalyzerName, "tcp", isTLSHandshake},
+	{sshAnalyzerName, "tcp", isSSHBanner},
+	{httpAnalyzerName, "tcp", isHTTPMessage},
+	{smbService, "tcp", isSMBSession},
+	{dnsAnalyzerName, "tcp", isDNSStream},
+	{dnsAnalyzerName, "udp", isDNSQuery},
+	{smtpService, "tcp", isSMTPGreeting},
+	{ftpService, "tcp", isFTPGreeting},
+}
+
+// detectService sets the Service of the connection from the signature of its payload, so that the
+// protocols that analyzers and file extraction look for are recognized on any port. Services that
+// are already set, from port_protocols or by the tracker of the connection, are kept.
+func (c *Connection) detectService() {
+	if c.Service != "" {
+		return
+	}
+	client, server := peekPayload(c.ClientPayload), peekPayload(c.ServerPayload)
+	if len(client) == 0 && len(server) == 0 {
+		return
+	}
+	for _, sig := range protocolSignatures {
+		if sig.transport == c.TransportType && sig.match(client, server) {
+			c.Service = sig.service
+			return
+		}
+	}
+}
+
+// hasSignature reports whether the payload of the connection matches the signature of the service,
+// whatever its Service was set to, so that a port_protocols mapping such as 8443: http does not hide
+// the protocol from its analyzer.
+func (c *Connection) hasSignature(service string) bool {
+	client, server := peekPayload(c.ClientPayload), peekPayload(c.ServerPayload)
+	for _, sig := range protocolSignatures {
+		if sig.service == service && sig.transport == c.TransportType && sig.match(client, server) {
+			return true
+		}
+	}
+	return false
+}
+
+// KnownService reports whether a service is one that Gourmet detects or that an analyzer of the
+// config is named after, so that a port_protocols mapping to a misspelled name, which no analyzer or
+// extractor would ever match, is rejected when the config is loaded.
+func KnownService(c *Config, service string) bool {
+	switch service {
+	case quicService, smbService, ftpDataService:
+		return true
+	}
+	for _, sig := range protocolSignatures {
+		if sig.service == service {
+			return true
+		}
+	}
+	if _, ok := builtinAnalyzers[service]; ok {
+		return true
+	}
+	_, ok := c.Analyzers[service]
+	return ok
+}
+
+// peekPayload returns the first bytes of one direction of a connection.
+func peekPayload(payload Payload) []byte {
+	if payload == nil || payload.Len() == 0 {
+		return nil
+	}
+	b := make([]byte, detectPeekBytes)
+	n, _ := io.ReadFull(payload.Reader(), b)
+	return b[:n]
+}
+
+// isTLSHandshake matches a client that opens with a TLS handshake record.
+func isTLSHandshake(client, server []byte) bool {
+	return len(client) >= 3 && client[0] == tlsRecordHandshake && client[1] == 3 && client[2] <= 4
+}
+
+// isSSHBanner matches connections where either side opens with an SSH identification line.
+func isSSHBanner(client, server []byte) bool {
+	return bytes.HasPrefix(client, []byte("SSH-")) || bytes.HasPrefix(server, []byte("SSH-"))
+}
+
+// isHTTPMessage matches a client that opens with an HTTP/1.x request, or a server that opens with a
+// response when the client was not captured.
+func isHTTPMessage(client, server []byte) bool {
+	for _, method := range httpMethods {
+		if bytes.HasPrefix(client, []byte(method)) {
+			return true
+		}
+	}
+	return len(client) == 0 && bytes.HasPrefix(server, []byte("HTTP/1."))
+}
+
+// isSMBSession matches a client that opens with a NetBIOS session message carrying an SMB1 or SMB2
+// header.
+func isSMBSession(client, server []byte) bool {
+	if len(client) < 8 || client[0] != smbSessionMessage {
+		return false
+	}
+	protocol := client[4:8]
+	return bytes.Equal(protocol, []byte("\xffSMB")) || bytes.Equal(protocol, []byte("\xfeSMB"))
+}
+
+// isDNSStream matches a client that opens with a DNS query prefixed with its length.
+func isDNSStream(client, server []byte) bool {
+	messages := decodeDNSStream(client)
+	return len(messages) > 0 && isDNSQueryMessage(messages[0])
+}
+
+// isDNSQuery matches a client that sent a DNS query in a datagram.
+func isDNSQuery(client, server []byte) bool {
+	msg := decodeDNSMessage(client)
+	return msg != nil && isDNSQueryMessage(msg)
+}
+
+// isDNSQueryMessage reports whether a decoded message looks like a standard query, as random bytes
+// often decode as a DNS header.
+func isDNSQueryMessage(msg *layers.DNS) bool {
+	return !msg.QR && msg.OpCode == layers.DNSOpCodeQuery && msg.QDCount == 1 && len(msg.Questions) == 1 &&
+		msg.ANCount == 0 && msg.NSCount == 0
+}
+
+// isSMTPGreeting matches a server that greets with 220 and a client that answers with EHLO or HELO.
+func isSMTPGreeting(client, server []byte) bool {
+	if !bytes.HasPrefix(server, []byte("220")) {
+		return false
+	}
+	return hasCommand(client, "EHLO ", "HELO ")
+}
+
+// isFTPGreeting matches a server that greets with 220 and a client that logs in with USER, or asks
+// for TLS with AUTH.
+func isFTPGreeting(client, server []byte) bool {
+	if !bytes.HasPrefix(server, []byte("220")) {
+		return false
+	}
+	return hasCommand(client, "USER ", "AUTH ")
+}
+
+// hasCommand reports whether the client opens with one of the commands, in any case.
+func hasCommand(client []byte, commands ...string) bool {
+	for _, command := range commands {
+		if len(client) >= len(command) && strings.EqualFold(string(client[:len(command)]), command) {
+			return true
+		}
+	}
+	return false
+}
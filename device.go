@@ -0,0 +1,139 @@
+package gourmet
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/google/gopacket/pcap"
+)
+
+// npcapPrefix starts the names of the devices of Npcap and WinPcap, which are followed by the GUID
+// of the adapter
+const npcapPrefix = `\Device\NPF_`
+
+// captureDevice is a device that libpcap captures on, with the interface of the system that it is,
+// if it was found
+type captureDevice struct {
+	device pcap.Interface
+	iface  *net.Interface
+}
+
+// findCaptureDevices lists the devices of libpcap, matched to the interfaces of the system by name,
+// or by address where their names differ, as they do on Windows.
+func findCaptureDevices() ([]*captureDevice, error) {
+	devices, err := pcap.FindAllDevs()
+	if err != nil {
+		return nil, err
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	var found []*captureDevice
+	for _, device := range devices {
+		cd := &captureDevice{device: device}
+		for i := range ifaces {
+			if ifaces[i].Name == device.Name || sharesAddress(device, &ifaces[i]) {
+				cd.iface = &ifaces[i]
+				break
+			}
+		}
+		found = append(found, cd)
+	}
+	return found, nil
+}
+
+// sharesAddress reports whether a libpcap device has an address of the interface.
+func sharesAddress(device pcap.Interface, iface *net.Interface) bool {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		for _, address := range device.Addresses {
+			if address.IP.Equal(ipNet.IP) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matches reports whether an interface of the config names the device. Npcap names devices
+// \Device\NPF_{GUID}, so on Windows interfaces may also be named by the GUID of their adapter, by
+// their friendly name such as Ethernet, or by the description of their adapter.
+func (cd *captureDevice) matches(iface string) bool {
+	name := cd.device.Name
+	switch {
+	case name == iface:
+		return true
+	case strings.HasPrefix(name, npcapPrefix):
+		guid := strings.Trim(strings.TrimPrefix(name, npcapPrefix), "{}")
+		return strings.EqualFold(strings.Trim(iface, "{}"), guid) ||
+			(cd.iface != nil && cd.iface.Name == iface) ||
+			(cd.device.Description != "" && cd.device.Description == iface)
+	}
+	return false
+}
+
+// index returns the index of the interface of the device, or 0 if it was not found.
+func (cd *captureDevice) index() int {
+	if cd.iface == nil {
+		return 0
+	}
+	return cd.iface.Index
+}
+
+// String formats the device with the friendly name and description that Windows gives it, if they
+// differ from its name.
+func (cd *captureDevice) String() string {
+	var aliases []string
+	if cd.iface != nil && cd.iface.Name != cd.device.Name {
+		aliases = append(aliases, cd.iface.Name)
+	}
+	if cd.device.Description != "" {
+		aliases = append(aliases, cd.device.Description)
+	}
+	if len(aliases) == 0 {
+		return cd.device.Name
+	}
+	return fmt.Sprintf("%s (%s)", cd.device.Name, strings.Join(aliases, ", "))
+}
+
+// findCaptureDevice looks up the libpcap device that an interface of the config names. The error
+// lists the devices that can be captured on when none matches.
+func findCaptureDevice(iface string) (*captureDevice, error) {
+	devices, err := findCaptureDevices()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, cd := range devices {
+		if cd.matches(iface) {
+			return cd, nil
+		}
+		names = append(names, cd.String())
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("specified network interface does not exist, and no interfaces can be captured on")
+	}
+	return nil, fmt.Errorf("specified network interface does not exist. Available interfaces: %s",
+		strings.Join(names, "; "))
+}
+
+// LookupCaptureDevice returns the name of the libpcap device that an interface names. On Windows,
+// where Npcap names devices \Device\NPF_{GUID}, an interface may also be named by its GUID, its
+// friendly name, or the description of its adapter. The error lists the interfaces that can be
+// captured on, with their friendly names, when none matches.
+func LookupCaptureDevice(iface string) (string, error) {
+	cd, err := findCaptureDevice(iface)
+	if err != nil {
+		return "", err
+	}
+	return cd.device.Name, nil
+}
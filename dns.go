@@ -0,0 +1,197 @@
+package gourmet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	dnsAnalyzerName = "dns"
+	dnsPort         = 53
+	// dnsMaxMessages bounds the messages decoded per direction of a DNS over TCP connection
+	dnsMaxMessages = 100
+)
+
+// dnsAnalyzer is the built-in DNS analyzer. It decodes the DNS messages of connections on port 53,
+// or whose Service is dns, over UDP and TCP, and pairs each query with its response by transaction
+// ID. The result is logged under the dns key. Over UDP, a connection normally holds a single
+// datagram. When udp_timeout groups a flow into one connection, datagram boundaries are lost, so
+// only the first message of each direction is decoded.
+type dnsAnalyzer struct{}
+
+// DNSResult is the result of the built-in DNS analyzer, with one transaction per query or
+// unsolicited response.
+type DNSResult struct {
+	Transactions []*DNSTransaction
+}
+
+// DNSTransaction is a DNS query and its response. QueryType is the name of the record type, such as
+// AAAA, or TYPE followed by its number for types without a name. RCode and Answers are only set if
+// the response was seen.
+type DNSTransaction struct {
+	ID        uint16
+	Query     string
+	QueryType string
+	Responded bool
+	RCode     string      `json:",omitempty"`
+	Answers   []DNSAnswer `json:",omitempty"`
+}
+
+// DNSAnswer is a resource record of the answer section of a DNS response. Data is the address of A
+// and AAAA records, the target name of CNAME, NS, PTR, MX, and SRV records, and the text of TXT
+// records.
+type DNSAnswer struct {
+	Name string
+	Type string
+	TTL  uint32
+	Data string `json:",omitempty"`
+}
+
+// Key implements Result.
+func (r *DNSResult) Key() string {
+	return dnsAnalyzerName
+}
+
+func (da *dnsAnalyzer) Filter(c *Connection) bool {
+	if c.TransportType != "udp" && c.TransportType != "tcp" {
+		return false
+	}
+	return c.Service == dnsAnalyzerName || c.SourcePort == dnsPort || c.DestinationPort == dnsPort
+}
+
+func (da *dnsAnalyzer) Analyze(c *Connection) (Result, error) {
+	var messages []*layers.DNS
+	for _, payload := range []Payload{c.ClientPayload, c.ServerPayload} {
+		if payload == nil || payload.Len() == 0 {
+			continue
+		}
+		if c.TransportType == "tcp" {
+			messages = append(messages, decodeDNSStream(payload.Bytes())...)
+		} else if msg := decodeDNSMessage(payload.Bytes()); msg != nil {
+			messages = append(messages, msg)
+		}
+	}
+	if len(messages) == 0 {
+		return nil, nil
+	}
+	result := &DNSResult{}
+	queries := make(map[uint16]*DNSTransaction)
+	for _, msg := range messages {
+		if !msg.QR {
+			t := newDNSTransaction(msg)
+			queries[msg.ID] = t
+			result.Transactions = append(result.Transactions, t)
+			continue
+		}
+		t, ok := queries[msg.ID]
+		if !ok || t.Responded {
+			t = newDNSTransaction(msg)
+			result.Transactions = append(result.Transactions, t)
+		}
+		t.Responded = true
+		t.RCode = dnsRCode(msg.ResponseCode)
+		for _, rr := range msg.Answers {
+			t.Answers = append(t.Answers, DNSAnswer{
+				Name: string(rr.Name),
+				Type: dnsTypeName(rr.Type),
+				TTL:  rr.TTL,
+				Data: dnsRecordData(rr),
+			})
+		}
+	}
+	return result, nil
+}
+
+func newDNSTransaction(msg *layers.DNS) *DNSTransaction {
+	t := &DNSTransaction{ID: msg.ID}
+	if len(msg.Questions) > 0 {
+		t.Query = string(msg.Questions[0].Name)
+		t.QueryType = dnsTypeName(msg.Questions[0].Type)
+	}
+	return t
+}
+
+// decodeDNSMessage returns the DNS message at the start of data, or nil if it is not one.
+func decodeDNSMessage(data []byte) *layers.DNS {
+	msg := &layers.DNS{}
+	if err := msg.DecodeFromBytes(data, gopacket.NilDecodeFeedback); err != nil {
+		return nil
+	}
+	return msg
+}
+
+// decodeDNSStream decodes the messages of one direction of a DNS over TCP connection, each of which
+// is prefixed with its length. It stops at the first message that is truncated or malformed.
+func decodeDNSStream(data []byte) (messages []*layers.DNS) {
+	for len(data) >= 2 && len(messages) < dnsMaxMessages {
+		n := int(binary.BigEndian.Uint16(data))
+		if len(data) < 2+n {
+			break
+		}
+		msg := decodeDNSMessage(data[2 : 2+n])
+		if msg == nil {
+			break
+		}
+		messages = append(messages, msg)
+		data = data[2+n:]
+	}
+	return messages
+}
+
+func dnsTypeName(t layers.DNSType) string {
+	if name := t.String(); name != "Unknown" {
+		return name
+	}
+	return fmt.Sprintf("TYPE%d", uint16(t))
+}
+
+var dnsRCodeNames = map[layers.DNSResponseCode]string{
+	layers.DNSResponseCodeNoErr:    "NOERROR",
+	layers.DNSResponseCodeFormErr:  "FORMERR",
+	layers.DNSResponseCodeServFail: "SERVFAIL",
+	layers.DNSResponseCodeNXDomain: "NXDOMAIN",
+	layers.DNSResponseCodeNotImp:   "NOTIMP",
+	layers.DNSResponseCodeRefused:  "REFUSED",
+	layers.DNSResponseCodeYXDomain: "YXDOMAIN",
+	layers.DNSResponseCodeYXRRSet:  "YXRRSET",
+	layers.DNSResponseCodeNXRRSet:  "NXRRSET",
+	layers.DNSResponseCodeNotAuth:  "NOTAUTH",
+	layers.DNSResponseCodeNotZone:  "NOTZONE",
+}
+
+func dnsRCode(code layers.DNSResponseCode) string {
+	if name, ok := dnsRCodeNames[code]; ok {
+		return name
+	}
+	return fmt.Sprintf("RCODE%d", uint8(code))
+}
+
+func dnsRecordData(rr layers.DNSResourceRecord) string {
+	switch rr.Type {
+	case layers.DNSTypeA, layers.DNSTypeAAAA:
+		if rr.IP != nil {
+			return rr.IP.String()
+		}
+	case layers.DNSTypeCNAME:
+		return string(rr.CNAME)
+	case layers.DNSTypeNS:
+		return string(rr.NS)
+	case layers.DNSTypePTR:
+		return string(rr.PTR)
+	case layers.DNSTypeMX:
+		return string(rr.MX.Name)
+	case layers.DNSTypeSRV:
+		return string(rr.SRV.Name)
+	case layers.DNSTypeTXT:
+		txts := make([]string, len(rr.TXTs))
+		for i, txt := range rr.TXTs {
+			txts[i] = string(txt)
+		}
+		return strings.Join(txts, " ")
+	}
+	return ""
+}
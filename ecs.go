@@ -0,0 +1,501 @@
+package gourmet
+
+import (
+	"encoding/json"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// ecsVersion is the version of the Elastic Common Schema that documents follow
+	ecsVersion = "8.11.0"
+	// ecsDataset names the documents of connections in event.dataset, and ecsStatsDataset those of
+	// stats records
+	ecsDataset      = "gourmet.connection"
+	ecsStatsDataset = "gourmet.stats"
+)
+
+// ecsEncoder encodes a connection as a document of the Elastic Common Schema on a single line, so
+// that the dashboards and detection rules of Elastic that are built on ECS work on it. Connections
+// are network events with their endpoints in source and destination, and the results of the
+// built-in DNS, HTTP, and TLS analyzers fill the dns, http, url, user_agent, and tls field sets, for
+// the first transaction of the connection. The fields without an ECS counterpart, such as the
+// results of other analyzers, are kept under gourmet.
+type ecsEncoder struct{}
+
+// ecsDocument is a connection in the Elastic Common Schema
+type ecsDocument struct {
+	Timestamp   string          `json:"@timestamp"`
+	ECS         ecsVersionField `json:"ecs"`
+	Event       ecsEvent        `json:"event"`
+	Source      ecsEndpoint     `json:"source"`
+	Destination ecsEndpoint     `json:"destination"`
+	Network     ecsNetwork      `json:"network"`
+	Observer    *ecsObserver    `json:"observer,omitempty"`
+	Process     *ecsProcess     `json:"process,omitempty"`
+	DNS         *ecsDNS         `json:"dns,omitempty"`
+	HTTP        *ecsHTTP        `json:"http,omitempty"`
+	URL         *ecsURL         `json:"url,omitempty"`
+	UserAgent   *ecsUserAgent   `json:"user_agent,omitempty"`
+	TLS         *ecsTLS         `json:"tls,omitempty"`
+	Related     ecsRelated      `json:"related"`
+	Tags        []string        `json:"tags,omitempty"`
+	Gourmet     ecsGourmet      `json:"gourmet"`
+}
+
+type ecsVersionField struct {
+	Version string `json:"version"`
+}
+
+type ecsEvent struct {
+	ID       string   `json:"id"`
+	Kind     string   `json:"kind"`
+	Category []string `json:"category"`
+	Type     []string `json:"type"`
+	Module   string   `json:"module"`
+	Dataset  string   `json:"dataset"`
+	Start    string   `json:"start"`
+	End      string   `json:"end"`
+	// Duration is in nanoseconds
+	Duration int64 `json:"duration"`
+}
+
+type ecsEndpoint struct {
+	IP      string  `json:"ip"`
+	Port    int     `json:"port,omitempty"`
+	Bytes   uint64  `json:"bytes"`
+	Packets uint64  `json:"packets"`
+	Geo     *ecsGeo `json:"geo,omitempty"`
+	AS      *ecsAS  `json:"as,omitempty"`
+}
+
+type ecsGeo struct {
+	CountryISOCode string `json:"country_iso_code,omitempty"`
+	CityName       string `json:"city_name,omitempty"`
+}
+
+type ecsAS struct {
+	Number       uint               `json:"number,omitempty"`
+	Organization *ecsASOrganization `json:"organization,omitempty"`
+}
+
+type ecsASOrganization struct {
+	Name string `json:"name"`
+}
+
+type ecsNetwork struct {
+	Transport   string    `json:"transport"`
+	Type        string    `json:"type,omitempty"`
+	IANANumber  string    `json:"iana_number,omitempty"`
+	Protocol    string    `json:"protocol,omitempty"`
+	Direction   string    `json:"direction,omitempty"`
+	CommunityID string    `json:"community_id,omitempty"`
+	Bytes       uint64    `json:"bytes"`
+	Packets     uint64    `json:"packets"`
+	VLAN        *ecsVLAN  `json:"vlan,omitempty"`
+	Inner       *ecsInner `json:"inner,omitempty"`
+}
+
+type ecsVLAN struct {
+	ID string `json:"id"`
+}
+
+type ecsInner struct {
+	VLAN ecsVLAN `json:"vlan"`
+}
+
+type ecsObserver struct {
+	Ingress ecsIngress `json:"ingress"`
+}
+
+type ecsIngress struct {
+	Interface ecsInterface `json:"interface"`
+}
+
+type ecsInterface struct {
+	Name string `json:"name"`
+}
+
+type ecsProcess struct {
+	PID  int    `json:"pid,omitempty"`
+	Name string `json:"name,omitempty"`
+}
+
+type ecsDNS struct {
+	ID           string         `json:"id"`
+	Type         string         `json:"type"`
+	Question     ecsDNSQuestion `json:"question"`
+	ResponseCode string         `json:"response_code,omitempty"`
+	Answers      []ecsDNSAnswer `json:"answers,omitempty"`
+	ResolvedIP   []string       `json:"resolved_ip,omitempty"`
+}
+
+type ecsDNSQuestion struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+type ecsDNSAnswer struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	TTL  uint32 `json:"ttl"`
+	Data string `json:"data,omitempty"`
+}
+
+type ecsHTTP struct {
+	Version  string           `json:"version,omitempty"`
+	Request  ecsHTTPRequest   `json:"request"`
+	Response *ecsHTTPResponse `json:"response,omitempty"`
+}
+
+type ecsHTTPRequest struct {
+	Method string      `json:"method"`
+	Body   ecsHTTPBody `json:"body"`
+}
+
+type ecsHTTPResponse struct {
+	StatusCode int         `json:"status_code"`
+	MIMEType   string      `json:"mime_type,omitempty"`
+	Body       ecsHTTPBody `json:"body"`
+}
+
+type ecsHTTPBody struct {
+	Bytes int64 `json:"bytes"`
+}
+
+type ecsURL struct {
+	Original string `json:"original"`
+	Domain   string `json:"domain,omitempty"`
+	Path     string `json:"path,omitempty"`
+	Query    string `json:"query,omitempty"`
+}
+
+type ecsUserAgent struct {
+	Original string `json:"original"`
+}
+
+type ecsTLS struct {
+	Version         string        `json:"version,omitempty"`
+	VersionProtocol string        `json:"version_protocol,omitempty"`
+	Cipher          string        `json:"cipher,omitempty"`
+	Client          *ecsTLSClient `json:"client,omitempty"`
+	Server          *ecsTLSServer `json:"server,omitempty"`
+}
+
+type ecsTLSClient struct {
+	ServerName string `json:"server_name,omitempty"`
+	JA3        string `json:"ja3,omitempty"`
+}
+
+type ecsTLSServer struct {
+	JA3S      string `json:"ja3s,omitempty"`
+	Subject   string `json:"subject,omitempty"`
+	Issuer    string `json:"issuer,omitempty"`
+	NotBefore string `json:"not_before,omitempty"`
+	NotAfter  string `json:"not_after,omitempty"`
+}
+
+type ecsRelated struct {
+	IP    []string `json:"ip"`
+	Hosts []string `json:"hosts,omitempty"`
+	Hash  []string `json:"hash,omitempty"`
+}
+
+// ecsGourmet holds the fields of a connection that ECS has no place for
+type ecsGourmet struct {
+	ConnState    string                 `json:"conn_state,omitempty"`
+	History      string                 `json:"history,omitempty"`
+	Preliminary  bool                   `json:"preliminary,omitempty"`
+	Tunnel       *Tunnel                `json:"tunnel,omitempty"`
+	IntelMatches []IntelMatch           `json:"intel_matches,omitempty"`
+	Files        []*ExtractedFile       `json:"files,omitempty"`
+	Analyzers    map[string]interface{} `json:"analyzers,omitempty"`
+}
+
+func (ee ecsEncoder) header() []byte {
+	return nil
+}
+
+func (ee ecsEncoder) encode(c *Connection) ([]byte, error) {
+	record, err := json.Marshal(newECSDocument(c))
+	if err != nil {
+		return nil, err
+	}
+	return append(record, '\n'), nil
+}
+
+// ecsStatsDocument is a stats record in the Elastic Common Schema, as a metric event whose counters
+// are kept under gourmet.stats
+type ecsStatsDocument struct {
+	Timestamp string          `json:"@timestamp"`
+	ECS       ecsVersionField `json:"ecs"`
+	Event     ecsMetricEvent  `json:"event"`
+	Gourmet   struct {
+		Stats *SensorStats `json:"stats"`
+	} `json:"gourmet"`
+}
+
+type ecsMetricEvent struct {
+	Kind    string `json:"kind"`
+	Module  string `json:"module"`
+	Dataset string `json:"dataset"`
+	// Duration is the interval of the record in nanoseconds
+	Duration int64 `json:"duration"`
+}
+
+func (ee ecsEncoder) encodeStats(stats *SensorStats) ([]byte, error) {
+	doc := &ecsStatsDocument{
+		Timestamp: stats.Timestamp.Format(time.RFC3339Nano),
+		ECS:       ecsVersionField{Version: ecsVersion},
+		Event: ecsMetricEvent{
+			Kind:     "metric",
+			Module:   "gourmet",
+			Dataset:  ecsStatsDataset,
+			Duration: int64(stats.Interval * float64(time.Second)),
+		},
+	}
+	doc.Gourmet.Stats = stats
+	record, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	return append(record, '\n'), nil
+}
+
+func newECSDocument(c *Connection) *ecsDocument {
+	duration := time.Duration(c.Duration * float64(time.Second))
+	doc := &ecsDocument{
+		Timestamp: c.Timestamp.Format(time.RFC3339Nano),
+		ECS:       ecsVersionField{Version: ecsVersion},
+		Event: ecsEvent{
+			ID:       c.UID,
+			Kind:     "event",
+			Category: []string{"network"},
+			Type:     []string{"connection"},
+			Module:   "gourmet",
+			Dataset:  ecsDataset,
+			Start:    c.Timestamp.Format(time.RFC3339Nano),
+			End:      c.Timestamp.Add(duration).Format(time.RFC3339Nano),
+			Duration: int64(duration),
+		},
+		Source: ecsEndpoint{
+			IP:      c.SourceIP,
+			Port:    c.SourcePort,
+			Bytes:   c.OrigBytes,
+			Packets: c.OrigPackets,
+		},
+		Destination: ecsEndpoint{
+			IP:      c.DestinationIP,
+			Port:    c.DestinationPort,
+			Bytes:   c.RespBytes,
+			Packets: c.RespPackets,
+		},
+		Network: ecsNetwork{
+			Transport:   ecsTransport(c.TransportType),
+			Type:        ecsNetworkType(c.SourceIP),
+			IANANumber:  ecsIANANumber(c.TransportType),
+			Protocol:    strings.ToLower(c.Service),
+			Direction:   c.Locality,
+			CommunityID: c.CommunityID,
+			Bytes:       c.OrigBytes + c.RespBytes,
+			Packets:     c.OrigPackets + c.RespPackets,
+		},
+		Related: ecsRelated{IP: ecsUnique(nil, c.SourceIP, c.DestinationIP)},
+		Tags:    c.Tags,
+		Gourmet: ecsGourmet{
+			ConnState:    c.ConnState,
+			History:      c.History,
+			Preliminary:  c.Preliminary,
+			Tunnel:       c.Tunnel,
+			IntelMatches: c.IntelMatches,
+			Files:        c.Files,
+			Analyzers:    c.Analyzers,
+		},
+	}
+	if c.Enrichments != nil {
+		doc.Source.Geo, doc.Source.AS = ecsGeoIP(c.Enrichments.SourceGeo)
+		doc.Destination.Geo, doc.Destination.AS = ecsGeoIP(c.Enrichments.DestinationGeo)
+	}
+	if len(c.VLANs) > 0 {
+		doc.Network.VLAN = &ecsVLAN{ID: strconv.Itoa(c.VLANs[0])}
+	}
+	if len(c.VLANs) > 1 {
+		doc.Network.Inner = &ecsInner{VLAN: ecsVLAN{ID: strconv.Itoa(c.VLANs[1])}}
+	}
+	if c.Interface != "" {
+		doc.Observer = &ecsObserver{Ingress: ecsIngress{Interface: ecsInterface{Name: c.Interface}}}
+	}
+	if c.ProcessID != 0 || c.ProcessName != "" {
+		doc.Process = &ecsProcess{PID: c.ProcessID, Name: c.ProcessName}
+	}
+	if c.ServerName != "" {
+		doc.Related.Hosts = ecsUnique(doc.Related.Hosts, c.ServerName)
+	}
+	for _, f := range c.Files {
+		doc.Related.Hash = ecsUnique(doc.Related.Hash, f.SHA256)
+	}
+	doc.addDNS(c)
+	doc.addHTTP(c)
+	doc.addTLS(c)
+	return doc
+}
+
+// addDNS fills the dns field set from the first transaction of the dns analyzer.
+func (doc *ecsDocument) addDNS(c *Connection) {
+	dns, ok := findResult(c, dnsAnalyzerName).(*DNSResult)
+	if !ok || len(dns.Transactions) == 0 {
+		return
+	}
+	t := dns.Transactions[0]
+	doc.DNS = &ecsDNS{
+		ID:       strconv.Itoa(int(t.ID)),
+		Type:     "query",
+		Question: ecsDNSQuestion{Name: t.Query, Type: t.QueryType},
+	}
+	if t.Responded {
+		doc.DNS.Type = "answer"
+		doc.DNS.ResponseCode = t.RCode
+	}
+	for _, a := range t.Answers {
+		doc.DNS.Answers = append(doc.DNS.Answers, ecsDNSAnswer{Name: a.Name, Type: a.Type, TTL: a.TTL, Data: a.Data})
+		if a.Type == "A" || a.Type == "AAAA" {
+			doc.DNS.ResolvedIP = append(doc.DNS.ResolvedIP, a.Data)
+			doc.Related.IP = ecsUnique(doc.Related.IP, a.Data)
+		}
+	}
+	doc.Related.Hosts = ecsUnique(doc.Related.Hosts, t.Query)
+}
+
+// addHTTP fills the http, url, and user_agent field sets from the first transaction of the http
+// analyzer.
+func (doc *ecsDocument) addHTTP(c *Connection) {
+	http, ok := findResult(c, httpAnalyzerName).(*HTTPResult)
+	if !ok || len(http.Transactions) == 0 {
+		return
+	}
+	t := http.Transactions[0]
+	doc.HTTP = &ecsHTTP{
+		Version: strings.TrimPrefix(t.Version, "HTTP/"),
+		Request: ecsHTTPRequest{Method: t.Method, Body: ecsHTTPBody{Bytes: t.RequestBodyLength}},
+	}
+	if t.StatusCode != 0 {
+		doc.HTTP.Response = &ecsHTTPResponse{
+			StatusCode: t.StatusCode,
+			MIMEType:   t.ContentType,
+			Body:       ecsHTTPBody{Bytes: t.ResponseBodyLength},
+		}
+	}
+	doc.URL = &ecsURL{Original: t.URI, Domain: t.Host}
+	if i := strings.IndexByte(t.URI, '?'); i >= 0 {
+		doc.URL.Path, doc.URL.Query = t.URI[:i], t.URI[i+1:]
+	} else {
+		doc.URL.Path = t.URI
+	}
+	if t.UserAgent != "" {
+		doc.UserAgent = &ecsUserAgent{Original: t.UserAgent}
+	}
+	if t.Host != "" {
+		doc.Related.Hosts = ecsUnique(doc.Related.Hosts, t.Host)
+	}
+}
+
+// addTLS fills the tls field set from the result of the tls analyzer.
+func (doc *ecsDocument) addTLS(c *Connection) {
+	tls, ok := findResult(c, tlsAnalyzerName).(*TLSResult)
+	if !ok {
+		return
+	}
+	doc.TLS = &ecsTLS{Cipher: tls.CipherSuite}
+	if version := eveTLSVersion(tls.Version); strings.HasPrefix(version, "TLS ") {
+		doc.TLS.VersionProtocol, doc.TLS.Version = "tls", strings.TrimPrefix(version, "TLS ")
+	}
+	if tls.ServerName != "" || tls.JA3 != "" {
+		doc.TLS.Client = &ecsTLSClient{ServerName: tls.ServerName, JA3: tls.JA3}
+	}
+	if tls.JA3S != "" || tls.Subject != "" {
+		doc.TLS.Server = &ecsTLSServer{JA3S: tls.JA3S, Subject: tls.Subject, Issuer: tls.Issuer}
+		if tls.NotBefore != nil {
+			doc.TLS.Server.NotBefore = tls.NotBefore.UTC().Format(time.RFC3339)
+		}
+		if tls.NotAfter != nil {
+			doc.TLS.Server.NotAfter = tls.NotAfter.UTC().Format(time.RFC3339)
+		}
+	}
+	if tls.ServerName != "" {
+		doc.Related.Hosts = ecsUnique(doc.Related.Hosts, tls.ServerName)
+	}
+}
+
+func ecsGeoIP(g *GeoIP) (*ecsGeo, *ecsAS) {
+	if g == nil {
+		return nil, nil
+	}
+	var geo *ecsGeo
+	var as *ecsAS
+	if g.Country != "" || g.City != "" {
+		geo = &ecsGeo{CountryISOCode: g.Country, CityName: g.City}
+	}
+	if g.ASN != 0 {
+		as = &ecsAS{Number: g.ASN}
+		if g.ASOrganization != "" {
+			as.Organization = &ecsASOrganization{Name: g.ASOrganization}
+		}
+	}
+	return geo, as
+}
+
+// ecsTransport returns the network.transport of a connection, which ECS spells as the keyword of
+// the IANA protocol number.
+func ecsTransport(transport string) string {
+	if transport == icmpv6Transport {
+		return "ipv6-icmp"
+	}
+	return transport
+}
+
+func ecsIANANumber(transport string) string {
+	switch transport {
+	case "tcp":
+		return "6"
+	case "udp":
+		return "17"
+	case icmpTransport:
+		return "1"
+	case icmpv6Transport:
+		return "58"
+	}
+	return ""
+}
+
+func ecsNetworkType(ip string) string {
+	parsed := net.ParseIP(ip)
+	switch {
+	case parsed == nil:
+		return ""
+	case parsed.To4() != nil:
+		return "ipv4"
+	}
+	return "ipv6"
+}
+
+// ecsUnique appends the non-empty values that the list does not have yet.
+func ecsUnique(list []string, values ...string) []string {
+	for _, value := range values {
+		if value == "" {
+			continue
+		}
+		found := false
+		for _, v := range list {
+			if v == value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, value)
+		}
+	}
+	return list
+}
@@ -0,0 +1,215 @@
+package gourmet
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	elasticsearchDefaultBatch = 500
+	// elasticsearchDefaultFlush is how many seconds connections may wait in a partial batch
+	elasticsearchDefaultFlush = 5
+)
+
+// elasticsearchOutput indexes connections into Elasticsearch with the bulk API, as the JSON object of
+// the connection, or as a document of the Elastic Common Schema with the ecs encoding. Connections are
+// batched, and a batch is sent once it holds batch_size connections or flush_interval seconds after
+// the previous one was sent. A batch that fails to send is dropped, so a down cluster does not grow
+// the memory of the sensor. Stats records are indexed into an index of their own, in the same
+// batches.
+type elasticsearchOutput struct {
+	url        string
+	index      string
+	statsIndex string
+	batch      int
+	encoder    logEncoder
+	client     *http.Client
+	// mutex guards the pending batch, which is taken out from under it to be sent, so that writes
+	// are not held up by the bulk requests
+	mutex   sync.Mutex
+	pending *bytes.Buffer
+	count   int
+	quit    chan struct{}
+	done    chan struct{}
+}
+
+// elasticsearchBulkResponse holds the part of a bulk API response that reports failed documents
+type elasticsearchBulkResponse struct {
+	Errors bool
+	Items  []map[string]struct {
+		Status int
+		Error  json.RawMessage
+	}
+}
+
+func newElasticsearchOutput(args map[string]interface{}) (*elasticsearchOutput, error) {
+	url, err := outputString(args, "url", "")
+	if err != nil {
+		return nil, err
+	}
+	if url == "" {
+		return nil, errors.New("url must be set")
+	}
+	index, err := outputString(args, "index", "gourmet")
+	if err != nil {
+		return nil, err
+	}
+	statsIndex, err := outputString(args, "stats_index", index+"-stats")
+	if err != nil {
+		return nil, err
+	}
+	batch, err := outputInt(args, "batch_size", elasticsearchDefaultBatch)
+	if err != nil {
+		return nil, err
+	}
+	flush, err := outputInt(args, "flush_interval", elasticsearchDefaultFlush)
+	if err != nil {
+		return nil, err
+	}
+	// the bulk API takes a document per line
+	encoding, err := outputString(args, "encoding", encodingNDJSON)
+	if err != nil {
+		return nil, err
+	}
+	if encoding != encodingNDJSON && encoding != encodingECS {
+		return nil, errors.New("invalid encoding. Must be ndjson or ecs")
+	}
+	encoder, err := newLogEncoder(args, encodingNDJSON)
+	if err != nil {
+		return nil, err
+	}
+	eo := &elasticsearchOutput{
+		url:        strings.TrimSuffix(url, "/") + "/_bulk",
+		index:      index,
+		statsIndex: statsIndex,
+		batch:      batch,
+		encoder:    encoder,
+		client:     &http.Client{Timeout: 30 * time.Second},
+		pending:    &bytes.Buffer{},
+		quit:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	go eo.flushPeriodically(time.Second * time.Duration(flush))
+	return eo, nil
+}
+
+func (eo *elasticsearchOutput) Write(c *Connection) error {
+	document, err := encodeMessage(eo.encoder, c)
+	if err != nil {
+		return err
+	}
+	return eo.add(eo.index, document)
+}
+
+func (eo *elasticsearchOutput) writeStats(stats *SensorStats) error {
+	document, err := encodeStatsMessage(eo.encoder, stats)
+	if err != nil {
+		return err
+	}
+	return eo.add(eo.statsIndex, document)
+}
+
+// add adds a document to the pending batch, and sends the batch once it is full.
+func (eo *elasticsearchOutput) add(index string, document []byte) error {
+	eo.mutex.Lock()
+	fmt.Fprintf(eo.pending, "{\"index\":{\"_index\":%q}}\n", index)
+	eo.pending.Write(document)
+	eo.pending.WriteByte('\n')
+	eo.count++
+	if eo.count < eo.batch {
+		eo.mutex.Unlock()
+		return nil
+	}
+	body, count := eo.take()
+	eo.mutex.Unlock()
+	return eo.send(body, count)
+}
+
+// take returns the pending batch and the number of documents in it, and starts a new one. The mutex
+// must be held.
+func (eo *elasticsearchOutput) take() (*bytes.Buffer, int) {
+	body, count := eo.pending, eo.count
+	eo.pending, eo.count = &bytes.Buffer{}, 0
+	return body, count
+}
+
+// flush sends the pending batch.
+func (eo *elasticsearchOutput) flush() error {
+	eo.mutex.Lock()
+	body, count := eo.take()
+	eo.mutex.Unlock()
+	return eo.send(body, count)
+}
+
+// send sends a batch of count documents with the bulk API.
+func (eo *elasticsearchOutput) send(body *bytes.Buffer, count int) error {
+	if count == 0 {
+		return nil
+	}
+	resp, err := eo.client.Post(eo.url, "application/x-ndjson", body)
+	if err != nil {
+		return fmt.Errorf("failed to send %d connections: %s", count, err)
+	}
+	defer resp.Body.Close()
+	contents, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read bulk response: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to send %d connections: %s", count, resp.Status)
+	}
+	var bulk elasticsearchBulkResponse
+	err = json.Unmarshal(contents, &bulk)
+	if err != nil {
+		return fmt.Errorf("failed to parse bulk response: %s", err)
+	}
+	if !bulk.Errors {
+		return nil
+	}
+	var failed int
+	var first json.RawMessage
+	for _, item := range bulk.Items {
+		for _, result := range item {
+			if result.Status >= 300 {
+				if failed == 0 {
+					first = result.Error
+				}
+				failed++
+			}
+		}
+	}
+	return fmt.Errorf("failed to index %d of %d connections: %s", failed, count, first)
+}
+
+// flushPeriodically sends partial batches every interval until the output is closed.
+func (eo *elasticsearchOutput) flushPeriodically(interval time.Duration) {
+	defer close(eo.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-eo.quit:
+			return
+		case <-ticker.C:
+		}
+		err := eo.flush()
+		if err != nil {
+			log.Printf("[!] Elasticsearch output: %s", err)
+		}
+	}
+}
+
+// Close sends the last partial batch.
+func (eo *elasticsearchOutput) Close() error {
+	close(eo.quit)
+	<-eo.done
+	return eo.flush()
+}
@@ -0,0 +1,173 @@
+package gourmet
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// sensorErrorBuffer is how many errors a Sensor holds for a program that does not read them
+const sensorErrorBuffer = 64
+
+// Sensor is a sensor embedded in a Go program, which receives the analyzed connections on a channel
+// instead of reading them back from a log. The sensor captures and analyzes packets according to its
+// config as Start does, and also writes to the outputs listed in the config, but not to the log file
+// unless the file output is listed.
+//
+// Connections are sent on the channel once they were analyzed, and the sensor waits for the program
+// to receive them, so a program that stops reading holds up the sensor until packets are dropped.
+// The payload of a connection is released once it was sent, so its Payload must not be read;
+// programs that need the payload should register an analyzer instead. Errors that the sensor logs
+// while it runs, such as those of analyzers and outputs, are sent on the error channel as well, and
+// dropped while it is full.
+type Sensor struct {
+	sensor      *sensor
+	connections chan *Connection
+	errors      chan error
+	stopped     int32
+	// mutex guards closed, which is set once the error channel is closed
+	mutex  sync.Mutex
+	closed bool
+}
+
+// NewSensor loads the analyzers, opens the packet source, and starts a sensor with the config. The
+// sensor runs until Stop is called, and a sensor that replays a capture file also finishes at the end
+// of the file. Analyzers are global to the process, so only one sensor runs at a time.
+func NewSensor(config *Config) (*Sensor, error) {
+	queue := config.AnalyzerQueueSize
+	if queue < 0 {
+		queue = 0
+	}
+	embedded := &Sensor{
+		connections: make(chan *Connection, queue),
+		errors:      make(chan error, sensorErrorBuffer),
+	}
+	s, err := start(config, embedded)
+	if err != nil {
+		return nil, err
+	}
+	embedded.sensor = s
+	return embedded, nil
+}
+
+// Connections returns the channel that analyzed connections are sent on. It is closed once the
+// sensor stopped.
+func (es *Sensor) Connections() <-chan *Connection {
+	return es.connections
+}
+
+// Errors returns the channel that the errors of the running sensor are sent on. It is closed once the
+// sensor stopped.
+func (es *Sensor) Errors() <-chan error {
+	return es.errors
+}
+
+// Finished returns a channel that is closed when a sensor replaying a capture file reached its end.
+// It is never closed for a live capture.
+func (es *Sensor) Finished() <-chan struct{} {
+	return es.sensor.finished
+}
+
+// Stop shuts the sensor down gracefully, as StartWithContext does when its context is done, and
+// closes the channels. The connections still open are flushed and sent on the channel before it is
+// closed, so the program must keep receiving them until then. Connections still in flight after
+// ShutdownTimeout seconds are abandoned and reported in the returned error, and those of a capture
+// file that reached its end are always waited for. Only the first call stops the sensor.
+func (es *Sensor) Stop() error {
+	if !atomic.CompareAndSwapInt32(&es.stopped, 0, 1) {
+		return errors.New("sensor already stopped")
+	}
+	timeout := time.Second * time.Duration(es.sensor.config.ShutdownTimeout)
+	select {
+	case <-es.sensor.finished:
+		timeout = drainAll
+	default:
+	}
+	err := es.sensor.stop(timeout)
+	es.mutex.Lock()
+	es.closed = true
+	close(es.errors)
+	es.mutex.Unlock()
+	return err
+}
+
+// ShutdownRequested returns a channel that is closed when a shutdown of the sensor was requested
+// over the control server. The sensor keeps running until Stop is called.
+func (es *Sensor) ShutdownRequested() <-chan struct{} {
+	return es.sensor.shutdown
+}
+
+// SetFilter replaces the BPF filter of the packet sources of the running sensor, without losing the
+// connections it tracks. An invalid filter is reported and leaves capture as it was, and an empty
+// filter captures every packet. The filter of AF_XDP and remote sources cannot be changed.
+func (es *Sensor) SetFilter(bpf string) error {
+	return es.sensor.setFilter(bpf)
+}
+
+// Filter returns the BPF filter of the packet sources of the running sensor.
+func (es *Sensor) Filter() string {
+	return es.sensor.currentFilter()
+}
+
+// report sends an error to the program that the sensor is embedded in, if it is, unless the error
+// channel is full or closed.
+func (es *Sensor) report(err error) {
+	if es == nil {
+		return
+	}
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+	if es.closed {
+		return
+	}
+	select {
+	case es.errors <- err:
+	default:
+	}
+}
+
+// channelOutput sends the connections of an embedded sensor on its channel. It is closed with the
+// other outputs, once the last connection was written. Connections abandoned at shutdown may still
+// be written after that, so writes in progress are cut short by done, and later ones are dropped,
+// before the channel is closed.
+type channelOutput struct {
+	sensor  *Sensor
+	mutex   sync.Mutex
+	closed  bool
+	done    chan struct{}
+	writers sync.WaitGroup
+}
+
+func newChannelOutput(es *Sensor) *channelOutput {
+	return &channelOutput{
+		sensor: es,
+		done:   make(chan struct{}),
+	}
+}
+
+func (co *channelOutput) Write(c *Connection) error {
+	co.mutex.Lock()
+	if co.closed {
+		co.mutex.Unlock()
+		return nil
+	}
+	co.writers.Add(1)
+	co.mutex.Unlock()
+	defer co.writers.Done()
+	select {
+	case co.sensor.connections <- c:
+	case <-co.done:
+	}
+	return nil
+}
+
+func (co *channelOutput) Close() error {
+	co.mutex.Lock()
+	co.closed = true
+	close(co.done)
+	co.mutex.Unlock()
+	co.writers.Wait()
+	close(co.sensor.connections)
+	return nil
+}
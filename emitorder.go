@@ -0,0 +1,142 @@
+package gourmet
+
+import (
+	"container/heap"
+	"errors"
+	"time"
+)
+
+const (
+	emitOrderEnd        = "end"
+	emitOrderStart      = "start"
+	emitDefaultWindow   = 10
+	emitReleaseInterval = time.Second
+)
+
+// startOrderBuffer reorders connections, which are emitted when they end, so that they are logged in
+// the order they started. Every connection is held until no connection lasting at most window could
+// still start before it, using the end of the most recent connection as the clock. Connections that
+// last longer than the window are released as soon as they end, so ordering is exact for
+// connections shorter than the window and best-effort for longer ones.
+//
+// The trade-off is latency and memory: a larger window orders more of the long-lived connections,
+// but delays every connection by up to the window and keeps all connections ending within it in
+// memory, analyzer results included. When no connections arrive, the clock advances with wall time
+// so that buffered connections are still released.
+type startOrderBuffer struct {
+	in          chan *Connection
+	out         chan *Connection
+	window      time.Duration
+	pending     connectionHeap
+	latestEnd   time.Time
+	lastArrival time.Time
+	flushes     chan struct{}
+	flushing    bool
+	// quit is closed when the sensor stops
+	quit <-chan struct{}
+}
+
+// newStartOrderBuffer returns nil if connections should be emitted in end order.
+func newStartOrderBuffer(order string, window int, in chan *Connection) (*startOrderBuffer, error) {
+	switch order {
+	case "", emitOrderEnd:
+		return nil, nil
+	case emitOrderStart:
+	default:
+		return nil, errors.New("invalid emit_order. Must be end or start")
+	}
+	if window <= 0 {
+		window = emitDefaultWindow
+	}
+	return &startOrderBuffer{
+		in:      in,
+		out:     make(chan *Connection),
+		window:  time.Second * time.Duration(window),
+		flushes: make(chan struct{}, 1),
+	}, nil
+}
+
+// run reorders the connections until quit is closed.
+func (b *startOrderBuffer) run(quit <-chan struct{}) {
+	b.quit = quit
+	ticker := time.NewTicker(emitReleaseInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-quit:
+			return
+		case c := <-b.in:
+			if b.flushing {
+				b.emit(c)
+				continue
+			}
+			heap.Push(&b.pending, c)
+			end := c.Timestamp.Add(time.Duration(c.Duration * float64(time.Second)))
+			if end.After(b.latestEnd) {
+				b.latestEnd = end
+			}
+			b.lastArrival = time.Now()
+			b.release(b.latestEnd)
+		case <-ticker.C:
+			if b.pending.Len() > 0 {
+				b.release(b.latestEnd.Add(time.Since(b.lastArrival)))
+			}
+		case <-b.flushes:
+			b.flushing = true
+			b.release(time.Time{})
+		}
+	}
+}
+
+// release emits the buffered connections that started at least one window before clock, or all of
+// them if clock is zero.
+func (b *startOrderBuffer) release(clock time.Time) {
+	horizon := clock.Add(-b.window)
+	for b.pending.Len() > 0 {
+		if !clock.IsZero() && b.pending[0].Timestamp.After(horizon) {
+			return
+		}
+		if !b.emit(heap.Pop(&b.pending).(*Connection)) {
+			return
+		}
+	}
+}
+
+// emit hands a connection on, and returns false if the sensor stopped before it was taken.
+func (b *startOrderBuffer) emit(c *Connection) bool {
+	select {
+	case b.out <- c:
+		return true
+	case <-b.quit:
+		return false
+	}
+}
+
+// flush releases every buffered connection and passes later connections through unordered. It is
+// used when the sensor shuts down.
+func (b *startOrderBuffer) flush() {
+	select {
+	case b.flushes <- struct{}{}:
+	default:
+	}
+}
+
+// connectionHeap is a min-heap of connections by start time
+type connectionHeap []*Connection
+
+func (h connectionHeap) Len() int           { return len(h) }
+func (h connectionHeap) Less(i, j int) bool { return h[i].Timestamp.Before(h[j].Timestamp) }
+func (h connectionHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *connectionHeap) Push(x interface{}) {
+	*h = append(*h, x.(*Connection))
+}
+
+func (h *connectionHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	c := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return c
+}
@@ -0,0 +1,304 @@
+package gourmet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Encodings that connections are written in by the stdout, syslog, kafka, and elasticsearch outputs.
+// The other outputs reject them, as their records always have the same format.
+const (
+	encodingJSON    = "json"
+	encodingNDJSON  = "ndjson"
+	encodingCSV     = "csv"
+	encodingMsgpack = "msgpack"
+	encodingECS     = "ecs"
+)
+
+// logEncoder encodes connections as the records of an output. A record ends with a newline if the
+// encoding is line oriented, so that records can be written to a stream one after the other.
+type logEncoder interface {
+	// header returns what is written to a stream before its first record, or nil
+	header() []byte
+	encode(c *Connection) ([]byte, error)
+	// encodeStats encodes a stats record, or returns nil if the encoding has no place for them
+	encodeStats(stats *SensorStats) ([]byte, error)
+}
+
+// statsRecord is a stats record among the connections of a stream, which its Stats key tells apart
+type statsRecord struct {
+	Stats *SensorStats
+}
+
+// newLogEncoder returns the encoder named by the encoding argument of an output, or fallback if it is
+// not set.
+func newLogEncoder(args map[string]interface{}, fallback string) (logEncoder, error) {
+	encoding, err := outputString(args, "encoding", fallback)
+	if err != nil {
+		return nil, err
+	}
+	switch encoding {
+	case encodingJSON:
+		return jsonEncoder{indent: true}, nil
+	case encodingNDJSON:
+		return jsonEncoder{}, nil
+	case encodingCSV:
+		return csvEncoder{}, nil
+	case encodingMsgpack:
+		return msgpackEncoder{}, nil
+	case encodingECS:
+		return ecsEncoder{}, nil
+	}
+	return nil, errors.New("invalid encoding. Must be json, ndjson, csv, msgpack, or ecs")
+}
+
+// encodeMessage encodes a connection as a message of its own, without the newline that separates
+// the records of a stream.
+func encodeMessage(enc logEncoder, c *Connection) ([]byte, error) {
+	record, err := enc.encode(c)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(record, []byte("\n")), nil
+}
+
+// encodeStatsMessage encodes a stats record as a message of its own, or returns nil if the encoding
+// has no place for stats records.
+func encodeStatsMessage(enc logEncoder, stats *SensorStats) ([]byte, error) {
+	record, err := enc.encodeStats(stats)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(record, []byte("\n")), nil
+}
+
+// jsonEncoder encodes a connection as a JSON object, indented like the log file, or on a single line
+// for NDJSON.
+type jsonEncoder struct {
+	indent bool
+}
+
+func (je jsonEncoder) header() []byte {
+	return nil
+}
+
+func (je jsonEncoder) encode(c *Connection) ([]byte, error) {
+	return je.marshal(c)
+}
+
+func (je jsonEncoder) encodeStats(stats *SensorStats) ([]byte, error) {
+	return je.marshal(statsRecord{Stats: stats})
+}
+
+func (je jsonEncoder) marshal(v interface{}) ([]byte, error) {
+	var record []byte
+	var err error
+	if je.indent {
+		record, err = json.MarshalIndent(v, "", "  ")
+	} else {
+		record, err = json.Marshal(v)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return append(record, '\n'), nil
+}
+
+// csvColumns are the fields of a connection in the CSV encoding. The results of the analyzers do not
+// fit in columns, so they are written as a JSON object in the last one.
+var csvColumns = []string{
+	"timestamp", "uid", "source_ip", "source_port", "destination_ip", "destination_port",
+	"transport", "service", "duration", "orig_bytes", "resp_bytes", "orig_packets", "resp_packets",
+	"analyzers",
+}
+
+// csvEncoder encodes a connection as a CSV row, for spreadsheets. Streams start with a row of column
+// names.
+type csvEncoder struct{}
+
+func (ce csvEncoder) header() []byte {
+	row, _ := csvRow(csvColumns)
+	return row
+}
+
+func (ce csvEncoder) encode(c *Connection) ([]byte, error) {
+	analyzers, err := json.Marshal(c.Analyzers)
+	if err != nil {
+		return nil, err
+	}
+	return csvRow([]string{
+		c.Timestamp.Format(time.RFC3339Nano),
+		c.UID,
+		c.SourceIP,
+		strconv.Itoa(c.SourcePort),
+		c.DestinationIP,
+		strconv.Itoa(c.DestinationPort),
+		c.TransportType,
+		c.Service,
+		strconv.FormatFloat(c.Duration, 'f', -1, 64),
+		strconv.FormatUint(c.OrigBytes, 10),
+		strconv.FormatUint(c.RespBytes, 10),
+		strconv.FormatUint(c.OrigPackets, 10),
+		strconv.FormatUint(c.RespPackets, 10),
+		string(analyzers),
+	})
+}
+
+// encodeStats writes no stats records, as they do not fit the columns of connections.
+func (ce csvEncoder) encodeStats(stats *SensorStats) ([]byte, error) {
+	return nil, nil
+}
+
+func csvRow(fields []string) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	err := w.Write(fields)
+	if err != nil {
+		return nil, err
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// msgpackEncoder encodes a connection as a MessagePack map with the same keys as its JSON object.
+// Records are self-delimiting, so they are not separated by newlines.
+type msgpackEncoder struct{}
+
+func (me msgpackEncoder) header() []byte {
+	return nil
+}
+
+func (me msgpackEncoder) encode(c *Connection) ([]byte, error) {
+	// the JSON object of the connection already applies the encoding of its fields and of the
+	// results of the analyzers, so it is what is packed
+	return me.pack(c)
+}
+
+func (me msgpackEncoder) encodeStats(stats *SensorStats) ([]byte, error) {
+	return me.pack(statsRecord{Stats: stats})
+}
+
+// pack packs the JSON object of a value.
+func (me msgpackEncoder) pack(v interface{}) ([]byte, error) {
+	object, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(object))
+	decoder.UseNumber()
+	var value interface{}
+	err = decoder.Decode(&value)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	err = packMsgpack(&buf, value)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// packMsgpack appends the MessagePack encoding of a decoded JSON value to buf. Map keys are sorted so
+// that the same connection is always packed the same way.
+func packMsgpack(buf *bytes.Buffer, value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if v {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case json.Number:
+		packMsgpackNumber(buf, v)
+	case string:
+		packMsgpackLength(buf, len(v), 0xa0, 31, 0xd9, 0xda, 0xdb)
+		buf.WriteString(v)
+	case []interface{}:
+		packMsgpackLength(buf, len(v), 0x90, 15, 0, 0xdc, 0xdd)
+		for _, item := range v {
+			err := packMsgpack(buf, item)
+			if err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		packMsgpackLength(buf, len(v), 0x80, 15, 0, 0xde, 0xdf)
+		for _, key := range keys {
+			packMsgpack(buf, key)
+			err := packMsgpack(buf, v[key])
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unable to encode %T as msgpack", value)
+	}
+	return nil
+}
+
+// packMsgpackNumber packs a JSON number as the smallest fitting integer, or as a float64 if it is not
+// an integer.
+func packMsgpackNumber(buf *bytes.Buffer, n json.Number) {
+	if i, err := strconv.ParseInt(n.String(), 10, 64); err == nil {
+		switch {
+		case i >= 0 && i <= 127, i < 0 && i >= -32:
+			buf.WriteByte(byte(i))
+		case i >= math.MinInt8 && i <= math.MaxInt8:
+			buf.WriteByte(0xd0)
+			buf.WriteByte(byte(i))
+		case i >= math.MinInt16 && i <= math.MaxInt16:
+			buf.WriteByte(0xd1)
+			binary.Write(buf, binary.BigEndian, int16(i))
+		case i >= math.MinInt32 && i <= math.MaxInt32:
+			buf.WriteByte(0xd2)
+			binary.Write(buf, binary.BigEndian, int32(i))
+		default:
+			buf.WriteByte(0xd3)
+			binary.Write(buf, binary.BigEndian, i)
+		}
+		return
+	}
+	if u, err := strconv.ParseUint(n.String(), 10, 64); err == nil {
+		buf.WriteByte(0xcf)
+		binary.Write(buf, binary.BigEndian, u)
+		return
+	}
+	f, _ := n.Float64()
+	buf.WriteByte(0xcb)
+	binary.Write(buf, binary.BigEndian, f)
+}
+
+// packMsgpackLength packs the type and length of a string, array, or map. Lengths up to fixMax fit
+// in the fix type, and the 8, 16, and 32 bit types are used for longer ones. Arrays and maps have no
+// 8 bit type, which is passed as 0.
+func packMsgpackLength(buf *bytes.Buffer, n int, fix byte, fixMax int, t8, t16, t32 byte) {
+	switch {
+	case n <= fixMax:
+		buf.WriteByte(fix | byte(n))
+	case t8 != 0 && n <= math.MaxUint8:
+		buf.WriteByte(t8)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(t16)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(t32)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
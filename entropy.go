@@ -0,0 +1,72 @@
+package gourmet
+
+import "math"
+
+// byteHistogram counts the byte values of a payload as it is reassembled, so that its Shannon
+// entropy can be computed without keeping the payload. Entropy is in bits per byte, from 0 for a
+// payload of a single repeated byte to 8 for uniformly random data, and encrypted or compressed
+// payloads come close to 8. Only the first limit bytes are counted, or all of them if limit is 0. A
+// nil byteHistogram counts nothing.
+type byteHistogram struct {
+	counts [256]uint64
+	total  uint64
+	limit  uint64
+}
+
+// newByteHistogram returns nil if payload entropy is disabled.
+func newByteHistogram(enabled bool, limit int) *byteHistogram {
+	if !enabled {
+		return nil
+	}
+	if limit < 0 {
+		limit = 0
+	}
+	return &byteHistogram{limit: uint64(limit)}
+}
+
+func (bh *byteHistogram) add(data []byte) {
+	if bh == nil {
+		return
+	}
+	if bh.limit > 0 {
+		if bh.total >= bh.limit {
+			return
+		}
+		if remaining := bh.limit - bh.total; uint64(len(data)) > remaining {
+			data = data[:remaining]
+		}
+	}
+	for _, b := range data {
+		bh.counts[b]++
+	}
+	bh.total += uint64(len(data))
+}
+
+// full reports whether the histogram has counted as many bytes as it will.
+func (bh *byteHistogram) full() bool {
+	return bh == nil || (bh.limit > 0 && bh.total >= bh.limit)
+}
+
+// entropy returns the Shannon entropy of the counted bytes, or 0 if nothing was counted.
+func (bh *byteHistogram) entropy() float64 {
+	if bh == nil || bh.total == 0 {
+		return 0
+	}
+	var entropy float64
+	total := float64(bh.total)
+	for _, count := range bh.counts {
+		if count == 0 {
+			continue
+		}
+		p := float64(count) / total
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
+
+// payloadEntropy returns the entropy of a payload that is available in full, such as a UDP datagram.
+func payloadEntropy(limit int, payload []byte) float64 {
+	bh := newByteHistogram(true, limit)
+	bh.add(payload)
+	return bh.entropy()
+}
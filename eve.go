@@ -0,0 +1,404 @@
+package gourmet
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// eveTimeFormat is the format of the timestamps of Suricata
+	eveTimeFormat = "2006-01-02T15:04:05.000000-0700"
+	// eveFlowIDMask keeps flow IDs within the integers that JSON consumers read exactly, as Suricata
+	// does
+	eveFlowIDMask = 0x0000ffffffffffff
+)
+
+// eveOutput writes connections as events of the EVE JSON format of Suricata to a file, one event per
+// line, so that pipelines built to ingest EVE can read them. Every connection is written as a flow
+// event, and the results of the built-in DNS, HTTP, and TLS analyzers as dns, http, and tls events,
+// along with a fileinfo event per extracted file. The events of a connection share its flow_id, which
+// is derived from its UID. Preliminary records are not written, as Suricata logs a flow once.
+type eveOutput struct {
+	mutex sync.Mutex
+	file  *os.File
+}
+
+// eveEvent holds the fields common to every EVE event, and the section of its event type
+type eveEvent struct {
+	Timestamp   string       `json:"timestamp"`
+	FlowID      uint64       `json:"flow_id"`
+	CommunityID string       `json:"community_id,omitempty"`
+	InIface     string       `json:"in_iface,omitempty"`
+	VLAN        []int        `json:"vlan,omitempty"`
+	EventType   string       `json:"event_type"`
+	SrcIP       string       `json:"src_ip"`
+	SrcPort     int          `json:"src_port,omitempty"`
+	DestIP      string       `json:"dest_ip"`
+	DestPort    int          `json:"dest_port,omitempty"`
+	Proto       string       `json:"proto"`
+	AppProto    string       `json:"app_proto,omitempty"`
+	TxID        *int         `json:"tx_id,omitempty"`
+	Flow        *eveFlow     `json:"flow,omitempty"`
+	TCP         *eveTCP      `json:"tcp,omitempty"`
+	DNS         *eveDNS      `json:"dns,omitempty"`
+	HTTP        *eveHTTP     `json:"http,omitempty"`
+	TLS         *eveTLS      `json:"tls,omitempty"`
+	SSH         *eveSSH      `json:"ssh,omitempty"`
+	FileInfo    *eveFileInfo `json:"fileinfo,omitempty"`
+}
+
+type eveFlow struct {
+	PktsToServer  uint64 `json:"pkts_toserver"`
+	PktsToClient  uint64 `json:"pkts_toclient"`
+	BytesToServer uint64 `json:"bytes_toserver"`
+	BytesToClient uint64 `json:"bytes_toclient"`
+	Start         string `json:"start"`
+	End           string `json:"end"`
+	Age           int64  `json:"age"`
+	State         string `json:"state"`
+	Alerted       bool   `json:"alerted"`
+}
+
+type eveTCP struct {
+	TCPFlags string `json:"tcp_flags"`
+	SYN      bool   `json:"syn,omitempty"`
+	FIN      bool   `json:"fin,omitempty"`
+	RST      bool   `json:"rst,omitempty"`
+	PSH      bool   `json:"psh,omitempty"`
+	ACK      bool   `json:"ack,omitempty"`
+	URG      bool   `json:"urg,omitempty"`
+	ECN      bool   `json:"ecn,omitempty"`
+	CWR      bool   `json:"cwr,omitempty"`
+	State    string `json:"state,omitempty"`
+}
+
+type eveDNS struct {
+	Version int                 `json:"version,omitempty"`
+	Type    string              `json:"type"`
+	ID      uint16              `json:"id"`
+	RRName  string              `json:"rrname,omitempty"`
+	RRType  string              `json:"rrtype,omitempty"`
+	RCode   string              `json:"rcode,omitempty"`
+	Answers []eveDNSAnswer      `json:"answers,omitempty"`
+	Grouped map[string][]string `json:"grouped,omitempty"`
+}
+
+type eveDNSAnswer struct {
+	RRName string `json:"rrname"`
+	RRType string `json:"rrtype"`
+	TTL    uint32 `json:"ttl"`
+	RData  string `json:"rdata,omitempty"`
+}
+
+type eveHTTP struct {
+	Hostname        string `json:"hostname,omitempty"`
+	URL             string `json:"url"`
+	HTTPUserAgent   string `json:"http_user_agent,omitempty"`
+	HTTPContentType string `json:"http_content_type,omitempty"`
+	HTTPMethod      string `json:"http_method"`
+	Protocol        string `json:"protocol"`
+	Status          int    `json:"status,omitempty"`
+	Length          int64  `json:"length"`
+}
+
+type eveTLS struct {
+	Subject   string  `json:"subject,omitempty"`
+	IssuerDN  string  `json:"issuerdn,omitempty"`
+	SNI       string  `json:"sni,omitempty"`
+	Version   string  `json:"version,omitempty"`
+	NotBefore string  `json:"notbefore,omitempty"`
+	NotAfter  string  `json:"notafter,omitempty"`
+	JA3       *eveJA3 `json:"ja3,omitempty"`
+	JA3S      *eveJA3 `json:"ja3s,omitempty"`
+}
+
+type eveJA3 struct {
+	Hash   string `json:"hash"`
+	String string `json:"string"`
+}
+
+type eveSSH struct {
+	Client *eveSSHHost `json:"client,omitempty"`
+	Server *eveSSHHost `json:"server,omitempty"`
+}
+
+type eveSSHHost struct {
+	ProtoVersion    string  `json:"proto_version"`
+	SoftwareVersion string  `json:"software_version"`
+	HASSH           *eveJA3 `json:"hassh,omitempty"`
+}
+
+type eveFileInfo struct {
+	Filename string `json:"filename"`
+	Magic    string `json:"magic,omitempty"`
+	SHA256   string `json:"sha256"`
+	Size     int64  `json:"size"`
+	Stored   bool   `json:"stored"`
+	State    string `json:"state"`
+}
+
+func newEVEOutput(args map[string]interface{}) (*eveOutput, error) {
+	path, err := outputString(args, "file", "eve.json")
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &eveOutput{file: f}, nil
+}
+
+func (eo *eveOutput) Write(c *Connection) error {
+	if c.Preliminary {
+		return nil
+	}
+	var lines []byte
+	for _, event := range eveEvents(c) {
+		line, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		lines = append(append(lines, line...), '\n')
+	}
+	eo.mutex.Lock()
+	defer eo.mutex.Unlock()
+	_, err := eo.file.Write(lines)
+	return err
+}
+
+func (eo *eveOutput) Close() error {
+	eo.mutex.Lock()
+	defer eo.mutex.Unlock()
+	return eo.file.Close()
+}
+
+// eveEvents returns the events of a connection: its application events, then its flow event, as
+// Suricata logs a flow once it ended.
+func eveEvents(c *Connection) []*eveEvent {
+	var events []*eveEvent
+	newEvent := func(eventType string) *eveEvent {
+		return &eveEvent{
+			Timestamp:   c.Timestamp.Format(eveTimeFormat),
+			FlowID:      c.uid & eveFlowIDMask,
+			CommunityID: c.CommunityID,
+			InIface:     c.Interface,
+			VLAN:        c.VLANs,
+			EventType:   eventType,
+			SrcIP:       c.SourceIP,
+			SrcPort:     c.SourcePort,
+			DestIP:      c.DestinationIP,
+			DestPort:    c.DestinationPort,
+			Proto:       eveProto(c.TransportType),
+			AppProto:    eveAppProto(c),
+		}
+	}
+	if dns, ok := findResult(c, dnsAnalyzerName).(*DNSResult); ok {
+		for i, t := range dns.Transactions {
+			query := newEvent("dns")
+			query.TxID = eveTxID(i)
+			query.DNS = &eveDNS{Type: "query", ID: t.ID, RRName: t.Query, RRType: t.QueryType}
+			events = append(events, query)
+			if t.Responded {
+				answer := newEvent("dns")
+				answer.TxID = eveTxID(i)
+				answer.DNS = eveDNSAnswers(t)
+				events = append(events, answer)
+			}
+		}
+	}
+	if http, ok := findResult(c, httpAnalyzerName).(*HTTPResult); ok {
+		for i, t := range http.Transactions {
+			event := newEvent("http")
+			event.TxID = eveTxID(i)
+			event.HTTP = &eveHTTP{
+				Hostname:        t.Host,
+				URL:             t.URI,
+				HTTPUserAgent:   t.UserAgent,
+				HTTPContentType: t.ContentType,
+				HTTPMethod:      t.Method,
+				Protocol:        t.Version,
+				Status:          t.StatusCode,
+				Length:          t.ResponseBodyLength,
+			}
+			events = append(events, event)
+		}
+	}
+	if tls, ok := findResult(c, tlsAnalyzerName).(*TLSResult); ok {
+		event := newEvent("tls")
+		event.TLS = &eveTLS{
+			Subject:  tls.Subject,
+			IssuerDN: tls.Issuer,
+			SNI:      tls.ServerName,
+			Version:  eveTLSVersion(tls.Version),
+		}
+		if tls.NotBefore != nil {
+			event.TLS.NotBefore = tls.NotBefore.UTC().Format("2006-01-02T15:04:05")
+		}
+		if tls.NotAfter != nil {
+			event.TLS.NotAfter = tls.NotAfter.UTC().Format("2006-01-02T15:04:05")
+		}
+		if tls.JA3 != "" {
+			event.TLS.JA3 = &eveJA3{Hash: tls.JA3, String: tls.JA3String}
+		}
+		if tls.JA3S != "" {
+			event.TLS.JA3S = &eveJA3{Hash: tls.JA3S, String: tls.JA3SString}
+		}
+		events = append(events, event)
+	}
+	if ssh, ok := findResult(c, sshAnalyzerName).(*SSHResult); ok {
+		event := newEvent("ssh")
+		event.SSH = &eveSSH{
+			Client: eveSSHBanner(ssh.Client, ssh.HASSH, ssh.HASSHString),
+			Server: eveSSHBanner(ssh.Server, ssh.HASSHServer, ssh.HASSHServerString),
+		}
+		events = append(events, event)
+	}
+	for _, f := range c.Files {
+		event := newEvent("fileinfo")
+		state := "CLOSED"
+		if f.Truncated {
+			state = "TRUNCATED"
+		}
+		event.FileInfo = &eveFileInfo{
+			Filename: f.Name,
+			Magic:    f.MIMEType,
+			SHA256:   f.SHA256,
+			Size:     f.Size,
+			Stored:   true,
+			State:    state,
+		}
+		events = append(events, event)
+	}
+	return append(events, eveFlowEvent(newEvent("flow"), c))
+}
+
+func eveFlowEvent(event *eveEvent, c *Connection) *eveEvent {
+	duration := time.Duration(c.Duration * float64(time.Second))
+	event.Flow = &eveFlow{
+		PktsToServer:  c.OrigPackets,
+		PktsToClient:  c.RespPackets,
+		BytesToServer: c.OrigBytes,
+		BytesToClient: c.RespBytes,
+		Start:         c.Timestamp.Format(eveTimeFormat),
+		End:           c.Timestamp.Add(duration).Format(eveTimeFormat),
+		Age:           int64(duration / time.Second),
+		State:         eveFlowState(c),
+	}
+	if c.TransportType == "tcp" {
+		event.TCP = &eveTCP{
+			TCPFlags: fmt.Sprintf("%02x", c.tcpFlags),
+			FIN:      c.tcpFlags&(1<<0) != 0,
+			SYN:      c.tcpFlags&(1<<1) != 0,
+			RST:      c.tcpFlags&(1<<2) != 0,
+			PSH:      c.tcpFlags&(1<<3) != 0,
+			ACK:      c.tcpFlags&(1<<4) != 0,
+			URG:      c.tcpFlags&(1<<5) != 0,
+			ECN:      c.tcpFlags&(1<<6) != 0,
+			CWR:      c.tcpFlags&(1<<7) != 0,
+			State:    eveTCPState(c.State),
+		}
+	}
+	return event
+}
+
+func eveDNSAnswers(t *DNSTransaction) *eveDNS {
+	dns := &eveDNS{
+		Version: 2,
+		Type:    "answer",
+		ID:      t.ID,
+		RRName:  t.Query,
+		RRType:  t.QueryType,
+		RCode:   t.RCode,
+	}
+	for _, a := range t.Answers {
+		dns.Answers = append(dns.Answers, eveDNSAnswer{RRName: a.Name, RRType: a.Type, TTL: a.TTL, RData: a.Data})
+		if a.Data != "" {
+			if dns.Grouped == nil {
+				dns.Grouped = make(map[string][]string)
+			}
+			dns.Grouped[a.Type] = append(dns.Grouped[a.Type], a.Data)
+		}
+	}
+	return dns
+}
+
+func eveTxID(i int) *int {
+	return &i
+}
+
+// eveSSHBanner splits an SSH identification line into its protocol and software versions, or
+// returns nil if the side was not seen.
+func eveSSHBanner(banner, hassh, hasshString string) *eveSSHHost {
+	fields := strings.SplitN(banner, "-", 3)
+	if len(fields) < 3 {
+		return nil
+	}
+	host := &eveSSHHost{ProtoVersion: fields[1], SoftwareVersion: strings.SplitN(fields[2], " ", 2)[0]}
+	if hassh != "" {
+		host.HASSH = &eveJA3{Hash: hassh, String: hasshString}
+	}
+	return host
+}
+
+func eveProto(transport string) string {
+	switch transport {
+	case icmpv6Transport:
+		return "IPv6-ICMP"
+	}
+	return strings.ToUpper(transport)
+}
+
+// eveAppProto returns the application protocol of the connection, from the results of the built-in
+// analyzers, or from its service.
+func eveAppProto(c *Connection) string {
+	for _, name := range []string{httpAnalyzerName, tlsAnalyzerName, sshAnalyzerName, dnsAnalyzerName} {
+		if findResult(c, name) != nil {
+			return name
+		}
+	}
+	return c.Service
+}
+
+// eveFlowState returns new for flows that were not answered, closed for TCP connections that were
+// closed or reset, and established otherwise.
+func eveFlowState(c *Connection) string {
+	switch {
+	case c.State == TCPStateClosed || c.State == TCPStateReset:
+		return "closed"
+	case c.State == TCPStateSynSent || c.State == TCPStateSynReceived:
+		return "new"
+	case c.TransportType != "tcp" && c.RespPackets == 0:
+		return "new"
+	}
+	return "established"
+}
+
+func eveTCPState(state string) string {
+	switch state {
+	case TCPStateSynSent:
+		return "syn_sent"
+	case TCPStateSynReceived:
+		return "syn_recv"
+	case TCPStateEstablished:
+		return "established"
+	case TCPStateFinWait:
+		return "fin_wait1"
+	case TCPStateClosed, TCPStateReset:
+		return "closed"
+	}
+	return ""
+}
+
+// eveTLSVersion returns a version of the TLS analyzer, such as TLSv12, as Suricata writes it, such as
+// TLS 1.2.
+func eveTLSVersion(version string) string {
+	if strings.HasPrefix(version, "TLSv1") && len(version) == 6 {
+		return "TLS 1." + version[5:]
+	}
+	return version
+}
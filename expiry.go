@@ -0,0 +1,288 @@
+package gourmet
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+)
+
+// flowSweepInterval is how often idle flows and half-open TCP streams are expired
+const flowSweepInterval = time.Second
+
+// tcpTimeouts returns the idle timeouts of established and half-open TCP streams. The established
+// timeout defaults to the connection timeout, and the half-open timeout to the established one.
+func tcpTimeouts(config *Config) (established, halfOpen time.Duration) {
+	established = time.Second * time.Duration(config.ConnTimeout)
+	if config.TCPEstablishedTimeout > 0 {
+		established = time.Second * time.Duration(config.TCPEstablishedTimeout)
+	}
+	halfOpen = established
+	if config.TCPHalfOpenTimeout > 0 {
+		halfOpen = time.Second * time.Duration(config.TCPHalfOpenTimeout)
+	}
+	return established, halfOpen
+}
+
+// flowTable groups the UDP datagrams of a flow, and the ICMP and ICMPv6 messages of an exchange when
+// they are tracked, into one Connection per flow rather than one per datagram. A datagram belongs to the
+// flow of its 5-tuple in either direction, so the sender of the first datagram of a flow is its
+// client. A flow is expired and logged once it has been idle for the timeout of its transport. The
+// datagrams of a transport without a timeout are not held in the table, and each of them is logged
+// on its own.
+type flowTable struct {
+	mutex          sync.Mutex
+	flows          map[string]*datagramFlow
+	udpTimeout     time.Duration
+	icmpTimeout    time.Duration
+	spillThreshold int
+	spillDir       string
+	payloadEntropy bool
+	entropyBytes   int
+	budget         *memoryBudget
+	limit          *connectionLimit
+	// open is the number of flows in the table, each of which is held under two keys
+	open int
+	emit func(*Connection)
+	// now is the clock that idle flows are measured against
+	now func() time.Time
+}
+
+type datagramFlow struct {
+	connection     *Connection
+	keys           [2]string
+	timeout        time.Duration
+	lastSeen       time.Time
+	payload        *payloadBuffer
+	client, server directionPayload
+	entropy        *byteHistogram
+	origPkts       uint64
+	respPkts       uint64
+	// set when a datagram was truncated, or its payload was discarded to stay within the memory
+	// budget
+	incomplete bool
+}
+
+// newFlowTable returns nil if neither UDP nor ICMP has a timeout, which logs every datagram on its
+// own.
+func newFlowTable(config *Config, budget *memoryBudget, limit *connectionLimit, emit func(*Connection), now func() time.Time) *flowTable {
+	if config.UDPTimeout <= 0 && config.ICMPTimeout <= 0 {
+		return nil
+	}
+	return &flowTable{
+		flows:          make(map[string]*datagramFlow),
+		udpTimeout:     time.Second * time.Duration(config.UDPTimeout),
+		icmpTimeout:    time.Second * time.Duration(config.ICMPTimeout),
+		spillThreshold: config.PayloadSpillThreshold,
+		spillDir:       config.PayloadSpillDir,
+		payloadEntropy: config.PayloadEntropy,
+		entropyBytes:   config.EntropyBytes,
+		budget:         budget,
+		limit:          limit,
+		emit:           emit,
+		now:            now,
+	}
+}
+
+func (ft *flowTable) timeout(transport string) time.Duration {
+	if ft == nil {
+		return 0
+	}
+	if isICMP(transport) {
+		return ft.icmpTimeout
+	}
+	return ft.udpTimeout
+}
+
+// flowKeys returns the key of the flow of a datagram within its zone, and the key of the same flow
+// in the opposite direction.
+func flowKeys(c *Connection) (forward, reverse string) {
+	forward = fmt.Sprintf("%s|%s|%d|%s|%d", c.TransportType, c.SourceIP, c.SourcePort, c.DestinationIP, c.DestinationPort)
+	if isICMP(c.TransportType) {
+		// the type of an ICMP message is its source port, and a reply has a type of its own. Echo
+		// messages are also keyed by their identifier, so each ping is a flow of its own.
+		forward = fmt.Sprintf("%s|%d", forward, c.icmpID)
+		reverse = fmt.Sprintf("%s|%s|%d|%s|%d|%d", c.TransportType, c.DestinationIP, icmpCounterpart(c.TransportType, c.SourcePort), c.SourceIP, c.DestinationPort, c.icmpID)
+	} else {
+		reverse = fmt.Sprintf("%s|%s|%d|%s|%d", c.TransportType, c.DestinationIP, c.DestinationPort, c.SourceIP, c.SourcePort)
+	}
+	if zone := zoneOf(c.VLANs, c.Tunnel); zone != "" {
+		forward, reverse = zone+"|"+forward, zone+"|"+reverse
+	}
+	return forward, reverse
+}
+
+// add adds the datagram that a connection was created for to its flow. It returns false if the
+// transport of the datagram is not held in the table, and otherwise whether the datagram started a
+// new flow. A new flow is dropped instead while memory is critical, and evicts other flows when the
+// table is full.
+func (ft *flowTable) add(c *Connection, data []byte, ci gopacket.CaptureInfo) (tracked, started bool) {
+	timeout := ft.timeout(c.TransportType)
+	if timeout <= 0 {
+		return false, false
+	}
+	forward, reverse := flowKeys(c)
+	var evicted []*Connection
+	// evicted flows are emitted once the mutex is released
+	defer func() {
+		for _, e := range evicted {
+			ft.emit(e)
+		}
+	}()
+	ft.mutex.Lock()
+	defer ft.mutex.Unlock()
+	flow, fromClient := ft.flows[forward], true
+	if flow == nil {
+		flow, fromClient = ft.flows[reverse], false
+	}
+	if flow == nil {
+		if ft.budget.shedFlow(c) {
+			return true, false
+		}
+		flow = ft.newFlow(c, forward, reverse, timeout)
+		fromClient, started = true, true
+	}
+	flow.update(c, data, ci, fromClient, ft.budget)
+	flow.lastSeen = ft.now()
+	if started {
+		evicted = ft.evictFlows()
+	}
+	return true, started
+}
+
+func (ft *flowTable) newFlow(c *Connection, forward, reverse string, timeout time.Duration) *datagramFlow {
+	flow := &datagramFlow{
+		connection: c,
+		keys:       [2]string{forward, reverse},
+		timeout:    timeout,
+		payload:    newPayloadBuffer(ft.spillThreshold, ft.spillDir),
+		entropy:    newByteHistogram(ft.payloadEntropy, ft.entropyBytes),
+	}
+	flow.client.stream = flow.payload
+	flow.server.stream = flow.payload
+	ft.flows[forward] = flow
+	ft.flows[reverse] = flow
+	ft.open++
+	return flow
+}
+
+// size returns the number of flows in the table.
+func (ft *flowTable) size() int {
+	ft.mutex.Lock()
+	defer ft.mutex.Unlock()
+	return ft.open
+}
+
+// remove takes a flow out of the table and completes its connection. It must be called with the
+// mutex of the table held.
+func (ft *flowTable) remove(flow *datagramFlow) *Connection {
+	delete(ft.flows, flow.keys[0])
+	delete(ft.flows, flow.keys[1])
+	ft.open--
+	return flow.finish()
+}
+
+func (flow *datagramFlow) update(d *Connection, data []byte, ci gopacket.CaptureInfo, fromClient bool, budget *memoryBudget) {
+	c := flow.connection
+	if ci.Timestamp.Before(c.Timestamp) {
+		c.Duration += c.Timestamp.Sub(ci.Timestamp).Seconds()
+		c.Timestamp = ci.Timestamp
+	}
+	if duration := ci.Timestamp.Sub(c.Timestamp).Seconds(); duration > c.Duration {
+		c.Duration = duration
+	}
+	// the counters of the first datagram are already those of the flow
+	if d != c {
+		c.transportBytes += d.transportBytes
+		c.transportPackets += d.transportPackets
+		if fromClient {
+			c.OrigBytes += d.transportBytes
+			c.OrigPackets++
+		} else {
+			c.RespBytes += d.transportBytes
+			c.RespPackets++
+		}
+		if c.ICMP != nil {
+			c.ICMP.addMessage(len(data), fromClient)
+		}
+	}
+	if fromClient {
+		flow.origPkts++
+	} else {
+		flow.respPkts++
+	}
+	if !d.PayloadComplete {
+		flow.incomplete = true
+	}
+	if d.snapTruncated {
+		c.snapTruncated = true
+	}
+	if len(data) == 0 {
+		return
+	}
+	if !flow.entropy.full() {
+		flow.entropy.add(data)
+	}
+	if budget.shedPayload(len(data)) {
+		flow.incomplete = true
+		return
+	}
+	offset := flow.payload.Len()
+	n, _ := flow.payload.Write(data)
+	if fromClient {
+		flow.client.add(offset, n)
+	} else {
+		flow.server.add(offset, n)
+	}
+}
+
+// finish completes the connection of a flow that is leaving the table.
+func (flow *datagramFlow) finish() *Connection {
+	c := flow.connection
+	c.Payload = flow.payload
+	c.ClientPayload = &flow.client
+	c.ServerPayload = &flow.server
+	c.PayloadComplete = !flow.incomplete
+	c.Asymmetric = flow.origPkts == 0 || flow.respPkts == 0
+	c.PayloadEntropy = flow.entropy.entropy()
+	return c
+}
+
+// flush emits the flows that have been idle for longer than the timeout of their transport at now,
+// or all of them if now is zero.
+func (ft *flowTable) flush(now time.Time) {
+	var idle []*Connection
+	ft.mutex.Lock()
+	for key, flow := range ft.flows {
+		if key != flow.keys[0] || (!now.IsZero() && now.Sub(flow.lastSeen) < flow.timeout) {
+			continue
+		}
+		idle = append(idle, ft.remove(flow))
+	}
+	ft.mutex.Unlock()
+	for _, c := range idle {
+		ft.emit(c)
+	}
+}
+
+// sweepFlows expires idle UDP and ICMP flows and half-open TCP streams until quit is closed.
+// Established TCP streams are expired by the capture loop, which flushes the assembler.
+func (s *sensor) sweepFlows(quit <-chan struct{}) {
+	ticker := time.NewTicker(flowSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+		}
+		now := s.now()
+		if s.flows != nil {
+			s.flows.flush(now)
+		}
+		if s.streamFactory.halfOpenTimeout < s.streamFactory.establishedTimeout {
+			s.streamFactory.expireHalfOpen(now.Add(-s.streamFactory.halfOpenTimeout))
+		}
+	}
+}
@@ -0,0 +1,312 @@
+package gourmet
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// Protocols that files are extracted from
+const (
+	extractHTTP = "http"
+	extractFTP  = "ftp"
+	extractSMB  = "smb"
+)
+
+// ExtractedFile is a file that was transferred over a connection and written to the extract_dir. It
+// is stored under its SHA-256 checksum, so a file transferred several times is stored once. Name is
+// the name the file was transferred under, if the protocol gave one, and MIMEType is detected from
+// its content. Upload is set for files sent by the client. Truncated is set when the file was larger
+// than extract_max_bytes, or not every part of it was captured, in which case the checksum is that of
+// the part that was stored.
+type ExtractedFile struct {
+	Protocol  string
+	Name      string `json:",omitempty"`
+	MIMEType  string `json:",omitempty"`
+	Size      int64
+	SHA256    string
+	Path      string
+	Upload    bool `json:",omitempty"`
+	Truncated bool `json:",omitempty"`
+}
+
+// fileExtractor carves the files transferred over the connections of the sensor once they closed:
+// the bodies of HTTP requests and responses, the data connections of FTP, and the files read and
+// written over SMB2. Files are extracted on the analyzer workers, before the connection is analyzed,
+// so analyzers can read them from the paths in Connection.Files.
+type fileExtractor struct {
+	dir      string
+	maxBytes int64
+	// maxTotal bounds the bytes stored in dir, and stored counts them, along with the files that were
+	// already there when the sensor started
+	maxTotal  int64
+	stored    int64
+	full      int32
+	protocols map[string]bool
+	mimeTypes map[string]bool
+	// ftp holds the data connections announced on FTP control connections, and is nil unless files
+	// are extracted from FTP
+	ftp *ftpExpectations
+}
+
+func newFileExtractor(c *Config) (*fileExtractor, error) {
+	if c.ExtractDir == "" {
+		return nil, nil
+	}
+	err := os.MkdirAll(c.ExtractDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	fe := &fileExtractor{
+		dir:       c.ExtractDir,
+		maxBytes:  int64(c.ExtractMaxBytes),
+		maxTotal:  c.ExtractMaxTotalBytes,
+		protocols: make(map[string]bool),
+	}
+	fe.stored, err = storedBytes(c.ExtractDir)
+	if err != nil {
+		return nil, err
+	}
+	protocols := c.ExtractProtocols
+	if len(protocols) == 0 {
+		protocols = []string{extractHTTP, extractFTP, extractSMB}
+	}
+	for _, p := range protocols {
+		switch p {
+		case extractHTTP, extractFTP, extractSMB:
+			fe.protocols[p] = true
+		default:
+			return nil, fmt.Errorf("invalid extract_protocols %s. Must be http, ftp, or smb", p)
+		}
+	}
+	if len(c.ExtractMIMETypes) > 0 {
+		fe.mimeTypes = make(map[string]bool)
+		for _, t := range c.ExtractMIMETypes {
+			fe.mimeTypes[strings.ToLower(t)] = true
+		}
+	}
+	if fe.protocols[extractFTP] {
+		fe.ftp = newFTPExpectations()
+	}
+	return fe, nil
+}
+
+// storedBytes returns the size of the files in the extract_dir, leaving out the temporary files of
+// extractions that were cut short.
+func storedBytes(dir string) (int64, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, f := range files {
+		if f.Mode().IsRegular() && !strings.HasPrefix(f.Name(), ".extract-") {
+			total += f.Size()
+		}
+	}
+	return total, nil
+}
+
+// reserve counts size bytes against extract_max_total_bytes, and returns false if they do not fit.
+// The warning is logged once, as every later file would repeat it until files are removed from the
+// extract_dir and the sensor is restarted.
+func (fe *fileExtractor) reserve(size int64) bool {
+	for {
+		stored := atomic.LoadInt64(&fe.stored)
+		if stored+size > fe.maxTotal {
+			if atomic.CompareAndSwapInt32(&fe.full, 0, 1) {
+				log.Printf("[!] %s holds extract_max_total_bytes of files, new files are no longer stored", fe.dir)
+			}
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&fe.stored, stored, stored+size) {
+			return true
+		}
+	}
+}
+
+// extract stores the files transferred over a connection, and lists them in its Files. Preliminary
+// records are skipped, as their payload is partial.
+func (fe *fileExtractor) extract(c *Connection) {
+	if c.Preliminary || c.TransportType != "tcp" {
+		return
+	}
+	var err error
+	var expected *ftpExpectation
+	isFTPData := false
+	if fe.ftp != nil {
+		expected, isFTPData = fe.ftp.take(c)
+		isFTPData = isFTPData || c.Service == ftpDataService || c.SourcePort == ftpDataPort
+	}
+	switch {
+	case isFTPData:
+		err = fe.extractFTPData(c, expected)
+	case fe.protocols[extractSMB] && isSMB(c):
+		err = fe.extractSMB(c)
+	case fe.protocols[extractHTTP] && (&httpAnalyzer{}).Filter(c):
+		err = fe.extractHTTP(c)
+	}
+	if err != nil {
+		log.Printf("[!] Failed to extract files from connection %s: %s", c.UID, err)
+	}
+}
+
+// extractHTTP stores the bodies of the requests and responses of an HTTP/1.x connection. Response
+// bodies compressed with gzip are decompressed.
+func (fe *fileExtractor) extractHTTP(c *Connection) error {
+	var requests []*http.Request
+	client := bufio.NewReader(c.ClientPayload.Reader())
+	for len(requests) < httpMaxTransactions {
+		req, err := http.ReadRequest(client)
+		if err != nil {
+			break
+		}
+		requests = append(requests, req)
+		file := &ExtractedFile{Protocol: extractHTTP, Name: httpFileName(req.URL.Path, req.Header), Upload: true}
+		err = fe.saveBody(c, file, req.Body, "")
+		if err != nil {
+			return err
+		}
+	}
+	if len(requests) == 0 || c.ServerPayload == nil {
+		return nil
+	}
+	server := bufio.NewReader(c.ServerPayload.Reader())
+	for _, req := range requests {
+		resp, err := readHTTPResponse(server, req)
+		if err != nil {
+			break
+		}
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			break
+		}
+		file := &ExtractedFile{Protocol: extractHTTP, Name: httpFileName(req.URL.Path, resp.Header)}
+		err = fe.saveBody(c, file, resp.Body, resp.Header.Get("Content-Encoding"))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saveBody stores an HTTP body, and reads it to its end so that the next message can be read.
+func (fe *fileExtractor) saveBody(c *Connection, file *ExtractedFile, body io.ReadCloser, encoding string) error {
+	defer io.Copy(ioutil.Discard, body)
+	var r io.Reader = body
+	if encoding == "gzip" || encoding == "x-gzip" {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return nil
+		}
+		r = gz
+	}
+	return fe.save(c, file, r)
+}
+
+// httpFileName returns the name of a file transferred over HTTP, from the Content-Disposition header
+// of the message if it has one, and from the last element of the path of the request otherwise.
+func httpFileName(urlPath string, header http.Header) string {
+	if _, params, err := mime.ParseMediaType(header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		return path.Base(params["filename"])
+	}
+	name := path.Base(urlPath)
+	if name == "/" || name == "." {
+		return ""
+	}
+	return name
+}
+
+// save copies a file of the connection into a temporary file of the extract_dir, up to
+// extract_max_bytes, and stores it. Empty files are not stored.
+func (fe *fileExtractor) save(c *Connection, file *ExtractedFile, r io.Reader) error {
+	tmp, err := ioutil.TempFile(fe.dir, ".extract-")
+	if err != nil {
+		return err
+	}
+	if fe.maxBytes > 0 {
+		r = io.LimitReader(r, fe.maxBytes+1)
+	}
+	n, err := io.Copy(tmp, r)
+	if err != nil {
+		// the file ended before its announced length, because the payload is incomplete
+		file.Truncated = true
+	}
+	if fe.maxBytes > 0 && n > fe.maxBytes {
+		file.Truncated = true
+		err = tmp.Truncate(fe.maxBytes)
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return err
+		}
+	}
+	return fe.store(c, file, tmp)
+}
+
+// store names a temporary file of the extract_dir after its checksum and adds it to the Files of the
+// connection, unless it is empty, its MIME type is not one of extract_mime_types, or the
+// extract_dir is full. The temporary file is closed, and removed if it is not kept.
+func (fe *fileExtractor) store(c *Connection, file *ExtractedFile, tmp *os.File) error {
+	defer tmp.Close()
+	_, err := tmp.Seek(0, io.SeekStart)
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	head := make([]byte, sniffLen)
+	n, _ := io.ReadFull(tmp, head)
+	if n == 0 {
+		os.Remove(tmp.Name())
+		return nil
+	}
+	file.MIMEType = http.DetectContentType(head[:n])
+	if i := strings.Index(file.MIMEType, ";"); i >= 0 {
+		file.MIMEType = file.MIMEType[:i]
+	}
+	if fe.mimeTypes != nil && !fe.mimeTypes[file.MIMEType] {
+		os.Remove(tmp.Name())
+		return nil
+	}
+	_, err = tmp.Seek(0, io.SeekStart)
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	h := sha256.New()
+	file.Size, err = io.Copy(h, tmp)
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	file.SHA256 = hex.EncodeToString(h.Sum(nil))
+	file.Path = filepath.Join(fe.dir, file.SHA256)
+	if _, err := os.Stat(file.Path); err == nil {
+		// the same file was already stored
+		os.Remove(tmp.Name())
+	} else {
+		if !fe.reserve(file.Size) {
+			os.Remove(tmp.Name())
+			return nil
+		}
+		err = os.Rename(tmp.Name(), file.Path)
+		if err != nil {
+			atomic.AddInt64(&fe.stored, -file.Size)
+			os.Remove(tmp.Name())
+			return err
+		}
+	}
+	c.Files = append(c.Files, file)
+	return nil
+}
@@ -0,0 +1,204 @@
+package gourmet
+
+import (
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/reassembly"
+)
+
+const (
+	ftpControlPort = 21
+	ftpDataPort    = 20
+	ftpDataService = "ftp-data"
+	// ftpMaxLine bounds the line buffered per direction of a control connection
+	ftpMaxLine = 1024
+	// ftpExpectationTTL is how long an announced data connection is waited for
+	ftpExpectationTTL = 5 * time.Minute
+)
+
+var (
+	// ftpHostPort matches the h1,h2,h3,h4,p1,p2 address of PORT commands and 227 replies
+	ftpHostPort = regexp.MustCompile(`(\d+),(\d+),(\d+),(\d+),(\d+),(\d+)`)
+	// ftpExtendedPort matches the (|||port|) of 229 replies
+	ftpExtendedPort = regexp.MustCompile(`\(\|\|\|(\d+)\|\)`)
+)
+
+// ftpExpectation is a data connection announced on an FTP control connection, with the file that the
+// command after the announcement transfers over it
+type ftpExpectation struct {
+	name    string
+	upload  bool
+	created time.Time
+}
+
+// ftpExpectations are the data connections announced on the FTP control connections, by the address
+// that the data connection is opened to. The control connection is still open when its data
+// connections close, so it is followed as it is reassembled, rather than once it is logged.
+type ftpExpectations struct {
+	mutex    sync.Mutex
+	expected map[string]*ftpExpectation
+}
+
+func newFTPExpectations() *ftpExpectations {
+	return &ftpExpectations{expected: make(map[string]*ftpExpectation)}
+}
+
+// expect records a data connection to the address, and drops the announcements that were not
+// followed by a connection in time.
+func (fx *ftpExpectations) expect(address string, now time.Time) *ftpExpectation {
+	fx.mutex.Lock()
+	defer fx.mutex.Unlock()
+	for key, e := range fx.expected {
+		if now.Sub(e.created) > ftpExpectationTTL {
+			delete(fx.expected, key)
+		}
+	}
+	e := &ftpExpectation{created: now}
+	fx.expected[address] = e
+	return e
+}
+
+// setFile names the file transferred over an announced data connection.
+func (fx *ftpExpectations) setFile(e *ftpExpectation, name string, upload bool) {
+	fx.mutex.Lock()
+	e.name = name
+	e.upload = upload
+	fx.mutex.Unlock()
+}
+
+// take returns and forgets the announcement of the data connection that c is, if any.
+func (fx *ftpExpectations) take(c *Connection) (*ftpExpectation, bool) {
+	address := net.JoinHostPort(normalizeIP(c.DestinationIP), strconv.Itoa(c.DestinationPort))
+	fx.mutex.Lock()
+	defer fx.mutex.Unlock()
+	e, ok := fx.expected[address]
+	if ok {
+		delete(fx.expected, address)
+	}
+	return e, ok
+}
+
+// ftpControl follows the commands and replies of an FTP control connection, to learn the data
+// connections it announces with PORT, EPRT, and the replies to PASV and EPSV, and the file that the
+// next RETR, STOR, APPE, or STOU transfers over them.
+type ftpControl struct {
+	expectations *ftpExpectations
+	serverIP     string
+	// serverDir is the direction in which the server sends its replies
+	serverDir reassembly.TCPFlowDirection
+	lines     [2][]byte
+	pending   *ftpExpectation
+}
+
+// newFTPControl returns a follower for the stream if it is an FTP control connection, or nil.
+func newFTPControl(fx *ftpExpectations, ts *tcpStream) *ftpControl {
+	srcIP, dstIP := processAddresses(ts.addresses)
+	srcPort, dstPort := processPorts(ts.transport)
+	switch {
+	case dstPort == ftpControlPort:
+		return &ftpControl{expectations: fx, serverIP: dstIP, serverDir: reassembly.TCPDirServerToClient}
+	case srcPort == ftpControlPort:
+		return &ftpControl{expectations: fx, serverIP: srcIP, serverDir: reassembly.TCPDirClientToServer}
+	}
+	return nil
+}
+
+// feed adds reassembled data of the control connection, and handles every line it completes.
+func (fc *ftpControl) feed(dir reassembly.TCPFlowDirection, data []byte, now time.Time) {
+	i := dirIndex(dir)
+	for _, b := range data {
+		if b != '\n' {
+			if len(fc.lines[i]) < ftpMaxLine {
+				fc.lines[i] = append(fc.lines[i], b)
+			}
+			continue
+		}
+		line := strings.TrimRight(string(fc.lines[i]), "\r")
+		fc.lines[i] = fc.lines[i][:0]
+		if dir == fc.serverDir {
+			fc.reply(line, now)
+		} else {
+			fc.command(line, now)
+		}
+	}
+}
+
+func (fc *ftpControl) reply(line string, now time.Time) {
+	switch {
+	case strings.HasPrefix(line, "227"):
+		if m := ftpHostPort.FindStringSubmatch(line); m != nil {
+			fc.pending = fc.expectations.expect(ftpAddress(m[1:]), now)
+		}
+	case strings.HasPrefix(line, "229"):
+		if m := ftpExtendedPort.FindStringSubmatch(line); m != nil {
+			fc.pending = fc.expectations.expect(net.JoinHostPort(normalizeIP(fc.serverIP), m[1]), now)
+		}
+	}
+}
+
+func (fc *ftpControl) command(line string, now time.Time) {
+	verb, arg := line, ""
+	if i := strings.IndexByte(line, ' '); i >= 0 {
+		verb, arg = line[:i], strings.TrimSpace(line[i+1:])
+	}
+	switch strings.ToUpper(verb) {
+	case "PORT":
+		if m := ftpHostPort.FindStringSubmatch(arg); m != nil {
+			fc.pending = fc.expectations.expect(ftpAddress(m[1:]), now)
+		}
+	case "EPRT":
+		// |protocol|address|port|, with any character as the delimiter
+		if len(arg) > 0 {
+			fields := strings.Split(arg, arg[:1])
+			if len(fields) >= 4 {
+				fc.pending = fc.expectations.expect(net.JoinHostPort(normalizeIP(fields[2]), fields[3]), now)
+			}
+		}
+	case "RETR":
+		fc.transfer(arg, false)
+	case "STOR", "APPE", "STOU":
+		fc.transfer(arg, true)
+	}
+}
+
+// transfer names the file of the data connection announced last.
+func (fc *ftpControl) transfer(name string, upload bool) {
+	if fc.pending == nil {
+		return
+	}
+	fc.expectations.setFile(fc.pending, name, upload)
+	fc.pending = nil
+}
+
+// ftpAddress returns the address of the six decimal fields of a PORT command or 227 reply.
+func ftpAddress(fields []string) string {
+	p1, _ := strconv.Atoi(fields[4])
+	p2, _ := strconv.Atoi(fields[5])
+	return net.JoinHostPort(normalizeIP(strings.Join(fields[:4], ".")), strconv.Itoa(p1*256+p2))
+}
+
+// extractFTPData stores the file transferred over an FTP data connection, which is all the data sent
+// by one side of it. The name is only known if the data connection was announced on a control
+// connection the sensor followed.
+func (fe *fileExtractor) extractFTPData(c *Connection, e *ftpExpectation) error {
+	file := &ExtractedFile{Protocol: extractFTP}
+	if e != nil {
+		fe.ftp.mutex.Lock()
+		file.Name, file.Upload = e.name, e.upload
+		fe.ftp.mutex.Unlock()
+	}
+	payload := c.ServerPayload
+	if c.ClientPayload != nil && (payload == nil || c.ClientPayload.Len() > payload.Len()) {
+		payload = c.ClientPayload
+	}
+	if payload == nil || payload.Len() == 0 {
+		return nil
+	}
+	file.Truncated = !c.PayloadComplete
+	return fe.save(c, file, payload.Reader())
+}
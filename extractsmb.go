@@ -0,0 +1,305 @@
+package gourmet
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"unicode/utf16"
+)
+
+const (
+	smbService          = "smb"
+	smbPort             = 445
+	smbNetBIOSPort      = 139
+	smb2HeaderLen       = 64
+	smb2FlagResponse    = 0x1
+	smb2StatusPending   = 0x103
+	smb2CommandCreate   = 0x5
+	smb2CommandRead     = 0x8
+	smb2CommandWrite    = 0x9
+	smbSessionMessage   = 0x0
+	smbMaxMessageLength = 1 << 24
+)
+
+var smb2Magic = []byte{0xfe, 'S', 'M', 'B'}
+
+// smb2FileID is the identifier of an open file of an SMB2 session
+type smb2FileID [16]byte
+
+// smb2RelatedFileID stands, in a compound request, for the file opened by the CREATE before it
+var smb2RelatedFileID = smb2FileID{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+func isSMB(c *Connection) bool {
+	return c.Service == smbService ||
+		c.DestinationPort == smbPort || c.SourcePort == smbPort ||
+		c.DestinationPort == smbNetBIOSPort || c.SourcePort == smbNetBIOSPort
+}
+
+// smb2Request is what the response to a request needs from it
+type smb2Request struct {
+	command uint16
+	name    string
+	fileID  smb2FileID
+	offset  int64
+}
+
+// smbFile is a file being rebuilt from the READ and WRITE messages of an SMB2 connection, in a
+// temporary file of the extract_dir. covered counts the bytes written, and end is the end of the
+// furthest one, so a file with less covered than its end has holes.
+type smbFile struct {
+	tmp       *os.File
+	upload    bool
+	covered   int64
+	end       int64
+	truncated bool
+}
+
+// smbExtraction rebuilds the files of an SMB2 connection. The requests sent by the client are read
+// first, then the responses of the server, which are paired with them by message ID. Files are named
+// by the CREATE that opened them, and their data is written at the offsets of the READ responses and
+// WRITE requests, so files read out of order or in parallel are put back together.
+type smbExtraction struct {
+	fe       *fileExtractor
+	requests map[uint64]*smb2Request
+	names    map[smb2FileID]string
+	files    map[smb2FileID]*smbFile
+	order    []smb2FileID
+	// lastCreated is the file opened by the latest CREATE response, for compound requests
+	lastCreated smb2FileID
+}
+
+// extractSMB stores the files read and written over an SMB2 connection, which is carried directly
+// over TCP or in NetBIOS session messages. SMB1 and encrypted SMB3 sessions are not extracted.
+func (fe *fileExtractor) extractSMB(c *Connection) error {
+	ex := &smbExtraction{
+		fe:       fe,
+		requests: make(map[uint64]*smb2Request),
+		names:    make(map[smb2FileID]string),
+		files:    make(map[smb2FileID]*smbFile),
+	}
+	defer ex.discard()
+	if c.ClientPayload != nil {
+		err := readSMBMessages(c.ClientPayload.Reader(), ex.request)
+		if err != nil {
+			return err
+		}
+	}
+	if c.ServerPayload != nil {
+		err := readSMBMessages(c.ServerPayload.Reader(), ex.response)
+		if err != nil {
+			return err
+		}
+	}
+	for _, id := range ex.order {
+		f := ex.files[id]
+		delete(ex.files, id)
+		file := &ExtractedFile{
+			Protocol:  extractSMB,
+			Name:      ex.names[id],
+			Upload:    f.upload,
+			Truncated: f.truncated || f.covered < f.end,
+		}
+		err := fe.store(c, file, f.tmp)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// discard removes the temporary files that were not stored.
+func (ex *smbExtraction) discard() {
+	for _, f := range ex.files {
+		f.tmp.Close()
+		os.Remove(f.tmp.Name())
+	}
+}
+
+// readSMBMessages hands every SMB2 header of a direction of the connection to handle, along with the
+// rest of its message. Reading stops at the end of the stream, or at a length that cannot be right,
+// as the stream cannot be followed past it.
+func readSMBMessages(r io.Reader, handle func(h []byte) error) error {
+	br := bufio.NewReader(r)
+	prefix := make([]byte, 4)
+	for {
+		_, err := io.ReadFull(br, prefix)
+		if err != nil {
+			return nil
+		}
+		length := int(prefix[1])<<16 | int(prefix[2])<<8 | int(prefix[3])
+		if prefix[0] != smbSessionMessage {
+			// other NetBIOS session packets, such as keepalives
+			_, err = io.CopyN(ioutil.Discard, br, int64(length))
+			if err != nil {
+				return nil
+			}
+			continue
+		}
+		if length > smbMaxMessageLength {
+			return nil
+		}
+		msg := make([]byte, length)
+		_, err = io.ReadFull(br, msg)
+		if err != nil {
+			return nil
+		}
+		// a message can hold several compounded commands, each with its own header
+		for len(msg) >= smb2HeaderLen && bytes.HasPrefix(msg, smb2Magic) {
+			next := int(binary.LittleEndian.Uint32(msg[20:]))
+			if next == 0 {
+				// the last command of the message
+				err = handle(msg)
+				if err != nil {
+					return err
+				}
+				break
+			}
+			if next < smb2HeaderLen || next > len(msg) {
+				// the offset would cut into the header, or run past the message
+				break
+			}
+			err = handle(msg[:next])
+			if err != nil {
+				return err
+			}
+			msg = msg[next:]
+		}
+	}
+}
+
+// smb2Slice returns the bytes of h at offset, or nil if they are not all there.
+func smb2Slice(h []byte, offset, length int) []byte {
+	if offset < 0 || length < 0 || offset+length > len(h) {
+		return nil
+	}
+	return h[offset : offset+length]
+}
+
+func (ex *smbExtraction) request(h []byte) error {
+	if binary.LittleEndian.Uint32(h[16:])&smb2FlagResponse != 0 {
+		return nil
+	}
+	command := binary.LittleEndian.Uint16(h[12:])
+	messageID := binary.LittleEndian.Uint64(h[24:])
+	body := h[smb2HeaderLen:]
+	switch command {
+	case smb2CommandCreate:
+		if len(body) < 48 {
+			return nil
+		}
+		nameOffset := int(binary.LittleEndian.Uint16(body[44:]))
+		nameLength := int(binary.LittleEndian.Uint16(body[46:]))
+		ex.requests[messageID] = &smb2Request{command: command, name: decodeUTF16(smb2Slice(h, nameOffset, nameLength))}
+	case smb2CommandRead:
+		if len(body) < 32 {
+			return nil
+		}
+		req := &smb2Request{command: command, offset: int64(binary.LittleEndian.Uint64(body[8:]))}
+		copy(req.fileID[:], body[16:32])
+		ex.requests[messageID] = req
+	case smb2CommandWrite:
+		if len(body) < 32 {
+			return nil
+		}
+		dataOffset := int(binary.LittleEndian.Uint16(body[2:]))
+		length := int(binary.LittleEndian.Uint32(body[4:]))
+		var id smb2FileID
+		copy(id[:], body[16:32])
+		data := smb2Slice(h, dataOffset, length)
+		if data != nil {
+			return ex.write(id, int64(binary.LittleEndian.Uint64(body[8:])), data, true)
+		}
+	}
+	return nil
+}
+
+func (ex *smbExtraction) response(h []byte) error {
+	if binary.LittleEndian.Uint32(h[16:])&smb2FlagResponse == 0 {
+		return nil
+	}
+	messageID := binary.LittleEndian.Uint64(h[24:])
+	req, ok := ex.requests[messageID]
+	if !ok {
+		return nil
+	}
+	status := binary.LittleEndian.Uint32(h[8:])
+	if status == smb2StatusPending {
+		// an interim response, the final one carries the same message ID
+		return nil
+	}
+	delete(ex.requests, messageID)
+	body := h[smb2HeaderLen:]
+	if status != 0 || binary.LittleEndian.Uint16(h[12:]) != req.command {
+		return nil
+	}
+	switch req.command {
+	case smb2CommandCreate:
+		if len(body) < 80 {
+			return nil
+		}
+		copy(ex.lastCreated[:], body[64:80])
+		ex.names[ex.lastCreated] = req.name
+	case smb2CommandRead:
+		if len(body) < 8 {
+			return nil
+		}
+		data := smb2Slice(h, int(body[2]), int(binary.LittleEndian.Uint32(body[4:])))
+		id := req.fileID
+		if id == smb2RelatedFileID {
+			id = ex.lastCreated
+		}
+		if data != nil {
+			return ex.write(id, req.offset, data, false)
+		}
+	}
+	return nil
+}
+
+// write writes data of a file at its offset, up to extract_max_bytes.
+func (ex *smbExtraction) write(id smb2FileID, offset int64, data []byte, upload bool) error {
+	if offset < 0 {
+		return nil
+	}
+	f, ok := ex.files[id]
+	if !ok {
+		tmp, err := ioutil.TempFile(ex.fe.dir, ".extract-")
+		if err != nil {
+			return err
+		}
+		f = &smbFile{tmp: tmp}
+		ex.files[id] = f
+		ex.order = append(ex.order, id)
+	}
+	f.upload = f.upload || upload
+	if max := ex.fe.maxBytes; max > 0 {
+		if offset >= max {
+			f.truncated = true
+			return nil
+		}
+		if offset+int64(len(data)) > max {
+			data = data[:max-offset]
+			f.truncated = true
+		}
+	}
+	_, err := f.tmp.WriteAt(data, offset)
+	if err != nil {
+		return err
+	}
+	f.covered += int64(len(data))
+	if end := offset + int64(len(data)); end > f.end {
+		f.end = end
+	}
+	return nil
+}
+
+// decodeUTF16 decodes the little-endian UTF-16 strings of SMB2.
+func decodeUTF16(b []byte) string {
+	units := make([]uint16, len(b)/2)
+	for i := range units {
+		units[i] = binary.LittleEndian.Uint16(b[2*i:])
+	}
+	return string(utf16.Decode(units))
+}
@@ -0,0 +1,156 @@
+package gourmet
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// dltRaw is the DLT_RAW data link type of libpcap on Linux, which filters for bare IP packets are
+// compiled for. Capture files use LINKTYPE_RAW instead, which libpcap does not compile filters for.
+const dltRaw = layers.LinkType(12)
+
+// captureFilter is the BPF filter set on the packet sources of a running sensor, which replaces the
+// filters of the config. Its mutex serializes changes, so that every source ends up with the same
+// filter.
+type captureFilter struct {
+	mutex sync.Mutex
+	set   bool
+	bpf   string
+}
+
+// setFilter changes the BPF filter of every packet source of the running sensor, without touching
+// the connections being tracked. The filter is compiled for every source before it is set on any of
+// them, so an invalid filter leaves capture as it was, and if setting it fails on a source, the
+// sources it was already set on get their previous filter back. An empty filter captures every
+// packet. With vlan_trunk, the filter also matches tagged frames, as at startup. The filter of AF_XDP
+// and remote sources cannot be changed, and neither can the filter of any source while
+// interface_bpf is set, as a single filter would replace those of the interfaces.
+func (s *sensor) setFilter(expr string) error {
+	if len(s.config.InterfaceBpf) > 0 {
+		return errors.New("the filter cannot be changed while interface_bpf is set, restart gourmet to change it")
+	}
+	s.filter.mutex.Lock()
+	defer s.filter.mutex.Unlock()
+	effective := expr
+	if s.config.VLANTrunk && expr != "" {
+		effective = vlanFilter(expr)
+	}
+	var changes []filterChange
+	for _, src := range s.captureSources() {
+		set, err := sourceFilter(src, effective, s.config.SnapLen)
+		if err != nil {
+			return fmt.Errorf("invalid bpf filter %q for %s: %s", expr, src.name, err)
+		}
+		restore, err := sourceFilter(src, src.filter, s.config.SnapLen)
+		if err != nil {
+			return fmt.Errorf("unable to compile the current filter of %s: %s", src.name, err)
+		}
+		changes = append(changes, filterChange{src: src, set: set, restore: restore})
+	}
+	for i, change := range changes {
+		err := change.set()
+		if err == nil {
+			continue
+		}
+		for _, applied := range changes[:i] {
+			restoreErr := applied.restore()
+			if restoreErr != nil {
+				log.Printf("[!] Failed to restore the filter of %s: %s", applied.src.name, restoreErr)
+			}
+		}
+		return fmt.Errorf("unable to set the filter of %s: %s", change.src.name, err)
+	}
+	for _, change := range changes {
+		change.src.filter = effective
+	}
+	s.filter.set = true
+	s.filter.bpf = expr
+	return nil
+}
+
+// filterChange sets a new filter on a packet source, or restores its previous one.
+type filterChange struct {
+	src          *captureSource
+	set, restore func() error
+}
+
+// sourceFilter compiles a filter for a packet source, and returns the function that sets it.
+func sourceFilter(src *captureSource, expr string, snapLen int) (func() error, error) {
+	if handle, ok := src.source.(*pcap.Handle); ok {
+		_, err := handle.CompileBPFFilter(expr)
+		if err != nil {
+			return nil, err
+		}
+		return func() error { return handle.SetBPFFilter(expr) }, nil
+	}
+	linkType, _ := src.decoder.(layers.LinkType)
+	set, err := ringFilter(src.source, expr, linkType, snapLen)
+	if err != nil {
+		return nil, err
+	}
+	if set == nil {
+		return nil, errors.New("the filter of the source cannot be changed")
+	}
+	return set, nil
+}
+
+// filterLinkType returns the link type that libpcap compiles filters for frames of the link type
+// with.
+func filterLinkType(linkType layers.LinkType) layers.LinkType {
+	if linkType == layers.LinkTypeRaw {
+		return dltRaw
+	}
+	return linkType
+}
+
+// captureLinkType returns the link type of the frames that are captured on the interface with the
+// interface type of the config. libpcap devices are opened to ask libpcap.
+func captureLinkType(c *Config, iface string) (layers.LinkType, error) {
+	if c.InterfaceType == "afpacket" || c.InterfaceType == "afxdp" {
+		return interfaceLinkType(iface)
+	}
+	device, err := findCaptureDevice(iface)
+	if err != nil {
+		return 0, err
+	}
+	handle, err := pcap.OpenLive(device.device.Name, int32(c.SnapLen), false, pcap.BlockForever)
+	if err != nil {
+		return 0, err
+	}
+	defer handle.Close()
+	return handle.LinkType(), nil
+}
+
+// CheckFilter compiles a BPF filter for the link type of the frames that are captured on the
+// interface with the interface type of the config, so that an invalid filter is reported before
+// capture starts. The filters of remote interfaces are compiled by tcpdump on the remote host.
+func CheckFilter(c *Config, iface, expr string) error {
+	if c.InterfaceType == "ssh" {
+		return nil
+	}
+	linkType, err := captureLinkType(c, iface)
+	if err != nil {
+		return err
+	}
+	_, err = pcap.CompileBPFFilter(filterLinkType(linkType), c.SnapLen, expr)
+	if err != nil {
+		return fmt.Errorf("%s (link type %s)", err, linkType)
+	}
+	return nil
+}
+
+// currentFilter returns the BPF filter set at runtime, or the global filter of the config if none
+// was.
+func (s *sensor) currentFilter() string {
+	s.filter.mutex.Lock()
+	defer s.filter.mutex.Unlock()
+	if s.filter.set {
+		return s.filter.bpf
+	}
+	return s.config.Bpf
+}
@@ -0,0 +1,112 @@
+package gourmet
+
+import (
+	"fmt"
+	"log"
+	"net"
+
+	maxminddb "github.com/oschwald/maxminddb-golang"
+)
+
+// Enrichments holds the context that the sensor looks up for the endpoints of a connection after it
+// closed. It is only logged when an enrichment is enabled and found something.
+type Enrichments struct {
+	SourceGeo      *GeoIP `json:",omitempty"`
+	DestinationGeo *GeoIP `json:",omitempty"`
+}
+
+// GeoIP is the location and network of an IP address, as found in the MaxMind databases. Country
+// is the ISO 3166-1 code of the country, and City its English name.
+type GeoIP struct {
+	Country        string `json:",omitempty"`
+	City           string `json:",omitempty"`
+	ASN            uint   `json:",omitempty"`
+	ASOrganization string `json:",omitempty"`
+}
+
+// mmdbRecord holds the fields of a record that Gourmet reads, which covers the Country, City, and
+// ASN databases of MaxMind and the compatible databases of other vendors
+type mmdbRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	ASN            uint   `maxminddb:"autonomous_system_number"`
+	ASOrganization string `maxminddb:"autonomous_system_organization"`
+}
+
+// geoIPDatabases looks up IP addresses in MMDB files, typically a City or Country database along
+// with an ASN database. The fields found in each of them are merged, and the first database that
+// has a field wins.
+type geoIPDatabases struct {
+	readers []*maxminddb.Reader
+}
+
+func newGeoIPDatabases(paths []string) (*geoIPDatabases, error) {
+	if len(paths) == 0 {
+		return nil, nil
+	}
+	g := &geoIPDatabases{}
+	for _, path := range paths {
+		reader, err := maxminddb.Open(path)
+		if err != nil {
+			g.close()
+			return nil, fmt.Errorf("unable to open GeoIP database %s: %s", path, err)
+		}
+		g.readers = append(g.readers, reader)
+	}
+	return g, nil
+}
+
+// lookup returns what the databases know about the address, or nil if it is in none of them.
+func (g *geoIPDatabases) lookup(address string) *GeoIP {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return nil
+	}
+	geo := &GeoIP{}
+	for _, reader := range g.readers {
+		var record mmdbRecord
+		err := reader.Lookup(ip, &record)
+		if err != nil {
+			log.Printf("[!] GeoIP lookup of %s failed: %s", address, err)
+			continue
+		}
+		if geo.Country == "" {
+			geo.Country = record.Country.ISOCode
+		}
+		if geo.City == "" {
+			geo.City = record.City.Names["en"]
+		}
+		if geo.ASN == 0 {
+			geo.ASN = record.ASN
+			geo.ASOrganization = record.ASOrganization
+		}
+	}
+	if *geo == (GeoIP{}) {
+		return nil
+	}
+	return geo
+}
+
+// enrich sets the GeoIP enrichments of both endpoints of the connection.
+func (g *geoIPDatabases) enrich(c *Connection) {
+	source := g.lookup(c.SourceIP)
+	destination := g.lookup(c.DestinationIP)
+	if source == nil && destination == nil {
+		return
+	}
+	if c.Enrichments == nil {
+		c.Enrichments = &Enrichments{}
+	}
+	c.Enrichments.SourceGeo = source
+	c.Enrichments.DestinationGeo = destination
+}
+
+func (g *geoIPDatabases) close() {
+	for _, reader := range g.readers {
+		reader.Close()
+	}
+}
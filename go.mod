@@ -1,14 +1,21 @@
 module github.com/gourmetproject/gourmet
 
-go 1.12
+go 1.14
 
 require (
+	github.com/Shopify/sarama v1.24.0
+	github.com/asavie/xdp v0.3.3
 	github.com/deckarep/golang-set v1.7.1
 	github.com/ghodss/yaml v1.0.0
-	github.com/google/gopacket v1.1.17
-	github.com/kr/pretty v0.1.0 // indirect
-	golang.org/x/net v0.0.0-20191101175033-0deb6923b6d9 // indirect
-	golang.org/x/sys v0.0.0-20191029155521-f43be2a4598c // indirect
+	github.com/golang/protobuf v1.3.2
+	github.com/google/gopacket v1.1.19
+	github.com/hashicorp/go-hclog v0.0.0-20180709165350-ff2cf002a8dd
+	github.com/hashicorp/go-plugin v1.0.1
+	github.com/oschwald/maxminddb-golang v1.6.0
+	github.com/vishvananda/netlink v1.1.0
+	golang.org/x/net v0.0.0-20191101175033-0deb6923b6d9
+	golang.org/x/sys v0.0.0-20210324051608-47abb6519492
+	google.golang.org/grpc v1.26.0
 	gopkg.in/check.v1 v1.0.0-20190902080502-41f04d3bba15 // indirect
 	gopkg.in/yaml.v2 v2.2.4 // indirect
 )
@@ -0,0 +1,285 @@
+package gourmet
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+
+	"github.com/gourmetproject/gourmet/api"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/go-plugin"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// gRPC analyzers run as executables served with hashicorp/go-plugin, like the plugins of Terraform
+// and Vault, instead of being loaded as Go plugins. A Go plugin only loads into a sensor built with
+// the same Go toolchain and the same versions of every shared dependency, while a gRPC analyzer only
+// has to speak the Analyzer service of api/analyzer.proto, so it can be built with another Go version
+// and its own dependencies. They are enabled per analyzer with transport set to grpc in the
+// analyzers section of the config. Connections and results cross the process boundary as JSON, like
+// those of out-of-process analyzers, and the settings of the analyzer are passed to the process in
+// the GOURMET_ANALYZER_CONFIG environment variable. The Filter of the analyzer is called without the
+// payloads first, so that payloads only cross for the connections that the analyzer wants. Analyzers
+// implement the protocol by calling ServeGRPCAnalyzer from their main function.
+
+// grpcAnalyzerPluginName is the name that the analyzer is dispensed under
+const grpcAnalyzerPluginName = "analyzer"
+
+// grpcAnalyzerHandshake must match between the sensor and its gRPC analyzers. The protocol version
+// changes when the Analyzer service changes incompatibly, and the cookie keeps the executables from
+// being run by hand.
+var grpcAnalyzerHandshake = plugin.HandshakeConfig{
+	ProtocolVersion:  1,
+	MagicCookieKey:   "GOURMET_ANALYZER_PLUGIN",
+	MagicCookieValue: "d1d0c7bb3b1e4a0ba0c9d3fbbd6fa5f4",
+}
+
+// ServeGRPCAnalyzer runs the analyzer as a gRPC Gourmet analyzer until the sensor that started it
+// stops it. It fails if the analyzer rejects its settings, and exits the process if it was not
+// started by a sensor. Anything the analyzer prints to standard output is passed to the standard
+// error of the sensor.
+func ServeGRPCAnalyzer(a Analyzer) error {
+	if configurable, ok := a.(Configurable); ok {
+		err := configurable.Init([]byte(os.Getenv(processAnalyzerConfigEnv)))
+		if err != nil {
+			return err
+		}
+	}
+	plugin.Serve(&plugin.ServeConfig{
+		HandshakeConfig: grpcAnalyzerHandshake,
+		Plugins: map[string]plugin.Plugin{
+			grpcAnalyzerPluginName: &grpcAnalyzerPlugin{analyzer: a},
+		},
+		GRPCServer: plugin.DefaultGRPCServer,
+		Logger:     hclog.NewNullLogger(),
+	})
+	return nil
+}
+
+// grpcAnalyzerPlugin serves an analyzer in the analyzer process, and connects to it in the sensor.
+type grpcAnalyzerPlugin struct {
+	plugin.NetRPCUnsupportedPlugin
+	analyzer Analyzer
+}
+
+func (gp *grpcAnalyzerPlugin) GRPCServer(broker *plugin.GRPCBroker, s *grpc.Server) error {
+	api.RegisterAnalyzerServer(s, &grpcAnalyzerServer{analyzer: gp.analyzer})
+	return nil
+}
+
+func (gp *grpcAnalyzerPlugin) GRPCClient(ctx context.Context, broker *plugin.GRPCBroker, conn *grpc.ClientConn) (interface{}, error) {
+	return api.NewAnalyzerClient(conn), nil
+}
+
+// grpcAnalyzerServer answers the Analyze calls of the sensor in the analyzer process.
+type grpcAnalyzerServer struct {
+	analyzer Analyzer
+}
+
+// Filter runs the Filter of the analyzer on a connection without payloads. A connection that cannot
+// be decoded or whose filter panics is accepted, so that Analyze reports the error.
+func (gs *grpcAnalyzerServer) Filter(ctx context.Context, req *api.FilterRequest) (resp *api.FilterResponse, err error) {
+	resp = &api.FilterResponse{Analyze: true}
+	defer func() {
+		recover()
+	}()
+	c := &Connection{}
+	err = json.Unmarshal(req.ConnectionJson, c)
+	if err != nil {
+		return resp, nil
+	}
+	c.Payload = newMemoryPayload(nil)
+	c.ClientPayload = newMemoryPayload(nil)
+	c.ServerPayload = newMemoryPayload(nil)
+	c.Analyzers = make(map[string]interface{})
+	resp.Analyze = gs.analyzer.Filter(c)
+	return resp, nil
+}
+
+func (gs *grpcAnalyzerServer) Analyze(ctx context.Context, req *api.AnalyzeRequest) (*api.AnalyzeResponse, error) {
+	c := &Connection{}
+	err := json.Unmarshal(req.ConnectionJson, c)
+	if err != nil {
+		return &api.AnalyzeResponse{Error: fmt.Sprintf("failed to decode connection: %s", err)}, nil
+	}
+	resp := serveRequest(gs.analyzer, &processRequest{
+		Connection:    c,
+		Payload:       req.Payload,
+		ClientPayload: req.ClientPayload,
+		ServerPayload: req.ServerPayload,
+	})
+	return &api.AnalyzeResponse{
+		Key:        resp.Key,
+		Version:    resp.Version,
+		Namespace:  resp.Namespace,
+		ResultJson: resp.Result,
+		Error:      resp.Error,
+	}, nil
+}
+
+// grpcAnalyzer adapts a gRPC analyzer to the Analyzer interface. The process is started on the first
+// connection, and restarted on the next connection after it exits or a call fails. Calls are made
+// concurrently, and the mutex is only held while the process is started or stopped.
+type grpcAnalyzer struct {
+	name string
+	path string
+	// config holds the settings handed to every start of the process
+	config []byte
+	mutex  sync.Mutex
+	client *plugin.Client
+	rpc    api.AnalyzerClient
+}
+
+func newGRPCAnalyzer(name, path string) *grpcAnalyzer {
+	return &grpcAnalyzer{
+		name: name,
+		path: path,
+	}
+}
+
+func (ga *grpcAnalyzer) start() error {
+	cmd := exec.Command(ga.path)
+	cmd.Env = append(os.Environ(), processAnalyzerConfigEnv+"="+string(ga.config))
+	client := plugin.NewClient(&plugin.ClientConfig{
+		HandshakeConfig: grpcAnalyzerHandshake,
+		Plugins: map[string]plugin.Plugin{
+			grpcAnalyzerPluginName: &grpcAnalyzerPlugin{},
+		},
+		Cmd:              cmd,
+		AllowedProtocols: []plugin.Protocol{plugin.ProtocolGRPC},
+		Stderr:           os.Stderr,
+		SyncStdout:       os.Stderr,
+		SyncStderr:       os.Stderr,
+		Logger:           hclog.NewNullLogger(),
+	})
+	protocol, err := client.Client()
+	if err != nil {
+		client.Kill()
+		return fmt.Errorf("failed to start analyzer plugin %s: %s", ga.name, err)
+	}
+	raw, err := protocol.Dispense(grpcAnalyzerPluginName)
+	if err != nil {
+		client.Kill()
+		return fmt.Errorf("failed to connect to analyzer plugin %s: %s", ga.name, err)
+	}
+	ga.client = client
+	ga.rpc = raw.(api.AnalyzerClient)
+	return nil
+}
+
+func (ga *grpcAnalyzer) stop() {
+	if ga.client == nil {
+		return
+	}
+	ga.client.Kill()
+	ga.client, ga.rpc = nil, nil
+}
+
+// Init keeps the settings of the analyzer for its process, which validates them when it starts.
+func (ga *grpcAnalyzer) Init(config []byte) error {
+	ga.config = config
+	return nil
+}
+
+// Close stops the analyzer process.
+func (ga *grpcAnalyzer) Close() error {
+	ga.mutex.Lock()
+	defer ga.mutex.Unlock()
+	ga.stop()
+	return nil
+}
+
+// connect returns the client of the analyzer process, which it starts if it is not running.
+func (ga *grpcAnalyzer) connect() (*plugin.Client, api.AnalyzerClient, error) {
+	ga.mutex.Lock()
+	defer ga.mutex.Unlock()
+	if ga.client != nil && ga.client.Exited() {
+		ga.stop()
+	}
+	if ga.client == nil {
+		err := ga.start()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return ga.client, ga.rpc, nil
+}
+
+// failed stops the analyzer process after a call to it failed, unless another call already
+// replaced it.
+func (ga *grpcAnalyzer) failed(client *plugin.Client) {
+	ga.mutex.Lock()
+	defer ga.mutex.Unlock()
+	if ga.client == client {
+		ga.stop()
+	}
+}
+
+// Filter asks the analyzer process whether it wants the connection, before its payloads are sent.
+// The connection is accepted if the call fails, so that Analyze reports the failure, and by analyzers
+// built before the Filter call was added to the service.
+func (ga *grpcAnalyzer) Filter(c *Connection) bool {
+	client, rpc, err := ga.connect()
+	if err != nil {
+		return true
+	}
+	conn, err := json.Marshal(c)
+	if err != nil {
+		return true
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), processAnalyzerTimeout)
+	defer cancel()
+	resp, err := rpc.Filter(ctx, &api.FilterRequest{ConnectionJson: conn})
+	if err != nil {
+		if status.Code(err) != codes.Unimplemented {
+			ga.failed(client)
+		}
+		return true
+	}
+	return resp.Analyze
+}
+
+func (ga *grpcAnalyzer) Analyze(c *Connection) (Result, error) {
+	client, rpc, err := ga.connect()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	req := &api.AnalyzeRequest{ConnectionJson: conn}
+	if c.Payload != nil {
+		req.Payload = c.Payload.Bytes()
+	}
+	if c.ClientPayload != nil {
+		req.ClientPayload = c.ClientPayload.Bytes()
+	}
+	if c.ServerPayload != nil {
+		req.ServerPayload = c.ServerPayload.Bytes()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), processAnalyzerTimeout)
+	defer cancel()
+	resp, err := rpc.Analyze(ctx, req)
+	if err != nil {
+		ga.failed(client)
+		return nil, fmt.Errorf("analyzer plugin %s failed, restarting it: %s", ga.name, err)
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("%s: %s", ga.name, resp.Error)
+	}
+	if resp.Key == "" {
+		return nil, nil
+	}
+	return &processResult{
+		key:       resp.Key,
+		version:   resp.Version,
+		namespace: resp.Namespace,
+		raw:       resp.ResultJson,
+	}, nil
+}
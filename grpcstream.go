@@ -0,0 +1,296 @@
+package gourmet
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gourmetproject/gourmet/api"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// grpcDefaultBuffer is how many connections may wait to be sent to a subscriber
+	grpcDefaultBuffer = 1024
+	// grpcDefaultAddress only serves subscribers on the host, as connections reveal the traffic of
+	// the network
+	grpcDefaultAddress = "127.0.0.1:9090"
+)
+
+// grpcOutput serves the ConnectionStream service of the api package, which streams the logged
+// connections as protobuf messages to every subscriber whose filters they match. Each subscriber has
+// a buffer of connections waiting to be sent, and a subscriber that falls behind by a full buffer
+// misses the connections that do not fit, rather than holding up the outputs. Subscribers only
+// receive the connections logged after they subscribed. The server is served over TLS when it has a
+// certificate, and with a token, subscribers must send it as a bearer token in the authorization
+// metadata of their calls.
+type grpcOutput struct {
+	listener    net.Listener
+	server      *grpc.Server
+	buffer      int
+	token       string
+	mutex       sync.RWMutex
+	subscribers map[*grpcSubscriber]struct{}
+}
+
+type grpcSubscriber struct {
+	filter     *api.SubscribeRequest
+	ips        map[string]bool
+	ports      map[uint32]bool
+	events     chan *api.Connection
+	missed     uint64
+	lastReport int64
+}
+
+func newGRPCOutput(args map[string]interface{}) (*grpcOutput, error) {
+	address, err := outputString(args, "address", grpcDefaultAddress)
+	if err != nil {
+		return nil, err
+	}
+	buffer, err := outputInt(args, "buffer", grpcDefaultBuffer)
+	if err != nil {
+		return nil, err
+	}
+	token, err := outputString(args, "token", "")
+	if err != nil {
+		return nil, err
+	}
+	cert, err := outputString(args, "tls_cert", "")
+	if err != nil {
+		return nil, err
+	}
+	key, err := outputString(args, "tls_key", "")
+	if err != nil {
+		return nil, err
+	}
+	if (cert == "") != (key == "") {
+		return nil, errors.New("tls_cert and tls_key must be set together")
+	}
+	var options []grpc.ServerOption
+	if cert != "" {
+		creds, err := credentials.NewServerTLSFromFile(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load the TLS certificate: %s", err)
+		}
+		options = append(options, grpc.Creds(creds))
+	}
+	if cert == "" && token == "" && !loopbackAddress(address) {
+		log.Printf("[*] Warning: the grpc output streams connections to anyone who can reach %s. Set tls_cert and tls_key, or token", address)
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	gs := &grpcOutput{
+		listener:    listener,
+		server:      grpc.NewServer(options...),
+		buffer:      buffer,
+		token:       token,
+		subscribers: make(map[*grpcSubscriber]struct{}),
+	}
+	api.RegisterConnectionStreamServer(gs.server, gs)
+	go func() {
+		err := gs.server.Serve(listener)
+		if err != nil {
+			log.Printf("[!] gRPC server stopped: %s", err)
+		}
+	}()
+	return gs, nil
+}
+
+// loopbackAddress reports whether a listen address only accepts connections from the host.
+func loopbackAddress(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// authorized reports whether the call carries the token of the output, if it has one.
+func (gs *grpcOutput) authorized(ctx context.Context) bool {
+	if gs.token == "" {
+		return true
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, auth := range md.Get("authorization") {
+		if strings.HasPrefix(auth, "Bearer ") &&
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(gs.token)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// Subscribe implements api.ConnectionStreamServer.
+func (gs *grpcOutput) Subscribe(filter *api.SubscribeRequest, stream api.ConnectionStream_SubscribeServer) error {
+	if !gs.authorized(stream.Context()) {
+		return status.Error(codes.Unauthenticated, "a valid bearer token is required")
+	}
+	sub := &grpcSubscriber{
+		filter: filter,
+		ips:    make(map[string]bool),
+		ports:  make(map[uint32]bool),
+		events: make(chan *api.Connection, gs.buffer),
+	}
+	for _, ip := range filter.Ips {
+		sub.ips[normalizeIP(ip)] = true
+	}
+	for _, port := range filter.Ports {
+		sub.ports[port] = true
+	}
+	gs.mutex.Lock()
+	gs.subscribers[sub] = struct{}{}
+	gs.mutex.Unlock()
+	defer func() {
+		gs.mutex.Lock()
+		delete(gs.subscribers, sub)
+		gs.mutex.Unlock()
+	}()
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case event := <-sub.events:
+			err := stream.Send(event)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (gs *grpcOutput) Write(c *Connection) error {
+	var event *api.Connection
+	gs.mutex.RLock()
+	defer gs.mutex.RUnlock()
+	for sub := range gs.subscribers {
+		if !sub.matches(c) {
+			continue
+		}
+		// the connection is only encoded once some subscriber wants it
+		if event == nil {
+			var err error
+			event, err = connectionEvent(c)
+			if err != nil {
+				return err
+			}
+		}
+		select {
+		case sub.events <- event:
+		default:
+			sub.miss()
+		}
+	}
+	return nil
+}
+
+func (gs *grpcOutput) Close() error {
+	gs.server.Stop()
+	return nil
+}
+
+// miss counts a connection that did not fit in the buffer of the subscriber, and warns about it at
+// most once per overflowReportInterval.
+func (sub *grpcSubscriber) miss() {
+	missed := atomic.AddUint64(&sub.missed, 1)
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&sub.lastReport)
+	if now-last >= int64(overflowReportInterval) && atomic.CompareAndSwapInt64(&sub.lastReport, last, now) {
+		log.Printf("[!] A gRPC subscriber is falling behind, %d connections were not sent to it", missed)
+	}
+}
+
+func (sub *grpcSubscriber) matches(c *Connection) bool {
+	if c.Preliminary && !sub.filter.IncludePreliminary {
+		return false
+	}
+	if len(sub.ips) > 0 && !sub.ips[normalizeIP(c.SourceIP)] && !sub.ips[normalizeIP(c.DestinationIP)] {
+		return false
+	}
+	if len(sub.ports) > 0 && !sub.ports[uint32(c.SourcePort)] && !sub.ports[uint32(c.DestinationPort)] {
+		return false
+	}
+	if len(sub.filter.Analyzers) == 0 {
+		return true
+	}
+	for _, key := range sub.filter.Analyzers {
+		if hasResult(c, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasResult reports whether the connection has a result under the key, in the form key or
+// namespace.key.
+func hasResult(c *Connection, key string) bool {
+	if _, ok := c.Analyzers[key]; ok {
+		return true
+	}
+	i := strings.Index(key, ".")
+	if i < 0 {
+		return false
+	}
+	namespace, ok := c.Analyzers[key[:i]].(map[string]interface{})
+	if !ok {
+		return false
+	}
+	_, ok = namespace[key[i+1:]]
+	return ok
+}
+
+// normalizeIP returns the canonical form of an IP address, so that filters match however the
+// address is written.
+func normalizeIP(address string) string {
+	if ip := net.ParseIP(address); ip != nil {
+		return ip.String()
+	}
+	return address
+}
+
+func connectionEvent(c *Connection) (*api.Connection, error) {
+	analyzers, err := json.Marshal(c.Analyzers)
+	if err != nil {
+		return nil, err
+	}
+	return &api.Connection{
+		TimestampUnixNano: c.Timestamp.UnixNano(),
+		Uid:               c.uid,
+		SourceIp:          c.SourceIP,
+		SourcePort:        uint32(c.SourcePort),
+		DestinationIp:     c.DestinationIP,
+		DestinationPort:   uint32(c.DestinationPort),
+		TransportType:     c.TransportType,
+		Duration:          c.Duration,
+		OrigBytes:         c.OrigBytes,
+		RespBytes:         c.RespBytes,
+		OrigPackets:       c.OrigPackets,
+		RespPackets:       c.RespPackets,
+		State:             c.State,
+		ConnState:         c.ConnState,
+		History:           c.History,
+		Service:           c.Service,
+		Locality:          c.Locality,
+		Interface:         c.Interface,
+		Tags:              append([]string(nil), c.Tags...),
+		Preliminary:       c.Preliminary,
+		AnalyzersJson:     analyzers,
+	}, nil
+}
@@ -0,0 +1,80 @@
+package gourmet
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// healthDefaultMaxIdle is how many seconds the capture loop may go without reading a packet before
+// it is reported as wedged
+const healthDefaultMaxIdle = 60
+
+// healthServer answers liveness and readiness probes, for example from Kubernetes. /healthz returns
+// 200 while the capture loop is reading packets, and 503 once it has not read one for maxIdle or the
+// sensor is shutting down. /readyz returns 200 once the analyzers are loaded and capture has started,
+// and 503 before that and during shutdown. Both endpoints are deliberately cheap and carry no metrics.
+type healthServer struct {
+	sensor   *sensor
+	maxIdle  time.Duration
+	listener net.Listener
+	closed   int32
+}
+
+func newHealthServer(s *sensor, addr string, maxIdle int) (*healthServer, error) {
+	if addr == "" {
+		return nil, nil
+	}
+	if maxIdle == 0 {
+		maxIdle = healthDefaultMaxIdle
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for health checks on %s: %s", addr, err)
+	}
+	return &healthServer{
+		sensor:   s,
+		maxIdle:  time.Second * time.Duration(maxIdle),
+		listener: listener,
+	}, nil
+}
+
+// serve answers probes until the server is closed.
+func (hs *healthServer) serve() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", hs.healthz)
+	mux.HandleFunc("/readyz", hs.readyz)
+	err := http.Serve(hs.listener, mux)
+	if err != nil && atomic.LoadInt32(&hs.closed) == 0 {
+		log.Printf("[!] Health check server stopped: %s", err)
+	}
+}
+
+func (hs *healthServer) close() {
+	atomic.StoreInt32(&hs.closed, 1)
+	hs.listener.Close()
+}
+
+func (hs *healthServer) healthz(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&hs.sensor.stopping) != 0 {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	idle := time.Since(time.Unix(0, atomic.LoadInt64(&hs.sensor.lastPacket)))
+	if idle > hs.maxIdle {
+		http.Error(w, fmt.Sprintf("no packets captured for %s", idle.Truncate(time.Second)), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+func (hs *healthServer) readyz(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&hs.sensor.capturing) == 0 || atomic.LoadInt32(&hs.sensor.stopping) != 0 {
+		http.Error(w, "not capturing", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
@@ -0,0 +1,118 @@
+package gourmet
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+const (
+	httpAnalyzerName = "http"
+	// httpMaxTransactions bounds the requests recorded per connection
+	httpMaxTransactions = 100
+)
+
+// httpMethods are the request methods that the HTTP analyzer recognizes a connection by
+var httpMethods = []string{"GET ", "POST ", "HEAD ", "PUT ", "DELETE ", "OPTIONS ", "PATCH ", "CONNECT ", "TRACE "}
+
+// httpAnalyzer is the built-in HTTP/1.x analyzer. It parses the requests sent by the client and the
+// responses sent by the server of a TCP connection on any port, and pairs them in order, as HTTP/1.x
+// answers pipelined requests in the order they were sent. The result is logged under the http key.
+// Parsing stops at the first message that is malformed or cut short, and after a response that
+// switches protocols, such as a WebSocket upgrade.
+type httpAnalyzer struct{}
+
+// HTTPResult is the result of the built-in HTTP analyzer, with one transaction per request.
+type HTTPResult struct {
+	Transactions []*HTTPTransaction
+}
+
+// HTTPTransaction is an HTTP request and its response. The body lengths are the lengths of the
+// bodies after removing the chunked transfer encoding, if any, as far as they were captured. The
+// status code, content type, and response body length are only set if the response was seen.
+type HTTPTransaction struct {
+	Method             string
+	Host               string `json:",omitempty"`
+	URI                string
+	Version            string
+	UserAgent          string `json:",omitempty"`
+	RequestBodyLength  int64
+	StatusCode         int    `json:",omitempty"`
+	ContentType        string `json:",omitempty"`
+	ResponseBodyLength int64  `json:",omitempty"`
+}
+
+// Key implements Result.
+func (r *HTTPResult) Key() string {
+	return httpAnalyzerName
+}
+
+// Filter accepts TCP connections whose service is http, as detected from the request line the client
+// opened with or as set by port_protocols, and those whose client opened with a request line anyway.
+func (ha *httpAnalyzer) Filter(c *Connection) bool {
+	if c.TransportType != "tcp" || c.ClientPayload == nil || c.ClientPayload.Len() == 0 {
+		return false
+	}
+	return c.Service == httpAnalyzerName || c.hasSignature(httpAnalyzerName)
+}
+
+func (ha *httpAnalyzer) Analyze(c *Connection) (Result, error) {
+	var requests []*http.Request
+	result := &HTTPResult{}
+	client := bufio.NewReader(c.ClientPayload.Reader())
+	for len(result.Transactions) < httpMaxTransactions {
+		req, err := http.ReadRequest(client)
+		if err != nil {
+			break
+		}
+		t := &HTTPTransaction{
+			Method:    req.Method,
+			Host:      req.Host,
+			URI:       req.RequestURI,
+			Version:   req.Proto,
+			UserAgent: req.UserAgent(),
+		}
+		t.RequestBodyLength, err = io.Copy(ioutil.Discard, req.Body)
+		requests = append(requests, req)
+		result.Transactions = append(result.Transactions, t)
+		if err != nil {
+			break
+		}
+	}
+	if len(result.Transactions) == 0 {
+		return nil, nil
+	}
+	if c.ServerPayload == nil {
+		return result, nil
+	}
+	server := bufio.NewReader(c.ServerPayload.Reader())
+	for i, req := range requests {
+		resp, err := readHTTPResponse(server, req)
+		if err != nil {
+			break
+		}
+		t := result.Transactions[i]
+		t.StatusCode = resp.StatusCode
+		t.ContentType = resp.Header.Get("Content-Type")
+		t.ResponseBodyLength, err = io.Copy(ioutil.Discard, resp.Body)
+		if err != nil || resp.StatusCode == http.StatusSwitchingProtocols {
+			break
+		}
+	}
+	return result, nil
+}
+
+// readHTTPResponse reads the response to a request, skipping interim responses such as 100
+// Continue, which precede the final response of the same request.
+func readHTTPResponse(r *bufio.Reader, req *http.Request) (*http.Response, error) {
+	for {
+		resp, err := http.ReadResponse(r, req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode < 100 || resp.StatusCode >= 200 || resp.StatusCode == http.StatusSwitchingProtocols {
+			return resp, nil
+		}
+	}
+}
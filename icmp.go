@@ -0,0 +1,134 @@
+package gourmet
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	icmpTransport   = "icmp"
+	icmpv6Transport = "icmp6"
+)
+
+// ICMP describes the messages of an ICMP or ICMPv6 connection. Type and Code are those of the first
+// message, and ID is the identifier of echo messages, which tells the pings of different processes
+// between the same hosts apart. The payload bytes count the bytes of the messages after their
+// header in each direction, and MaxPayloadBytes is the largest of them, which is large for ICMP
+// tunnels.
+type ICMP struct {
+	Type             int
+	Code             int
+	ID               int `json:",omitempty"`
+	OrigPayloadBytes uint64
+	RespPayloadBytes uint64
+	MaxPayloadBytes  int
+}
+
+// isICMP reports whether a transport is ICMP or ICMPv6.
+func isICMP(transport string) bool {
+	return transport == icmpTransport || transport == icmpv6Transport
+}
+
+// processICMPPacket creates a connection for an ICMP message. The payload is the body of the
+// message after its 8 byte header, which for error messages is the start of the datagram that
+// caused the error.
+func processICMPPacket(packet gopacket.Packet, icmp *layers.ICMPv4, ci gopacket.CaptureInfo) *Connection {
+	id := -1
+	switch icmp.TypeCode.Type() {
+	case layers.ICMPv4TypeEchoRequest, layers.ICMPv4TypeEchoReply:
+		id = int(icmp.Id)
+	}
+	return newICMPConnection(packet, icmpTransport, int(icmp.TypeCode.Type()), int(icmp.TypeCode.Code()), id,
+		icmp.LayerContents(), icmp.LayerPayload(), ci)
+}
+
+// processICMPv6Packet creates a connection for an ICMPv6 message. The payload is the body of the
+// message after the type, code, and checksum.
+func processICMPv6Packet(packet gopacket.Packet, icmp *layers.ICMPv6, ci gopacket.CaptureInfo) *Connection {
+	id := -1
+	if echo, ok := packet.Layer(layers.LayerTypeICMPv6Echo).(*layers.ICMPv6Echo); ok {
+		id = int(echo.Identifier)
+	}
+	return newICMPConnection(packet, icmpv6Transport, int(icmp.TypeCode.Type()), int(icmp.TypeCode.Code()), id,
+		icmp.LayerContents(), icmp.LayerPayload(), ci)
+}
+
+// newICMPConnection creates the connection of an ICMP or ICMPv6 message. As ICMP has no ports, the
+// type of the message is recorded as the source port and its code as the destination port, the way
+// Zeek records ICMP. id is the identifier of an echo message, or -1.
+func newICMPConnection(packet gopacket.Packet, transport string, icmpType, code, id int, header, body []byte, ci gopacket.CaptureInfo) *Connection {
+	netFlow := packet.NetworkLayer().NetworkFlow()
+	srcIP, dstIP := processAddresses(netFlow)
+	payload := newMemoryPayload(body)
+	transportBytes := uint64(len(header) + len(body))
+	c := &Connection{
+		Timestamp:        ci.Timestamp,
+		uid:              netFlow.FastHash() + uint64(icmpType)<<8 + uint64(code) + uint64(id+1)<<16,
+		SourceIP:         srcIP,
+		SourcePort:       icmpType,
+		DestinationIP:    dstIP,
+		DestinationPort:  code,
+		TransportType:    transport,
+		Payload:          payload,
+		ClientPayload:    payload,
+		ServerPayload:    newMemoryPayload(nil),
+		Analyzers:        make(map[string]interface{}),
+		OrigBytes:        transportBytes,
+		OrigPackets:      1,
+		transportBytes:   transportBytes,
+		transportPackets: 1,
+		PayloadComplete:  !packet.Metadata().Truncated && ci.CaptureLength >= ci.Length,
+		snapTruncated:    packet.Metadata().Truncated || ci.CaptureLength < ci.Length,
+		InterfaceIndex:   ci.InterfaceIndex,
+		VLANs:            captureVLANs(ci),
+		Tunnel:           captureTunnel(ci),
+		ICMP: &ICMP{
+			Type:             icmpType,
+			Code:             code,
+			OrigPayloadBytes: uint64(len(body)),
+			MaxPayloadBytes:  len(body),
+		},
+	}
+	if id >= 0 {
+		c.ICMP.ID = id
+	}
+	c.icmpID = id
+	return c
+}
+
+// addMessage counts the payload of a message of the connection.
+func (i *ICMP) addMessage(payloadBytes int, fromClient bool) {
+	if fromClient {
+		i.OrigPayloadBytes += uint64(payloadBytes)
+	} else {
+		i.RespPayloadBytes += uint64(payloadBytes)
+	}
+	if payloadBytes > i.MaxPayloadBytes {
+		i.MaxPayloadBytes = payloadBytes
+	}
+}
+
+// icmpCounterpart returns the type of the message that answers an ICMP or ICMPv6 message of the
+// given type, or the type itself if it is not part of a request and reply exchange.
+func icmpCounterpart(transport string, t int) int {
+	if transport == icmpv6Transport {
+		switch t {
+		case 128, 133, 135:
+			return t + 1
+		case 129, 134, 136:
+			return t - 1
+		}
+		return t
+	}
+	switch t {
+	case 8:
+		return 0
+	case 0:
+		return 8
+	case 13, 15, 17:
+		return t + 1
+	case 14, 16, 18:
+		return t - 1
+	}
+	return t
+}
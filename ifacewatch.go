@@ -0,0 +1,179 @@
+package gourmet
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// Interfaces can be selected by a pattern instead of by name, for hosts whose interfaces come and
+// go, such as the veth interfaces of containers. The libpcap devices whose name matches
+// interface_pattern are captured on, and with interface_rescan they are listed again periodically:
+// capture starts on the interfaces that appeared and stops on those that disappeared, without
+// restarting the sensor or dropping the connections of the other interfaces.
+
+// matchCaptureDevices returns the libpcap devices of interfaces whose name, or friendly name on
+// Windows, matches the pattern. Pseudo-devices without an interface, such as any, never match.
+func matchCaptureDevices(pattern string) ([]*captureDevice, error) {
+	devices, err := findCaptureDevices()
+	if err != nil {
+		return nil, err
+	}
+	var matched []*captureDevice
+	for _, cd := range devices {
+		if cd.iface == nil {
+			continue
+		}
+		byName, _ := path.Match(pattern, cd.device.Name)
+		byFriendlyName, _ := path.Match(pattern, cd.iface.Name)
+		if byName || byFriendlyName {
+			matched = append(matched, cd)
+		}
+	}
+	return matched, nil
+}
+
+// getPatternSources opens the interfaces that match interface_pattern. None have to match when they
+// are rescanned, as they may appear later.
+func (s *sensor) getPatternSources() error {
+	pattern := s.config.InterfacePattern
+	devices, err := matchCaptureDevices(pattern)
+	if err != nil {
+		return err
+	}
+	if len(devices) == 0 {
+		if s.config.InterfaceRescan == 0 {
+			return fmt.Errorf("no interfaces match interface_pattern %s", pattern)
+		}
+		log.Printf("[!] No interfaces match interface_pattern %s yet", pattern)
+	}
+	s.ifNames = make(map[int]string)
+	for _, cd := range devices {
+		src, err := s.patternSource(cd)
+		if err != nil {
+			return fmt.Errorf("unable to capture on %s: %s", cd.device.Name, err)
+		}
+		s.sources = append(s.sources, src)
+		s.ifNames[src.index] = src.name
+	}
+	return nil
+}
+
+// patternSource opens the device of an interface that matches interface_pattern, with the filter
+// that was set on the other sources while the sensor runs, if any. The mutex of the filter must be
+// held once capture started.
+func (s *sensor) patternSource(cd *captureDevice) (*captureSource, error) {
+	name := cd.device.Name
+	handle, err := newLibpcapSensor(s.config, name, cd)
+	if err != nil {
+		return nil, err
+	}
+	filter := s.config.effectiveBpf(name)
+	if s.filter.set {
+		filter = s.filter.bpf
+		if s.config.VLANTrunk && filter != "" {
+			filter = vlanFilter(filter)
+		}
+		err = handle.SetBPFFilter(filter)
+		if err != nil {
+			handle.Close()
+			return nil, err
+		}
+	}
+	return &captureSource{
+		name:    name,
+		source:  handle,
+		decoder: handle.LinkType(),
+		index:   cd.index(),
+		watched: s.config.InterfaceRescan > 0,
+		filter:  filter,
+	}, nil
+}
+
+// watchInterfaces rescans the interfaces every interval until quit is closed. start runs the capture
+// loop of a source.
+func (s *sensor) watchInterfaces(interval time.Duration, start func(*captureSource), quit <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+		}
+		if atomic.LoadInt32(&s.stopping) == 0 {
+			s.rescanInterfaces(start)
+		}
+	}
+}
+
+// rescanInterfaces stops capturing on the interfaces that no longer match interface_pattern, or
+// whose capture failed, and starts capturing on those that match and are not captured on. The
+// filter is held, so that a filter being set reaches the new sources as well.
+func (s *sensor) rescanInterfaces(start func(*captureSource)) {
+	devices, err := matchCaptureDevices(s.config.InterfacePattern)
+	if err != nil {
+		log.Printf("[!] Failed to list interfaces: %s", err)
+		return
+	}
+	present := make(map[string]bool)
+	for _, cd := range devices {
+		present[cd.device.Name] = true
+	}
+	s.filter.mutex.Lock()
+	defer s.filter.mutex.Unlock()
+	var kept, gone []*captureSource
+	running := make(map[string]bool)
+	s.sourcesMutex.Lock()
+	for _, src := range s.sources {
+		if present[src.name] && atomic.LoadInt32(&src.stopped) == 0 {
+			kept = append(kept, src)
+			running[src.name] = true
+		} else {
+			gone = append(gone, src)
+		}
+	}
+	s.sources = kept
+	s.sourcesMutex.Unlock()
+	for _, src := range gone {
+		s.detachSource(src)
+	}
+	for _, cd := range devices {
+		if running[cd.device.Name] || atomic.LoadInt32(&s.stopping) != 0 {
+			continue
+		}
+		src, err := s.patternSource(cd)
+		if err != nil {
+			log.Printf("[!] Unable to capture on %s: %s", cd.device.Name, err)
+			continue
+		}
+		if lt, ok := src.decoder.(layers.LinkType); ok && s.ring != nil && lt != s.ring.linkType {
+			log.Printf("[!] Not capturing on %s, as its link type %s differs from that of the capture ring", src.name, lt)
+			src.source.(*pcap.Handle).Close()
+			continue
+		}
+		s.sourcesMutex.Lock()
+		s.sources = append(s.sources, src)
+		s.ifNames[src.index] = src.name
+		s.sourcesMutex.Unlock()
+		log.Printf("[*] Started capturing on %s", src.name)
+		start(src)
+	}
+}
+
+// detachSource stops capturing on a source whose interface is gone. Its drops are kept in the
+// counters of the sensor.
+func (s *sensor) detachSource(src *captureSource) {
+	atomic.StoreInt32(&src.stopped, 1)
+	if drops, err := sourceDrops(src.source); err == nil {
+		atomic.AddUint64(&s.detachedDrops, drops)
+	}
+	// the capture loop returns once the handle is closed, if it is still reading
+	src.source.(*pcap.Handle).Close()
+	log.Printf("[*] Stopped capturing on %s", src.name)
+}
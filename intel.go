@@ -0,0 +1,395 @@
+package gourmet
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	intelTag            = "intel"
+	intelDefaultRefresh = 3600
+)
+
+// Types of the indicators of intel feeds
+const (
+	intelAddr   = "addr"
+	intelDomain = "domain"
+	intelJA3    = "ja3"
+	intelURL    = "url"
+)
+
+// intelUnsupported are the types of the Zeek intel framework that name nothing Gourmet observes,
+// whose indicators are skipped rather than failing the feed
+var intelUnsupported = map[string]bool{
+	"file_hash":   true,
+	"file_name":   true,
+	"email":       true,
+	"software":    true,
+	"user_name":   true,
+	"cert_hash":   true,
+	"pubkey_hash": true,
+}
+
+// intelJA3Hash matches the MD5 hashes of JA3 fingerprints
+var intelJA3Hash = regexp.MustCompile(`^[0-9a-fA-F]{32}$`)
+
+// IntelMatch records a field of a connection that matched an indicator of an intel feed. Field names
+// where the value was seen, such as DestinationIP, DNS.Query, HTTP.URL, or TLS.JA3. Type is the type
+// of the indicator, and Source and Description are those given for it by the feed, with Source
+// defaulting to the name of the feed.
+type IntelMatch struct {
+	Field       string
+	Value       string
+	Indicator   string
+	Type        string `json:",omitempty"`
+	Source      string `json:",omitempty"`
+	Description string `json:",omitempty"`
+}
+
+// intelIndicator is an indicator of an intel feed
+type intelIndicator struct {
+	value       string
+	kind        string
+	source      string
+	description string
+}
+
+// intelIndicators are the indicators loaded from a feed, by type
+type intelIndicators struct {
+	networks *ipTrie
+	// domains, ja3, and urls are keyed by their normalized value
+	domains map[string]*intelIndicator
+	ja3     map[string]*intelIndicator
+	urls    map[string]*intelIndicator
+	// skipped counts the indicators of unsupported types, by the type field of the feed
+	skipped map[string]int
+}
+
+// intelFeed matches connections against the indicators of files or URLs: IP addresses and CIDR
+// blocks, domains, JA3 and JA3S hashes, and URLs. Each line of a feed is an indicator, optionally
+// followed by its type, source, and description, separated by tabs or commas, so that both plain
+// blocklists and the files of the Zeek intel framework can be loaded. The type is guessed from the
+// indicator when it is not given. Blank lines and lines starting with # are ignored. Feeds are
+// reloaded periodically, and a feed that fails to reload keeps its previously loaded indicators.
+type intelFeed struct {
+	sources []string
+	refresh time.Duration
+	mutex   sync.RWMutex
+	// indicators holds the indicators of each source, in the order of sources
+	indicators []*intelIndicators
+}
+
+func newIntelFeed(sources []string, refresh int) (*intelFeed, error) {
+	if refresh == 0 {
+		refresh = intelDefaultRefresh
+	}
+	feed := &intelFeed{
+		sources:    sources,
+		refresh:    time.Second * time.Duration(refresh),
+		indicators: make([]*intelIndicators, len(sources)),
+	}
+	for i := range sources {
+		err := feed.load(i)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return feed, nil
+}
+
+func openIntelSource(source string) (io.ReadCloser, error) {
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		resp, err := http.Get(source)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("failed to download intel feed %s: %s", source, resp.Status)
+		}
+		return resp.Body, nil
+	}
+	return os.Open(source)
+}
+
+// load reads the indicators of the ith source.
+func (f *intelFeed) load(i int) error {
+	source := f.sources[i]
+	r, err := openIntelSource(source)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	indicators, err := readIndicators(r, path.Base(source))
+	if err != nil {
+		return fmt.Errorf("failed to read intel feed %s: %s", source, err)
+	}
+	f.mutex.Lock()
+	f.indicators[i] = indicators
+	f.mutex.Unlock()
+	log.Printf("[*] Loaded %d network, %d domain, %d JA3, and %d URL indicators from intel feed %s",
+		indicators.networks.size, len(indicators.domains), len(indicators.ja3), len(indicators.urls), source)
+	if len(indicators.skipped) > 0 {
+		var skipped []string
+		for kind, count := range indicators.skipped {
+			skipped = append(skipped, fmt.Sprintf("%d %s", count, kind))
+		}
+		sort.Strings(skipped)
+		log.Printf("[*] Warning: skipped indicators of intel feed %s whose types are not supported: %s",
+			source, strings.Join(skipped, ", "))
+	}
+	return nil
+}
+
+// readIndicators reads the indicators of a feed, whose default source is name.
+func readIndicators(r io.Reader, name string) (*intelIndicators, error) {
+	indicators := &intelIndicators{
+		networks: newIPTrie(),
+		domains:  make(map[string]*intelIndicator),
+		ja3:      make(map[string]*intelIndicator),
+		urls:     make(map[string]*intelIndicator),
+		skipped:  make(map[string]int),
+	}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields, err := splitIndicator(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err)
+		}
+		indicator := &intelIndicator{value: fields[0], source: name}
+		if len(fields) > 1 {
+			indicator.kind = intelType(fields[1])
+		}
+		if len(fields) > 2 && fields[2] != "" && fields[2] != "-" {
+			indicator.source = fields[2]
+		}
+		if len(fields) > 3 && fields[3] != "-" {
+			indicator.description = fields[3]
+		}
+		if indicator.kind == "" {
+			indicator.kind = guessIntelType(indicator.value)
+		}
+		if intelUnsupported[indicator.kind] {
+			indicators.skipped[fields[1]]++
+			continue
+		}
+		switch indicator.kind {
+		case intelAddr:
+			network, err := parseNetwork(indicator.value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", line, err)
+			}
+			indicators.networks.insert(network, indicator)
+		case intelDomain:
+			indicators.domains[normalizeDomain(indicator.value)] = indicator
+		case intelJA3:
+			indicators.ja3[strings.ToLower(indicator.value)] = indicator
+		case intelURL:
+			indicators.urls[normalizeURL(indicator.value)] = indicator
+		default:
+			return nil, fmt.Errorf("line %d: invalid indicator type %q. Must be addr, domain, ja3, or url", line, fields[1])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return indicators, nil
+}
+
+// splitIndicator splits a line of a feed into its fields, on tabs if it has any, and as a CSV record
+// otherwise.
+func splitIndicator(line string) ([]string, error) {
+	if strings.Contains(line, "\t") {
+		fields := strings.Split(line, "\t")
+		for i := range fields {
+			fields[i] = strings.TrimSpace(fields[i])
+		}
+		return fields, nil
+	}
+	r := csv.NewReader(strings.NewReader(line))
+	r.TrimLeadingSpace = true
+	return r.Read()
+}
+
+// intelType returns the type of indicator that a type field names. The types of the Zeek intel
+// framework are accepted as well, such as Intel::ADDR and Intel::SUBNET. An empty or unknown type
+// is returned as it is.
+func intelType(field string) string {
+	kind := strings.ToLower(strings.TrimPrefix(field, "Intel::"))
+	switch kind {
+	case "ip", "subnet", "cidr":
+		return intelAddr
+	case "ja3s":
+		return intelJA3
+	case "-":
+		return ""
+	}
+	return kind
+}
+
+// guessIntelType returns the type of an indicator given without one.
+func guessIntelType(value string) string {
+	switch {
+	case intelJA3Hash.MatchString(value):
+		return intelJA3
+	case strings.Contains(value, "/"):
+		if _, err := parseNetwork(value); err == nil {
+			return intelAddr
+		}
+		return intelURL
+	case net.ParseIP(value) != nil:
+		return intelAddr
+	}
+	return intelDomain
+}
+
+func normalizeDomain(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(domain), ".")
+}
+
+// normalizeURL returns a URL without its scheme and with its host in lower case, the way the URL
+// indicators of Zeek are written.
+func normalizeURL(u string) string {
+	if i := strings.Index(u, "://"); i >= 0 {
+		u = u[i+3:]
+	}
+	host, rest := u, ""
+	if i := strings.IndexByte(u, '/'); i >= 0 {
+		host, rest = u[:i], u[i:]
+	}
+	return normalizeDomain(host) + rest
+}
+
+// reload refreshes the feeds at the configured interval until quit is closed.
+func (f *intelFeed) reload(quit <-chan struct{}) {
+	ticker := time.NewTicker(f.refresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+		}
+		for i, source := range f.sources {
+			err := f.load(i)
+			if err != nil {
+				log.Printf("[!] Failed to reload intel feed %s, keeping previous indicators: %s", source, err)
+			}
+		}
+	}
+}
+
+// intelMatcher records the matches of a connection, once per field and value
+type intelMatcher struct {
+	c          *Connection
+	indicators []*intelIndicators
+}
+
+func (f *intelFeed) matcher(c *Connection) *intelMatcher {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	return &intelMatcher{c: c, indicators: f.indicators}
+}
+
+func (im *intelMatcher) add(field, value string, indicator *intelIndicator) {
+	for _, m := range im.c.IntelMatches {
+		if m.Field == field && m.Value == value {
+			return
+		}
+	}
+	im.c.IntelMatches = append(im.c.IntelMatches, IntelMatch{
+		Field:       field,
+		Value:       value,
+		Indicator:   indicator.value,
+		Type:        indicator.kind,
+		Source:      indicator.source,
+		Description: indicator.description,
+	})
+	im.c.addTag(intelTag)
+}
+
+func (im *intelMatcher) addr(field, value string) {
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return
+	}
+	for _, indicators := range im.indicators {
+		if indicator, ok := indicators.networks.lookup(ip); ok {
+			im.add(field, value, indicator.(*intelIndicator))
+			return
+		}
+	}
+}
+
+func (im *intelMatcher) lookup(field, value, key string, table func(*intelIndicators) map[string]*intelIndicator) {
+	if value == "" {
+		return
+	}
+	for _, indicators := range im.indicators {
+		if indicator, ok := table(indicators)[key]; ok {
+			im.add(field, value, indicator)
+			return
+		}
+	}
+}
+
+func (im *intelMatcher) domain(field, value string) {
+	im.lookup(field, value, normalizeDomain(value), func(i *intelIndicators) map[string]*intelIndicator { return i.domains })
+}
+
+func (im *intelMatcher) ja3(field, value string) {
+	im.lookup(field, value, strings.ToLower(value), func(i *intelIndicators) map[string]*intelIndicator { return i.ja3 })
+}
+
+func (im *intelMatcher) url(field, value string) {
+	im.lookup(field, value, normalizeURL(value), func(i *intelIndicators) map[string]*intelIndicator { return i.urls })
+}
+
+// match records the endpoints, and the server name if it is already known, of a connection that are
+// found in the feeds. It runs before analysis, so analyzers can act on the matches.
+func (f *intelFeed) match(c *Connection) {
+	im := f.matcher(c)
+	im.addr("SourceIP", c.SourceIP)
+	im.addr("DestinationIP", c.DestinationIP)
+	im.domain("ServerName", c.ServerName)
+}
+
+// matchResults records the domains, URLs, and JA3 hashes found by the built-in dns, http, and tls
+// analyzers that are found in the feeds. It runs after analysis.
+func (f *intelFeed) matchResults(c *Connection) {
+	im := f.matcher(c)
+	im.domain("ServerName", c.ServerName)
+	if dnsResult, ok := findResult(c, dnsAnalyzerName).(*DNSResult); ok {
+		for _, t := range dnsResult.Transactions {
+			im.domain("DNS.Query", t.Query)
+		}
+	}
+	if httpResult, ok := findResult(c, httpAnalyzerName).(*HTTPResult); ok {
+		for _, t := range httpResult.Transactions {
+			im.domain("HTTP.Host", t.Host)
+			if t.Host != "" {
+				im.url("HTTP.URL", t.Host+t.URI)
+			}
+		}
+	}
+	if tlsResult, ok := findResult(c, tlsAnalyzerName).(*TLSResult); ok {
+		im.ja3("TLS.JA3", tlsResult.JA3)
+		im.ja3("TLS.JA3S", tlsResult.JA3S)
+	}
+}
@@ -0,0 +1,170 @@
+package gourmet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+)
+
+// IPFIX (RFC 7011) export of connections to a flow collector. Each connection is sent as one data
+// record. Since IPFIX collectors over UDP cannot ask for templates, the templates are resent at the
+// configured refresh interval, as required by section 8.4 of the RFC.
+
+const (
+	ipfixVersion         = 10
+	ipfixTemplateSetID   = 2
+	ipfixIPv4TemplateID  = 256
+	ipfixIPv6TemplateID  = 257
+	ipfixMessageHdrLen   = 16
+	ipfixSetHdrLen       = 4
+	ipfixObservationID   = 0
+	ipfixProtocolTCP     = 6
+	ipfixProtocolUDP     = 17
+	ipfixProtocolICMP    = 1
+	ipfixProtocolICMPv6  = 58
+	ieSourceIPv4         = 8
+	ieDestinationIPv4    = 12
+	ieSourceIPv6         = 27
+	ieDestinationIPv6    = 28
+	ieSourcePort         = 7
+	ieDestinationPort    = 11
+	ieProtocol           = 4
+	ieTCPControlBits     = 6
+	ieTransportOctets    = 401
+	ieTransportPackets   = 402
+	ieFlowStartMillis    = 152
+	ieFlowEndMillis      = 153
+	ipfixDefaultTemplate = 600
+)
+
+type ipfixField struct {
+	id     uint16
+	length uint16
+}
+
+func ipfixTemplate(srcIE, dstIE, addrLen uint16) []ipfixField {
+	return []ipfixField{
+		{srcIE, addrLen},
+		{dstIE, addrLen},
+		{ieSourcePort, 2},
+		{ieDestinationPort, 2},
+		{ieProtocol, 1},
+		{ieTCPControlBits, 2},
+		{ieTransportOctets, 8},
+		{ieTransportPackets, 8},
+		{ieFlowStartMillis, 8},
+		{ieFlowEndMillis, 8},
+	}
+}
+
+var (
+	ipfixIPv4Fields = ipfixTemplate(ieSourceIPv4, ieDestinationIPv4, 4)
+	ipfixIPv6Fields = ipfixTemplate(ieSourceIPv6, ieDestinationIPv6, 16)
+)
+
+type ipfixExporter struct {
+	conn            net.Conn
+	templateRefresh time.Duration
+	mutex           sync.Mutex
+	lastTemplate    time.Time
+	sequence        uint32
+}
+
+func newIPFIXExporter(collector string, templateRefresh int) (*ipfixExporter, error) {
+	conn, err := net.Dial("udp", collector)
+	if err != nil {
+		return nil, err
+	}
+	if templateRefresh == 0 {
+		templateRefresh = ipfixDefaultTemplate
+	}
+	return &ipfixExporter{
+		conn:            conn,
+		templateRefresh: time.Second * time.Duration(templateRefresh),
+	}, nil
+}
+
+func (e *ipfixExporter) close() error {
+	return e.conn.Close()
+}
+
+func writeTemplateRecord(buf *bytes.Buffer, id uint16, fields []ipfixField) {
+	binary.Write(buf, binary.BigEndian, id)
+	binary.Write(buf, binary.BigEndian, uint16(len(fields)))
+	for _, f := range fields {
+		binary.Write(buf, binary.BigEndian, f.id)
+		binary.Write(buf, binary.BigEndian, f.length)
+	}
+}
+
+func writeSet(buf *bytes.Buffer, id uint16, contents []byte) {
+	binary.Write(buf, binary.BigEndian, id)
+	binary.Write(buf, binary.BigEndian, uint16(ipfixSetHdrLen+len(contents)))
+	buf.Write(contents)
+}
+
+func ipfixProtocol(transportType string) uint8 {
+	switch transportType {
+	case "tcp":
+		return ipfixProtocolTCP
+	case icmpTransport:
+		return ipfixProtocolICMP
+	case icmpv6Transport:
+		return ipfixProtocolICMPv6
+	}
+	return ipfixProtocolUDP
+}
+
+// export sends the connection to the collector as a single data record, preceded by the templates
+// when they are due for a refresh.
+func (e *ipfixExporter) export(c *Connection) error {
+	src := net.ParseIP(c.SourceIP)
+	dst := net.ParseIP(c.DestinationIP)
+	if src == nil || dst == nil {
+		return nil
+	}
+	templateID := uint16(ipfixIPv6TemplateID)
+	if src.To4() != nil && dst.To4() != nil {
+		templateID = ipfixIPv4TemplateID
+		src, dst = src.To4(), dst.To4()
+	}
+	start := c.Timestamp
+	end := start.Add(time.Duration(c.Duration * float64(time.Second)))
+	record := new(bytes.Buffer)
+	record.Write(src)
+	record.Write(dst)
+	binary.Write(record, binary.BigEndian, uint16(c.SourcePort))
+	binary.Write(record, binary.BigEndian, uint16(c.DestinationPort))
+	binary.Write(record, binary.BigEndian, ipfixProtocol(c.TransportType))
+	binary.Write(record, binary.BigEndian, uint16(c.tcpFlags))
+	binary.Write(record, binary.BigEndian, c.transportBytes)
+	binary.Write(record, binary.BigEndian, c.transportPackets)
+	binary.Write(record, binary.BigEndian, uint64(start.UnixNano()/int64(time.Millisecond)))
+	binary.Write(record, binary.BigEndian, uint64(end.UnixNano()/int64(time.Millisecond)))
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	sets := new(bytes.Buffer)
+	now := time.Now()
+	if now.Sub(e.lastTemplate) >= e.templateRefresh {
+		templates := new(bytes.Buffer)
+		writeTemplateRecord(templates, ipfixIPv4TemplateID, ipfixIPv4Fields)
+		writeTemplateRecord(templates, ipfixIPv6TemplateID, ipfixIPv6Fields)
+		writeSet(sets, ipfixTemplateSetID, templates.Bytes())
+		e.lastTemplate = now
+	}
+	writeSet(sets, templateID, record.Bytes())
+	message := new(bytes.Buffer)
+	binary.Write(message, binary.BigEndian, uint16(ipfixVersion))
+	binary.Write(message, binary.BigEndian, uint16(ipfixMessageHdrLen+sets.Len()))
+	binary.Write(message, binary.BigEndian, uint32(now.Unix()))
+	binary.Write(message, binary.BigEndian, e.sequence)
+	binary.Write(message, binary.BigEndian, uint32(ipfixObservationID))
+	message.Write(sets.Bytes())
+	// the sequence number counts data records, not messages
+	e.sequence++
+	_, err := e.conn.Write(message.Bytes())
+	return err
+}
@@ -0,0 +1,99 @@
+package gourmet
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ipTrie is a binary radix tree over the bits of IP addresses, used to match addresses against sets
+// of CIDR blocks with a longest-prefix lookup. IPv4 networks are stored in their IPv4-mapped IPv6
+// form, so that both address families share one tree.
+type ipTrie struct {
+	root trieNode
+	size int
+}
+
+type trieNode struct {
+	children [2]*trieNode
+	value    interface{}
+	set      bool
+}
+
+func newIPTrie() *ipTrie {
+	return &ipTrie{}
+}
+
+// parseNetwork parses a CIDR block. A bare IP address is treated as a network containing only that
+// address.
+func parseNetwork(network string) (*net.IPNet, error) {
+	network = strings.TrimSpace(network)
+	if !strings.Contains(network, "/") {
+		ip := net.ParseIP(network)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address or CIDR block %q", network)
+		}
+		bits := 128
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, ipNet, err := net.ParseCIDR(network)
+	if err != nil {
+		return nil, fmt.Errorf("invalid IP address or CIDR block %q", network)
+	}
+	return ipNet, nil
+}
+
+func ipBit(ip net.IP, i int) int {
+	return int(ip[i/8]>>(7-uint(i%8))) & 1
+}
+
+func (t *ipTrie) insert(network *net.IPNet, value interface{}) {
+	ones, bits := network.Mask.Size()
+	if bits == 32 {
+		ones += 96
+	}
+	ip := network.IP.To16()
+	node := &t.root
+	for i := 0; i < ones; i++ {
+		b := ipBit(ip, i)
+		if node.children[b] == nil {
+			node.children[b] = &trieNode{}
+		}
+		node = node.children[b]
+	}
+	if !node.set {
+		t.size++
+	}
+	node.value = value
+	node.set = true
+}
+
+// lookup returns the value of the most specific network containing ip.
+func (t *ipTrie) lookup(ip net.IP) (interface{}, bool) {
+	ip = ip.To16()
+	if ip == nil {
+		return nil, false
+	}
+	var value interface{}
+	var found bool
+	node := &t.root
+	for i := 0; node != nil; i++ {
+		if node.set {
+			value, found = node.value, true
+		}
+		if i == 128 {
+			break
+		}
+		node = node.children[ipBit(ip, i)]
+	}
+	return value, found
+}
+
+func (t *ipTrie) contains(ip string) bool {
+	_, found := t.lookup(net.ParseIP(ip))
+	return found
+}
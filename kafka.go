@@ -0,0 +1,107 @@
+package gourmet
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// kafkaFlushFrequency is how long messages may wait to be sent in a batch
+const kafkaFlushFrequency = 500 * time.Millisecond
+
+// kafkaOutput produces every connection as a message to a Kafka topic, in JSON unless another
+// encoding is set. Messages are keyed by the connection UID, and are sent in batches in the
+// background, so writes do not wait for the brokers. Messages that the leader of their partition
+// fails to acknowledge are logged. Stats records are produced to a topic of their own, without a
+// key.
+type kafkaOutput struct {
+	topic      string
+	statsTopic string
+	producer   sarama.AsyncProducer
+	encoder    logEncoder
+	// done is closed once the errors of the producer were all logged
+	done chan struct{}
+}
+
+func newKafkaOutput(args map[string]interface{}) (*kafkaOutput, error) {
+	brokers, err := outputStrings(args, "brokers")
+	if err != nil {
+		return nil, err
+	}
+	if len(brokers) == 0 {
+		return nil, errors.New("brokers must list at least one broker")
+	}
+	topic, err := outputString(args, "topic", "gourmet")
+	if err != nil {
+		return nil, err
+	}
+	statsTopic, err := outputString(args, "stats_topic", topic+"-stats")
+	if err != nil {
+		return nil, err
+	}
+	encoder, err := newLogEncoder(args, encodingNDJSON)
+	if err != nil {
+		return nil, err
+	}
+	config := sarama.NewConfig()
+	config.ClientID = "gourmet"
+	config.Producer.RequiredAcks = sarama.WaitForLocal
+	config.Producer.Flush.Frequency = kafkaFlushFrequency
+	config.Producer.Return.Errors = true
+	producer, err := sarama.NewAsyncProducer(brokers, config)
+	if err != nil {
+		return nil, err
+	}
+	ko := &kafkaOutput{
+		topic:      topic,
+		statsTopic: statsTopic,
+		producer:   producer,
+		encoder:    encoder,
+		done:       make(chan struct{}),
+	}
+	go ko.logErrors()
+	return ko, nil
+}
+
+// logErrors logs the messages that failed to be produced until the producer is closed.
+func (ko *kafkaOutput) logErrors() {
+	defer close(ko.done)
+	for err := range ko.producer.Errors() {
+		log.Printf("[!] Kafka output: %s", err)
+	}
+}
+
+func (ko *kafkaOutput) Write(c *Connection) error {
+	value, err := encodeMessage(ko.encoder, c)
+	if err != nil {
+		return err
+	}
+	ko.producer.Input() <- &sarama.ProducerMessage{
+		Topic: ko.topic,
+		Key:   sarama.StringEncoder(c.UID),
+		Value: sarama.ByteEncoder(value),
+	}
+	return nil
+}
+
+func (ko *kafkaOutput) writeStats(stats *SensorStats) error {
+	value, err := encodeStatsMessage(ko.encoder, stats)
+	if err != nil || value == nil {
+		return err
+	}
+	ko.producer.Input() <- &sarama.ProducerMessage{
+		Topic: ko.statsTopic,
+		Value: sarama.ByteEncoder(value),
+	}
+	return nil
+}
+
+// Close sends the messages that are still waiting, and returns once they were acknowledged or
+// failed.
+func (ko *kafkaOutput) Close() error {
+	ko.producer.AsyncClose()
+	<-ko.done
+	return nil
+}
@@ -1,18 +1,43 @@
 package gourmet
 
 import (
+	"fmt"
+
 	"github.com/google/gopacket/pcap"
 )
 
-func newLibpcapSensor(c *Config) (*pcap.Handle, error) {
+// newLibpcapSensor opens a live capture on the libpcap device of the interface, with the filter of
+// the interface.
+func newLibpcapSensor(c *Config, iface string, device *captureDevice) (*pcap.Handle, error) {
 	var handle *pcap.Handle
-	handle, err := pcap.OpenLive(c.Interface, int32(c.SnapLen), c.Promiscuous, pcap.BlockForever)
+	handle, err := pcap.OpenLive(device.device.Name, int32(c.SnapLen), c.Promiscuous, pcap.BlockForever)
 	if err != nil {
 		return nil, err
 	}
-	err = handle.SetBPFFilter(c.Bpf)
+	bpf := c.effectiveBpf(iface)
+	_, err = handle.CompileBPFFilter(bpf)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bpf filter %q for interface %s (link type %s): %s",
+			bpf, iface, handle.LinkType(), err)
+	}
+	err = handle.SetBPFFilter(bpf)
 	if err != nil {
 		return nil, err
 	}
 	return handle, nil
 }
+
+// newPcapFileSensor opens a capture file for replay, applying the global BPF filter.
+func newPcapFileSensor(c *Config) (*pcap.Handle, error) {
+	handle, err := pcap.OpenOffline(c.PcapFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open capture file %s: %s", c.PcapFile, err)
+	}
+	if c.Bpf != "" {
+		err = handle.SetBPFFilter(c.Bpf)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bpf filter %q for capture file %s: %s", c.Bpf, c.PcapFile, err)
+		}
+	}
+	return handle, nil
+}
@@ -5,48 +5,148 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"sync"
-)
-
-var (
-	gLogger *logger
+	"time"
 )
 
 type logger struct {
 	fileName string
-	mutex    sync.Mutex
+	// mutex is shared by the loggers of the same file, as the logger that a reload replaced writes
+	// the connections it was given while the new one already writes to the file
+	mutex *sync.Mutex
+	// partition is set when records are written into time partitioned directories
+	partition *partitioner
+	// rotator is set when the log file is rotated by size, which only applies without partitions
+	rotator  *logRotator
+	metadata *sensorMetadata
 }
 
 type logFile struct {
 	SensorMetadata *sensorMetadata
 	Connections    []Connection
+	ARPEvents      []ARPEvent    `json:",omitempty"`
+	Stats          []SensorStats `json:",omitempty"`
+}
+
+func newLogger(logName string, metadata *sensorMetadata, partitionTemplate string, rotator *logRotator, resume bool) (*logger, error) {
+	partition, err := newPartitioner(partitionTemplate, logName)
+	if err != nil {
+		return nil, err
+	}
+	l := &logger{
+		fileName:  logName,
+		mutex:     logFileMutex(logName),
+		partition: partition,
+		metadata:  metadata,
+	}
+	if partition == nil {
+		l.rotator = rotator
+	}
+	// partition files are created as their first record arrives
+	if partition != nil {
+		return l, nil
+	}
+	if resume && l.holdsLog(logName) {
+		return l, nil
+	}
+	err = l.create(logName)
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// logFileMutexes holds a mutex for each log file name
+var logFileMutexes sync.Map
+
+func logFileMutex(fileName string) *sync.Mutex {
+	m, _ := logFileMutexes.LoadOrStore(fileName, &sync.Mutex{})
+	return m.(*sync.Mutex)
 }
 
-func initLogger(logName string, interfaceName string) error {
-	f, err := os.Create(logName)
+// create starts a log file that holds only the metadata of the sensor.
+func (l *logger) create(fileName string) error {
+	f, err := os.Create(fileName)
 	if err != nil {
 		return err
 	}
+	defer f.Close()
 	logFile := &logFile{
-		SensorMetadata: getSensorMetadata(interfaceName),
+		SensorMetadata: l.metadata,
 	}
 	initJSON, err := json.MarshalIndent(logFile, "", "  ")
 	if err != nil {
 		return err
 	}
 	_, err = f.Write(initJSON)
+	return err
+}
+
+// holdsLog reports whether the file is a log file that records can be added to.
+func (l *logger) holdsLog(fileName string) bool {
+	contents, err := ioutil.ReadFile(fileName)
 	if err != nil {
-		return err
+		return false
 	}
-	gLogger = &logger{
-		fileName: logName,
+	var logfile logFile
+	return json.Unmarshal(contents, &logfile) == nil
+}
+
+// location describes where records are logged, with the placeholders of the partition template if
+// records are partitioned.
+func (l *logger) location() string {
+	if l.partition == nil {
+		return l.fileName
+	}
+	return filepath.Join(l.partition.dir, l.partition.template, l.partition.base)
+}
+
+// fileFor returns the log file that a record with the timestamp is written to, creating the file of
+// its partition if needed.
+func (l *logger) fileFor(t time.Time) string {
+	if l.partition == nil {
+		return l.fileName
+	}
+	fileName := l.partition.path(t)
+	if _, err := os.Stat(fileName); os.IsNotExist(err) {
+		err = os.MkdirAll(filepath.Dir(fileName), 0755)
+		if err == nil {
+			err = l.create(fileName)
+		}
+		if err != nil {
+			log.Printf("[!] Failed to create log partition %s: %s", fileName, err)
+		}
 	}
-	return nil
+	if previous := l.partition.advance(fileName, t); previous != "" {
+		rotated(previous)
+	}
+	return fileName
 }
 
 func (l *logger) log(c Connection) {
+	l.update(c.Timestamp, func(logfile *logFile) {
+		logfile.Connections = append(logfile.Connections, c)
+	})
+}
+
+func (l *logger) logARP(e ARPEvent) {
+	l.update(e.Timestamp, func(logfile *logFile) {
+		logfile.ARPEvents = append(logfile.ARPEvents, e)
+	})
+}
+
+func (l *logger) logStats(stats SensorStats) {
+	l.update(stats.Timestamp, func(logfile *logFile) {
+		logfile.Stats = append(logfile.Stats, stats)
+	})
+}
+
+// update reads the log file of the timestamp, applies the given change to it, and writes it back.
+func (l *logger) update(t time.Time, change func(*logFile)) {
 	l.mutex.Lock()
-	contents, err := ioutil.ReadFile(l.fileName)
+	fileName := l.fileFor(t)
+	contents, err := ioutil.ReadFile(fileName)
 	if err != nil {
 		log.Println(err)
 	}
@@ -55,14 +155,31 @@ func (l *logger) log(c Connection) {
 	if err != nil {
 		log.Println(err)
 	}
-	logfile.Connections = append(logfile.Connections, c)
+	change(&logfile)
 	newContents, err := json.MarshalIndent(logfile, "", "  ")
 	if err != nil {
 		log.Println(err)
 	}
-	err = ioutil.WriteFile(l.fileName, newContents, 0644)
+	err = ioutil.WriteFile(fileName, newContents, 0644)
 	if err != nil {
 		log.Println(err)
 	}
+	if l.rotator.due(len(newContents)) {
+		l.rotate()
+	}
 	l.mutex.Unlock()
 }
+
+// rotate moves the full log file aside and starts a new one. The mutex must be held.
+func (l *logger) rotate() {
+	backup, err := l.rotator.rotate(l.fileName, time.Now())
+	if err != nil {
+		log.Printf("[!] %s", err)
+		return
+	}
+	err = l.create(l.fileName)
+	if err != nil {
+		log.Printf("[!] Failed to start a new log file after rotation: %s", err)
+	}
+	go l.rotator.finish(l.fileName, backup)
+}
@@ -0,0 +1,193 @@
+package gourmet
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+)
+
+type memoryPressure int32
+
+const (
+	pressureNormal memoryPressure = iota
+	pressureHigh
+	pressureCritical
+)
+
+var pressureNames = [...]string{"normal", "high", "critical"}
+
+func (mp memoryPressure) String() string {
+	return pressureNames[mp]
+}
+
+const (
+	// fractions of the budget at which each level of pressure starts
+	pressureHighRatio     = 0.8
+	pressureCriticalRatio = 0.95
+	memorySampleInterval  = time.Second
+	memoryReportInterval  = time.Minute
+	// streams idle for longer than this are evicted while memory is critical
+	memoryEvictIdle = 5 * time.Second
+	// memoryMaxShedFlows bounds how many dropped flows are remembered while memory is critical, past
+	// which the packets of other dropped flows are counted again
+	memoryMaxShedFlows = 65536
+)
+
+// memoryBudget keeps the heap of the sensor within a configured budget by shedding load as it
+// approaches the limit, trading completeness for keeping the capture loop alive. Under high
+// pressure, TCP streams stop buffering payload, so connections are still logged but without their
+// remaining data. Under critical pressure, new TCP and UDP connections are dropped as well, and idle
+// streams are evicted from the connection table. A dropped flow is counted once, however many of its
+// packets follow while memory stays critical. The pressure and the counters are exported in the
+// metrics and the stats records. A nil memoryBudget never sheds anything.
+type memoryBudget struct {
+	limit         uint64
+	level         int32
+	inUse         uint64
+	payloadBytes  uint64
+	dropped       uint64
+	evicted       uint64
+	streamFactory *tcpStreamFactory
+	// shedFlows holds the hashes of the flows dropped since memory became critical
+	shedMutex sync.Mutex
+	shedFlows map[uint64]struct{}
+}
+
+func newMemoryBudget(mb int, tsf *tcpStreamFactory) *memoryBudget {
+	if mb <= 0 {
+		return nil
+	}
+	return &memoryBudget{
+		limit:         uint64(mb) << 20,
+		streamFactory: tsf,
+	}
+}
+
+func (mb *memoryBudget) pressure() memoryPressure {
+	if mb == nil {
+		return pressureNormal
+	}
+	return memoryPressure(atomic.LoadInt32(&mb.level))
+}
+
+// shedPayload reports whether a segment of n bytes should be discarded instead of buffered.
+func (mb *memoryBudget) shedPayload(n int) bool {
+	if mb.pressure() < pressureHigh {
+		return false
+	}
+	atomic.AddUint64(&mb.payloadBytes, uint64(n))
+	return true
+}
+
+// shedConnection reports whether a new connection of the flow should be dropped. flow identifies it
+// in both directions, as returned by flowHash or stringFlowHash.
+func (mb *memoryBudget) shedConnection(flow uint64) bool {
+	if mb.pressure() < pressureCritical {
+		return false
+	}
+	mb.shedMutex.Lock()
+	_, seen := mb.shedFlows[flow]
+	if !seen && len(mb.shedFlows) < memoryMaxShedFlows {
+		if mb.shedFlows == nil {
+			mb.shedFlows = make(map[uint64]struct{})
+		}
+		mb.shedFlows[flow] = struct{}{}
+	}
+	mb.shedMutex.Unlock()
+	if !seen {
+		atomic.AddUint64(&mb.dropped, 1)
+	}
+	return true
+}
+
+// shedFlow reports whether a new connection should be dropped, identifying its flow by the keys of
+// the flow table only while memory is critical.
+func (mb *memoryBudget) shedFlow(c *Connection) bool {
+	if mb.pressure() < pressureCritical {
+		return false
+	}
+	forward, reverse := flowKeys(c)
+	if reverse < forward {
+		forward = reverse
+	}
+	return mb.shedConnection(stringFlowHash(forward))
+}
+
+// flowHash identifies a flow by its network and transport flows, the same in both directions.
+func flowHash(network, transport gopacket.Flow) uint64 {
+	return network.FastHash()*31 + transport.FastHash()
+}
+
+// stringFlowHash identifies a flow by a key, which must be the same in both directions.
+func stringFlowHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+// counters returns the payload bytes shed and the connections dropped so far.
+func (mb *memoryBudget) counters() (payloadBytes, dropped uint64) {
+	if mb == nil {
+		return 0, 0
+	}
+	return atomic.LoadUint64(&mb.payloadBytes), atomic.LoadUint64(&mb.dropped)
+}
+
+// monitor samples the heap and adjusts the pressure until quit is closed.
+func (mb *memoryBudget) monitor(quit <-chan struct{}) {
+	var stats runtime.MemStats
+	lastReport := time.Now()
+	ticker := time.NewTicker(memorySampleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+		}
+		runtime.ReadMemStats(&stats)
+		atomic.StoreUint64(&mb.inUse, stats.HeapInuse)
+		level := pressureNormal
+		switch ratio := float64(stats.HeapInuse) / float64(mb.limit); {
+		case ratio >= pressureCriticalRatio:
+			level = pressureCritical
+		case ratio >= pressureHighRatio:
+			level = pressureHigh
+		}
+		previous := memoryPressure(atomic.SwapInt32(&mb.level, int32(level)))
+		if level != previous {
+			log.Printf("[!] Memory pressure is %s: %s", level, mb)
+		}
+		if level < pressureCritical && previous == pressureCritical {
+			mb.shedMutex.Lock()
+			mb.shedFlows = nil
+			mb.shedMutex.Unlock()
+		}
+		if level == pressureCritical {
+			mb.evict()
+			runtime.GC()
+		}
+		if time.Since(lastReport) >= memoryReportInterval {
+			log.Printf("[*] Memory: %s", mb)
+			lastReport = time.Now()
+		}
+	}
+}
+
+// evict flushes the streams that have been idle for a while, which frees their buffers.
+func (mb *memoryBudget) evict() {
+	closed := mb.streamFactory.flushOlderThan(mb.streamFactory.now().Add(-memoryEvictIdle))
+	atomic.AddUint64(&mb.evicted, uint64(closed))
+}
+
+func (mb *memoryBudget) String() string {
+	return fmt.Sprintf("%d of %d MiB in use, pressure %s, shed %d payload bytes, dropped %d new connections, evicted %d streams",
+		atomic.LoadUint64(&mb.inUse)>>20, mb.limit>>20, mb.pressure(), atomic.LoadUint64(&mb.payloadBytes),
+		atomic.LoadUint64(&mb.dropped), atomic.LoadUint64(&mb.evicted))
+}
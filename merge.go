@@ -0,0 +1,140 @@
+package gourmet
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	mergeByTuple    = "tuple"
+	mergeByHostPair = "host_pair"
+)
+
+// connectionMerger aggregates rapid reconnections into a single record, which reduces the log
+// volume of applications that open and close many short connections to the same endpoint. This
+// changes the one record per connection semantics of the log: a merged record describes the first
+// connection of a burst, with its UID and analyzer results, and MergedCount, MergedBytes, and
+// Duration cover every connection of the burst. A connection joins a pending record if it starts
+// within the window of the end of the previous connection with the same key, and the record is
+// logged once no connection joined it for a whole window. Both are measured on the clock of the
+// packets. Connections are keyed by their transport, host pair, and destination port, which leaves
+// out the ephemeral source port that every reconnection picks anew, or only by their transport and
+// host pair. Preliminary records are never merged.
+type connectionMerger struct {
+	window     time.Duration
+	byHostPair bool
+	emit       func(*Connection)
+	now        func() time.Time
+	// mutex also serializes emit, so that merged records are logged one at a time
+	mutex   sync.Mutex
+	pending map[string]*pendingMerge
+}
+
+type pendingMerge struct {
+	connection *Connection
+	// lastSeen is the end of the latest connection of the record
+	lastSeen time.Time
+}
+
+// newConnectionMerger returns nil if the window is not positive, which disables merging.
+func newConnectionMerger(window int, by string, emit func(*Connection), now func() time.Time) (*connectionMerger, error) {
+	if window <= 0 {
+		return nil, nil
+	}
+	var byHostPair bool
+	switch by {
+	case "", mergeByTuple:
+	case mergeByHostPair:
+		byHostPair = true
+	default:
+		return nil, errors.New("invalid merge_by. Must be tuple or host_pair")
+	}
+	return &connectionMerger{
+		window:     time.Millisecond * time.Duration(window),
+		byHostPair: byHostPair,
+		emit:       emit,
+		now:        now,
+		pending:    make(map[string]*pendingMerge),
+	}, nil
+}
+
+func (cm *connectionMerger) key(c *Connection) string {
+	if cm.byHostPair {
+		return fmt.Sprintf("%s|%s|%s", c.TransportType, c.SourceIP, c.DestinationIP)
+	}
+	return fmt.Sprintf("%s|%s|%s|%d", c.TransportType, c.SourceIP, c.DestinationIP, c.DestinationPort)
+}
+
+// add merges the connection into the pending record for its key, or starts a new pending record.
+// It returns false if the connection was merged away and will not be logged on its own.
+func (cm *connectionMerger) add(c *Connection) bool {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+	key := cm.key(c)
+	end := c.Timestamp.Add(time.Duration(c.Duration * float64(time.Second)))
+	pm, ok := cm.pending[key]
+	if ok && c.Timestamp.Sub(pm.lastSeen) > cm.window {
+		// the burst of the pending record is over
+		delete(cm.pending, key)
+		cm.emit(pm.connection)
+		ok = false
+	}
+	if !ok {
+		cm.pending[key] = &pendingMerge{connection: c, lastSeen: end}
+		return true
+	}
+	first := pm.connection
+	if first.MergedCount == 0 {
+		first.MergedCount = 1
+		first.MergedBytes = first.transportBytes
+	}
+	first.MergedCount++
+	first.MergedBytes += c.transportBytes
+	first.transportBytes += c.transportBytes
+	first.transportPackets += c.transportPackets
+	first.OrigBytes += c.OrigBytes
+	first.RespBytes += c.RespBytes
+	first.OrigPackets += c.OrigPackets
+	first.RespPackets += c.RespPackets
+	first.tcpFlags |= c.tcpFlags
+	if span := end.Sub(first.Timestamp).Seconds(); span > first.Duration {
+		first.Duration = span
+	}
+	if end.After(pm.lastSeen) {
+		pm.lastSeen = end
+	}
+	return false
+}
+
+// run logs the pending records that have not been joined for a window, until quit is closed.
+func (cm *connectionMerger) run(quit <-chan struct{}) {
+	interval := cm.window / 2
+	if interval < 100*time.Millisecond {
+		interval = 100 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+		}
+		cm.flush(cm.now().Add(-cm.window))
+	}
+}
+
+// flush logs the pending records last joined before the cutoff, or all of them if it is zero.
+func (cm *connectionMerger) flush(cutoff time.Time) {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+	for key, pm := range cm.pending {
+		if !cutoff.IsZero() && pm.lastSeen.After(cutoff) {
+			continue
+		}
+		delete(cm.pending, key)
+		cm.emit(pm.connection)
+	}
+}
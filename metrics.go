@@ -0,0 +1,210 @@
+package gourmet
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// metricsRateInterval is how often the connection rate is sampled
+const metricsRateInterval = 10 * time.Second
+
+// sensorMetrics exposes the counters of the sensor on /metrics in the Prometheus text format. Time is
+// exported as a sum and a count of observations, from which Prometheus derives averages and rates.
+// The connection rate is also exported as a gauge sampled every metricsRateInterval, for dashboards
+// that do not compute rates. A nil sensorMetrics records nothing, so the pipeline does not time
+// analyzers or log writes unless metrics are enabled.
+type sensorMetrics struct {
+	sensor      *sensor
+	listener    net.Listener
+	closed      int32
+	connections uint64
+	// connectionRate holds the bits of the float64 rate of connections per second
+	connectionRate uint64
+	logNanos       int64
+	logWrites      int64
+	// analyzers has an entry per analyzer ever registered, and is only written while analyzersLock is
+	// held for writing, so that it can be read under analyzersLock
+	analyzers map[string]*analyzerMetrics
+}
+
+type analyzerMetrics struct {
+	nanos  int64
+	calls  int64
+	errors int64
+}
+
+func newSensorMetrics(s *sensor, addr string) (*sensorMetrics, error) {
+	if addr == "" {
+		return nil, nil
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for metrics on %s: %s", addr, err)
+	}
+	sm := &sensorMetrics{
+		sensor:    s,
+		listener:  listener,
+		analyzers: make(map[string]*analyzerMetrics),
+	}
+	sm.addAnalyzers(currentAnalyzers())
+	return sm, nil
+}
+
+// addAnalyzers adds an entry for the analyzers that do not have one yet.
+func (sm *sensorMetrics) addAnalyzers(analyzers []*registeredAnalyzer) {
+	if sm == nil {
+		return
+	}
+	for _, ra := range analyzers {
+		if _, ok := sm.analyzers[ra.name]; !ok {
+			sm.analyzers[ra.name] = &analyzerMetrics{}
+		}
+	}
+}
+
+func (sm *sensorMetrics) start() time.Time {
+	if sm == nil {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+func (sm *sensorMetrics) addConnection() {
+	if sm == nil {
+		return
+	}
+	atomic.AddUint64(&sm.connections, 1)
+}
+
+func (sm *sensorMetrics) observeAnalyzer(name string, start time.Time, err error) {
+	if sm == nil {
+		return
+	}
+	am := sm.analyzers[name]
+	atomic.AddInt64(&am.nanos, int64(time.Since(start)))
+	atomic.AddInt64(&am.calls, 1)
+	if err != nil {
+		atomic.AddInt64(&am.errors, 1)
+	}
+}
+
+func (sm *sensorMetrics) observeLog(start time.Time) {
+	if sm == nil {
+		return
+	}
+	atomic.AddInt64(&sm.logNanos, int64(time.Since(start)))
+	atomic.AddInt64(&sm.logWrites, 1)
+}
+
+// sampleRate samples the connection rate until quit is closed.
+func (sm *sensorMetrics) sampleRate(quit <-chan struct{}) {
+	ticker := time.NewTicker(metricsRateInterval)
+	defer ticker.Stop()
+	previous := atomic.LoadUint64(&sm.connections)
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+		}
+		current := atomic.LoadUint64(&sm.connections)
+		rate := float64(current-previous) / metricsRateInterval.Seconds()
+		atomic.StoreUint64(&sm.connectionRate, math.Float64bits(rate))
+		previous = current
+	}
+}
+
+// serve answers scrapes until the server is closed.
+func (sm *sensorMetrics) serve() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", sm.metrics)
+	err := http.Serve(sm.listener, mux)
+	if err != nil && atomic.LoadInt32(&sm.closed) == 0 {
+		log.Printf("[!] Metrics server stopped: %s", err)
+	}
+}
+
+func (sm *sensorMetrics) close() {
+	atomic.StoreInt32(&sm.closed, 1)
+	sm.listener.Close()
+}
+
+func writeMetricHeader(w http.ResponseWriter, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func (sm *sensorMetrics) metrics(w http.ResponseWriter, r *http.Request) {
+	s := sm.sensor
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetricHeader(w, "gourmet_packets_captured_total", "counter", "Packets read from the packet sources.")
+	fmt.Fprintf(w, "gourmet_packets_captured_total %d\n", atomic.LoadUint64(&s.summary.packets))
+	writeMetricHeader(w, "gourmet_packets_dropped_total", "counter", "Packets dropped by the kernel, per packet source.")
+	sources := s.captureSources()
+	for _, src := range sources {
+		if drops, err := sourceDrops(src.source); err == nil {
+			fmt.Fprintf(w, "gourmet_packets_dropped_total{source=%q} %d\n", src.name, drops)
+		}
+	}
+	writeMetricHeader(w, "gourmet_capture_sources", "gauge", "Packet sources being captured on.")
+	fmt.Fprintf(w, "gourmet_capture_sources %d\n", len(sources))
+	writeMetricHeader(w, "gourmet_active_connections", "gauge", "Connections being tracked, per transport.")
+	fmt.Fprintf(w, "gourmet_active_connections{transport=\"tcp\"} %d\n", s.streamFactory.openStreams())
+	if s.quic != nil {
+		fmt.Fprintf(w, "gourmet_active_connections{transport=\"quic\"} %d\n", s.quic.open())
+	}
+	writeMetricHeader(w, "gourmet_connections_in_flight", "gauge", "Connections waiting to be analyzed and logged.")
+	fmt.Fprintf(w, "gourmet_connections_in_flight %d\n", atomic.LoadInt64(&s.inFlight))
+	writeMetricHeader(w, "gourmet_connections_total", "counter", "Connections analyzed, excluding preliminary records.")
+	fmt.Fprintf(w, "gourmet_connections_total %d\n", atomic.LoadUint64(&sm.connections))
+	if s.analyzers != nil {
+		writeMetricHeader(w, "gourmet_analyzer_queue_length", "gauge", "Connections waiting for an analyzer worker.")
+		fmt.Fprintf(w, "gourmet_analyzer_queue_length %d\n", len(s.analyzers.queue))
+		writeMetricHeader(w, "gourmet_analyzer_overflows_total", "counter", "Connections logged without analysis because the analyzer queue was full.")
+		fmt.Fprintf(w, "gourmet_analyzer_overflows_total %d\n", atomic.LoadUint64(&s.summary.overflows))
+	}
+	if s.sampler != nil {
+		writeMetricHeader(w, "gourmet_connections_unlogged_total", "counter", "Connections not written to the outputs because of log sampling or rate limiting.")
+		fmt.Fprintf(w, "gourmet_connections_unlogged_total %d\n", atomic.LoadUint64(&s.summary.unlogged))
+	}
+	if s.streamFactory.limit != nil {
+		writeMetricHeader(w, "gourmet_connections_evicted_total", "counter", "Connections evicted because the connection table held max_connections connections.")
+		fmt.Fprintf(w, "gourmet_connections_evicted_total %d\n", atomic.LoadUint64(&s.summary.evictions))
+	}
+	if budget := s.streamFactory.budget; budget != nil {
+		payloadBytes, dropped := budget.counters()
+		writeMetricHeader(w, "gourmet_memory_pressure", "gauge", "Memory pressure against memory_budget_mb: 0 normal, 1 high, 2 critical.")
+		fmt.Fprintf(w, "gourmet_memory_pressure %d\n", budget.pressure())
+		writeMetricHeader(w, "gourmet_memory_shed_payload_bytes_total", "counter", "Payload bytes discarded under memory pressure.")
+		fmt.Fprintf(w, "gourmet_memory_shed_payload_bytes_total %d\n", payloadBytes)
+		writeMetricHeader(w, "gourmet_memory_shed_connections_total", "counter", "New connections dropped while memory was critical.")
+		fmt.Fprintf(w, "gourmet_memory_shed_connections_total %d\n", dropped)
+	}
+	writeMetricHeader(w, "gourmet_connections_per_second", "gauge", "Connections analyzed per second over the last sampling interval.")
+	fmt.Fprintf(w, "gourmet_connections_per_second %g\n", math.Float64frombits(atomic.LoadUint64(&sm.connectionRate)))
+	analyzersLock.RLock()
+	defer analyzersLock.RUnlock()
+	var names []string
+	for name := range sm.analyzers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	writeMetricHeader(w, "gourmet_analyzer_duration_seconds", "summary", "Time spent in the Analyze method of each analyzer.")
+	for _, name := range names {
+		am := sm.analyzers[name]
+		fmt.Fprintf(w, "gourmet_analyzer_duration_seconds_sum{analyzer=%q} %g\n", name, time.Duration(atomic.LoadInt64(&am.nanos)).Seconds())
+		fmt.Fprintf(w, "gourmet_analyzer_duration_seconds_count{analyzer=%q} %d\n", name, atomic.LoadInt64(&am.calls))
+	}
+	writeMetricHeader(w, "gourmet_analyzer_errors_total", "counter", "Errors returned by the Analyze method of each analyzer.")
+	for _, name := range names {
+		fmt.Fprintf(w, "gourmet_analyzer_errors_total{analyzer=%q} %d\n", name, atomic.LoadInt64(&sm.analyzers[name].errors))
+	}
+	writeMetricHeader(w, "gourmet_log_write_duration_seconds", "summary", "Time spent writing connections to the log.")
+	fmt.Fprintf(w, "gourmet_log_write_duration_seconds_sum %g\n", time.Duration(atomic.LoadInt64(&sm.logNanos)).Seconds())
+	fmt.Fprintf(w, "gourmet_log_write_duration_seconds_count %d\n", atomic.LoadInt64(&sm.logWrites))
+}
@@ -0,0 +1,288 @@
+package gourmet
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// Output is a sink that analyzed connections are written to. Outputs are selected and stacked in
+// the outputs section of the config, and every connection is written to each of them in turn. Write
+// must be safe for concurrent use, as merged connections are logged from their own goroutine.
+// Outputs that implement io.Closer are closed when the sensor shuts down, after the last connection
+// was written.
+type Output interface {
+	Write(*Connection) error
+}
+
+const (
+	outputFile          = "file"
+	outputStdout        = "stdout"
+	outputSyslog        = "syslog"
+	outputKafka         = "kafka"
+	outputElasticsearch = "elasticsearch"
+	outputZeek          = "zeek"
+	outputGRPC          = "grpc"
+	outputEVE           = "eve"
+)
+
+type configuredOutput struct {
+	name   string
+	output Output
+	// args is the section of the output in the config
+	args map[string]interface{}
+}
+
+// newOutputs creates the outputs listed in the config, or the JSON log file if none are listed. An
+// output of reuse whose section is unchanged is kept instead of being created again, which keeps
+// its connections and log file going when the config is reloaded. If an output cannot be created,
+// those created before it are closed.
+func newOutputs(config *Config, reuse []configuredOutput, reloading bool) ([]configuredOutput, error) {
+	entries := config.Outputs
+	if len(entries) == 0 {
+		entries = []map[string]interface{}{{"type": outputFile}}
+	}
+	reused := make([]bool, len(reuse))
+	var outputs, created []configuredOutput
+entries:
+	for i, args := range entries {
+		for j, o := range reuse {
+			if !reused[j] && reflect.DeepEqual(o.args, args) {
+				reused[j] = true
+				outputs = append(outputs, o)
+				continue entries
+			}
+		}
+		kind, ok := args["type"].(string)
+		if !ok {
+			closeOutputs(created)
+			return nil, fmt.Errorf("output %d has no type", i+1)
+		}
+		var output Output
+		err := checkEncoding(kind, args)
+		if err == nil {
+			output, err = newOutput(config, kind, args, reloading)
+		}
+		if err != nil {
+			closeOutputs(created)
+			return nil, fmt.Errorf("unable to create output %s: %s", kind, err)
+		}
+		o := configuredOutput{name: kind, output: output, args: args}
+		created = append(created, o)
+		outputs = append(outputs, o)
+	}
+	return outputs, nil
+}
+
+// newOutput creates an output of the kind with the arguments of its section.
+func newOutput(config *Config, kind string, args map[string]interface{}, reloading bool) (Output, error) {
+	switch kind {
+	case outputFile:
+		return newFileOutput(config, reloading)
+	case outputStdout:
+		return newStreamOutput(os.Stdout, args)
+	case outputSyslog:
+		return newSyslogOutput(args)
+	case outputKafka:
+		return newKafkaOutput(args)
+	case outputElasticsearch:
+		return newElasticsearchOutput(args)
+	case outputZeek:
+		return newZeekOutput(args)
+	case outputGRPC:
+		return newGRPCOutput(args)
+	case outputEVE:
+		return newEVEOutput(args)
+	}
+	return nil, errors.New("invalid type. Must be file, stdout, syslog, kafka, elasticsearch, zeek, grpc, or eve")
+}
+
+// checkEncoding rejects the encoding argument on the outputs whose records always have the same
+// format. The file output is a single JSON document, which only takes json, and the zeek, grpc, and
+// eve outputs write formats of their own.
+func checkEncoding(kind string, args map[string]interface{}) error {
+	if _, ok := args["encoding"]; !ok {
+		return nil
+	}
+	switch kind {
+	case outputFile:
+		encoding, err := outputString(args, "encoding", encodingJSON)
+		if err != nil || encoding == encodingJSON {
+			return err
+		}
+		return errors.New("invalid encoding. The file output is always written as json")
+	case outputZeek, outputGRPC, outputEVE:
+		return fmt.Errorf("encoding does not apply to the %s output, which writes a format of its own", kind)
+	}
+	return nil
+}
+
+// closeOutputs closes every output that implements io.Closer.
+func closeOutputs(outputs []configuredOutput) {
+	for _, o := range outputs {
+		closer, ok := o.output.(io.Closer)
+		if !ok {
+			continue
+		}
+		err := closer.Close()
+		if err != nil {
+			log.Printf("[!] Failed to close output %s: %s", o.name, err)
+		}
+	}
+}
+
+// describeOutputs returns where connections are written, for the startup message.
+func describeOutputs(outputs []configuredOutput) string {
+	var locations []string
+	for _, o := range outputs {
+		if fo, ok := o.output.(*fileOutput); ok {
+			locations = append(locations, fo.logger.location())
+			continue
+		}
+		locations = append(locations, o.name)
+	}
+	return strings.Join(locations, ", ")
+}
+
+// outputString returns a string argument of an output, or fallback if it is not set.
+func outputString(args map[string]interface{}, key, fallback string) (string, error) {
+	value, ok := args[key]
+	if !ok {
+		return fallback, nil
+	}
+	s, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("%s must be a string", key)
+	}
+	return s, nil
+}
+
+// outputStrings returns a list argument of an output. A single string is accepted as a list of one.
+func outputStrings(args map[string]interface{}, key string) ([]string, error) {
+	switch value := args[key].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{value}, nil
+	case []interface{}:
+		var list []string
+		for _, v := range value {
+			s, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s must be a list of strings", key)
+			}
+			list = append(list, s)
+		}
+		return list, nil
+	}
+	return nil, fmt.Errorf("%s must be a list of strings", key)
+}
+
+// outputInt returns a positive integer argument of an output, or fallback if it is not set.
+func outputInt(args map[string]interface{}, key string, fallback int) (int, error) {
+	value, ok := args[key]
+	if !ok {
+		return fallback, nil
+	}
+	n, ok := value.(float64)
+	if !ok || n <= 0 || n != float64(int(n)) {
+		return 0, fmt.Errorf("%s must be a positive integer", key)
+	}
+	return int(n), nil
+}
+
+// fileOutput writes connections to the JSON log file, which also holds the sensor metadata, the ARP
+// events, and the stats records.
+type fileOutput struct {
+	logger *logger
+}
+
+// newFileOutput starts the log file, or continues the one that is already there when the outputs are
+// reloaded, so that a reload does not throw away the connections logged before it.
+func newFileOutput(config *Config, resume bool) (*fileOutput, error) {
+	rotator := newLogRotator(config.LogMaxSize, config.LogMaxAge, config.LogMaxBackups, config.LogCompress)
+	l, err := newLogger(config.LogFile, getSensorMetadata(config), config.LogPartition, rotator, resume)
+	if err != nil {
+		return nil, err
+	}
+	return &fileOutput{logger: l}, nil
+}
+
+func (fo *fileOutput) Write(c *Connection) error {
+	fo.logger.log(*c)
+	return nil
+}
+
+func (fo *fileOutput) writeStats(stats *SensorStats) error {
+	fo.logger.logStats(*stats)
+	return nil
+}
+
+// findFileOutput returns the file output among the outputs, or nil if there is none.
+func findFileOutput(outputs []configuredOutput) *fileOutput {
+	for _, o := range outputs {
+		if fo, ok := o.output.(*fileOutput); ok {
+			return fo
+		}
+	}
+	return nil
+}
+
+// streamOutput writes connections to a stream in its encoding, which is NDJSON by default, one
+// connection per line.
+type streamOutput struct {
+	mutex   sync.Mutex
+	w       io.Writer
+	encoder logEncoder
+	// started is set once the header of the encoding was written
+	started bool
+}
+
+func newStreamOutput(w io.Writer, args map[string]interface{}) (*streamOutput, error) {
+	encoder, err := newLogEncoder(args, encodingNDJSON)
+	if err != nil {
+		return nil, err
+	}
+	return &streamOutput{
+		w:       w,
+		encoder: encoder,
+	}, nil
+}
+
+func (so *streamOutput) Write(c *Connection) error {
+	record, err := so.encoder.encode(c)
+	if err != nil {
+		return err
+	}
+	return so.write(record)
+}
+
+// writeStats writes a stats record between the connections, unless the encoding has no place for it.
+func (so *streamOutput) writeStats(stats *SensorStats) error {
+	record, err := so.encoder.encodeStats(stats)
+	if err != nil || record == nil {
+		return err
+	}
+	return so.write(record)
+}
+
+func (so *streamOutput) write(record []byte) error {
+	so.mutex.Lock()
+	defer so.mutex.Unlock()
+	if !so.started {
+		so.started = true
+		if header := so.encoder.header(); header != nil {
+			_, err := so.w.Write(header)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	_, err := so.w.Write(record)
+	return err
+}
@@ -0,0 +1,51 @@
+package gourmet
+
+import (
+	"math"
+	"time"
+)
+
+// PacketTiming describes the gaps between consecutive packets sent in one direction of a
+// connection. MeanGap and Jitter are in seconds, where Jitter is the standard deviation of the gaps.
+type PacketTiming struct {
+	Gaps    int
+	MeanGap float64
+	Jitter  float64
+}
+
+// gapStats computes the mean and variance of inter-packet gaps in a streaming fashion (Welford's
+// algorithm), so that no per-packet timestamps need to be retained.
+type gapStats struct {
+	last time.Time
+	n    int
+	mean float64
+	m2   float64
+}
+
+func (gs *gapStats) add(timestamp time.Time) {
+	if !gs.last.IsZero() {
+		gap := timestamp.Sub(gs.last).Seconds()
+		if gap < 0 {
+			gap = 0
+		}
+		gs.n++
+		delta := gap - gs.mean
+		gs.mean += delta / float64(gs.n)
+		gs.m2 += delta * (gap - gs.mean)
+	}
+	if timestamp.After(gs.last) {
+		gs.last = timestamp
+	}
+}
+
+// timing returns the accumulated statistics, or nil if fewer than two packets were seen.
+func (gs *gapStats) timing() *PacketTiming {
+	if gs.n == 0 {
+		return nil
+	}
+	return &PacketTiming{
+		Gaps:    gs.n,
+		MeanGap: gs.mean,
+		Jitter:  math.Sqrt(gs.m2 / float64(gs.n)),
+	}
+}
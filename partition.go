@@ -0,0 +1,90 @@
+package gourmet
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// partitionFields are the placeholders of a partition template and the time layouts they are
+// replaced with
+var partitionFields = []struct {
+	name   string
+	layout string
+}{
+	{"{year}", "2006"},
+	{"{month}", "01"},
+	{"{day}", "02"},
+	{"{hour}", "15"},
+	{"{minute}", "04"},
+}
+
+// partitioner writes records into time partitioned directories for data lakes that expect layouts
+// such as year=2020/month=05/day=14/hour=09. The template is a relative path with the placeholders
+// {year}, {month}, {day}, {hour}, and {minute}, which are replaced with the UTC timestamp of each
+// record, so its finest placeholder sets the granularity of the partitions. Each partition holds a
+// log file with the name of log_file, in the directory of log_file. Once a record of a later
+// partition is logged, the previous partition is considered complete and handed to the rotation
+// hook. Records that arrive late are still added to the partition of their timestamp.
+type partitioner struct {
+	template string
+	dir      string
+	base     string
+	mutex    sync.Mutex
+	// current is the partition of the latest record logged so far
+	current string
+	latest  time.Time
+}
+
+func newPartitioner(template, logName string) (*partitioner, error) {
+	if template == "" {
+		return nil, nil
+	}
+	if filepath.IsAbs(template) || strings.Contains(template, "..") {
+		return nil, errors.New("log_partition must be a relative path below the directory of log_file")
+	}
+	found := false
+	for _, field := range partitionFields {
+		if strings.Contains(template, field.name) {
+			found = true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("log_partition %s has none of the placeholders {year}, {month}, {day}, {hour}, or {minute}", template)
+	}
+	return &partitioner{
+		template: template,
+		dir:      filepath.Dir(logName),
+		base:     filepath.Base(logName),
+	}, nil
+}
+
+// path returns the log file of the partition that the timestamp falls into.
+func (p *partitioner) path(t time.Time) string {
+	t = t.UTC()
+	partition := p.template
+	for _, field := range partitionFields {
+		partition = strings.Replace(partition, field.name, t.Format(field.layout), -1)
+	}
+	return filepath.Join(p.dir, partition, p.base)
+}
+
+// advance records that a record with the timestamp was logged to the partition at path. It returns
+// the previous partition if the record moved the partitions on from it, or an empty string.
+func (p *partitioner) advance(path string, t time.Time) string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if t.Before(p.latest) {
+		return ""
+	}
+	p.latest = t
+	if path == p.current {
+		return ""
+	}
+	previous := p.current
+	p.current = path
+	return previous
+}
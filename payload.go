@@ -0,0 +1,182 @@
+package gourmet
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+// Payload is the application layer data of a Connection, or of one direction of it. Small payloads
+// are kept in memory, while reassembled payloads larger than the configured spill threshold are
+// written to a temporary file, so that analyzers can read the full stream of large connections
+// without holding it in memory. The temporary file is removed once the connection has been logged,
+// so a Payload must not be used after the Analyzer that received it has returned.
+type Payload interface {
+	// Len returns the number of bytes in the payload.
+	Len() int
+	// Bytes returns the whole payload. A payload that was spilled to disk is read into memory, so
+	// analyzers that may see large connections should prefer Reader.
+	Bytes() []byte
+	// Reader returns a reader positioned at the start of the payload. Every call returns a new,
+	// independent reader.
+	Reader() io.Reader
+}
+
+// payloadBuffer is the Payload implementation used for all connections. It buffers writes in memory
+// until they exceed the threshold, and appends everything to a temporary file from then on. A zero
+// threshold keeps the payload in memory regardless of its size.
+type payloadBuffer struct {
+	mem       bytes.Buffer
+	file      *os.File
+	size      int
+	threshold int
+	dir       string
+}
+
+func newPayloadBuffer(threshold int, dir string) *payloadBuffer {
+	return &payloadBuffer{
+		threshold: threshold,
+		dir:       dir,
+	}
+}
+
+// newMemoryPayload returns a payload holding b, which is never spilled to disk
+func newMemoryPayload(b []byte) *payloadBuffer {
+	pb := &payloadBuffer{size: len(b)}
+	pb.mem.Write(b)
+	return pb
+}
+
+func (pb *payloadBuffer) Write(b []byte) (int, error) {
+	if pb.file == nil && pb.threshold > 0 && pb.size+len(b) > pb.threshold {
+		err := pb.spill()
+		if err != nil {
+			// keep the payload in memory rather than losing it
+			log.Printf("[!] Failed to spill payload to disk, keeping it in memory: %s", err)
+			pb.threshold = 0
+		}
+	}
+	var n int
+	var err error
+	if pb.file != nil {
+		n, err = pb.file.Write(b)
+	} else {
+		n, err = pb.mem.Write(b)
+	}
+	pb.size += n
+	return n, err
+}
+
+// spill moves the buffered payload into a new temporary file
+func (pb *payloadBuffer) spill() error {
+	file, err := ioutil.TempFile(pb.dir, "gourmet-payload-")
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(pb.mem.Bytes())
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+	pb.file = file
+	pb.mem = bytes.Buffer{}
+	return nil
+}
+
+func (pb *payloadBuffer) Len() int {
+	return pb.size
+}
+
+func (pb *payloadBuffer) Bytes() []byte {
+	if pb.file == nil {
+		return pb.mem.Bytes()
+	}
+	b, err := ioutil.ReadAll(pb.Reader())
+	if err != nil {
+		log.Printf("[!] Failed to read payload from %s: %s", pb.file.Name(), err)
+	}
+	return b
+}
+
+func (pb *payloadBuffer) Reader() io.Reader {
+	if pb.file == nil {
+		return bytes.NewReader(pb.mem.Bytes())
+	}
+	return io.NewSectionReader(pb.file, 0, int64(pb.size))
+}
+
+// readerAt returns random access to the payload written so far.
+func (pb *payloadBuffer) readerAt() io.ReaderAt {
+	if pb.file == nil {
+		return bytes.NewReader(pb.mem.Bytes())
+	}
+	return pb.file
+}
+
+// close removes the temporary file of a spilled payload
+func (pb *payloadBuffer) close() {
+	if pb.file == nil {
+		return
+	}
+	pb.file.Close()
+	os.Remove(pb.file.Name())
+	pb.file = nil
+	pb.size = 0
+}
+
+// payloadSegment is a range of a payload buffer
+type payloadSegment struct {
+	offset, length int
+}
+
+// directionPayload is the Payload of one direction of a TCP stream or a UDP flow. The reassembled
+// stream is buffered once, with both directions interleaved in the order they were reassembled, and
+// each direction is a view of the segments of the stream it sent. It must only be read once the
+// stream is complete.
+type directionPayload struct {
+	stream   *payloadBuffer
+	segments []payloadSegment
+	size     int
+}
+
+// add records that the stream buffer holds n bytes of this direction at offset. Consecutive writes
+// of the same direction are joined into one segment.
+func (dp *directionPayload) add(offset, n int) {
+	if n <= 0 {
+		return
+	}
+	if last := len(dp.segments) - 1; last >= 0 && dp.segments[last].offset+dp.segments[last].length == offset {
+		dp.segments[last].length += n
+	} else {
+		dp.segments = append(dp.segments, payloadSegment{offset, n})
+	}
+	dp.size += n
+}
+
+func (dp *directionPayload) Len() int {
+	return dp.size
+}
+
+func (dp *directionPayload) Bytes() []byte {
+	if len(dp.segments) == 1 && dp.stream.file == nil {
+		s := dp.segments[0]
+		return dp.stream.mem.Bytes()[s.offset : s.offset+s.length]
+	}
+	b, err := ioutil.ReadAll(dp.Reader())
+	if err != nil {
+		log.Printf("[!] Failed to read payload: %s", err)
+	}
+	return b
+}
+
+func (dp *directionPayload) Reader() io.Reader {
+	ra := dp.stream.readerAt()
+	readers := make([]io.Reader, len(dp.segments))
+	for i, s := range dp.segments {
+		readers[i] = io.NewSectionReader(ra, int64(s.offset), int64(s.length))
+	}
+	return io.MultiReader(readers...)
+}
@@ -0,0 +1,443 @@
+package gourmet
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+const (
+	pcapRingFormatPcap   = "pcap"
+	pcapRingFormatPcapng = "pcapng"
+	// pcapRingFlushInterval is how often buffered packets are written out, so that the packets of
+	// recent connections can be read from the current file
+	pcapRingFlushInterval = time.Second
+	// pcapHeaderLen and pcapRecordHeaderLen are the lengths of the file header and of the header of
+	// each packet of the pcap format
+	pcapHeaderLen       = 24
+	pcapRecordHeaderLen = 16
+	// pcapngRecordLen is the length of an enhanced packet block without its data and padding
+	pcapngRecordLen = 32
+	// pcapRingQueue is how many packets wait for the writer of the ring before the capture loops
+	// block on it
+	pcapRingQueue = 4096
+	// pcapRingMaxFlows bounds how many flows are indexed, past which the connections of new flows are
+	// logged without their CaptureLocation until old files are removed
+	pcapRingMaxFlows = 1 << 18
+)
+
+// CaptureLocation is where the packet ring wrote the packets of a connection. Files are the names
+// of the capture files that hold them, in the order they were written, and Offset is the offset of
+// the first packet of the connection in the first file.
+type CaptureLocation struct {
+	Files  []string
+	Offset int64
+}
+
+// packetRing writes every captured packet to a ring of pcap or pcapng files in a directory, like
+// tcpdump -C and -W. A file is closed once it reaches the file size, and the oldest file is removed
+// once the ring holds the configured number of files. Files are named after the capture time of
+// their first packet and their sequence number, so a name is never reused for other packets. The
+// ring indexes where the packets of each TCP and UDP flow were written, so that connections can
+// record their CaptureLocation. The files of earlier runs in the directory count toward the ring, so
+// restarts do not fill the disk.
+//
+// Packets are copied into a queue and written by a single goroutine, so that the capture loops do
+// not wait on each other or on the disk. The files and the writers are only touched by that
+// goroutine, and the mutex guards the index.
+type packetRing struct {
+	dir      string
+	format   string
+	fileSize int64
+	maxFiles int
+	snapLen  uint32
+	linkType layers.LinkType
+	records  chan ringRecord
+	done     chan struct{}
+	file     *os.File
+	buffer   *bufio.Writer
+	pcap     *pcapgo.Writer
+	ng       *pcapgo.NgWriter
+	// offset is the number of bytes written to the current file, and start the length of its header
+	offset   int64
+	start    int64
+	sequence int
+	// files are the paths of the files of the ring, oldest first
+	files []string
+	mutex sync.Mutex
+	// flows holds the location of the packets of each flow, by ringFlowKey, and fileFlows the keys
+	// of the flows whose first packet is in each file
+	flows     map[string]*CaptureLocation
+	fileFlows map[string][]string
+	// full is set once the index reached pcapRingMaxFlows, so that it is only reported once
+	full bool
+	// failed is set once a write failed, so that the error is only reported once until writes work
+	// again
+	failed bool
+}
+
+// ringRecord is a packet queued for the writer of the ring, with the key of its flow if it has one.
+type ringRecord struct {
+	ci   gopacket.CaptureInfo
+	data []byte
+	key  string
+}
+
+// newPacketRing returns the packet ring of the config, or nil if pcap_ring_dir is not set. Every
+// packet source must have the same link type, as a file holds packets of a single one.
+func newPacketRing(c *Config, sources []*captureSource) (*packetRing, error) {
+	if c.PcapRingDir == "" {
+		return nil, nil
+	}
+	err := os.MkdirAll(c.PcapRingDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	linkType := layers.LinkTypeEthernet
+	for i, src := range sources {
+		lt, ok := src.decoder.(layers.LinkType)
+		if !ok {
+			lt = layers.LinkTypeEthernet
+		}
+		if i > 0 && lt != linkType {
+			return nil, fmt.Errorf("%s has link type %s, but %s has %s, and the packets of a ring must share one",
+				src.name, lt, sources[0].name, linkType)
+		}
+		linkType = lt
+	}
+	format := c.PcapRingFormat
+	if format == "" {
+		format = pcapRingFormatPcap
+	}
+	if format != pcapRingFormatPcap && format != pcapRingFormatPcapng {
+		return nil, errors.New("invalid pcap_ring_format. Must be pcap or pcapng")
+	}
+	pr := &packetRing{
+		dir:       c.PcapRingDir,
+		format:    format,
+		fileSize:  int64(c.PcapRingFileSize) << 20,
+		maxFiles:  c.PcapRingFiles,
+		snapLen:   uint32(c.SnapLen),
+		linkType:  linkType,
+		records:   make(chan ringRecord, pcapRingQueue),
+		done:      make(chan struct{}),
+		flows:     make(map[string]*CaptureLocation),
+		fileFlows: make(map[string][]string),
+	}
+	err = pr.resume()
+	if err != nil {
+		return nil, err
+	}
+	return pr, nil
+}
+
+// resume adds the files that earlier runs left in the directory to the ring, oldest first, so that
+// they are removed in turn, and numbers new files after them.
+func (pr *packetRing) resume() error {
+	var files []string
+	for _, format := range []string{pcapRingFormatPcap, pcapRingFormatPcapng} {
+		matches, err := filepath.Glob(filepath.Join(pr.dir, "gourmet-*."+format))
+		if err != nil {
+			return err
+		}
+		files = append(files, matches...)
+	}
+	// names start with the capture time of their first packet, so they sort by age
+	sort.Strings(files)
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+		if i := strings.LastIndex(name, "-"); i >= 0 {
+			if sequence, err := strconv.Atoi(name[i+1:]); err == nil && sequence > pr.sequence {
+				pr.sequence = sequence
+			}
+		}
+	}
+	if len(files) > 0 {
+		log.Printf("[*] Capture ring continues after %d files in %s", len(files), pr.dir)
+	}
+	pr.files = files
+	return nil
+}
+
+// write queues a copy of a packet for the writer of the ring, waiting if the queue is full, so that
+// the ring keeps every packet.
+func (pr *packetRing) write(packet gopacket.Packet, ci gopacket.CaptureInfo, data []byte) {
+	key, _ := packetFlowKey(packet)
+	r := ringRecord{ci: ci, data: append([]byte(nil), data...), key: key}
+	select {
+	case pr.records <- r:
+	case <-pr.done:
+	}
+}
+
+// run writes the queued packets and flushes them every pcapRingFlushInterval until quit is closed,
+// then writes the packets left in the queue. Errors are passed to report, once until writes work
+// again.
+func (pr *packetRing) run(quit <-chan struct{}, report func(error)) {
+	defer close(pr.done)
+	ticker := time.NewTicker(pcapRingFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case r := <-pr.records:
+			pr.writeRecord(r, report)
+		case <-ticker.C:
+			if err := pr.flush(); err != nil {
+				log.Printf("[!] Failed to flush capture ring: %s", err)
+			}
+		case <-quit:
+			for {
+				select {
+				case r := <-pr.records:
+					pr.writeRecord(r, report)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// writeRecord appends a packet to the current file of the ring. Writes that keep failing are
+// dropped silently.
+func (pr *packetRing) writeRecord(r ringRecord, report func(error)) {
+	err := pr.writePacket(r)
+	if err != nil {
+		if !pr.failed {
+			pr.failed = true
+			report(fmt.Errorf("failed to write packet to capture ring, dropping packets until writes succeed: %s", err))
+		}
+		return
+	}
+	if pr.failed {
+		pr.failed = false
+		log.Println("[*] Writing packets to capture ring again")
+	}
+}
+
+// writePacket appends a packet to the current file of the ring, starting a new file first if it
+// would grow past the file size.
+func (pr *packetRing) writePacket(r ringRecord) error {
+	ci, data := r.ci, r.data
+	size := int64(pcapRecordHeaderLen + len(data))
+	if pr.format == pcapRingFormatPcapng {
+		size = int64(pcapngRecordLen + len(data))
+		size += (4 - size&3) & 3
+	}
+	if pr.file == nil || (pr.offset+size > pr.fileSize && pr.offset > pr.start) {
+		err := pr.rotate(ci.Timestamp)
+		if err != nil {
+			return err
+		}
+	}
+	var err error
+	if pr.ng != nil {
+		ci.InterfaceIndex = 0
+		err = pr.ng.WritePacket(ci, data)
+	} else {
+		err = pr.pcap.WritePacket(ci, data)
+	}
+	if err != nil {
+		return err
+	}
+	if r.key != "" {
+		pr.index(r.key, pr.file.Name(), pr.offset)
+	}
+	pr.offset += size
+	return nil
+}
+
+// index records that a packet of a flow was written at the offset of a file.
+func (pr *packetRing) index(key, file string, offset int64) {
+	pr.mutex.Lock()
+	defer pr.mutex.Unlock()
+	location, ok := pr.flows[key]
+	if !ok {
+		if len(pr.flows) >= pcapRingMaxFlows {
+			if !pr.full {
+				pr.full = true
+				log.Printf("[!] Capture ring indexes %d flows, new connections are not located until old files are removed", len(pr.flows))
+			}
+			return
+		}
+		pr.flows[key] = &CaptureLocation{Files: []string{file}, Offset: offset}
+		pr.fileFlows[file] = append(pr.fileFlows[file], key)
+		return
+	}
+	if location.Files[len(location.Files)-1] != file {
+		location.Files = append(location.Files, file)
+	}
+}
+
+// rotate closes the current file, removes the oldest files beyond the size of the ring, and starts a
+// new file named after the capture time of its first packet.
+func (pr *packetRing) rotate(first time.Time) error {
+	err := pr.closeFile()
+	if err != nil {
+		return err
+	}
+	for len(pr.files) >= pr.maxFiles {
+		oldest := pr.files[0]
+		pr.files = pr.files[1:]
+		err = os.Remove(oldest)
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("[!] Failed to remove capture file %s: %s", oldest, err)
+		}
+		pr.forget(oldest)
+	}
+	pr.sequence++
+	name := fmt.Sprintf("gourmet-%s-%06d.%s", first.UTC().Format("20060102T150405"), pr.sequence, pr.format)
+	f, err := os.OpenFile(filepath.Join(pr.dir, name), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	pr.files = append(pr.files, f.Name())
+	err = pr.startFile(f)
+	if err != nil {
+		f.Close()
+		pr.buffer, pr.pcap, pr.ng = nil, nil, nil
+		return err
+	}
+	pr.file = f
+	return nil
+}
+
+// startFile writes the header of a new file of the ring.
+func (pr *packetRing) startFile(f *os.File) (err error) {
+	if pr.format == pcapRingFormatPcapng {
+		intf := pcapgo.DefaultNgInterface
+		intf.LinkType = pr.linkType
+		intf.SnapLength = pr.snapLen
+		options := pcapgo.DefaultNgWriterOptions
+		options.SectionInfo.Application = "gourmet"
+		// the pcapng writer buffers on its own, so it writes to the file directly
+		pr.ng, err = pcapgo.NewNgWriterInterface(f, intf, options)
+		if err == nil {
+			err = pr.ng.Flush()
+		}
+		if err != nil {
+			return err
+		}
+		pr.start, err = f.Seek(0, io.SeekCurrent)
+		pr.offset = pr.start
+		return err
+	}
+	pr.buffer = bufio.NewWriter(f)
+	pr.pcap = pcapgo.NewWriterNanos(pr.buffer)
+	pr.start, pr.offset = pcapHeaderLen, pcapHeaderLen
+	return pr.pcap.WriteFileHeader(pr.snapLen, pr.linkType)
+}
+
+// forget drops the flows whose first packet was in a file that was removed. A key may have been
+// located and indexed again in a later file since, which is kept.
+func (pr *packetRing) forget(file string) {
+	pr.mutex.Lock()
+	defer pr.mutex.Unlock()
+	for _, key := range pr.fileFlows[file] {
+		if location, ok := pr.flows[key]; ok && location.Files[0] == file {
+			delete(pr.flows, key)
+		}
+	}
+	delete(pr.fileFlows, file)
+	pr.full = false
+}
+
+func (pr *packetRing) flush() error {
+	if pr.ng != nil {
+		return pr.ng.Flush()
+	}
+	if pr.buffer != nil {
+		return pr.buffer.Flush()
+	}
+	return nil
+}
+
+func (pr *packetRing) closeFile() error {
+	if pr.file == nil {
+		return nil
+	}
+	err := pr.flush()
+	closeErr := pr.file.Close()
+	pr.file, pr.buffer, pr.pcap, pr.ng = nil, nil, nil, nil
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// locate sets the CaptureLocation of a connection from the packets of its flow that were written.
+// The flow is forgotten once its final record is located, so that the next connection with the same
+// endpoints starts over.
+func (pr *packetRing) locate(c *Connection) {
+	key, ok := connectionFlowKey(c)
+	if !ok {
+		return
+	}
+	pr.mutex.Lock()
+	defer pr.mutex.Unlock()
+	location, ok := pr.flows[key]
+	if !ok {
+		return
+	}
+	c.Capture = &CaptureLocation{Files: append([]string(nil), location.Files...), Offset: location.Offset}
+	if !c.Preliminary {
+		delete(pr.flows, key)
+	}
+}
+
+// close waits for the writer of the ring to write the queued packets, and closes the current file.
+// The quit channel of the writer must be closed.
+func (pr *packetRing) close() error {
+	<-pr.done
+	return pr.closeFile()
+}
+
+// packetFlowKey returns the key of the TCP or UDP flow of a packet, which is the same in both
+// directions.
+func packetFlowKey(packet gopacket.Packet) (string, bool) {
+	network, transport := packet.NetworkLayer(), packet.TransportLayer()
+	if network == nil || transport == nil {
+		return "", false
+	}
+	var proto string
+	switch transport.LayerType() {
+	case layers.LayerTypeTCP:
+		proto = "tcp"
+	case layers.LayerTypeUDP:
+		proto = "udp"
+	default:
+		return "", false
+	}
+	srcIP, dstIP := processAddresses(network.NetworkFlow())
+	srcPort, dstPort := processPorts(transport.TransportFlow())
+	return ringFlowKey(proto, srcIP, srcPort, dstIP, dstPort), true
+}
+
+// connectionFlowKey returns the key of the flow of a TCP or UDP connection.
+func connectionFlowKey(c *Connection) (string, bool) {
+	if c.TransportType != "tcp" && c.TransportType != "udp" {
+		return "", false
+	}
+	return ringFlowKey(c.TransportType, c.SourceIP, c.SourcePort, c.DestinationIP, c.DestinationPort), true
+}
+
+func ringFlowKey(proto, srcIP string, srcPort int, dstIP string, dstPort int) string {
+	src, dst := quicEndpoint(srcIP, srcPort), quicEndpoint(dstIP, dstPort)
+	if dst < src {
+		src, dst = dst, src
+	}
+	return proto + "|" + src + "|" + dst
+}
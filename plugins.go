@@ -0,0 +1,388 @@
+package gourmet
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// pluginManifestFile is the name of the manifest in the plugins directory
+const pluginManifestFile = "manifest.json"
+
+// Plugin is an analyzer plugin installed with `gourmet plugin install`. Name is the name under which
+// the analyzer is listed in the analyzers config, which is its repository path, such as
+// github.com/gourmetproject/simple_analyzer. Version is the closest tag of the checked out commit as
+// given by git describe, or the abbreviated commit if the repository has no tag. Revision is the tag
+// or commit that the plugin was installed or updated at, if it was given one, and a plugin with a
+// revision stays at it until it is updated to another.
+type Plugin struct {
+	Name        string    `json:"name"`
+	Repository  string    `json:"repository"`
+	Revision    string    `json:"revision,omitempty"`
+	Version     string    `json:"version"`
+	Commit      string    `json:"commit"`
+	InstalledAt time.Time `json:"installed_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// pluginManifest records the installed plugins, in manifest.json of the plugins directory
+type pluginManifest struct {
+	Plugins map[string]*Plugin `json:"plugins"`
+}
+
+// PluginsDir returns the directory that plugins are installed in, ~/.gourmet/plugins.
+func PluginsDir() (string, error) {
+	usr, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(usr.HomeDir, ".gourmet/plugins/"), nil
+}
+
+func readPluginManifest(pluginsDir string) (*pluginManifest, error) {
+	manifest := &pluginManifest{Plugins: make(map[string]*Plugin)}
+	contents, err := ioutil.ReadFile(filepath.Join(pluginsDir, pluginManifestFile))
+	if os.IsNotExist(err) {
+		return manifest, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(contents, manifest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the plugin manifest: %s", err)
+	}
+	if manifest.Plugins == nil {
+		manifest.Plugins = make(map[string]*Plugin)
+	}
+	return manifest, nil
+}
+
+// write replaces the manifest through a temporary file, so that it is never left half written.
+func (pm *pluginManifest) write(pluginsDir string) error {
+	contents, err := json.MarshalIndent(pm, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(pluginsDir, 0755)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(pluginsDir, pluginManifestFile)
+	err = ioutil.WriteFile(path+".tmp", append(contents, '\n'), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// splitRevision splits a plugin argument of the form repo@revision.
+func splitRevision(arg string) (repo, revision string) {
+	i := strings.LastIndex(arg, "@")
+	if i < 0 || i < strings.LastIndex(arg, "/") {
+		return arg, ""
+	}
+	return arg[:i], arg[i+1:]
+}
+
+// pluginName returns the name of the plugin in a repository, which is its URL without the scheme or
+// the .git suffix, and the URL to clone it from.
+func pluginName(repo string) (name, url string) {
+	name = strings.TrimSuffix(strings.TrimSuffix(repo, "/"), ".git")
+	if i := strings.Index(name, "://"); i >= 0 {
+		return name[i+3:], repo
+	}
+	return name, "https://" + name
+}
+
+// pluginPath returns the directory of a plugin in the plugins directory. Names come from the command
+// line and the config, so names that are absolute or have empty, . or .. elements are rejected
+// rather than resolved to a directory outside of the plugins directory, or to one that holds other
+// plugins.
+func pluginPath(pluginsDir, name string) (string, error) {
+	if name == "" || strings.HasPrefix(name, "/") || strings.Contains(name, "\\") || filepath.IsAbs(name) {
+		return "", fmt.Errorf("invalid plugin name %q", name)
+	}
+	for _, element := range strings.Split(name, "/") {
+		if element == "" || element == "." || element == ".." {
+			return "", fmt.Errorf("invalid plugin name %q", name)
+		}
+	}
+	dir := filepath.Join(pluginsDir, filepath.FromSlash(name))
+	rel, err := filepath.Rel(pluginsDir, dir)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid plugin name %q", name)
+	}
+	return dir, nil
+}
+
+// nestedPlugin returns an installed plugin whose directory holds that of the named plugin, or is
+// held by it, as one could not be removed without the other.
+func (m *pluginManifest) nestedPlugin(name string) string {
+	for installed := range m.Plugins {
+		if strings.HasPrefix(installed, name+"/") || strings.HasPrefix(name, installed+"/") {
+			return installed
+		}
+	}
+	return ""
+}
+
+// InstallPlugin clones the analyzer plugin in repo into the plugins directory and records it in the
+// manifest. The repository can be given as a URL, or as a path like github.com/user/analyzer, which
+// is cloned over HTTPS, and may be followed by @ and the tag or commit to check out.
+func InstallPlugin(repo string) (*Plugin, error) {
+	pluginsDir, err := PluginsDir()
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := readPluginManifest(pluginsDir)
+	if err != nil {
+		return nil, err
+	}
+	repo, revision := splitRevision(repo)
+	name, url := pluginName(repo)
+	if name == "" {
+		return nil, errors.New("no plugin repository given")
+	}
+	if _, ok := manifest.Plugins[name]; ok {
+		return nil, fmt.Errorf("%s is already installed. Use gourmet plugin update %s to update it", name, name)
+	}
+	if nested := manifest.nestedPlugin(name); nested != "" {
+		return nil, fmt.Errorf("%s cannot be installed alongside %s, as the directory of one holds the other", name, nested)
+	}
+	pluginDir, err := pluginPath(pluginsDir, name)
+	if err != nil {
+		return nil, err
+	}
+	exists, err := dirExists(pluginDir)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		// only directories listed in the manifest are ever removed, so that a name cannot delete
+		// files that were not installed as that plugin
+		return nil, fmt.Errorf("%s already exists, but is not an installed plugin. Move it away to install %s", pluginDir, name)
+	}
+	err = runGit("", "clone", url, pluginDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to install %s: %s", name, err)
+	}
+	if revision != "" {
+		err = runGit(pluginDir, "checkout", "--quiet", revision)
+		if err != nil {
+			os.RemoveAll(pluginDir)
+			return nil, fmt.Errorf("failed to check out %s of %s: %s", revision, name, err)
+		}
+	}
+	_, err = os.Stat(filepath.Join(pluginDir, "main.go"))
+	if err != nil {
+		os.RemoveAll(pluginDir)
+		return nil, fmt.Errorf("%s is not an analyzer plugin, it has no main.go", name)
+	}
+	now := time.Now()
+	p := &Plugin{
+		Name:        name,
+		Repository:  url,
+		Revision:    revision,
+		InstalledAt: now,
+		UpdatedAt:   now,
+	}
+	err = p.readVersion(pluginDir)
+	if err != nil {
+		return nil, err
+	}
+	manifest.Plugins[name] = p
+	return p, manifest.write(pluginsDir)
+}
+
+// UpdatePlugin pulls the latest commit of an installed plugin, or checks out the tag or commit given
+// after @ in name. A plugin that was given a revision can only be updated to another revision. A
+// sensor that is running picks the update up when its analyzers are reloaded.
+func UpdatePlugin(name string) (*Plugin, error) {
+	pluginsDir, err := PluginsDir()
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := readPluginManifest(pluginsDir)
+	if err != nil {
+		return nil, err
+	}
+	name, revision := splitRevision(name)
+	name, _ = pluginName(name)
+	p, ok := manifest.Plugins[name]
+	if !ok {
+		return nil, fmt.Errorf("%s is not installed", name)
+	}
+	pluginDir, err := pluginPath(pluginsDir, name)
+	if err != nil {
+		return nil, err
+	}
+	if revision != "" {
+		err = runGit(pluginDir, "fetch", "--quiet", "--tags", "origin")
+		if err == nil {
+			err = runGit(pluginDir, "checkout", "--quiet", revision)
+		}
+	} else if p.Revision != "" {
+		return nil, fmt.Errorf("%s is pinned to %s. Give the revision to update to as %s@<tag or commit>", name, p.Revision, name)
+	} else {
+		err = runGit(pluginDir, "pull", "--ff-only")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to update %s: %s", name, err)
+	}
+	p.Revision = revision
+	err = p.readVersion(pluginDir)
+	if err != nil {
+		return nil, err
+	}
+	p.UpdatedAt = time.Now()
+	return p, manifest.write(pluginsDir)
+}
+
+// RemovePlugin deletes an installed plugin and removes it from the manifest.
+func RemovePlugin(name string) error {
+	pluginsDir, err := PluginsDir()
+	if err != nil {
+		return err
+	}
+	manifest, err := readPluginManifest(pluginsDir)
+	if err != nil {
+		return err
+	}
+	name, _ = pluginName(name)
+	if _, ok := manifest.Plugins[name]; !ok {
+		return fmt.Errorf("%s is not installed", name)
+	}
+	pluginDir, err := pluginPath(pluginsDir, name)
+	if err != nil {
+		return err
+	}
+	err = os.RemoveAll(pluginDir)
+	if err != nil {
+		return err
+	}
+	delete(manifest.Plugins, name)
+	return manifest.write(pluginsDir)
+}
+
+// ListPlugins returns the installed plugins, sorted by name.
+func ListPlugins() ([]*Plugin, error) {
+	pluginsDir, err := PluginsDir()
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := readPluginManifest(pluginsDir)
+	if err != nil {
+		return nil, err
+	}
+	var plugins []*Plugin
+	for _, p := range manifest.Plugins {
+		plugins = append(plugins, p)
+	}
+	sort.Slice(plugins, func(i, j int) bool {
+		return plugins[i].Name < plugins[j].Name
+	})
+	return plugins, nil
+}
+
+// readVersion sets the version and commit of the plugin from its checkout.
+func (p *Plugin) readVersion(pluginDir string) error {
+	commit, err := gitOutput(pluginDir, "rev-parse", "HEAD")
+	if err != nil {
+		return err
+	}
+	version, err := gitOutput(pluginDir, "describe", "--tags", "--always")
+	if err != nil {
+		return err
+	}
+	p.Commit = commit
+	p.Version = version
+	return nil
+}
+
+// runGit runs git in dir, and returns its error output along with its error if it fails.
+func runGit(dir string, args ...string) error {
+	_, err := gitOutput(dir, args...)
+	return err
+}
+
+func gitOutput(dir string, args ...string) (string, error) {
+	if dir != "" {
+		args = append([]string{"-C", dir}, args...)
+	}
+	cmd := exec.Command("git", args...)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("%s: %s", err, msg)
+		}
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// verifyPlugin checks that an installed plugin is checked out at the revision it is pinned to,
+// without local changes, and that its main.go has the pinned checksum, before it is built.
+func verifyPlugin(pluginsDir, name, revision, checksum string) error {
+	pluginDir, err := pluginPath(pluginsDir, name)
+	if err != nil {
+		return err
+	}
+	if revision != "" {
+		changes, err := gitOutput(pluginDir, "status", "--porcelain")
+		if err != nil {
+			return fmt.Errorf("failed to verify %s: %s", name, err)
+		}
+		if changes != "" {
+			return fmt.Errorf("%s has local changes, refusing to build it at its pinned revision %s", name, revision)
+		}
+		want, err := gitOutput(pluginDir, "rev-parse", "--verify", "--quiet", revision+"^{commit}")
+		if err != nil {
+			return fmt.Errorf("%s has no revision %s. Check it out with: gourmet plugin update %s@%s", name, revision, name, revision)
+		}
+		head, err := gitOutput(pluginDir, "rev-parse", "HEAD")
+		if err != nil {
+			return fmt.Errorf("failed to verify %s: %s", name, err)
+		}
+		if head != want {
+			return fmt.Errorf("%s is checked out at %s, not at its pinned revision %s (%s)", name, head, revision, want)
+		}
+	}
+	if checksum != "" {
+		got, err := fileSHA256(filepath.Join(pluginDir, "main.go"))
+		if err != nil {
+			return err
+		}
+		if got != checksum {
+			return fmt.Errorf("main.go of %s has the SHA-256 checksum %s, not its pinned checksum %s", name, got, checksum)
+		}
+	}
+	return nil
+}
+
+// installedAnalyzer returns the path of the main.go of an installed analyzer plugin.
+func installedAnalyzer(pluginsDir, name string) (string, error) {
+	pluginDir, err := pluginPath(pluginsDir, name)
+	if err != nil {
+		return "", err
+	}
+	mainPath := filepath.Join(pluginDir, "main.go")
+	_, err = os.Stat(mainPath)
+	if os.IsNotExist(err) {
+		return "", fmt.Errorf("analyzer %s is not installed. Install it with: gourmet plugin install %s", name, name)
+	}
+	if err != nil {
+		return "", err
+	}
+	return mainPath, nil
+}
@@ -0,0 +1,111 @@
+package gourmet
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// pmtuRetention is how long an ICMP report is kept for a flow that has no open TCP stream yet
+const pmtuRetention = 5 * time.Minute
+
+// pmtuReport is the next-hop MTU reported by an ICMP fragmentation needed or packet too big
+// message for a flow
+type pmtuReport struct {
+	mtu  int
+	seen time.Time
+}
+
+// parsePMTUMessage returns the flow of the TCP segment quoted in an ICMP fragmentation needed or
+// ICMPv6 packet too big message, along with the MTU it reports.
+func parsePMTUMessage(packet gopacket.Packet) (key flowKey, mtu int, ok bool) {
+	var quoted []byte
+	if icmp, isICMP := packet.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4); isICMP {
+		if icmp.TypeCode != layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodeFragmentationNeeded) {
+			return key, 0, false
+		}
+		// the next-hop MTU is carried in the second half of the rest of the header
+		mtu, quoted = int(icmp.Seq), icmp.Payload
+	} else if icmp, isICMP := packet.Layer(layers.LayerTypeICMPv6).(*layers.ICMPv6); isICMP {
+		if icmp.TypeCode.Type() != layers.ICMPv6TypePacketTooBig || len(icmp.Payload) < 4 {
+			return key, 0, false
+		}
+		mtu, quoted = int(binary.BigEndian.Uint32(icmp.Payload)), icmp.Payload[4:]
+	} else {
+		return key, 0, false
+	}
+	var net gopacket.Flow
+	var offset int
+	switch {
+	case len(quoted) >= 20 && quoted[0]>>4 == 4:
+		offset = int(quoted[0]&0x0f) * 4
+		if quoted[9] != byte(layers.IPProtocolTCP) {
+			return key, 0, false
+		}
+		net = gopacket.NewFlow(layers.EndpointIPv4, quoted[12:16], quoted[16:20])
+	case len(quoted) >= 40 && quoted[0]>>4 == 6:
+		offset = 40
+		if quoted[6] != byte(layers.IPProtocolTCP) {
+			return key, 0, false
+		}
+		net = gopacket.NewFlow(layers.EndpointIPv6, quoted[8:24], quoted[24:40])
+	default:
+		return key, 0, false
+	}
+	if len(quoted) < offset+4 {
+		return key, 0, false
+	}
+	transport := gopacket.NewFlow(layers.EndpointTCPPort, quoted[offset:offset+2], quoted[offset+2:offset+4])
+	return flowKey{net, transport}, mtu, true
+}
+
+// observePMTU records the MTU reported by an ICMP message for the TCP flow it quotes, so that the
+// connection can be flagged when its stream completes.
+func (tsf *tcpStreamFactory) observePMTU(packet gopacket.Packet, ci gopacket.CaptureInfo) {
+	key, mtu, ok := parsePMTUMessage(packet)
+	if !ok {
+		return
+	}
+	// the message comes back on the VLAN and through the tunnel of the flow
+	key.net = zonedFlow(key.net, captureZone(ci))
+	sh := tsf.shardOf(key.net, key.transport)
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
+	report := sh.pmtu[key]
+	if report.mtu == 0 || mtu < report.mtu {
+		report.mtu = mtu
+	}
+	report.seen = ci.Timestamp
+	sh.pmtu[key] = report
+}
+
+// expirePMTU drops the reports of every shard that were last seen before t, for flows that never
+// turned up.
+func (tsf *tcpStreamFactory) expirePMTU(t time.Time) {
+	for _, sh := range tsf.shards {
+		sh.mutex.Lock()
+		for key, report := range sh.pmtu {
+			if report.seen.Before(t) {
+				delete(sh.pmtu, key)
+			}
+		}
+		sh.mutex.Unlock()
+	}
+}
+
+// takePMTU returns the smallest MTU reported for either direction of a flow, and forgets the reports.
+// It must be called with the mutex of the shard held.
+func (sh *tcpShard) takePMTU(net, transport gopacket.Flow) int {
+	mtu := 0
+	for _, key := range []flowKey{{net, transport}, {net.Reverse(), transport.Reverse()}} {
+		if report, ok := sh.pmtu[key]; ok {
+			if mtu == 0 || report.mtu < mtu {
+				mtu = report.mtu
+			}
+			delete(sh.pmtu, key)
+		}
+	}
+	return mtu
+}
@@ -0,0 +1,269 @@
+package gourmet
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// processRefresh is how often the socket table is rescanned, and processMinRefresh bounds how
+	// often a new connection can trigger an early rescan
+	processRefresh    = time.Second
+	processMinRefresh = 100 * time.Millisecond
+	// processRetention is how long a socket is remembered after it disappears from the table, and a
+	// UDP flow after its last datagram
+	processRetention = 5 * time.Minute
+	// processMaxFlows bounds how many UDP flows are remembered, past which new flows wait for the
+	// periodic scan
+	processMaxFlows = 65536
+)
+
+// procOwner is the process that owned a socket when the socket table was last scanned
+type procOwner struct {
+	pid      int
+	name     string
+	lastSeen time.Time
+}
+
+// processTable attributes connections with a local endpoint to the process that owns their socket,
+// which makes it possible to monitor the network activity of the sensor's own host. It only works on
+// Linux, where sockets are listed in /proc/net and matched to processes by the inodes of their file
+// descriptors. Attributing every process requires the sensor to run as root.
+//
+// Connections are logged once they end, when their socket is often already closed. The table is
+// therefore scanned periodically and early whenever a new connection starts, and sockets are
+// remembered for a while after they disappear. A connection whose socket closed before any scan saw
+// it is logged without a process. Only the endpoints with an address of the host are looked up, so
+// that traffic forwarded by the host is never attributed to a local socket on the same port.
+type processTable struct {
+	root    string
+	mutex   sync.RWMutex
+	sockets map[string]procOwner
+	addrs   map[string]bool
+	wake    chan struct{}
+	// flows holds when the UDP flows that asked for a scan were last seen
+	flowsMutex sync.Mutex
+	flows      map[string]time.Time
+}
+
+func newProcessTable(enabled bool) *processTable {
+	if !enabled {
+		return nil
+	}
+	pt := &processTable{
+		root:    "/proc",
+		sockets: make(map[string]procOwner),
+		wake:    make(chan struct{}, 1),
+		flows:   make(map[string]time.Time),
+	}
+	pt.scan()
+	return pt
+}
+
+// connectionStarted asks for an early scan, so that short-lived sockets are seen before they close.
+func (pt *processTable) connectionStarted() {
+	select {
+	case pt.wake <- struct{}{}:
+	default:
+	}
+}
+
+// datagramSeen asks for an early scan on the first datagram of a UDP flow, in either direction.
+// Connections of untracked UDP flows hold a single datagram, and a scan for each would rescan the
+// table for every packet.
+func (pt *processTable) datagramSeen(c *Connection, ts time.Time) {
+	a := c.SourceIP + "|" + strconv.Itoa(c.SourcePort)
+	b := c.DestinationIP + "|" + strconv.Itoa(c.DestinationPort)
+	if b < a {
+		a, b = b, a
+	}
+	key := a + "|" + b
+	pt.flowsMutex.Lock()
+	_, seen := pt.flows[key]
+	if seen || len(pt.flows) < processMaxFlows {
+		pt.flows[key] = ts
+	}
+	pt.flowsMutex.Unlock()
+	if !seen {
+		pt.connectionStarted()
+	}
+}
+
+// run rescans the socket table until quit is closed.
+func (pt *processTable) run(quit <-chan struct{}) {
+	ticker := time.NewTicker(processRefresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+		case <-pt.wake:
+		}
+		pt.scan()
+		time.Sleep(processMinRefresh)
+	}
+}
+
+// attribute sets the process of the connection if one of its endpoints is a local socket. Either
+// endpoint may be the local one, as long as its address belongs to the host, and sockets that are
+// not connected, as used by UDP servers, match any remote endpoint.
+func (pt *processTable) attribute(c *Connection) {
+	pt.mutex.RLock()
+	defer pt.mutex.RUnlock()
+	local := []struct {
+		ip   string
+		port int
+	}{{c.SourceIP, c.SourcePort}, {c.DestinationIP, c.DestinationPort}}
+	for i, l := range local {
+		if !pt.addrs[l.ip] {
+			continue
+		}
+		remote := local[1-i]
+		for _, key := range []string{
+			socketKey(c.TransportType, l.ip, l.port, remote.ip, remote.port),
+			socketKey(c.TransportType, l.ip, l.port, "", 0),
+			socketKey(c.TransportType, "", l.port, "", 0),
+		} {
+			if owner, ok := pt.sockets[key]; ok {
+				c.ProcessID = owner.pid
+				c.ProcessName = owner.name
+				return
+			}
+		}
+	}
+}
+
+// socketKey identifies a socket by its transport and endpoints. Unspecified addresses and ports of
+// sockets that are not connected are written as empty strings and 0.
+func socketKey(transport, localIP string, localPort int, remoteIP string, remotePort int) string {
+	return fmt.Sprintf("%s|%s|%d|%s|%d", transport, localIP, localPort, remoteIP, remotePort)
+}
+
+// scan reads the socket tables and the file descriptors of every process. Processes and sockets that
+// vanish while they are read are skipped, since they race with the scan by nature.
+func (pt *processTable) scan() {
+	inodes := make(map[string]string)
+	for _, table := range []struct{ file, transport string }{
+		{"tcp", "tcp"}, {"tcp6", "tcp"}, {"udp", "udp"}, {"udp6", "udp"},
+	} {
+		pt.readSockets(filepath.Join(pt.root, "net", table.file), table.transport, inodes)
+	}
+	now := time.Now()
+	addrs := make(map[string]bool)
+	if ifAddrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range ifAddrs {
+			if ipNet, ok := addr.(*net.IPNet); ok {
+				addrs[formatIP(ipNet.IP)] = true
+			}
+		}
+	}
+	owners := make(map[string]procOwner)
+	pids, _ := filepath.Glob(filepath.Join(pt.root, "[0-9]*"))
+	for _, dir := range pids {
+		pid, err := strconv.Atoi(filepath.Base(dir))
+		if err != nil {
+			continue
+		}
+		fds, err := ioutil.ReadDir(filepath.Join(dir, "fd"))
+		if err != nil {
+			continue
+		}
+		var owner *procOwner
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(dir, "fd", fd.Name()))
+			if err != nil || !strings.HasPrefix(link, "socket:[") {
+				continue
+			}
+			key, ok := inodes[strings.TrimSuffix(strings.TrimPrefix(link, "socket:["), "]")]
+			if !ok {
+				continue
+			}
+			if owner == nil {
+				comm, _ := ioutil.ReadFile(filepath.Join(dir, "comm"))
+				owner = &procOwner{pid: pid, name: strings.TrimSpace(string(comm)), lastSeen: now}
+			}
+			owners[key] = *owner
+		}
+	}
+	pt.mutex.Lock()
+	pt.addrs = addrs
+	for key, owner := range owners {
+		pt.sockets[key] = owner
+	}
+	for key, owner := range pt.sockets {
+		if now.Sub(owner.lastSeen) > processRetention {
+			delete(pt.sockets, key)
+		}
+	}
+	pt.mutex.Unlock()
+	pt.flowsMutex.Lock()
+	for key, lastSeen := range pt.flows {
+		if now.Sub(lastSeen) > processRetention {
+			delete(pt.flows, key)
+		}
+	}
+	pt.flowsMutex.Unlock()
+}
+
+// readSockets adds the sockets of a /proc/net table to inodes, keyed by their inode.
+func (pt *processTable) readSockets(path, transport string, inodes map[string]string) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	// skip the header
+	scanner.Scan()
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 || fields[9] == "0" {
+			continue
+		}
+		localIP, localPort, err := parseProcAddress(fields[1])
+		if err != nil {
+			continue
+		}
+		remoteIP, remotePort, err := parseProcAddress(fields[2])
+		if err != nil {
+			continue
+		}
+		inodes[fields[9]] = socketKey(transport, localIP, localPort, remoteIP, remotePort)
+	}
+}
+
+// parseProcAddress parses an address of a /proc/net table, which is written as the hexadecimal
+// address in 32 bit words of host byte order, a colon, and the hexadecimal port. The unspecified
+// address is returned as an empty string.
+func parseProcAddress(s string) (string, int, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return "", 0, fmt.Errorf("invalid socket address %s", s)
+	}
+	raw, err := hex.DecodeString(parts[0])
+	if err != nil || (len(raw) != net.IPv4len && len(raw) != net.IPv6len) {
+		return "", 0, fmt.Errorf("invalid socket address %s", s)
+	}
+	port, err := strconv.ParseUint(parts[1], 16, 16)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid socket port %s", s)
+	}
+	ip := make(net.IP, len(raw))
+	for i := 0; i < len(raw); i += 4 {
+		ip[i], ip[i+1], ip[i+2], ip[i+3] = raw[i+3], raw[i+2], raw[i+1], raw[i]
+	}
+	if ip.IsUnspecified() {
+		return "", int(port), nil
+	}
+	return formatIP(ip), int(port), nil
+}
@@ -0,0 +1,285 @@
+package gourmet
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// Out-of-process analyzers run as separate executables instead of Go plugins, so that a crashing or
+// memory-unsafe analyzer cannot take the sensor down with it. They are enabled per analyzer with
+// the process argument in the analyzers section of the config. Isolation costs a serialization
+// round trip per connection, and the payload and each of its directions are always copied in full,
+// including payloads spilled to disk.
+//
+// The wire protocol is a stream of JSON objects, one per line. For every connection Gourmet writes
+// a processRequest to the standard input of the analyzer, and the analyzer answers with exactly one
+// processResponse on its standard output. Filter is applied in the analyzer process, and a response
+// without a Key means that the analyzer did not record anything for the connection. The standard
+// error of the analyzer is passed through to the sensor's. Analyzers implement the protocol by
+// calling ServeAnalyzer from their main function. The settings of the analyzer are passed to the
+// process in the GOURMET_ANALYZER_CONFIG environment variable, and handed to its Init method.
+
+// processAnalyzerTimeout bounds how long a single connection may take in an out-of-process analyzer
+// before the process is killed and restarted
+const processAnalyzerTimeout = 10 * time.Second
+
+// processAnalyzerConfigEnv is the environment variable that holds the settings of an out-of-process
+// analyzer
+const processAnalyzerConfigEnv = "GOURMET_ANALYZER_CONFIG"
+
+type processRequest struct {
+	ID            uint64
+	Connection    *Connection
+	Payload       []byte
+	ClientPayload []byte `json:",omitempty"`
+	ServerPayload []byte `json:",omitempty"`
+}
+
+type processResponse struct {
+	ID        uint64
+	Key       string          `json:",omitempty"`
+	Version   string          `json:",omitempty"`
+	Namespace string          `json:",omitempty"`
+	Result    json.RawMessage `json:",omitempty"`
+	Error     string          `json:",omitempty"`
+}
+
+// ServeAnalyzer runs the analyzer as an out-of-process Gourmet analyzer, answering connections read
+// from standard input until it is closed. Anything the analyzer prints to standard output is
+// redirected to standard error, which keeps the protocol stream intact. An analyzer can support
+// both execution models by exporting NewAnalyzer as usual and calling ServeAnalyzer(NewAnalyzer())
+// from main, which is ignored when it is built as a plugin.
+func ServeAnalyzer(a Analyzer) error {
+	if configurable, ok := a.(Configurable); ok {
+		err := configurable.Init([]byte(os.Getenv(processAnalyzerConfigEnv)))
+		if err != nil {
+			return err
+		}
+	}
+	out := json.NewEncoder(os.Stdout)
+	os.Stdout = os.Stderr
+	in := json.NewDecoder(os.Stdin)
+	for {
+		var req processRequest
+		err := in.Decode(&req)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		err = out.Encode(serveRequest(a, &req))
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func serveRequest(a Analyzer, req *processRequest) (resp *processResponse) {
+	resp = &processResponse{ID: req.ID}
+	defer func() {
+		if r := recover(); r != nil {
+			resp.Error = fmt.Sprintf("analyzer panicked: %v", r)
+		}
+	}()
+	c := req.Connection
+	if c == nil {
+		resp.Error = "request has no connection"
+		return resp
+	}
+	c.Payload = newMemoryPayload(req.Payload)
+	c.ClientPayload = newMemoryPayload(req.ClientPayload)
+	c.ServerPayload = newMemoryPayload(req.ServerPayload)
+	if c.Analyzers == nil {
+		c.Analyzers = make(map[string]interface{})
+	}
+	if !a.Filter(c) {
+		return resp
+	}
+	result, err := a.Analyze(c)
+	if err != nil {
+		resp.Error = err.Error()
+		return resp
+	}
+	if isNilResult(result) {
+		return resp
+	}
+	resp.Result, err = json.Marshal(result)
+	if err != nil {
+		resp.Error = fmt.Sprintf("failed to marshal result: %s", err)
+		return resp
+	}
+	resp.Key = result.Key()
+	resp.Version = resultVersion(a, result)
+	resp.Namespace = resultNamespace(a, result)
+	return resp
+}
+
+// processAnalyzer adapts an out-of-process analyzer to the Analyzer interface. The process is
+// started on the first connection, and restarted on the next connection after it fails or times
+// out.
+type processAnalyzer struct {
+	name string
+	path string
+	// config holds the settings handed to every start of the process
+	config []byte
+	mutex  sync.Mutex
+	cmd    *exec.Cmd
+	in     *json.Encoder
+	out    *json.Decoder
+	next   uint64
+}
+
+func newProcessAnalyzer(name, path string) *processAnalyzer {
+	return &processAnalyzer{
+		name: name,
+		path: path,
+	}
+}
+
+func (pa *processAnalyzer) start() error {
+	cmd := exec.Command(pa.path)
+	cmd.Env = append(os.Environ(), processAnalyzerConfigEnv+"="+string(pa.config))
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return fmt.Errorf("failed to start analyzer process %s: %s", pa.name, err)
+	}
+	pa.cmd = cmd
+	pa.in = json.NewEncoder(stdin)
+	pa.out = json.NewDecoder(stdout)
+	return nil
+}
+
+func (pa *processAnalyzer) stop() {
+	if pa.cmd == nil {
+		return
+	}
+	pa.cmd.Process.Kill()
+	pa.cmd.Wait()
+	pa.cmd = nil
+}
+
+// Init keeps the settings of the analyzer for its process, which validates them when it starts.
+func (pa *processAnalyzer) Init(config []byte) error {
+	pa.config = config
+	return nil
+}
+
+// Close stops the analyzer process.
+func (pa *processAnalyzer) Close() error {
+	pa.mutex.Lock()
+	defer pa.mutex.Unlock()
+	pa.stop()
+	return nil
+}
+
+// Filter accepts every connection, because the analyzer's own Filter runs in its process.
+func (pa *processAnalyzer) Filter(c *Connection) bool {
+	return true
+}
+
+func (pa *processAnalyzer) Analyze(c *Connection) (Result, error) {
+	pa.mutex.Lock()
+	defer pa.mutex.Unlock()
+	if pa.cmd == nil {
+		err := pa.start()
+		if err != nil {
+			return nil, err
+		}
+	}
+	pa.next++
+	req := &processRequest{
+		ID:         pa.next,
+		Connection: c,
+	}
+	if c.Payload != nil {
+		req.Payload = c.Payload.Bytes()
+	}
+	if c.ClientPayload != nil {
+		req.ClientPayload = c.ClientPayload.Bytes()
+	}
+	if c.ServerPayload != nil {
+		req.ServerPayload = c.ServerPayload.Bytes()
+	}
+	resp, err := pa.roundTrip(req)
+	if err != nil {
+		pa.stop()
+		return nil, fmt.Errorf("analyzer process %s failed, restarting it: %s", pa.name, err)
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("%s: %s", pa.name, resp.Error)
+	}
+	if resp.Key == "" {
+		return nil, nil
+	}
+	return &processResult{
+		key:       resp.Key,
+		version:   resp.Version,
+		namespace: resp.Namespace,
+		raw:       resp.Result,
+	}, nil
+}
+
+func (pa *processAnalyzer) roundTrip(req *processRequest) (*processResponse, error) {
+	done := make(chan error, 1)
+	resp := &processResponse{}
+	go func() {
+		err := pa.in.Encode(req)
+		if err == nil {
+			err = pa.out.Decode(resp)
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			return nil, err
+		}
+	case <-time.After(processAnalyzerTimeout):
+		return nil, errors.New("timed out waiting for a response")
+	}
+	if resp.ID != req.ID {
+		return nil, fmt.Errorf("response %d does not match request %d", resp.ID, req.ID)
+	}
+	return resp, nil
+}
+
+// processResult is a Result received from an out-of-process analyzer. It is logged as the JSON the
+// analyzer produced.
+type processResult struct {
+	key       string
+	version   string
+	namespace string
+	raw       json.RawMessage
+}
+
+func (pr *processResult) Key() string {
+	return pr.key
+}
+
+func (pr *processResult) Version() string {
+	return pr.version
+}
+
+func (pr *processResult) Namespace() string {
+	return pr.namespace
+}
+
+func (pr *processResult) MarshalJSON() ([]byte, error) {
+	return pr.raw, nil
+}
@@ -0,0 +1,561 @@
+package gourmet
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	quicService         = "quic"
+	quicVersion1        = 0x00000001
+	quicIdleTimeout     = 30 * time.Second
+	quicReapInterval    = 5 * time.Second
+	quicMaxCryptoBytes  = 16384
+	quicMaxConnectionID = 20
+)
+
+// quicInitialSalt is the salt that QUIC version 1 derives the keys of Initial packets from, as
+// defined in RFC 9001
+var quicInitialSalt = []byte{
+	0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17,
+	0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a,
+}
+
+// quicTracker groups the UDP datagrams of QUIC connections into one Connection per QUIC
+// connection, rather than one per datagram. A connection is only tracked once the long header
+// packet of its client has been seen. Datagrams are matched to a connection by their 5-tuple, or by
+// a connection ID the endpoints announced in their long headers, which keeps a connection together
+// when it migrates to a new 5-tuple. Initial packets of QUIC version 1 are protected with keys
+// derived from public values, so the tracker decrypts the client's Initial packets to read the
+// server name from its TLS ClientHello. Everything after the handshake is encrypted, so the record
+// of a QUIC connection is limited to this handshake metadata and the packet and byte counts.
+type quicTracker struct {
+	mutex   sync.Mutex
+	byCID   map[string]*quicFlow
+	byTuple map[string]*quicFlow
+	// cidLens are the lengths of the connection IDs seen so far, which are needed to find the
+	// connection ID of a short header packet
+	cidLens map[int]bool
+	timeout time.Duration
+	budget  *memoryBudget
+	emit    func(*Connection)
+	// now is the clock that idle flows are measured against
+	now func() time.Time
+}
+
+type quicFlow struct {
+	connection *Connection
+	client     string
+	odcid      []byte
+	cids       []string
+	tuples     []string
+	lastSeen   time.Time
+	crypto     map[uint64][]byte
+	cryptoLen  int
+	done       bool
+	origPkts   uint64
+	respPkts   uint64
+}
+
+func newQUICTracker(connTimeout int, budget *memoryBudget, emit func(*Connection), now func() time.Time) *quicTracker {
+	timeout := time.Second * time.Duration(connTimeout)
+	if timeout < quicIdleTimeout {
+		timeout = quicIdleTimeout
+	}
+	return &quicTracker{
+		byCID:   make(map[string]*quicFlow),
+		byTuple: make(map[string]*quicFlow),
+		cidLens: make(map[int]bool),
+		timeout: timeout,
+		budget:  budget,
+		emit:    emit,
+		now:     now,
+	}
+}
+
+func quicEndpoint(ip string, port int) string {
+	return ip + "|" + strconv.Itoa(port)
+}
+
+func quicTuple(srcIP string, srcPort int, dstIP string, dstPort int) string {
+	return quicEndpoint(srcIP, srcPort) + "|" + quicEndpoint(dstIP, dstPort)
+}
+
+// observe tracks a UDP datagram if it belongs to a QUIC connection. It returns false for datagrams
+// that should be handled as plain UDP.
+func (qt *quicTracker) observe(packet gopacket.Packet, udp *layers.UDP, ci gopacket.CaptureInfo) bool {
+	data := udp.Payload
+	if len(data) == 0 {
+		return false
+	}
+	srcIP, dstIP := processAddresses(packet.NetworkLayer().NetworkFlow())
+	srcPort, dstPort := int(udp.SrcPort), int(udp.DstPort)
+	qt.mutex.Lock()
+	defer qt.mutex.Unlock()
+	flow := qt.byTuple[quicTuple(srcIP, srcPort, dstIP, dstPort)]
+	if flow == nil {
+		flow = qt.lookupCID(data)
+	}
+	if flow == nil {
+		h, ok := parseQUICLongHeader(data)
+		if !ok || h.version != quicVersion1 || h.packetType != quicInitial {
+			return false
+		}
+		if qt.budget.shedConnection(stringFlowHash(ringFlowKey("udp", srcIP, srcPort, dstIP, dstPort))) {
+			return true
+		}
+		flow = qt.newFlow(packet, ci, h, srcIP, srcPort, dstIP, dstPort)
+	}
+	tuple := quicTuple(srcIP, srcPort, dstIP, dstPort)
+	if qt.byTuple[tuple] == nil {
+		// the first datagram of the connection on this path, which changes when it migrates
+		qt.byTuple[tuple] = flow
+		qt.byTuple[quicTuple(dstIP, dstPort, srcIP, srcPort)] = flow
+		flow.tuples = append(flow.tuples, tuple, quicTuple(dstIP, dstPort, srcIP, srcPort))
+	}
+	qt.update(flow, data, ci, quicEndpoint(srcIP, srcPort) == flow.client)
+	return true
+}
+
+func (qt *quicTracker) newFlow(packet gopacket.Packet, ci gopacket.CaptureInfo, h *quicLongHeader, srcIP string, srcPort int, dstIP string, dstPort int) *quicFlow {
+	c := processUDPPacket(packet, ci)
+	c.Service = quicService
+	c.PayloadComplete = false
+	c.Payload = newMemoryPayload(nil)
+	c.ClientPayload = newMemoryPayload(nil)
+	c.transportBytes = 0
+	c.transportPackets = 0
+	c.OrigBytes = 0
+	c.OrigPackets = 0
+	flow := &quicFlow{
+		connection: c,
+		client:     quicEndpoint(srcIP, srcPort),
+		odcid:      append([]byte(nil), h.dcid...),
+		crypto:     make(map[uint64][]byte),
+	}
+	qt.addCID(flow, h.dcid)
+	qt.addCID(flow, h.scid)
+	return flow
+}
+
+func (qt *quicTracker) addCID(flow *quicFlow, cid []byte) {
+	if len(cid) == 0 {
+		return
+	}
+	key := string(cid)
+	if _, ok := qt.byCID[key]; ok {
+		return
+	}
+	qt.byCID[key] = flow
+	qt.cidLens[len(cid)] = true
+	flow.cids = append(flow.cids, key)
+}
+
+// lookupCID finds the connection of a datagram by the destination connection ID of its first packet.
+func (qt *quicTracker) lookupCID(data []byte) *quicFlow {
+	if data[0]&0x80 != 0 {
+		h, ok := parseQUICLongHeader(data)
+		if !ok {
+			return nil
+		}
+		return qt.byCID[string(h.dcid)]
+	}
+	// short header packets do not carry the length of their connection ID
+	for n := range qt.cidLens {
+		if len(data) > n {
+			if flow, ok := qt.byCID[string(data[1:1+n])]; ok {
+				return flow
+			}
+		}
+	}
+	return nil
+}
+
+func (qt *quicTracker) update(flow *quicFlow, data []byte, ci gopacket.CaptureInfo, fromClient bool) {
+	c := flow.connection
+	if ci.Timestamp.Before(c.Timestamp) {
+		c.Duration += c.Timestamp.Sub(ci.Timestamp).Seconds()
+		c.Timestamp = ci.Timestamp
+	}
+	if d := ci.Timestamp.Sub(c.Timestamp).Seconds(); d > c.Duration {
+		c.Duration = d
+	}
+	c.transportBytes += uint64(len(data) + 8)
+	c.transportPackets++
+	if fromClient {
+		flow.origPkts++
+		c.OrigBytes += uint64(len(data) + 8)
+		c.OrigPackets++
+	} else {
+		flow.respPkts++
+		c.RespBytes += uint64(len(data) + 8)
+		c.RespPackets++
+	}
+	c.Asymmetric = flow.origPkts == 0 || flow.respPkts == 0
+	flow.lastSeen = qt.now()
+	// walk the coalesced long header packets of the datagram
+	for len(data) > 0 && data[0]&0x80 != 0 {
+		h, ok := parseQUICLongHeader(data)
+		if !ok {
+			return
+		}
+		if h.version == quicVersion1 {
+			qt.addCID(flow, h.scid)
+			if fromClient && !flow.done && h.packetType == quicInitial {
+				qt.readInitial(flow, data[:h.total], h)
+			}
+		}
+		data = data[h.total:]
+	}
+}
+
+// readInitial decrypts a client Initial packet and collects its CRYPTO frames until the server name
+// can be read from the ClientHello.
+func (qt *quicTracker) readInitial(flow *quicFlow, packet []byte, h *quicLongHeader) {
+	payload, err := decryptQUICInitial(packet, h, flow.odcid)
+	if err != nil {
+		return
+	}
+	for _, frame := range parseQUICCryptoFrames(payload) {
+		if _, ok := flow.crypto[frame.offset]; ok {
+			continue
+		}
+		flow.crypto[frame.offset] = frame.data
+		flow.cryptoLen += len(frame.data)
+	}
+	var hello []byte
+	for {
+		next, ok := flow.crypto[uint64(len(hello))]
+		if !ok || len(next) == 0 {
+			break
+		}
+		hello = append(hello, next...)
+	}
+	serverName, complete := parseClientHelloServerName(hello)
+	if complete || flow.cryptoLen > quicMaxCryptoBytes {
+		flow.connection.ServerName = serverName
+		flow.done = true
+		flow.crypto = nil
+	}
+}
+
+// reap emits the connections that have been idle for longer than the timeout, until quit is
+// closed.
+func (qt *quicTracker) reap(quit <-chan struct{}) {
+	ticker := time.NewTicker(quicReapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+		}
+		qt.flush(qt.now().Add(-qt.timeout))
+	}
+}
+
+// flush emits the connections last seen before the cutoff, or all of them if it is zero.
+func (qt *quicTracker) flush(cutoff time.Time) {
+	var idle []*Connection
+	qt.mutex.Lock()
+	for _, flow := range qt.byTuple {
+		if flow.connection == nil || (!cutoff.IsZero() && flow.lastSeen.After(cutoff)) {
+			continue
+		}
+		for _, cid := range flow.cids {
+			delete(qt.byCID, cid)
+		}
+		for _, tuple := range flow.tuples {
+			delete(qt.byTuple, tuple)
+		}
+		idle = append(idle, flow.connection)
+		flow.connection = nil
+	}
+	qt.mutex.Unlock()
+	for _, c := range idle {
+		qt.emit(c)
+	}
+}
+
+const (
+	quicInitial = iota
+	quic0RTT
+	quicHandshake
+	quicRetry
+)
+
+type quicLongHeader struct {
+	version    uint32
+	packetType int
+	dcid       []byte
+	scid       []byte
+	// pnOffset is the offset of the packet number, and total the length of the packet
+	pnOffset int
+	total    int
+}
+
+var errQUICShort = errors.New("quic packet is too short")
+
+func quicVarint(b []byte) (uint64, int, bool) {
+	if len(b) == 0 {
+		return 0, 0, false
+	}
+	n := 1 << (b[0] >> 6)
+	if len(b) < n {
+		return 0, 0, false
+	}
+	v := uint64(b[0] & 0x3f)
+	for i := 1; i < n; i++ {
+		v = v<<8 | uint64(b[i])
+	}
+	return v, n, true
+}
+
+// parseQUICLongHeader parses the unprotected part of a long header packet.
+func parseQUICLongHeader(b []byte) (*quicLongHeader, bool) {
+	if len(b) < 7 || b[0]&0x80 == 0 {
+		return nil, false
+	}
+	h := &quicLongHeader{
+		version:    binary.BigEndian.Uint32(b[1:5]),
+		packetType: int(b[0]>>4) & 0x03,
+	}
+	pos := 5
+	for _, cid := range []*[]byte{&h.dcid, &h.scid} {
+		if pos >= len(b) {
+			return nil, false
+		}
+		n := int(b[pos])
+		pos++
+		if n > quicMaxConnectionID || pos+n > len(b) {
+			return nil, false
+		}
+		*cid = b[pos : pos+n]
+		pos += n
+	}
+	if h.version != quicVersion1 || h.packetType == quicRetry {
+		// the rest of the datagram belongs to this packet
+		h.total = len(b)
+		return h, true
+	}
+	if h.packetType == quicInitial {
+		tokenLen, n, ok := quicVarint(b[pos:])
+		if !ok || uint64(len(b)-pos-n) < tokenLen {
+			return nil, false
+		}
+		pos += n + int(tokenLen)
+	}
+	length, n, ok := quicVarint(b[pos:])
+	if !ok || uint64(len(b)-pos-n) < length {
+		return nil, false
+	}
+	h.pnOffset = pos + n
+	h.total = h.pnOffset + int(length)
+	return h, true
+}
+
+func hkdfExtract(salt, secret []byte) []byte {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(secret)
+	return mac.Sum(nil)
+}
+
+// hkdfExpandLabel is HKDF-Expand-Label of TLS 1.3 with an empty context
+func hkdfExpandLabel(secret []byte, label string, length int) []byte {
+	label = "tls13 " + label
+	info := []byte{byte(length >> 8), byte(length), byte(len(label))}
+	info = append(info, label...)
+	info = append(info, 0)
+	var out, block []byte
+	for i := byte(1); len(out) < length; i++ {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(block)
+		mac.Write(info)
+		mac.Write([]byte{i})
+		block = mac.Sum(nil)
+		out = append(out, block...)
+	}
+	return out[:length]
+}
+
+// decryptQUICInitial removes the header and packet protection of a client Initial packet, whose
+// keys are derived from the original destination connection ID of the client.
+func decryptQUICInitial(packet []byte, h *quicLongHeader, odcid []byte) ([]byte, error) {
+	if h.pnOffset+20 > h.total {
+		return nil, errQUICShort
+	}
+	secret := hkdfExpandLabel(hkdfExtract(quicInitialSalt, odcid), "client in", sha256.Size)
+	key := hkdfExpandLabel(secret, "quic key", 16)
+	iv := hkdfExpandLabel(secret, "quic iv", 12)
+	hp := hkdfExpandLabel(secret, "quic hp", 16)
+	pkt := append([]byte(nil), packet[:h.total]...)
+	hpCipher, err := aes.NewCipher(hp)
+	if err != nil {
+		return nil, err
+	}
+	mask := make([]byte, aes.BlockSize)
+	hpCipher.Encrypt(mask, pkt[h.pnOffset+4:h.pnOffset+20])
+	pkt[0] ^= mask[0] & 0x0f
+	pnLen := int(pkt[0]&0x03) + 1
+	var pn uint64
+	for i := 0; i < pnLen; i++ {
+		pkt[h.pnOffset+i] ^= mask[1+i]
+		pn = pn<<8 | uint64(pkt[h.pnOffset+i])
+	}
+	nonce := append([]byte(nil), iv...)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] ^= byte(pn >> (8 * uint(i)))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	headerLen := h.pnOffset + pnLen
+	return aead.Open(nil, nonce, pkt[headerLen:], pkt[:headerLen])
+}
+
+type quicCryptoFrame struct {
+	offset uint64
+	data   []byte
+}
+
+// parseQUICCryptoFrames returns the CRYPTO frames of a decrypted Initial packet. Parsing stops at
+// the first frame type that cannot appear in an Initial packet.
+func parseQUICCryptoFrames(b []byte) (frames []quicCryptoFrame) {
+	varints := func(count int) bool {
+		for i := 0; i < count; i++ {
+			_, n, ok := quicVarint(b)
+			if !ok {
+				return false
+			}
+			b = b[n:]
+		}
+		return true
+	}
+	for len(b) > 0 {
+		frameType, n, ok := quicVarint(b)
+		if !ok {
+			return frames
+		}
+		b = b[n:]
+		switch frameType {
+		case 0x00, 0x01:
+			// PADDING and PING
+		case 0x02, 0x03:
+			// ACK: largest acknowledged, delay, range count, first range, the other ranges, and the
+			// ECN counts
+			if !varints(2) {
+				return frames
+			}
+			ranges, n, ok := quicVarint(b)
+			if !ok {
+				return frames
+			}
+			b = b[n:]
+			if !varints(1 + 2*int(ranges)) {
+				return frames
+			}
+			if frameType == 0x03 && !varints(3) {
+				return frames
+			}
+		case 0x06:
+			offset, n, ok := quicVarint(b)
+			if !ok {
+				return frames
+			}
+			b = b[n:]
+			length, n, ok := quicVarint(b)
+			if !ok || uint64(len(b)-n) < length {
+				return frames
+			}
+			b = b[n:]
+			frames = append(frames, quicCryptoFrame{offset: offset, data: b[:length]})
+			b = b[length:]
+		default:
+			return frames
+		}
+	}
+	return frames
+}
+
+// parseClientHelloServerName reads the server name extension of a TLS ClientHello. It returns false
+// if the handshake message is still incomplete.
+func parseClientHelloServerName(b []byte) (string, bool) {
+	if len(b) < 4 {
+		return "", false
+	}
+	if b[0] != 1 {
+		return "", true
+	}
+	length := int(b[1])<<16 | int(b[2])<<8 | int(b[3])
+	if len(b) < 4+length {
+		return "", false
+	}
+	b = b[4 : 4+length]
+	skip := func(n int) bool {
+		if len(b) < n {
+			return false
+		}
+		b = b[n:]
+		return true
+	}
+	vector := func(lenBytes int) bool {
+		if len(b) < lenBytes {
+			return false
+		}
+		n := 0
+		for i := 0; i < lenBytes; i++ {
+			n = n<<8 | int(b[i])
+		}
+		return skip(lenBytes + n)
+	}
+	// legacy version, random, session ID, cipher suites, and compression methods
+	if !skip(2+32) || !vector(1) || !vector(2) || !vector(1) || len(b) < 2 {
+		return "", true
+	}
+	b = b[2:]
+	for len(b) >= 4 {
+		extType := int(b[0])<<8 | int(b[1])
+		extLen := int(b[2])<<8 | int(b[3])
+		if len(b) < 4+extLen {
+			return "", true
+		}
+		ext := b[4 : 4+extLen]
+		b = b[4+extLen:]
+		// server name list, with the host name type and length
+		if extType != 0 || len(ext) < 5 || ext[2] != 0 {
+			continue
+		}
+		nameLen := int(ext[3])<<8 | int(ext[4])
+		if len(ext) < 5+nameLen {
+			return "", true
+		}
+		return string(ext[5 : 5+nameLen]), true
+	}
+	return "", true
+}
+
+// open returns the number of flows being tracked.
+func (qt *quicTracker) open() int {
+	qt.mutex.Lock()
+	defer qt.mutex.Unlock()
+	flows := make(map[*quicFlow]bool)
+	for _, flow := range qt.byTuple {
+		flows[flow] = true
+	}
+	return len(flows)
+}
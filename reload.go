@@ -0,0 +1,252 @@
+package gourmet
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"syscall"
+
+	"github.com/ghodss/yaml"
+)
+
+// outputSettings are the fields of the config that outputs are created from, besides the outputs
+// section
+var outputSettings = []string{
+	"LogFile", "LogMaxSize", "LogMaxAge", "LogMaxBackups", "LogCompress", "LogPartition",
+}
+
+// reloadedSettings are the fields of the config that are applied when it is reloaded
+var reloadedSettings = append([]string{"Bpf", "Outputs", "Analyzers", "ConfigFile", "Reload"}, outputSettings...)
+
+// reloadOnSignal reloads the config every time the process receives SIGHUP, until quit is closed.
+func (s *sensor) reloadOnSignal(quit <-chan struct{}) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	defer signal.Stop(signals)
+	for {
+		select {
+		case <-quit:
+			return
+		case <-signals:
+		}
+		if s.service != nil {
+			s.service.reloading()
+		}
+		s.reload()
+		if s.service != nil {
+			s.service.reloaded(s.serviceStatus())
+		}
+	}
+}
+
+// reload reads the config file again and applies what can be changed while the sensor runs, without
+// stopping capture or dropping the connections being tracked: the BPF filter, the outputs and the
+// log file, and the analyzers. Each is applied on its own, and one that fails keeps running as it
+// was. Changes to any other setting are logged as needing a restart.
+func (s *sensor) reload() {
+	next, err := s.readConfig()
+	if err != nil {
+		log.Printf("[!] Failed to reload config, keeping the running one: %s", err)
+		return
+	}
+	// an embedded sensor may run with settings left unset, which the reloaded config has defaults for
+	current := *s.config
+	current.SetDefaults()
+	for _, name := range restartRequired(&current, next) {
+		log.Printf("[!] %s changed, restart gourmet to apply it", name)
+	}
+	err = s.reloadFilter(next)
+	if err != nil {
+		log.Printf("[!] Failed to reload bpf, keeping the running filter: %s", err)
+	}
+	err = s.reloadOutputs(next)
+	if err != nil {
+		log.Printf("[!] Failed to reload outputs, keeping the running ones: %s", err)
+	}
+	err = s.reloadAnalyzers(next.Analyzers)
+	if err != nil {
+		log.Printf("[!] Failed to reload analyzers, keeping the running ones: %s", err)
+	}
+}
+
+// readConfig reads the config again with its Reload function, or from its file with the defaults
+// applied. A config without either is reloaded as it was, which still rebuilds the plugins whose
+// source changed.
+func (s *sensor) readConfig() (*Config, error) {
+	if s.config.Reload != nil {
+		return s.config.Reload()
+	}
+	if s.config.ConfigFile == "" {
+		config := *s.config
+		config.SetDefaults()
+		return &config, nil
+	}
+	contents, err := ioutil.ReadFile(s.config.ConfigFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &Config{ConfigFile: s.config.ConfigFile}
+	err = yaml.Unmarshal(contents, config)
+	if err != nil {
+		return nil, err
+	}
+	config.SetDefaults()
+	return config, nil
+}
+
+// restartRequired returns the names of the settings that differ between the configs but are only
+// applied at startup.
+func restartRequired(current, next *Config) []string {
+	var names []string
+	cv, nv := reflect.ValueOf(current).Elem(), reflect.ValueOf(next).Elem()
+	t := cv.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if isReloaded(field.Name) || reflect.DeepEqual(cv.Field(i).Interface(), nv.Field(i).Interface()) {
+			continue
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+func isReloaded(field string) bool {
+	for _, name := range reloadedSettings {
+		if name == field {
+			return true
+		}
+	}
+	return false
+}
+
+// settingsChanged reports whether any of the fields of the configs differ.
+func settingsChanged(current, next *Config, fields []string) bool {
+	cv, nv := reflect.ValueOf(current).Elem(), reflect.ValueOf(next).Elem()
+	for _, field := range fields {
+		if !reflect.DeepEqual(cv.FieldByName(field).Interface(), nv.FieldByName(field).Interface()) {
+			return true
+		}
+	}
+	return false
+}
+
+// reloadFilter sets the global BPF filter of the config on the packet sources if it changed. Setting
+// it would replace the filters of interface_bpf, so setFilter refuses it while they are set.
+func (s *sensor) reloadFilter(next *Config) error {
+	if next.Bpf == s.config.Bpf {
+		return nil
+	}
+	err := s.setFilter(next.Bpf)
+	if err != nil {
+		return err
+	}
+	s.filter.mutex.Lock()
+	s.config.Bpf = next.Bpf
+	s.filter.mutex.Unlock()
+	log.Printf("[*] Capture filter changed to %q", next.Bpf)
+	return nil
+}
+
+// reloadOutputs replaces the outputs if their sections or the log file settings changed. Outputs
+// whose section is unchanged keep running, and so does the file output if the log file settings
+// are unchanged as well. The outputs that were removed or replaced are closed once the connections
+// being written to them are. The channels of an embedded sensor are kept.
+func (s *sensor) reloadOutputs(next *Config) error {
+	fileChanged := settingsChanged(s.config, next, outputSettings)
+	if !fileChanged && reflect.DeepEqual(s.config.Outputs, next.Outputs) {
+		return nil
+	}
+	s.outputsMutex.RLock()
+	previous := s.outputs
+	s.outputsMutex.RUnlock()
+	var reuse, channels []configuredOutput
+	for _, o := range previous {
+		switch o.output.(type) {
+		case *channelOutput:
+			channels = append(channels, o)
+		case *fileOutput:
+			if !fileChanged {
+				reuse = append(reuse, o)
+			}
+		default:
+			reuse = append(reuse, o)
+		}
+	}
+	var outputs []configuredOutput
+	if len(channels) == 0 || len(next.Outputs) > 0 {
+		var err error
+		outputs, err = newOutputs(next, reuse, true)
+		if err != nil {
+			return err
+		}
+	}
+	outputs = append(outputs, channels...)
+	s.outputsMutex.Lock()
+	s.outputs = outputs
+	s.config.Outputs = next.Outputs
+	for _, field := range outputSettings {
+		reflect.ValueOf(s.config).Elem().FieldByName(field).Set(reflect.ValueOf(next).Elem().FieldByName(field))
+	}
+	s.outputsMutex.Unlock()
+	kept := make(map[Output]bool)
+	for _, o := range outputs {
+		kept[o.output] = true
+	}
+	var removed []configuredOutput
+	for _, o := range previous {
+		if !kept[o.output] {
+			removed = append(removed, o)
+		}
+	}
+	closeOutputs(removed)
+	if s.config.StatsInterval > 0 && !takesStats(outputs) {
+		log.Println("[!] Not writing stats, as none of the reloaded outputs takes stats records")
+	}
+	if s.arp != nil && findFileOutput(outputs) == nil {
+		log.Println("[!] Not logging ARP events, as the reloaded outputs have no file output")
+	}
+	log.Printf("[*] Reloaded outputs, logging to %s", describeOutputs(outputs))
+	return nil
+}
+
+// reloadAnalyzers loads the analyzers of the reloaded config, without stopping capture or dropping
+// the connections being tracked. Analyzers that were added must already be installed, and plugins
+// whose main.go changed, for example after `gourmet plugin update`, are rebuilt and opened under a
+// new name, as a Go plugin cannot be unloaded. Analyzers whose source and section are unchanged keep
+// running as they are, and the analyzers that were removed or replaced are closed once no connection
+// is being analyzed by them. If any analyzer fails to load, the running analyzers are kept.
+func (s *sensor) reloadAnalyzers(links map[string]interface{}) error {
+	graph, err := resolveAnalyzers(links)
+	if err != nil {
+		return err
+	}
+	previous := currentAnalyzers()
+	analyzers, err := loadAnalyzers(graph, links, previous)
+	if err != nil {
+		return err
+	}
+	analyzersLock.Lock()
+	registeredAnalyzers = analyzers
+	countPacketAnalyzers(analyzers)
+	s.metrics.addAnalyzers(analyzers)
+	analyzersLock.Unlock()
+	kept := make(map[*registeredAnalyzer]bool)
+	for _, ra := range analyzers {
+		kept[ra] = true
+	}
+	for _, ra := range previous {
+		if !kept[ra] {
+			closeAnalyzer(ra)
+		}
+	}
+	s.config.Analyzers = links
+	log.Printf("[*] Reloaded analyzers, %d running", len(analyzers))
+	return nil
+}
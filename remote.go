@@ -0,0 +1,166 @@
+package gourmet
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// remoteRetryInterval is how long a remote source waits before starting tcpdump again after the
+// stream ended
+const remoteRetryInterval = 5 * time.Second
+
+// sshSource captures packets on an interface of a remote host, by running tcpdump there over SSH and
+// reading the pcap stream it writes to its standard output. The system ssh client is used in batch
+// mode, so the remote host must already be known, and authentication must not prompt, which is
+// usually done with the key file in remote_key. The remote user must be allowed to run tcpdump on
+// the interface. The BPF filter of the interface is applied by tcpdump, so unwanted packets are not
+// sent over the network. When the stream ends, because the connection dropped or tcpdump exited,
+// tcpdump is started again every remoteRetryInterval until the source is closed.
+type sshSource struct {
+	args   []string
+	mutex  sync.Mutex
+	closed bool
+	cmd    *exec.Cmd
+	stdout io.ReadCloser
+	reader *pcapgo.Reader
+}
+
+func newSSHSensor(c *Config, iface string) (*sshSource, error) {
+	host, port, err := net.SplitHostPort(c.Remote)
+	if err != nil {
+		host, port = c.Remote, "22"
+	}
+	if host == "" {
+		return nil, errors.New("remote must be set to the host to capture on, as host or host:port")
+	}
+	args := []string{"-o", "BatchMode=yes", "-p", port}
+	if c.RemoteKey != "" {
+		args = append(args, "-i", c.RemoteKey)
+	}
+	if c.RemoteUser != "" {
+		args = append(args, "-l", c.RemoteUser)
+	}
+	// tcpdump writes every packet as it is captured (-U), without resolving names (-n)
+	tcpdump := []string{"tcpdump", "-U", "-n", "-w", "-", "-i", iface, "-s", strconv.Itoa(c.SnapLen)}
+	if !c.Promiscuous {
+		tcpdump = append(tcpdump, "-p")
+	}
+	// ssh hands the command to the shell of the remote user, which splits it again
+	for i, arg := range tcpdump {
+		tcpdump[i] = shellQuote(arg)
+	}
+	// The packets of the SSH session that carries the stream would be captured as well, each of them
+	// sending more, so they are always filtered out. sh takes the address of the sensor, as the remote
+	// host sees it, and its SSH port from SSH_CLIENT.
+	filter := `"not (host ${SSH_CLIENT%% *} and port ${SSH_CLIENT##* })"`
+	if bpf := c.effectiveBpf(iface); bpf != "" {
+		filter = shellQuote("("+bpf+") and ") + filter
+	}
+	script := "exec " + strings.Join(tcpdump, " ") + " " + filter
+	ss := &sshSource{
+		args: append(args, host, "--", "sh", "-c", shellQuote(script)),
+	}
+	err = ss.start()
+	if err != nil {
+		return nil, err
+	}
+	return ss, nil
+}
+
+// start runs tcpdump on the remote host and reads the header of the pcap stream.
+func (ss *sshSource) start() error {
+	cmd := exec.Command("ssh", ss.args...)
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return fmt.Errorf("failed to run ssh: %s", err)
+	}
+	reader, err := pcapgo.NewReader(stdout)
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fmt.Errorf("failed to read the capture stream of the remote tcpdump: %s", err)
+	}
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	if ss.closed {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return io.EOF
+	}
+	ss.cmd = cmd
+	ss.stdout = stdout
+	ss.reader = reader
+	return nil
+}
+
+// stop kills the running ssh client, if any.
+func (ss *sshSource) stop() {
+	ss.mutex.Lock()
+	cmd := ss.cmd
+	ss.cmd = nil
+	ss.mutex.Unlock()
+	if cmd != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}
+}
+
+// LinkType returns the link type of the remote interface.
+func (ss *sshSource) LinkType() layers.LinkType {
+	return ss.reader.LinkType()
+}
+
+// ZeroCopyReadPacketData reads the next packet of the stream. When the stream ends, it starts tcpdump
+// again and returns the error that ended the stream, or io.EOF once the source is closed.
+func (ss *sshSource) ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	data, ci, err := ss.reader.ZeroCopyReadPacketData()
+	if err == nil {
+		return data, ci, nil
+	}
+	ss.stop()
+	for {
+		ss.mutex.Lock()
+		closed := ss.closed
+		ss.mutex.Unlock()
+		if closed {
+			return nil, ci, io.EOF
+		}
+		log.Printf("[!] Remote capture stream ended (%s), reconnecting in %s", err, remoteRetryInterval)
+		time.Sleep(remoteRetryInterval)
+		startErr := ss.start()
+		if startErr == nil {
+			return nil, ci, err
+		}
+		err = startErr
+	}
+}
+
+func (ss *sshSource) Close() {
+	ss.mutex.Lock()
+	ss.closed = true
+	ss.mutex.Unlock()
+	ss.stop()
+}
+
+// shellQuote quotes a word for a POSIX shell.
+func shellQuote(word string) string {
+	return "'" + strings.Replace(word, "'", `'\''`, -1) + "'"
+}
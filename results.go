@@ -0,0 +1,49 @@
+package gourmet
+
+// ResultStore receives the result of every analyzer that recorded something for a connection.
+// Results are stored in the Analyzers map of the connection by default. Embedders with very high
+// connection rates can replace the store to stream results directly to a backend, in which case
+// the results do not appear in the logged connection unless the store also adds them to the map.
+// Store is called from the goroutine that analyzes connections, one connection at a time, for
+// every analyzer in order, so a later analyzer only sees the results of earlier ones if they were
+// added to the map.
+type ResultStore interface {
+	Store(c *Connection, result Result, version string)
+}
+
+var resultStore ResultStore = mapResultStore{}
+
+// SetResultStore replaces the store that analyzer results are handed to. It must be called before
+// Start. Passing nil restores the default, which stores results in Connection.Analyzers.
+func SetResultStore(rs ResultStore) {
+	if rs == nil {
+		rs = mapResultStore{}
+	}
+	resultStore = rs
+}
+
+// mapResultStore stores results in the Analyzers map of the connection, nested in a map per
+// namespace, and their versions in the _meta section.
+type mapResultStore struct{}
+
+func (mapResultStore) Store(c *Connection, result Result, version string) {
+	if c.Analyzers == nil {
+		c.Analyzers = make(map[string]interface{})
+	}
+	if nr, ok := result.(*namespacedResult); ok {
+		namespace, ok := c.Analyzers[nr.namespace].(map[string]interface{})
+		if !ok {
+			namespace = make(map[string]interface{})
+			c.Analyzers[nr.namespace] = namespace
+		}
+		namespace[nr.Result.Key()] = nr.Result
+	} else {
+		c.Analyzers[result.Key()] = result
+	}
+	if version != "" {
+		if c.ResultVersions == nil {
+			c.ResultVersions = make(map[string]string)
+		}
+		c.ResultVersions[result.Key()] = version
+	}
+}
@@ -0,0 +1,201 @@
+package gourmet
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var rotationHook func(path string)
+
+// rotationHookFromConfig is set when rotationHook runs the rotate_hook command of the Config, rather
+// than being set with SetRotationHook
+var rotationHookFromConfig bool
+
+// SetRotationHook registers a function that is called with the path of every log file Gourmet has
+// just rotated, for example to compress it and upload it to object storage. The hook runs in its own
+// goroutine, so a slow hook does not hold up capture. It must be called before Start, and replaces the
+// rotate_hook command of the Config.
+func SetRotationHook(hook func(path string)) {
+	rotationHook = hook
+}
+
+// commandRotationHook returns a hook that runs the command with the path of the rotated file as its
+// last argument. The command is split on whitespace and is not run through a shell.
+func commandRotationHook(command string) func(string) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil
+	}
+	return func(path string) {
+		out, err := exec.Command(args[0], append(args[1:], path)...).CombinedOutput()
+		if err != nil {
+			log.Printf("[!] Rotation hook failed for %s: %s: %s", path, err, strings.TrimSpace(string(out)))
+		}
+	}
+}
+
+// rotated runs the rotation hook, if there is one, for a log file that was just rotated. Failures of
+// the hook are logged and otherwise ignored.
+func rotated(path string) {
+	hook := rotationHook
+	if hook == nil {
+		return
+	}
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("[!] Rotation hook panicked for %s: %v", path, r)
+			}
+		}()
+		hook(path)
+	}()
+}
+
+// backupTimeFormat is the layout of the rotation time in the name of a rotated log file
+const backupTimeFormat = "2006-01-02T15-04-05.000"
+
+// logRotator rotates the log file once it grows past maxSize. The rotated file is renamed to the
+// name of the log file with the rotation time before its extension, for example
+// gourmet-2020-05-14T09-30-00.000.log, and a new log file is started with the sensor metadata. Rotated
+// files are then optionally gzipped, files beyond maxBackups or older than maxAge are removed, and the
+// rotation hook is called with the final path of the rotated file. A nil logRotator never rotates.
+type logRotator struct {
+	maxSize    int
+	maxAge     time.Duration
+	maxBackups int
+	compress   bool
+	// mutex serializes the compression and pruning of rotated files
+	mutex sync.Mutex
+}
+
+func newLogRotator(maxSizeMB, maxAgeDays, maxBackups int, compress bool) *logRotator {
+	if maxSizeMB <= 0 {
+		return nil
+	}
+	return &logRotator{
+		maxSize:    maxSizeMB << 20,
+		maxAge:     24 * time.Hour * time.Duration(maxAgeDays),
+		maxBackups: maxBackups,
+		compress:   compress,
+	}
+}
+
+// due reports whether a log file of the given size must be rotated.
+func (lr *logRotator) due(size int) bool {
+	return lr != nil && size >= lr.maxSize
+}
+
+// backupName returns the name of the log file rotated at t.
+func backupName(fileName string, t time.Time) string {
+	ext := filepath.Ext(fileName)
+	return fmt.Sprintf("%s-%s%s", strings.TrimSuffix(fileName, ext), t.UTC().Format(backupTimeFormat), ext)
+}
+
+// rotate renames the log file to its backup name, and returns the backup name.
+func (lr *logRotator) rotate(fileName string, t time.Time) (string, error) {
+	backup := backupName(fileName, t)
+	err := os.Rename(fileName, backup)
+	if err != nil {
+		return "", fmt.Errorf("failed to rotate %s: %s", fileName, err)
+	}
+	return backup, nil
+}
+
+// finish compresses a rotated file, prunes the old rotated files, and runs the rotation hook. It
+// runs in its own goroutine, so that compression does not hold up logging.
+func (lr *logRotator) finish(fileName, backup string) {
+	lr.mutex.Lock()
+	defer lr.mutex.Unlock()
+	if lr.compress {
+		compressed, err := gzipFile(backup)
+		if err != nil {
+			log.Printf("[!] Failed to compress %s: %s", backup, err)
+		} else {
+			backup = compressed
+		}
+	}
+	lr.prune(fileName)
+	rotated(backup)
+}
+
+// gzipFile compresses a file into a file with the .gz extension, and removes the original.
+func gzipFile(path string) (string, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	compressed := path + ".gz"
+	out, err := os.Create(compressed)
+	if err != nil {
+		return "", err
+	}
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	if err == nil {
+		err = zw.Close()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(compressed)
+		return "", err
+	}
+	return compressed, os.Remove(path)
+}
+
+type logBackup struct {
+	path    string
+	rotated time.Time
+}
+
+// prune removes the rotated files of the log file beyond maxBackups, keeping the newest, and those
+// rotated longer than maxAge ago. Either limit is disabled when it is zero.
+func (lr *logRotator) prune(fileName string) {
+	if lr.maxBackups <= 0 && lr.maxAge <= 0 {
+		return
+	}
+	ext := filepath.Ext(fileName)
+	prefix := strings.TrimSuffix(filepath.Base(fileName), ext) + "-"
+	entries, err := ioutil.ReadDir(filepath.Dir(fileName))
+	if err != nil {
+		log.Printf("[!] Failed to list rotated log files: %s", err)
+		return
+	}
+	var backups []logBackup
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		stamp := strings.TrimSuffix(strings.TrimSuffix(strings.TrimPrefix(name, prefix), ".gz"), ext)
+		t, err := time.Parse(backupTimeFormat, stamp)
+		if err != nil {
+			continue
+		}
+		backups = append(backups, logBackup{filepath.Join(filepath.Dir(fileName), name), t})
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].rotated.After(backups[j].rotated)
+	})
+	for i, backup := range backups {
+		expired := lr.maxAge > 0 && time.Since(backup.rotated) > lr.maxAge
+		if (lr.maxBackups > 0 && i >= lr.maxBackups) || expired {
+			err = os.Remove(backup.path)
+			if err != nil {
+				log.Printf("[!] Failed to remove rotated log file: %s", err)
+			}
+		}
+	}
+}
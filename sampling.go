@@ -0,0 +1,86 @@
+package gourmet
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// logSampler decides which analyzed connections are written to the outputs, for links where logging
+// every connection is impractical. Connections are first sampled 1 in sampleRate by their UID, so
+// that the preliminary and final records of a connection are kept or dropped together, then those
+// with fewer than minBytes bytes in both directions together are dropped, and the connections left
+// are written at most ratePerSecond per second, with bursts of up to one second worth. The rate runs
+// on the time of the packets rather than the clock, so that a capture read faster than real time is
+// limited as its link was. Dropped connections are still counted in the summary and the metrics, and
+// still exported over IPFIX.
+type logSampler struct {
+	sampleRate uint64
+	minBytes   uint64
+	// the token bucket of the rate limit, which is disabled if ratePerSecond is 0
+	ratePerSecond float64
+	mutex         sync.Mutex
+	tokens        float64
+	lastRefill    time.Time
+}
+
+// newLogSampler returns nil if every connection is logged.
+func newLogSampler(sampleRate, minBytes, ratePerSecond int) *logSampler {
+	if sampleRate <= 1 && minBytes <= 0 && ratePerSecond <= 0 {
+		return nil
+	}
+	ls := &logSampler{
+		sampleRate: 1,
+	}
+	if sampleRate > 1 {
+		ls.sampleRate = uint64(sampleRate)
+	}
+	if minBytes > 0 {
+		ls.minBytes = uint64(minBytes)
+	}
+	if ratePerSecond > 0 {
+		ls.ratePerSecond = float64(ratePerSecond)
+		ls.tokens = ls.ratePerSecond
+	}
+	return ls
+}
+
+// keep reports whether the connection is written to the outputs.
+func (ls *logSampler) keep(c *Connection) bool {
+	if ls.sampleRate > 1 {
+		h := fnv.New64a()
+		uid := make([]byte, 8)
+		binary.BigEndian.PutUint64(uid, c.uid)
+		h.Write(uid)
+		if h.Sum64()%ls.sampleRate != 0 {
+			return false
+		}
+	}
+	if c.OrigBytes+c.RespBytes < ls.minBytes {
+		return false
+	}
+	if ls.ratePerSecond == 0 {
+		return true
+	}
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	// connections are emitted about in the order of their last packet, and one that ended before the
+	// last refill does not refill the bucket
+	now := c.Timestamp.Add(time.Duration(c.Duration * float64(time.Second)))
+	if ls.lastRefill.IsZero() {
+		ls.lastRefill = now
+	}
+	if now.After(ls.lastRefill) {
+		ls.tokens += now.Sub(ls.lastRefill).Seconds() * ls.ratePerSecond
+		if ls.tokens > ls.ratePerSecond {
+			ls.tokens = ls.ratePerSecond
+		}
+		ls.lastRefill = now
+	}
+	if ls.tokens < 1 {
+		return false
+	}
+	ls.tokens--
+	return true
+}
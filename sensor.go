@@ -1,13 +1,25 @@
 package gourmet
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math"
+	"net"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
 )
 
 type interfaceType byte
@@ -15,67 +27,458 @@ type interfaceType byte
 const (
 	afpacketType interfaceType = 1
 	libpcapType  interfaceType = 3
+	pcapfileType interfaceType = 4
+	afxdpType    interfaceType = 5
+	sshType      interfaceType = 6
 )
 
 type sensorMetadata struct {
-	// The network interface that the sensor is capturing traffic
-	NetworkInterface string
+	// The network interfaces that the sensor is capturing traffic on, separated by commas
+	NetworkInterface string `json:",omitempty"`
 	// The IP address of the capturing network interface
-	NetworkAddress []string
+	NetworkAddress []string `json:",omitempty"`
+	// The capture file that packets are replayed from
+	CaptureFile string `json:",omitempty"`
+	// The remote host that packets are captured on
+	RemoteHost string `json:",omitempty"`
 }
 
-func getSensorMetadata(interfaceName string) *sensorMetadata {
+func getSensorMetadata(config *Config) *sensorMetadata {
+	if config.InterfaceType == "pcapfile" {
+		return &sensorMetadata{
+			CaptureFile: config.PcapFile,
+		}
+	}
+	ifaces := config.CaptureInterfaces()
+	if config.InterfaceType == "ssh" {
+		return &sensorMetadata{
+			NetworkInterface: strings.Join(ifaces, ","),
+			RemoteHost:       config.Remote,
+		}
+	}
+	var addresses []string
+	for _, iface := range ifaces {
+		addresses = append(addresses, getInterfaceAddresses(iface)...)
+	}
 	return &sensorMetadata{
-		NetworkInterface: interfaceName,
-		NetworkAddress:   getInterfaceAddresses(interfaceName),
+		NetworkInterface: strings.Join(ifaces, ","),
+		NetworkAddress:   addresses,
 	}
 }
 
+// captureSource is a packet source of the sensor, which is an interface or a capture file
+type captureSource struct {
+	name   string
+	source gopacket.ZeroCopyPacketDataSource
+	// decoder decodes the first layer of captured packets
+	decoder gopacket.Decoder
+	// index is the index of the interface, or 0 if it is unknown or not an interface
+	index int
+	// watched is set for the interfaces of interface_pattern when they are rescanned, and stopped
+	// once capture on the interface stopped
+	watched bool
+	stopped int32
+	// filter is the BPF filter set on the source, as it was compiled with the VLAN tags of vlan_trunk,
+	// which a failed change of the filter restores. It is guarded by the mutex of the filter of the
+	// sensor.
+	filter string
+}
+
 type sensor struct {
-	source        gopacket.ZeroCopyPacketDataSource
+	config  *Config
+	sources []*captureSource
+	// sourcesMutex guards sources and ifNames, which change as the interfaces of interface_pattern
+	// come and go
+	sourcesMutex sync.RWMutex
+	// detachedDrops counts the drops of the sources that were stopped because their interface is gone
+	detachedDrops uint64
 	streamFactory *tcpStreamFactory
 	connections   chan *Connection
+	// emitted is the channel connections are analyzed and logged from, which is connections unless
+	// they are reordered by start time
+	emitted   <-chan *Connection
+	reorder   *startOrderBuffer
+	timer     *stageTimer
+	summary   *runSummary
+	arp       *arpTracker
+	ipfix     *ipfixExporter
+	localNets *ipTrie
+	uids      *uidGenerator
+	intel     *intelFeed
+	geoip     *geoIPDatabases
+	extractor *fileExtractor
+	ring      *packetRing
+	merger    *connectionMerger
+	analyzers *analyzerPool
+	sampler   *logSampler
+	quic      *quicTracker
+	flows     *flowTable
+	datagrams *datagramDirections
+	// ifNames maps interface indexes to names, and is only set when capturing on several interfaces
+	ifNames map[int]string
+	bogons  *ipTrie
+	defrag  *defragmenter
+	// inFlight counts connections that have been handed to the pipeline but not yet logged, and
+	// active holds those of them that processConnections took
+	inFlight int64
+	active   activeConnections
+	stopping int32
+	health   *healthServer
+	control  *controlServer
+	filter   captureFilter
+	metrics  *sensorMetrics
+	outputs  []configuredOutput
+	procs    *processTable
+	// outputsMutex guards outputs, which are replaced when the config is reloaded
+	outputsMutex sync.RWMutex
+	// replay is set when packets are read from a capture file. They are then processed one at a time
+	// in capture order, idle connections are timed by the capture clock, and the sensor shuts down
+	// at the end of the file.
+	replay bool
+	// packetClock is the latest capture timestamp replayed, in nanoseconds since the epoch
+	packetClock int64
+	finished    chan struct{}
+	// runDone is closed when the capture loops have returned, and quit is closed to stop the background
+	// goroutines of the sensor once it has shut down
+	runDone chan struct{}
+	quit    chan struct{}
+	// shutdown is closed when a shutdown was requested over the control server
+	shutdown     chan struct{}
+	shutdownOnce sync.Once
+	// started is when the sensor was started, and startCounters the counters at that time
+	started       time.Time
+	startCounters statsCounters
+	// lastPacket is the capture time of the last packet read, in nanoseconds since the epoch
+	lastPacket int64
+	capturing  int32
+	// errors is the Sensor that errors are reported to when the sensor is embedded in a program
+	errors *Sensor
+	// service is set when the sensor runs as a system service
+	service *service
 }
 
-// Start is the entry point for Gourmet
+// Start is the entry point for Gourmet. It runs the sensor until the process is interrupted or
+// terminated, or until a replayed capture file ends, then shuts it down and exits.
 func Start(config *Config) {
-	var err error
-	var workingGraph analyzerGraph
-	for k, v := range config.Analyzers {
-		analyzerNode, err := createAnalyzerNode(k, v)
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		cancel()
+	}()
+	err := StartWithContext(ctx, config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	os.Exit(0)
+}
+
+// StartWithContext runs the sensor until the context is done, a shutdown is requested over the
+// control server, or a replayed capture file ends, and then shuts it down gracefully: it stops
+// reading packets, flushes every open connection, waits for the in-flight connections to be analyzed
+// and logged, closes the packet source and the analyzers, and writes the end-of-run summary if it is
+// enabled. Connections still in flight after ShutdownTimeout seconds are abandoned and reported in
+// the returned error. The connections of a capture file are always waited for. Analyzers are loaded
+// again on every call, so a process can run sensors one after another, but not concurrently. With
+// ServiceMode set, operational messages are logged to ServiceLog, the PID file is kept while the
+// sensor runs, and startup, reloads, and shutdown are reported to systemd.
+func StartWithContext(ctx context.Context, config *Config) error {
+	svc, err := startService(config)
+	if err != nil {
+		return err
+	}
+	if svc != nil {
+		defer svc.close()
+	}
+	s, err := start(config, nil)
+	if err != nil {
+		return err
+	}
+	if svc != nil {
+		s.service = svc
+		go svc.keepAlive(s.quit)
+		svc.ready(s.serviceStatus())
+	}
+	timeout := time.Second * time.Duration(config.ShutdownTimeout)
+	select {
+	case <-ctx.Done():
+	case <-s.shutdown:
+		log.Println("[*] Shutting down as requested over the control server")
+	case <-s.finished:
+		timeout = drainAll
+	}
+	if svc != nil {
+		svc.stopping()
+	}
+	return s.stop(timeout)
+}
+
+// start loads the analyzers, opens the packet source, and starts the goroutines of a new sensor. A
+// sensor embedded in a program only writes to the outputs listed in the config, besides the
+// channels of the Sensor, and reports its errors on them.
+func start(config *Config, embedded *Sensor) (s *sensor, err error) {
+	defer func() {
 		if err != nil {
-			log.Fatal(fmt.Errorf("unable to process analyzer config: %s", err))
+			closeAnalyzers()
+			resetGlobals()
+		}
+	}()
+	err = newAnalyzers(config.Analyzers)
+	if err != nil {
+		return nil, err
+	}
+	var outputs []configuredOutput
+	if embedded == nil || len(config.Outputs) > 0 {
+		outputs, err = newOutputs(config, nil, false)
+		if err != nil {
+			return nil, err
 		}
-		workingGraph = append(workingGraph, analyzerNode)
 	}
-	err = resolveGraph(workingGraph)
+	s, err = newSensor(config)
 	if err != nil {
-		log.Fatal(fmt.Errorf("failed to build dependency graph for analyzers: %s", err))
+		return nil, err
 	}
-	err = newAnalyzers(config.Analyzers, config.SkipUpdate)
+	if embedded != nil {
+		outputs = append(outputs, configuredOutput{name: "channel", output: newChannelOutput(embedded)})
+		s.errors = embedded
+	}
+	s.outputs = outputs
+	if config.StatsInterval > 0 && !takesStats(outputs) {
+		log.Println("[!] Not writing stats, as stats records are only written to the file and zeek outputs")
+	}
+	if s.arp != nil && findFileOutput(outputs) == nil {
+		// ARP events are not connections, and are only written to the log file
+		log.Println("[!] Not tracking ARP, as ARP events are only written to the file output")
+		s.arp = nil
+	}
+	err = s.getPacketSource(config)
 	if err != nil {
-		log.Fatal(err)
+		s.releaseSources()
+		s.closeServers()
+		return nil, err
 	}
-	err = initLogger(config.LogFile, config.Interface)
+	s.ring, err = newPacketRing(config, s.sources)
 	if err != nil {
-		log.Fatal(err)
+		s.releaseSources()
+		s.closeServers()
+		return nil, fmt.Errorf("unable to set up capture ring: %s", err)
+	}
+	if s.ring != nil {
+		go s.ring.run(s.quit, func(err error) {
+			log.Println(err)
+			s.errors.report(err)
+		})
+	}
+	if s.intel != nil {
+		go s.intel.reload(s.quit)
+	}
+	if s.reorder != nil {
+		go s.reorder.run(s.quit)
+	}
+	if s.streamFactory.budget != nil {
+		go s.streamFactory.budget.monitor(s.quit)
+	}
+	if s.merger != nil {
+		go s.merger.run(s.quit)
+	}
+	if s.quic != nil {
+		go s.quic.reap(s.quit)
+	}
+	if s.flows != nil || s.streamFactory.halfOpenTimeout < s.streamFactory.establishedTimeout {
+		go s.sweepFlows(s.quit)
+	}
+	if s.health != nil {
+		go s.health.serve()
+	}
+	if s.control != nil {
+		go s.control.serve()
+	}
+	if s.metrics != nil {
+		go s.metrics.serve()
+		go s.metrics.sampleRate(s.quit)
+	}
+	if s.procs != nil {
+		go s.procs.run(s.quit)
+	}
+	if config.StatsInterval > 0 {
+		go s.writeStats(time.Second*time.Duration(config.StatsInterval), s.quit)
+	}
+	if s.analyzers != nil {
+		s.runAnalyzers(config.AnalyzerWorkers, s.quit)
 	}
+	go s.processConnections()
+	go s.defrag.discardStale(s.quit)
+	go s.timer.report(s.quit)
+	go s.dumpStateOnSignal(s.quit)
+	go s.reloadOnSignal(s.quit)
+	s.startCounters = s.currentCounters()
+	go s.runSources()
+	if config.ServiceMode {
+		log.Printf("[*] Gourmet is running and logging to %s", describeOutputs(s.outputs))
+	} else {
+		fmt.Printf("Gourmet is running and logging to %s. Press CTL+C to stop...", describeOutputs(s.outputs))
+		fmt.Println()
+	}
+	return s, nil
+}
+
+// serviceStatus is the status line that a sensor run as a service reports to the service manager.
+func (s *sensor) serviceStatus() string {
+	s.outputsMutex.RLock()
+	defer s.outputsMutex.RUnlock()
+	return "Capturing and logging to " + describeOutputs(s.outputs)
+}
+
+// newSensor creates a sensor that tracks connections according to the config. The packet source of
+// the sensor is set up separately.
+func newSensor(config *Config) (s *sensor, err error) {
 	c := make(chan *Connection)
-	s := &sensor{
+	s = &sensor{
+		config:      config,
 		connections: c,
-		streamFactory: &tcpStreamFactory{
-			connections: c,
-			connTimeout: config.ConnTimeout,
-		},
+		emitted:     c,
+		timer:       newStageTimer(config.StageTiming),
+		summary:     newRunSummary(),
+		defrag:      newDefragmenter(),
+		replay:      config.InterfaceType == "pcapfile",
+		finished:    make(chan struct{}),
+		runDone:     make(chan struct{}),
+		quit:        make(chan struct{}),
+		shutdown:    make(chan struct{}),
+		started:     time.Now(),
 	}
-	err = s.getPacketSource(config)
+	// s is nil once an error is returned, so the listeners opened before the error are closed
+	// through partial
+	partial := s
+	defer func() {
+		if err != nil {
+			partial.closeServers()
+		}
+	}()
+	s.streamFactory = &tcpStreamFactory{
+		connections:      c,
+		inFlight:         &s.inFlight,
+		packetTiming:     config.PacketTiming,
+		tolerance:        time.Millisecond * time.Duration(config.TimestampTolerance),
+		sniffContentType: config.SniffContentType,
+		spillThreshold:   config.PayloadSpillThreshold,
+		spillDir:         config.PayloadSpillDir,
+		payloadEntropy:   config.PayloadEntropy,
+		entropyBytes:     config.EntropyBytes,
+		now:              s.now,
+	}
+	s.streamFactory.establishedTimeout, s.streamFactory.halfOpenTimeout = tcpTimeouts(config)
+	s.streamFactory.budget = newMemoryBudget(config.MemoryBudgetMB, s.streamFactory)
+	s.streamFactory.limit, err = newConnectionLimit(config, s.summary)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	go s.processConnections()
-	fmt.Printf("Gourmet is running and logging to %s. Press CTL+C to stop...", gLogger.fileName)
-	fmt.Println()
-	s.run()
+	s.flows = newFlowTable(config, s.streamFactory.budget, s.streamFactory.limit, s.emitConnection, s.now)
+	s.datagrams = newDatagramDirections(config)
+	if config.TrackARP {
+		s.arp = newARPTracker()
+	}
+	s.streamFactory.directions, err = newReassemblyDirections(config.ReassembleDirections)
+	if err != nil {
+		return nil, err
+	}
+	s.reorder, err = newStartOrderBuffer(config.EmitOrder, config.EmitWindow, c)
+	if err != nil {
+		return nil, err
+	}
+	if s.reorder != nil {
+		s.emitted = s.reorder.out
+	}
+	s.uids, err = newUIDGenerator(config.UIDMode, config.UIDSeed)
+	if err != nil {
+		return nil, err
+	}
+	s.streamFactory.uids = s.uids
+	s.streamFactory.preliminaryBytes = config.PreliminaryBytes
+	err = validateUIDFormat(config.UIDFormat)
+	if err != nil {
+		return nil, err
+	}
+	err = setIPFormat(config.IPFormat)
+	if err != nil {
+		return nil, err
+	}
+	err = setEmptyResultKey(config.EmptyResultKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(config.LocalNetworks) > 0 {
+		s.localNets = newIPTrie()
+		for _, network := range config.LocalNetworks {
+			ipNet, err := parseNetwork(network)
+			if err != nil {
+				return nil, err
+			}
+			s.localNets.insert(ipNet, nil)
+		}
+	}
+	if config.BogonDetection {
+		s.bogons, err = loadBogons(config.BogonList)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load bogon list: %s", err)
+		}
+	}
+	s.merger, err = newConnectionMerger(config.MergeWindow, config.MergeBy, s.logConnection, s.now)
+	if err != nil {
+		return nil, err
+	}
+	if rotationHook == nil {
+		rotationHook = commandRotationHook(config.RotateHook)
+		rotationHookFromConfig = rotationHook != nil
+	}
+	if config.TrackPMTU {
+		s.streamFactory.trackPMTU = true
+	}
+	if config.TrackQUIC {
+		s.quic = newQUICTracker(config.ConnTimeout, s.streamFactory.budget, s.emitConnection, s.now)
+	}
+	if sources := config.IntelSources(); len(sources) > 0 {
+		s.intel, err = newIntelFeed(sources, config.IntelRefresh)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load intel feed: %s", err)
+		}
+	}
+	s.geoip, err = newGeoIPDatabases(config.GeoIPDatabases)
+	if err != nil {
+		return nil, err
+	}
+	s.extractor, err = newFileExtractor(config)
+	if err != nil {
+		return nil, fmt.Errorf("unable to set up file extraction: %s", err)
+	}
+	if s.extractor != nil {
+		s.streamFactory.ftp = s.extractor.ftp
+	}
+	if config.IPFIXCollector != "" {
+		s.ipfix, err = newIPFIXExporter(config.IPFIXCollector, config.IPFIXTemplateRefresh)
+		if err != nil {
+			return nil, fmt.Errorf("unable to connect to IPFIX collector: %s", err)
+		}
+	}
+	s.procs = newProcessTable(config.ProcessAttribution)
+	s.health, err = newHealthServer(s, config.HealthAddr, config.HealthMaxIdle)
+	if err != nil {
+		return nil, err
+	}
+	s.metrics, err = newSensorMetrics(s, config.MetricsAddress)
+	if err != nil {
+		return nil, err
+	}
+	s.control, err = newControlServer(s, config.ControlAddress, config.ControlToken)
+	if err != nil {
+		return nil, err
+	}
+	s.sampler = newLogSampler(config.LogSampleRate, config.LogMinBytes, config.LogRateLimit)
+	s.analyzers = newAnalyzerPool(config.AnalyzerWorkers, config.AnalyzerQueueSize, s.replay)
+	s.streamFactory.createShards(config.ConnectionShards)
+	s.streamFactory.ticker = time.NewTicker(time.Second * 10)
+	return s, nil
 }
 
 func convertIfaceType(ifaceType string) (interfaceType, error) {
@@ -83,8 +486,14 @@ func convertIfaceType(ifaceType string) (interfaceType, error) {
 		return libpcapType, nil
 	} else if ifaceType == "afpacket" {
 		return afpacketType, nil
+	} else if ifaceType == "pcapfile" {
+		return pcapfileType, nil
+	} else if ifaceType == "afxdp" {
+		return afxdpType, nil
+	} else if ifaceType == "ssh" {
+		return sshType, nil
 	} else {
-		return 0, errors.New("invalid interface type. Must be libpcap or afpacket")
+		return 0, errors.New("invalid interface type. Must be libpcap, afpacket, afxdp, ssh, or pcapfile")
 	}
 }
 
@@ -93,57 +502,640 @@ func (s *sensor) getPacketSource(c *Config) (err error) {
 	if err != nil {
 		return err
 	}
-	if ifaceType == afpacketType {
-		s.source, err = newAfpacketSensor(c)
+	if ifaceType == pcapfileType {
+		handle, err := newPcapFileSensor(c)
 		if err != nil {
 			return err
 		}
-	} else if ifaceType == libpcapType {
-		s.source, err = newLibpcapSensor(c)
+		s.sources = []*captureSource{{name: c.PcapFile, source: handle, decoder: handle.LinkType(), filter: c.Bpf}}
+		return nil
+	}
+	if c.InterfacePattern != "" {
+		return s.getPatternSources()
+	}
+	ifaces := c.CaptureInterfaces()
+	if len(ifaces) > 1 {
+		s.ifNames = make(map[int]string)
+	}
+	for i, iface := range ifaces {
+		src := &captureSource{name: iface, decoder: layers.LayerTypeEthernet, filter: c.effectiveBpf(iface)}
+		if ifaceType == sshType {
+			remote, err := newSSHSensor(c, iface)
+			if err != nil {
+				return fmt.Errorf("unable to capture on %s of %s: %s", iface, c.Remote, err)
+			}
+			// remote interfaces have no local index, and are numbered in the order they are listed
+			src.name = iface + "@" + c.Remote
+			src.source = remote
+			src.decoder = remote.LinkType()
+			src.index = i + 1
+			if s.ifNames != nil {
+				s.ifNames[src.index] = src.name
+			}
+			s.sources = append(s.sources, src)
+			continue
+		}
+		// the rings of afpacket interfaces are read as separate sources, and their fanout group is
+		// numbered after the process, so that other sensors on the host have their own
+		var rings []gopacket.ZeroCopyPacketDataSource
+		group := uint16(os.Getpid()) + uint16(i)
+		if ifaceType == afpacketType {
+			rings, err = s.afpacketSources(c, src, group)
+		} else if ifaceType == libpcapType {
+			var device *captureDevice
+			device, err = findCaptureDevice(iface)
+			var handle *pcap.Handle
+			if err == nil {
+				handle, err = newLibpcapSensor(c, iface, device)
+			}
+			if err == nil {
+				src.source, src.decoder = handle, handle.LinkType()
+				src.index = device.index()
+			}
+		} else if ifaceType == afxdpType {
+			if !c.AfxdpRedirect {
+				return errors.New("afxdp redirects every packet of the interface away from the host, and requires afxdp_redirect")
+			}
+			src.source, err = newXDPSensor(c, iface)
+			if err != nil {
+				log.Printf("[!] AF_XDP is not available on %s, falling back to afpacket: %s", iface, err)
+				src.source = nil
+				rings, err = s.afpacketSources(c, src, group)
+			}
+		} else {
+			return errors.New("interface type is not set")
+		}
 		if err != nil {
-			return err
+			return fmt.Errorf("unable to capture on %s: %s", iface, err)
+		}
+		if src.index > 0 {
+			// the interface of the libpcap device was already found, which on Windows has another name
+		} else if i, err := net.InterfaceByName(iface); err == nil {
+			src.index = i.Index
+		} else if c.IncludeInterfaceIndex || len(ifaces) > 1 {
+			return fmt.Errorf("unable to look up the index of interface %s: %s", iface, err)
+		}
+		if s.ifNames != nil {
+			s.ifNames[src.index] = iface
+		}
+		if len(rings) == 0 {
+			s.sources = append(s.sources, src)
+			continue
+		}
+		for k, ring := range rings {
+			ringSrc := *src
+			ringSrc.source = ring
+			if len(rings) > 1 {
+				ringSrc.name = fmt.Sprintf("%s#%d", iface, k+1)
+			}
+			s.sources = append(s.sources, &ringSrc)
 		}
-	} else {
-		return errors.New("interface type is not set")
 	}
 	return nil
 }
 
-func (s *sensor) run() {
-	s.streamFactory.createAssembler()
-	s.streamFactory.ticker = time.NewTicker(time.Second * 10)
-	for {
-		p, ci, err := s.source.ZeroCopyReadPacketData()
+// afpacketSources opens the afpacket rings of the interface of a source, whose frames are decoded
+// with the link type of the interface.
+func (s *sensor) afpacketSources(c *Config, src *captureSource, group uint16) ([]gopacket.ZeroCopyPacketDataSource, error) {
+	linkType, err := interfaceLinkType(src.name)
+	if err != nil {
+		return nil, err
+	}
+	src.decoder = linkType
+	return newAfpacketSensors(c, src.name, linkType, group)
+}
+
+// runSources runs a capture loop for every packet source, and for the interfaces of
+// interface_pattern that appear while the sensor runs, and closes runDone once they have all
+// returned.
+func (s *sensor) runSources() {
+	// the idle time of the capture loop is measured from the start of capture until the first packet
+	atomic.StoreInt64(&s.lastPacket, time.Now().UnixNano())
+	atomic.StoreInt32(&s.capturing, 1)
+	var wg sync.WaitGroup
+	start := func(src *captureSource) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.run(src)
+		}()
+	}
+	for _, src := range s.captureSources() {
+		start(src)
+	}
+	if s.config.InterfacePattern != "" && s.config.InterfaceRescan > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.watchInterfaces(time.Second*time.Duration(s.config.InterfaceRescan), start, s.quit)
+		}()
+	}
+	wg.Wait()
+	close(s.runDone)
+}
+
+// captureSources returns the packet sources that are being captured on.
+func (s *sensor) captureSources() []*captureSource {
+	s.sourcesMutex.RLock()
+	defer s.sourcesMutex.RUnlock()
+	return append([]*captureSource(nil), s.sources...)
+}
+
+// run reads packets from a source into the shared connection table. Packets are tagged with the
+// index of the interface they were captured on.
+func (s *sensor) run(src *captureSource) {
+	for atomic.LoadInt32(&s.stopping) == 0 && atomic.LoadInt32(&src.stopped) == 0 {
+		p, ci, err := src.source.ZeroCopyReadPacketData()
+		if err == errCaptureTimeout {
+			// nothing was captured within the poll timeout
+			s.streamFactory.reapIdle()
+			continue
+		}
+		if err == io.EOF && s.replay {
+			log.Printf("[*] Finished reading %s", src.name)
+			close(s.finished)
+			return
+		}
+		if err != nil && src.watched {
+			// the interface went away, and is captured on again if it comes back
+			if atomic.CompareAndSwapInt32(&src.stopped, 0, 1) {
+				log.Printf("[!] Capture on %s stopped: %s", src.name, err)
+			}
+			return
+		}
 		if err != nil {
 			log.Println(err)
+			s.errors.report(err)
+			continue
+		}
+		ci.InterfaceIndex = src.index
+		atomic.StoreInt64(&s.lastPacket, time.Now().UnixNano())
+		s.summary.addPacket()
+		start := s.timer.start()
+		packet := gopacket.NewPacket(p, frameDecoder(src.decoder), gopacket.DecodeStreamsAsDatagrams)
+		s.timer.stop(decodeStage, start)
+		if s.ring != nil {
+			// packets are queued in the order they were read, before the buffer of the source is reused
+			s.ring.write(packet, ci, p)
+		}
+		if s.replay {
+			// packets are processed one at a time, which keeps the capture order for reassembly and
+			// stops a fast read of the file from outrunning the analyzers
+			if ci.Timestamp.UnixNano() > atomic.LoadInt64(&s.packetClock) {
+				atomic.StoreInt64(&s.packetClock, ci.Timestamp.UnixNano())
+			}
+			s.processNewPacket(packet, ci)
 			continue
 		}
-		packet := gopacket.NewPacket(p, layers.LayerTypeEthernet, gopacket.DecodeStreamsAsDatagrams)
 		go s.processNewPacket(packet, ci)
 	}
 }
 
 func (s *sensor) processNewPacket(packet gopacket.Packet, ci gopacket.CaptureInfo) {
+	ci = tagVLANs(packet, ci)
+	packet, ok := s.defrag.defragment(packet)
+	if !ok {
+		return
+	}
+	if atomic.LoadInt32(&packetAnalyzerCount) > 0 {
+		packet.Metadata().CaptureInfo = ci
+		analyzePacket(packet)
+	}
+	if s.config.DecapsulateTunnels {
+		// packet analyzers see the tunnel, and the connection table the flow inside it, which may
+		// have been fragmented on its own
+		packet, ci = decapsulate(packet, ci)
+		packet, ok = s.defrag.defragment(packet)
+		if !ok {
+			return
+		}
+	}
 	if packet.TransportLayer() != nil {
 		layer := packet.TransportLayer()
 		switch layer.LayerType() {
 		case layers.LayerTypeTCP:
-			s.streamFactory.newPacket(packet.NetworkLayer().NetworkFlow(), packet.TransportLayer().(*layers.TCP))
+			if s.procs != nil && layer.(*layers.TCP).SYN {
+				s.procs.connectionStarted()
+			}
+			start := s.timer.start()
+			netFlow, ci := zoneTCP(packet.NetworkLayer().NetworkFlow(), ci)
+			s.streamFactory.newPacket(netFlow, packet.TransportLayer().(*layers.TCP), ci)
+			s.timer.stop(trackStage, start)
 			return
 		case layers.LayerTypeUDP:
+			start := s.timer.start()
+			if s.quic != nil && s.quic.observe(packet, layer.(*layers.UDP), ci) {
+				s.timer.stop(trackStage, start)
+				return
+			}
 			udp := processUDPPacket(packet, ci)
-			s.connections <- udp
+			if tracked, started := s.flows.add(udp, layer.LayerPayload(), ci); tracked {
+				if started && s.procs != nil {
+					s.procs.datagramSeen(udp, time.Now())
+				}
+				s.timer.stop(trackStage, start)
+				return
+			}
+			if s.streamFactory.budget.shedConnection(flowHash(packet.NetworkLayer().NetworkFlow(), layer.TransportFlow())) {
+				return
+			}
+			if s.procs != nil {
+				s.procs.datagramSeen(udp, time.Now())
+			}
+			if s.datagrams != nil {
+				s.datagrams.observe(udp)
+			}
+			if s.config.PayloadEntropy {
+				udp.PayloadEntropy = payloadEntropy(s.config.EntropyBytes, layer.LayerPayload())
+			}
+			s.timer.stop(trackStage, start)
+			s.emitConnection(udp)
 			return
 		}
 	}
+	if s.streamFactory.trackPMTU {
+		s.streamFactory.observePMTU(packet, ci)
+	}
+	if s.config.TrackICMP {
+		if icmp, ok := packet.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4); ok {
+			c := processICMPPacket(packet, icmp, ci)
+			if tracked, _ := s.flows.add(c, icmp.LayerPayload(), ci); !tracked && !s.streamFactory.budget.shedFlow(c) {
+				s.emitConnection(c)
+			}
+			return
+		}
+	}
+	if s.config.TrackICMPv6 {
+		if icmp, ok := packet.Layer(layers.LayerTypeICMPv6).(*layers.ICMPv6); ok {
+			c := processICMPv6Packet(packet, icmp, ci)
+			if tracked, _ := s.flows.add(c, icmp.LayerPayload(), ci); !tracked && !s.streamFactory.budget.shedFlow(c) {
+				s.emitConnection(c)
+			}
+			return
+		}
+	}
+	if s.arp != nil {
+		if arp, ok := packet.Layer(layers.LayerTypeARP).(*layers.ARP); ok {
+			s.logARP(*s.arp.observe(arp, ci.Timestamp))
+		}
+	}
+}
+
+// requestShutdown asks for the sensor to be shut down gracefully, by StartWithContext or by the
+// program that it is embedded in.
+func (s *sensor) requestShutdown() {
+	s.shutdownOnce.Do(func() {
+		close(s.shutdown)
+	})
+}
+
+// now returns the clock that idle connections are measured against, which is the wall clock, or the
+// capture clock when replaying a capture file.
+func (s *sensor) now() time.Time {
+	if s.replay {
+		return time.Unix(0, atomic.LoadInt64(&s.packetClock))
+	}
+	return time.Now()
+}
+
+// emitConnection hands a connection that is not tracked by the TCP assembler to the pipeline.
+func (s *sensor) emitConnection(c *Connection) {
+	atomic.AddInt64(&s.inFlight, 1)
+	s.connections <- c
 }
 
+// processConnections annotates the emitted connections in the order they were emitted, and then
+// analyzes and logs each of them, or hands it to the analyzer pool if there is one, until the sensor
+// stops.
 func (s *sensor) processConnections() {
-	for connection := range s.connections {
-		err := connection.analyze()
+	for {
+		var connection *Connection
+		select {
+		case connection = <-s.emitted:
+		case <-s.quit:
+			return
+		}
+		s.annotateConnection(connection)
+		s.active.add(connection)
+		// merged records are sampled as they are logged, once their bytes are known
+		if s.sampler != nil && s.merger == nil && !s.sampler.keep(connection) {
+			connection.unlogged = true
+			s.finishConnection(connection)
+			continue
+		}
+		if s.analyzers != nil {
+			if !s.analyzers.submit(connection) {
+				s.summary.addOverflow()
+				s.finishConnection(connection)
+			}
+			continue
+		}
+		s.analyzeConnection(connection)
+		s.finishConnection(connection)
+	}
+}
+
+// annotateConnection sets the fields of a connection that the sensor derives before analysis.
+func (s *sensor) annotateConnection(connection *Connection) {
+	if s.uids != nil && !connection.uidAssigned {
+		s.uids.assign(connection)
+	}
+	connection.UID = formatUID(connection.uid, s.config.UIDFormat)
+	s.sourcesMutex.RLock()
+	if s.ifNames != nil {
+		connection.Interface = s.ifNames[connection.InterfaceIndex]
+	}
+	s.sourcesMutex.RUnlock()
+	if !s.config.IncludeInterfaceIndex {
+		connection.InterfaceIndex = 0
+	}
+	if s.procs != nil {
+		s.procs.attribute(connection)
+	}
+	if s.ring != nil {
+		s.ring.locate(connection)
+	}
+	connection.forceService(s.config.PortProtocols)
+	connection.detectService()
+	if s.config.CommunityID {
+		connection.setCommunityID(uint16(s.config.CommunityIDSeed))
+	}
+	if s.localNets != nil {
+		connection.setLocality(s.localNets)
+	}
+	if s.bogons != nil {
+		connection.tagBogons(s.bogons, s.localNets)
+	}
+	if s.intel != nil {
+		s.intel.match(connection)
+	}
+	if s.geoip != nil {
+		s.geoip.enrich(connection)
+	}
+}
+
+// analyzeConnection extracts the files of a connection and runs the analyzers on it. Both read the
+// whole payload, so they run on the analyzer workers when there are any.
+func (s *sensor) analyzeConnection(connection *Connection) {
+	if s.extractor != nil {
+		s.extractor.extract(connection)
+	}
+	start := s.timer.start()
+	err := connection.analyze(s.metrics)
+	s.timer.stop(analyzeStage, start)
+	if err != nil {
+		s.summary.addAnalyzerError()
+		log.Println(err)
+		s.errors.report(err)
+	}
+	if s.intel != nil {
+		s.intel.matchResults(connection)
+	}
+	connection.capAnalyzerResults(s.config.MaxAnalyzerResults)
+}
+
+// finishConnection counts an analyzed connection and logs it, or merges it into a pending record.
+func (s *sensor) finishConnection(connection *Connection) {
+	if !connection.Preliminary {
+		s.summary.addConnection(connection)
+		s.metrics.addConnection()
+	}
+	if s.merger != nil && !connection.Preliminary {
+		if !s.merger.add(connection) {
+			connection.releasePayload()
+			s.active.remove(connection)
+			atomic.AddInt64(&s.inFlight, -1)
+		}
+		return
+	}
+	s.logConnection(connection)
+}
+
+// logConnection writes an analyzed connection to the log and the flow exporter.
+func (s *sensor) logConnection(connection *Connection) {
+	if connection.unlogged || s.merger != nil && s.sampler != nil && !s.sampler.keep(connection) {
+		s.summary.addUnlogged()
+	} else {
+		s.writeOutputs(connection)
+	}
+	if s.ipfix != nil && !connection.Preliminary {
+		err := s.ipfix.export(connection)
 		if err != nil {
 			log.Println(err)
+			s.errors.report(err)
+		}
+	}
+	connection.releasePayload()
+	s.active.remove(connection)
+	atomic.AddInt64(&s.inFlight, -1)
+}
+
+// activeConnections holds the connections that are being annotated, analyzed, merged, or logged, so
+// that those abandoned at shutdown can be reported.
+type activeConnections struct {
+	mutex       sync.Mutex
+	connections map[*Connection]struct{}
+}
+
+func (ac *activeConnections) add(c *Connection) {
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
+	if ac.connections == nil {
+		ac.connections = make(map[*Connection]struct{})
+	}
+	ac.connections[c] = struct{}{}
+}
+
+func (ac *activeConnections) remove(c *Connection) {
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
+	delete(ac.connections, c)
+}
+
+// describe returns the UID and 5-tuple of every active connection, sorted.
+func (ac *activeConnections) describe() []string {
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
+	var descriptions []string
+	for c := range ac.connections {
+		descriptions = append(descriptions, fmt.Sprintf("%s %s %s:%d -> %s:%d", c.UID, c.TransportType,
+			c.SourceIP, c.SourcePort, c.DestinationIP, c.DestinationPort))
+	}
+	sort.Strings(descriptions)
+	return descriptions
+}
+
+// writeOutputs writes a connection to every output.
+func (s *sensor) writeOutputs(connection *Connection) {
+	if s.config.IncludePayload {
+		connection.encodePayload(s.config.MaxPayloadBytes)
+	}
+	start := s.timer.start()
+	logStart := s.metrics.start()
+	s.outputsMutex.RLock()
+	defer s.outputsMutex.RUnlock()
+	for _, o := range s.outputs {
+		err := o.output.Write(connection)
+		if err != nil {
+			log.Printf("[!] Failed to write connection %s to output %s: %s", connection.UID, o.name, err)
+			s.errors.report(fmt.Errorf("failed to write connection %s to output %s: %s", connection.UID, o.name, err))
+		}
+	}
+	s.metrics.observeLog(logStart)
+	s.timer.stop(logStage, start)
+}
+
+// logARP writes an ARP event to the log file of the file output.
+func (s *sensor) logARP(e ARPEvent) {
+	s.outputsMutex.RLock()
+	defer s.outputsMutex.RUnlock()
+	if fo := findFileOutput(s.outputs); fo != nil {
+		fo.logger.logARP(e)
+	}
+}
+
+// drainAll is the drain timeout that waits for every in-flight connection, however long it takes
+const drainAll = time.Duration(math.MaxInt64)
+
+// drain stops reading new packets, flushes every open TCP stream, and waits up to timeout for the
+// in-flight connections to be analyzed and logged, or not at all if timeout is not positive. It
+// returns the number of connections that were still in flight when the timeout expired, and the UID
+// and 5-tuple of those of them that were taken from the pipeline to be analyzed and logged. The
+// others had not been emitted in order yet, so their UIDs were not assigned.
+func (s *sensor) drain(timeout time.Duration) (int64, []string) {
+	atomic.StoreInt32(&s.stopping, 1)
+	s.streamFactory.flushAll()
+	if s.quic != nil {
+		s.quic.flush(time.Time{})
+	}
+	if s.flows != nil {
+		s.flows.flush(time.Time{})
+	}
+	if s.reorder != nil {
+		s.reorder.flush()
+	}
+	if s.merger != nil {
+		// connections still arriving after this are merged into new records, which the merger
+		// flushes on its next tick
+		s.merger.flush(time.Time{})
+	}
+	start := time.Now()
+	for atomic.LoadInt64(&s.inFlight) > 0 && time.Since(start) < timeout {
+		time.Sleep(10 * time.Millisecond)
+	}
+	abandoned := atomic.LoadInt64(&s.inFlight)
+	if abandoned == 0 {
+		return 0, nil
+	}
+	return abandoned, s.active.describe()
+}
+
+// stop shuts the sensor down, draining in-flight connections for at most timeout, or until they are
+// all logged if timeout is drainAll.
+func (s *sensor) stop(timeout time.Duration) (err error) {
+	abandoned, active := s.drain(timeout)
+	if abandoned > 0 {
+		log.Printf("[!] Shutdown timeout reached, abandoning %d in-flight connections, %d of them not yet emitted",
+			abandoned, abandoned-int64(len(active)))
+		for _, c := range active {
+			log.Printf("[!] Abandoned connection %s", c)
+		}
+		err = fmt.Errorf("abandoned %d in-flight connections at shutdown", abandoned)
+	}
+	close(s.quit)
+	s.streamFactory.ticker.Stop()
+	// the drops are read from the packet sources, which cannot be asked once they are closed, and
+	// the metrics server reads them as well
+	var drops string
+	if s.config.Summary {
+		drops = s.summaryDrops()
+	}
+	s.closeServers()
+	s.closeSources()
+	if s.ring != nil {
+		ringErr := s.ring.close()
+		if ringErr != nil {
+			log.Printf("[!] Failed to close capture ring: %s", ringErr)
+		}
+	}
+	closeAnalyzers()
+	s.outputsMutex.Lock()
+	closeOutputs(s.outputs)
+	s.outputsMutex.Unlock()
+	if s.geoip != nil {
+		s.geoip.close()
+	}
+	if s.config.Summary {
+		summaryErr := s.writeSummary(s.config.SummaryFile, drops)
+		if summaryErr != nil {
+			log.Println(summaryErr)
+		}
+	}
+	resetGlobals()
+	return err
+}
+
+// closeServers closes the listeners of the health, control, and metrics servers, and the socket of
+// the flow exporter, those of them that were opened.
+func (s *sensor) closeServers() {
+	if s.health != nil {
+		s.health.close()
+	}
+	if s.control != nil {
+		s.control.close()
+	}
+	if s.metrics != nil {
+		s.metrics.close()
+	}
+	if s.ipfix != nil {
+		s.ipfix.close()
+	}
+}
+
+// resetGlobals puts the package state that a sensor sets from its config back to its defaults once
+// the sensor stopped or failed to start, so that the next sensor of the process does not inherit it.
+// A rotation hook set with SetRotationHook is kept.
+func resetGlobals() {
+	setRegisteredAnalyzers(nil)
+	emptyKeyUsesName = false
+	ipExpanded = false
+	if rotationHookFromConfig {
+		rotationHook = nil
+		rotationHookFromConfig = false
+	}
+}
+
+// releaseSources closes the packet sources of a sensor that failed to start, which gives the
+// interfaces of afxdp sources back to the host.
+func (s *sensor) releaseSources() {
+	for _, src := range s.sources {
+		if closer, ok := src.source.(interface{ Close() }); ok {
+			closer.Close()
+		}
+	}
+	s.sources = nil
+}
+
+// closeSources closes the packet sources once the capture loops have returned. A pcap handle can be
+// closed while it is being read, but the ring of an afpacket handle and the frames of an AF_XDP
+// source are unmapped on close, so those whose capture loop is still blocked waiting for a packet
+// are left open.
+func (s *sensor) closeSources() {
+	var returned bool
+	select {
+	case <-s.runDone:
+		returned = true
+	case <-time.After(time.Second):
+	}
+	for _, src := range s.captureSources() {
+		closer, ok := src.source.(interface{ Close() })
+		if !ok {
+			continue
+		}
+		if mapsRing(src.source) && !returned {
+			log.Printf("[!] The capture loop of %s is still waiting for a packet, leaving its capture handle open", src.name)
+			continue
 		}
-		gLogger.log(*connection)
+		closer.Close()
 	}
 }
@@ -0,0 +1,237 @@
+package gourmet
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// benchmarkCapture is a representative capture of HTTP connections, each with a request and a
+// response of several full segments, interleaved with DNS lookups.
+type benchmarkCapture struct {
+	pcap        []byte
+	packets     int
+	connections int
+}
+
+// benchmarkSegment is a segment of a connection of a benchmark capture, whose ports and sequence
+// numbers are set as it is written.
+type benchmarkSegment struct {
+	fromClient bool
+	tcp        layers.TCP
+	payload    []byte
+}
+
+// newBenchmarkCapture writes a capture of the connections to memory.
+func newBenchmarkCapture(connections int) (*benchmarkCapture, error) {
+	var buf bytes.Buffer
+	w := pcapgo.NewWriter(&buf)
+	err := w.WriteFileHeader(65536, layers.LinkTypeEthernet)
+	if err != nil {
+		return nil, err
+	}
+	capture := &benchmarkCapture{}
+	at := testStart
+	write := func(src, dst net.IP, transport gopacket.SerializableLayer, payload []byte) error {
+		eth := &layers.Ethernet{
+			SrcMAC:       net.HardwareAddr{0, 0, 0, 0, 0, 1},
+			DstMAC:       net.HardwareAddr{0, 0, 0, 0, 0, 2},
+			EthernetType: layers.EthernetTypeIPv4,
+		}
+		ip := &layers.IPv4{Version: 4, TTL: 64, SrcIP: src, DstIP: dst}
+		switch t := transport.(type) {
+		case *layers.TCP:
+			ip.Protocol = layers.IPProtocolTCP
+			t.SetNetworkLayerForChecksum(ip)
+		case *layers.UDP:
+			ip.Protocol = layers.IPProtocolUDP
+			t.SetNetworkLayerForChecksum(ip)
+		}
+		frame := gopacket.NewSerializeBuffer()
+		opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+		err := gopacket.SerializeLayers(frame, opts, eth, ip, transport, gopacket.Payload(payload))
+		if err != nil {
+			return err
+		}
+		at = at.Add(time.Millisecond)
+		capture.packets++
+		return w.WritePacket(gopacket.CaptureInfo{
+			Timestamp:     at,
+			CaptureLength: len(frame.Bytes()),
+			Length:        len(frame.Bytes()),
+		}, frame.Bytes())
+	}
+	request := []byte("GET /index.html HTTP/1.1\r\nHost: example.com\r\nUser-Agent: bench\r\n\r\n")
+	response := append([]byte("HTTP/1.1 200 OK\r\nContent-Type: text/html\r\nContent-Length: 8000\r\n\r\n"),
+		bytes.Repeat([]byte("<p>gourmet</p>"), 572)...)
+	server := net.IPv4(10, 255, 0, 1).To4()
+	resolver := net.IPv4(10, 255, 0, 53).To4()
+	for i := 0; i < connections; i++ {
+		client := net.IPv4(10, 0, byte(i>>8), byte(i)).To4()
+		sport := layers.TCPPort(40000 + i%20000)
+		lookup := &layers.UDP{SrcPort: layers.UDPPort(50000 + i%10000), DstPort: 53}
+		answer := &layers.UDP{SrcPort: 53, DstPort: lookup.SrcPort}
+		err = write(client, resolver, lookup, []byte("\x12\x34\x01\x00\x00\x01\x00\x00\x00\x00\x00\x00\x07example\x03com\x00\x00\x01\x00\x01"))
+		if err == nil {
+			err = write(resolver, client, answer, []byte("\x12\x34\x81\x80\x00\x01\x00\x01\x00\x00\x00\x00\x07example\x03com\x00\x00\x01\x00\x01\xc0\x0c\x00\x01\x00\x01\x00\x00\x0e\x10\x00\x04\x0a\xff\x00\x01"))
+		}
+		if err != nil {
+			return nil, err
+		}
+		capture.connections += 2
+		clientSeq, serverSeq := uint32(1000), uint32(5000)
+		segments := []benchmarkSegment{
+			{true, layers.TCP{SYN: true}, nil},
+			{false, layers.TCP{SYN: true, ACK: true}, nil},
+			{true, layers.TCP{ACK: true}, nil},
+			{true, layers.TCP{ACK: true, PSH: true}, request},
+		}
+		for off := 0; off < len(response); off += 1448 {
+			end := off + 1448
+			if end > len(response) {
+				end = len(response)
+			}
+			segments = append(segments, benchmarkSegment{false, layers.TCP{ACK: true}, response[off:end]})
+		}
+		segments = append(segments, []benchmarkSegment{
+			{true, layers.TCP{ACK: true, FIN: true}, nil},
+			{false, layers.TCP{ACK: true, FIN: true}, nil},
+			{true, layers.TCP{ACK: true}, nil},
+		}...)
+		for _, s := range segments {
+			tcp := s.tcp
+			tcp.Window = 65535
+			src, dst := client, server
+			if s.fromClient {
+				tcp.SrcPort, tcp.DstPort = sport, 80
+				tcp.Seq, tcp.Ack = clientSeq, serverSeq
+			} else {
+				src, dst = server, client
+				tcp.SrcPort, tcp.DstPort = 80, sport
+				tcp.Seq, tcp.Ack = serverSeq, clientSeq
+			}
+			if !tcp.ACK {
+				tcp.Ack = 0
+			}
+			err = write(src, dst, &tcp, s.payload)
+			if err != nil {
+				return nil, err
+			}
+			advance := uint32(len(s.payload))
+			if tcp.SYN || tcp.FIN {
+				advance++
+			}
+			if s.fromClient {
+				clientSeq += advance
+			} else {
+				serverSeq += advance
+			}
+		}
+		capture.connections++
+	}
+	capture.pcap = buf.Bytes()
+	return capture, nil
+}
+
+// countingOutput counts the connections written to it.
+type countingOutput struct {
+	written int64
+}
+
+func (co *countingOutput) Write(c *Connection) error {
+	atomic.AddInt64(&co.written, 1)
+	return nil
+}
+
+// replay reads a capture into a new sensor that runs the analyzers of the config and writes to the
+// output, and returns once every connection of it was logged.
+func replay(tb testing.TB, config *Config, capture []byte, output Output) *sensor {
+	err := newAnalyzers(config.Analyzers)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer resetGlobals()
+	defer closeAnalyzers()
+	s, err := newSensor(config)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	reader, err := pcapgo.NewReader(bytes.NewReader(capture))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	s.outputs = []configuredOutput{{name: "test", output: output}}
+	go s.processConnections()
+	s.run(&captureSource{name: "test", source: reader, decoder: reader.LinkType()})
+	s.streamFactory.flushAll()
+	if s.flows != nil {
+		s.flows.flush(time.Time{})
+	}
+	for atomic.LoadInt64(&s.inFlight) > 0 {
+		runtime.Gosched()
+	}
+	close(s.quit)
+	s.streamFactory.ticker.Stop()
+	return s
+}
+
+// BenchmarkReplay replays a capture through the whole pipeline, from decoding the packets through
+// the built-in http, dns, and tls analyzers to logging the connections, and reports the rate of
+// packets. With stage timing, the time spent in the analyzers is reported as well, and the time of
+// each stage of the last replay is logged.
+func BenchmarkReplay(b *testing.B) {
+	capture, err := newBenchmarkCapture(500)
+	if err != nil {
+		b.Fatal(err)
+	}
+	// every replay logs the end of the capture
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	for _, test := range []struct {
+		name   string
+		config Config
+	}{
+		{"default", Config{}},
+		{"community_id", Config{CommunityID: true}},
+		{"stage_timing", Config{StageTiming: true}},
+	} {
+		b.Run(test.name, func(b *testing.B) {
+			config := test.config
+			config.InterfaceType = "pcapfile"
+			config.Analyzers = map[string]interface{}{
+				httpAnalyzerName: nil,
+				dnsAnalyzerName:  nil,
+				tlsAnalyzerName:  nil,
+			}
+			config.SetDefaults()
+			b.SetBytes(int64(len(capture.pcap)))
+			b.ReportAllocs()
+			var s *sensor
+			var analyze int64
+			start := time.Now()
+			for i := 0; i < b.N; i++ {
+				output := &countingOutput{}
+				s = replay(b, &config, capture.pcap, output)
+				if written := atomic.LoadInt64(&output.written); written != int64(capture.connections) {
+					b.Fatalf("expected %d connections to be logged, got %d", capture.connections, written)
+				}
+				analyze += atomic.LoadInt64(&s.timer.nanos[analyzeStage])
+			}
+			b.ReportMetric(float64(capture.packets*b.N)/time.Since(start).Seconds(), "packets/s")
+			if config.StageTiming {
+				b.ReportMetric(float64(analyze)/float64(b.N), "analyze-ns/op")
+				b.Logf("stage timing: %s", s.timer)
+			}
+		})
+	}
+}
@@ -0,0 +1,246 @@
+package gourmet
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	serviceLogJournald = "journald"
+	serviceLogSyslog   = "syslog"
+	serviceLogStderr   = "stderr"
+)
+
+// Priorities of operational messages, as numbered by syslog and journald
+const (
+	priorityErr     = 3
+	priorityWarning = 4
+	priorityInfo    = 6
+)
+
+// service is what a sensor run as a system service, for example as a systemd unit, does besides
+// capturing: it writes its operational messages to journald or syslog, apart from the connection log,
+// keeps a PID file while it runs, and reports readiness, reloads, and shutdown to the service
+// manager with sd_notify when it was started with a NOTIFY_SOCKET.
+type service struct {
+	pidFile string
+	// notifySocket is the socket of the service manager, or empty if it does not expect notifications
+	notifySocket string
+	// watchdog is how often the service manager expects to hear from the sensor, or 0 if it does not
+	watchdog time.Duration
+}
+
+// startService sets up service mode if the config enables it, and returns nil otherwise.
+func startService(config *Config) (*service, error) {
+	if !config.ServiceMode {
+		return nil, nil
+	}
+	err := setServiceLog(config.ServiceLog)
+	if err != nil {
+		return nil, fmt.Errorf("unable to set up service log: %s", err)
+	}
+	sv := &service{
+		pidFile:      config.PidFile,
+		notifySocket: os.Getenv("NOTIFY_SOCKET"),
+		watchdog:     serviceWatchdog(),
+	}
+	if sv.pidFile != "" {
+		err = writePidFile(sv.pidFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return sv, nil
+}
+
+// serviceWatchdog returns the watchdog interval that systemd passed to the process, or 0 if it
+// passed none or passed it to another process.
+func serviceWatchdog() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// ready tells the service manager that the sensor is capturing, with a status line for systemctl
+// status.
+func (sv *service) ready(status string) {
+	sv.notify("READY=1", "STATUS="+status, "MAINPID="+strconv.Itoa(os.Getpid()))
+}
+
+// stopping tells the service manager that the sensor is shutting down.
+func (sv *service) stopping() {
+	sv.notify("STOPPING=1", "STATUS=Shutting down")
+}
+
+// reloading tells the service manager that the config is being reloaded, and reloaded that the
+// sensor is ready again.
+func (sv *service) reloading() {
+	sv.notify("RELOADING=1", "STATUS=Reloading config")
+}
+
+func (sv *service) reloaded(status string) {
+	sv.notify("READY=1", "STATUS="+status)
+}
+
+// keepAlive pings the watchdog of the service manager twice per interval until quit is closed, so
+// that a sensor that hangs is restarted.
+func (sv *service) keepAlive(quit <-chan struct{}) {
+	if sv.watchdog == 0 {
+		return
+	}
+	ticker := time.NewTicker(sv.watchdog / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+		}
+		sv.notify("WATCHDOG=1")
+	}
+}
+
+// close removes the PID file once the sensor has shut down.
+func (sv *service) close() {
+	if sv.pidFile != "" {
+		removePidFile(sv.pidFile)
+	}
+}
+
+// notify sends the state assignments to the service manager, as sd_notify does. It does nothing
+// when the sensor was not started by a service manager that expects notifications.
+func (sv *service) notify(state ...string) {
+	if sv.notifySocket == "" {
+		return
+	}
+	err := sdNotify(sv.notifySocket, strings.Join(state, "\n"))
+	if err != nil {
+		log.Printf("[!] Failed to notify service manager: %s", err)
+	}
+}
+
+// sdNotify sends a datagram to the notification socket of systemd. Sockets whose name starts with @
+// are in the abstract namespace.
+func sdNotify(socket, state string) error {
+	addr := &net.UnixAddr{Name: socket, Net: "unixgram"}
+	if strings.HasPrefix(socket, "@") {
+		addr.Name = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// writePidFile writes the PID of the process to a file. It fails if the file holds the PID of a
+// process that is still running, so that two sensors are not started with the same PID file, and
+// replaces the file left behind by one that died.
+func writePidFile(path string) error {
+	contents, err := ioutil.ReadFile(path)
+	if err == nil {
+		pid, err := strconv.Atoi(strings.TrimSpace(string(contents)))
+		if err == nil && pid != os.Getpid() && processRunning(pid) {
+			return fmt.Errorf("gourmet is already running with PID %d, according to %s", pid, path)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	err = ioutil.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+	if err != nil {
+		return fmt.Errorf("unable to write PID file: %s", err)
+	}
+	return nil
+}
+
+// removePidFile removes the PID file unless another process replaced it.
+func removePidFile(path string) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil || strings.TrimSpace(string(contents)) != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	err = os.Remove(path)
+	if err != nil {
+		log.Printf("[!] Failed to remove PID file %s: %s", path, err)
+	}
+}
+
+// setServiceLog sends the messages of the log package to journald, syslog, or stderr, without the
+// timestamps that they add on their own.
+func setServiceLog(destination string) error {
+	if destination == serviceLogStderr {
+		log.SetFlags(0)
+		return nil
+	}
+	var w logWriter
+	var err error
+	switch destination {
+	case serviceLogJournald:
+		w, err = newJournalWriter()
+		if err != nil {
+			// journald is not running on every system that runs services
+			w, err = newServiceSyslogWriter()
+			if err == nil {
+				defer log.Printf("[!] journald is not available, logging to syslog instead")
+			}
+		}
+	case serviceLogSyslog:
+		w, err = newServiceSyslogWriter()
+	default:
+		return errors.New("invalid service_log. Must be journald, syslog, or stderr")
+	}
+	if err != nil {
+		return err
+	}
+	log.SetFlags(0)
+	log.SetOutput(&serviceLog{writer: w})
+	return nil
+}
+
+// logWriter writes an operational message with a priority.
+type logWriter interface {
+	writeLog(priority int, message string) error
+}
+
+// serviceLog splits the messages of the log package into their priority and text. Each message is
+// written by the log package in a single call to Write.
+type serviceLog struct {
+	writer logWriter
+}
+
+func (sl *serviceLog) Write(p []byte) (int, error) {
+	priority, message := messagePriority(strings.TrimRight(string(p), "\n"))
+	err := sl.writer.writeLog(priority, message)
+	if err != nil {
+		// the message is not lost when the log daemon goes away
+		os.Stderr.Write(p)
+	}
+	return len(p), nil
+}
+
+// messagePriority returns the priority of an operational message from its prefix, and the message
+// without it. Messages prefixed with [*] are informational and those with [!] are warnings, while
+// the others are the errors that stop the sensor.
+func messagePriority(message string) (int, string) {
+	switch {
+	case strings.HasPrefix(message, "[*] "):
+		return priorityInfo, message[4:]
+	case strings.HasPrefix(message, "[!] "):
+		return priorityWarning, message[4:]
+	}
+	return priorityErr, message
+}
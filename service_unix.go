@@ -0,0 +1,85 @@
+//go:build !windows
+// +build !windows
+
+package gourmet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log/syslog"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// journalSocket is where journald reads native protocol messages from
+const journalSocket = "/run/systemd/journal/socket"
+
+// journalWriter sends operational messages to journald as structured entries, with their priority
+// and the gourmet identifier as fields.
+type journalWriter struct {
+	conn *net.UnixConn
+}
+
+func newJournalWriter() (*journalWriter, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &journalWriter{conn: conn}, nil
+}
+
+func (jw *journalWriter) writeLog(priority int, message string) error {
+	var entry bytes.Buffer
+	journalField(&entry, "PRIORITY", strconv.Itoa(priority))
+	journalField(&entry, "SYSLOG_IDENTIFIER", "gourmet")
+	journalField(&entry, "MESSAGE", message)
+	_, err := jw.conn.Write(entry.Bytes())
+	return err
+}
+
+// journalField appends a field to an entry of the native journal protocol. Values that span lines
+// are written as their length followed by their bytes.
+func journalField(entry *bytes.Buffer, name, value string) {
+	entry.WriteString(name)
+	if !strings.Contains(value, "\n") {
+		entry.WriteByte('=')
+		entry.WriteString(value)
+		entry.WriteByte('\n')
+		return
+	}
+	entry.WriteByte('\n')
+	binary.Write(entry, binary.LittleEndian, uint64(len(value)))
+	entry.WriteString(value)
+	entry.WriteByte('\n')
+}
+
+// serviceSyslogWriter sends operational messages to the local syslog daemon, in the daemon facility.
+type serviceSyslogWriter struct {
+	writer *syslog.Writer
+}
+
+func newServiceSyslogWriter() (*serviceSyslogWriter, error) {
+	writer, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "gourmet")
+	if err != nil {
+		return nil, err
+	}
+	return &serviceSyslogWriter{writer: writer}, nil
+}
+
+func (sw *serviceSyslogWriter) writeLog(priority int, message string) error {
+	switch priority {
+	case priorityInfo:
+		return sw.writer.Info(message)
+	case priorityWarning:
+		return sw.writer.Warning(message)
+	}
+	return sw.writer.Err(message)
+}
+
+// processRunning reports whether a process with the PID exists, including one of another user.
+func processRunning(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
@@ -0,0 +1,26 @@
+package gourmet
+
+import (
+	"errors"
+	"os"
+)
+
+// newJournalWriter and newServiceSyslogWriter fail on Windows, which has neither journald nor a
+// syslog daemon, so service mode can only log to stderr there.
+func newJournalWriter() (logWriter, error) {
+	return nil, errors.New("journald is not available on Windows. Set service_log to stderr instead")
+}
+
+func newServiceSyslogWriter() (logWriter, error) {
+	return nil, errors.New("syslog is not available on Windows. Set service_log to stderr instead")
+}
+
+// processRunning reports whether a process with the PID exists.
+func processRunning(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
@@ -0,0 +1,137 @@
+package gourmet
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/reassembly"
+)
+
+// tcpShard is a partition of the TCP connection table. Every shard has its own assembler and mutex,
+// so that packets of unrelated flows are reassembled concurrently instead of serializing on a single
+// lock. Flows are mapped to shards by a hash of their addresses and ports that is the same for both
+// directions, so both directions of a connection always land in the same shard. The state the factory
+// keeps per flow lives in the shard of the flow, and is guarded by the mutex of the shard.
+type tcpShard struct {
+	mutex      sync.Mutex
+	factory    *tcpStreamFactory
+	assembler  *reassembly.Assembler
+	seqOffsets map[flowKey]uint32
+	// latest is the latest timestamp seen by the shard
+	latest time.Time
+	// pmtu holds the ICMP path MTU reports per flow, and is nil unless path MTU tracking is enabled
+	pmtu map[flowKey]pmtuReport
+	// streams holds every open stream of the shard. Streams are only created and completed from
+	// within the assembler, so it is guarded by the mutex as well.
+	streams map[*tcpStream]struct{}
+	// held holds the streams with segments held near the sequence number wrap
+	held map[*tcpStream]struct{}
+}
+
+// New implements reassembly.StreamFactory for the assembler of the shard.
+func (sh *tcpShard) New(n, t gopacket.Flow, tcp *layers.TCP, ac reassembly.AssemblerContext) reassembly.Stream {
+	return sh.factory.newStream(sh, n, t, ac)
+}
+
+// createShards sets up the connection table with n shards, or a single one if n is not positive.
+func (tsf *tcpStreamFactory) createShards(n int) {
+	if n < 1 {
+		n = 1
+	}
+	tsf.shards = make([]*tcpShard, n)
+	for i := range tsf.shards {
+		sh := &tcpShard{
+			factory:    tsf,
+			seqOffsets: make(map[flowKey]uint32),
+			streams:    make(map[*tcpStream]struct{}),
+			held:       make(map[*tcpStream]struct{}),
+		}
+		if tsf.trackPMTU {
+			sh.pmtu = make(map[flowKey]pmtuReport)
+		}
+		sh.assembler = reassembly.NewAssembler(reassembly.NewStreamPool(sh))
+		tsf.shards[i] = sh
+	}
+}
+
+// shardOf returns the shard of a flow. FastHash is symmetric, so both directions of a flow share a
+// shard.
+func (tsf *tcpStreamFactory) shardOf(netFlow, transport gopacket.Flow) *tcpShard {
+	if len(tsf.shards) == 1 {
+		return tsf.shards[0]
+	}
+	hash := netFlow.FastHash() + transport.FastHash()
+	return tsf.shards[hash%uint64(len(tsf.shards))]
+}
+
+// openStreams returns the number of open streams in the connection table.
+func (tsf *tcpStreamFactory) openStreams() (open int) {
+	for _, sh := range tsf.shards {
+		sh.mutex.Lock()
+		open += len(sh.streams)
+		sh.mutex.Unlock()
+	}
+	return open
+}
+
+// expireHalfOpen closes and logs the half-open streams of every shard that have been idle since
+// before t, and returns how many were expired.
+func (tsf *tcpStreamFactory) expireHalfOpen(t time.Time) (expired int) {
+	for _, sh := range tsf.shards {
+		sh.mutex.Lock()
+		var idle []*tcpStream
+		for ts := range sh.streams {
+			if ts.tcpState.halfOpen() && ts.lastSeen.Before(t) {
+				idle = append(idle, ts)
+			}
+		}
+		for _, ts := range idle {
+			sh.closeStream(ts)
+		}
+		sh.mutex.Unlock()
+		expired += len(idle)
+	}
+	return expired
+}
+
+// closeStream closes a single stream through the assembler of its shard, which can only flush
+// streams by how long they have been idle. A reset is fed to the assembler in each direction, at
+// the sequence number it waits for, so that it releases the segments it buffered for the stream and
+// forgets it, and later segments of the flow start a new stream. The stream is then logged. It must
+// be called with the mutex of the shard held.
+func (sh *tcpShard) closeStream(ts *tcpStream) {
+	ts.closing = true
+	ctx := captureContext(gopacket.CaptureInfo{Timestamp: ts.lastSeen})
+	for _, reverse := range []bool{false, true} {
+		netFlow, src, dst := ts.net, ts.transport.Src().Raw(), ts.transport.Dst().Raw()
+		if reverse {
+			netFlow, src, dst = ts.net.Reverse(), dst, src
+		}
+		header := make([]byte, 20)
+		copy(header[0:2], src)
+		copy(header[2:4], dst)
+		// a data offset of five words, and the RST flag
+		header[12], header[13] = 5<<4, 0x04
+		tcp := &layers.TCP{}
+		err := tcp.DecodeFromBytes(header, gopacket.NilDecodeFeedback)
+		if err != nil {
+			continue
+		}
+		sh.assembler.AssembleWithContext(netFlow, tcp, &ctx)
+	}
+	ts.complete()
+}
+
+// flushOlderThan flushes and closes the streams of every shard that have been idle since before t,
+// one shard at a time, and returns how many were closed.
+func (tsf *tcpStreamFactory) flushOlderThan(t time.Time) (closed int) {
+	for _, sh := range tsf.shards {
+		sh.mutex.Lock()
+		_, c := sh.assembler.FlushCloseOlderThan(t)
+		sh.mutex.Unlock()
+		closed += c
+	}
+	return closed
+}
@@ -0,0 +1,63 @@
+package gourmet
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// benchmarkFlows is the number of flows that every goroutine of a benchmark sends segments of.
+const benchmarkFlows = 64
+
+// benchmarkFlow is an established flow whose client sends a segment of data at every step.
+type benchmarkFlow struct {
+	netFlow gopacket.Flow
+	tcp     *layers.TCP
+	ci      gopacket.CaptureInfo
+	seq     uint32
+}
+
+// BenchmarkConnectionTableContention measures the connection table while every processor sends the
+// segments of its own flows, so that the shards of the table are contended as they are by the
+// capture goroutines of the sensor.
+func BenchmarkConnectionTableContention(b *testing.B) {
+	for _, shards := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			tsf := newTestStreamFactory()
+			// the payloads are not buffered, so that memory does not grow with b.N
+			tsf.directions = reassemblyDirections{}
+			tsf.createShards(shards)
+			var goroutines uint32
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				id := atomic.AddUint32(&goroutines, 1)
+				flows := make([]*benchmarkFlow, benchmarkFlows)
+				for i := range flows {
+					src := fmt.Sprintf("10.%d.%d.%d", byte(id>>8), byte(id), i)
+					client := testSegment{src: src, dst: "10.255.0.1", sport: 40000, dport: 80}
+					server := testSegment{src: "10.255.0.1", dst: src, sport: 80, dport: 40000}
+					syn, synAck, data := client, server, client
+					syn.seq, syn.flags = 1000, "S"
+					synAck.seq, synAck.ack, synAck.flags = 5000, 1001, "SA"
+					data.seq, data.ack, data.flags, data.payload = 1001, 5001, "PA", "0123456789abcdef"
+					feed(b, tsf, syn, synAck)
+					netFlow, tcp, ci, err := decodeSegment(data)
+					if err != nil {
+						b.Fatal(err)
+					}
+					flows[i] = &benchmarkFlow{netFlow: netFlow, tcp: tcp, ci: ci, seq: 1001}
+				}
+				for i := 0; pb.Next(); i++ {
+					f := flows[i%len(flows)]
+					// the shard rebases the sequence number of the segment in place
+					f.tcp.Seq = f.seq
+					f.seq += uint32(len(f.tcp.Payload))
+					tsf.newPacket(f.netFlow, f.tcp, f.ci)
+				}
+			})
+		})
+	}
+}
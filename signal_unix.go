@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package gourmet
+
+import (
+	"os"
+	"syscall"
+)
+
+// stateDumpSignal is the signal that dumps the connection table
+var stateDumpSignal os.Signal = syscall.SIGUSR1
@@ -0,0 +1,6 @@
+package gourmet
+
+import "os"
+
+// stateDumpSignal is nil, as Windows has no signal to spare for dumping the connection table
+var stateDumpSignal os.Signal
@@ -0,0 +1,215 @@
+package gourmet
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"strings"
+)
+
+const (
+	sshAnalyzerName = "ssh"
+	// sshMaxHandshake bounds how much of each direction is read looking for the banner and the
+	// KEXINIT message
+	sshMaxHandshake = 65536
+	// sshMaxBanner is the longest identification line that RFC 4253 allows, with its CR LF
+	sshMaxBanner = 255
+	// sshMaxPacket is the largest packet that implementations must accept
+	sshMaxPacket = 35000
+
+	sshMsgKexInit = 20
+)
+
+// sshAnalyzer is the built-in SSH analyzer. It recognizes SSH on any port by the identification
+// lines that both sides send first, and reads the SSH_MSG_KEXINIT messages that follow them, which
+// are the last messages before the connection is encrypted. The result is logged under the ssh key.
+type sshAnalyzer struct{}
+
+// SSHResult is the result of the built-in SSH analyzer. Client and Server are the identification
+// lines of both sides, such as SSH-2.0-OpenSSH_8.9p1, and Version is the protocol version they
+// agree on. The algorithms are those negotiated from the KEXINIT messages, which for the cipher,
+// MAC, and compression are those of the client to server direction. HASSH and HASSHServer are the
+// MD5 fingerprints of the KEXINIT messages of the client and of the server, and HASSHString and
+// HASSHServerString the strings they are computed from.
+type SSHResult struct {
+	Version           string `json:",omitempty"`
+	Client            string `json:",omitempty"`
+	Server            string `json:",omitempty"`
+	KexAlgorithm      string `json:",omitempty"`
+	HostKeyAlgorithm  string `json:",omitempty"`
+	Cipher            string `json:",omitempty"`
+	MAC               string `json:",omitempty"`
+	Compression       string `json:",omitempty"`
+	HASSH             string `json:",omitempty"`
+	HASSHString       string `json:",omitempty"`
+	HASSHServer       string `json:",omitempty"`
+	HASSHServerString string `json:",omitempty"`
+}
+
+// Key implements Result.
+func (r *SSHResult) Key() string {
+	return sshAnalyzerName
+}
+
+// sshKexInit holds the name-lists of a KEXINIT message
+type sshKexInit struct {
+	kex         []string
+	hostKey     []string
+	cipherC2S   []string
+	cipherS2C   []string
+	macC2S      []string
+	macS2C      []string
+	compressC2S []string
+	compressS2C []string
+}
+
+// Filter accepts TCP connections whose service is ssh, as detected from the identification line
+// either side opened with or as set by port_protocols, and those where either side opened with an
+// identification line anyway. Servers may send other lines before their own, which the analyzer
+// skips.
+func (sa *sshAnalyzer) Filter(c *Connection) bool {
+	if c.TransportType != "tcp" {
+		return false
+	}
+	return c.Service == sshAnalyzerName || c.hasSignature(sshAnalyzerName)
+}
+
+func (sa *sshAnalyzer) Analyze(c *Connection) (Result, error) {
+	result := &SSHResult{}
+	var client, server *sshKexInit
+	if c.ClientPayload != nil {
+		result.Client, client = sshHandshake(c.ClientPayload)
+	}
+	if c.ServerPayload != nil {
+		result.Server, server = sshHandshake(c.ServerPayload)
+	}
+	if result.Client == "" && result.Server == "" {
+		return nil, nil
+	}
+	result.Version = sshVersion(result.Client, result.Server)
+	if client != nil {
+		result.HASSHString = strings.Join([]string{
+			strings.Join(client.kex, ","),
+			strings.Join(client.cipherC2S, ","),
+			strings.Join(client.macC2S, ","),
+			strings.Join(client.compressC2S, ","),
+		}, ";")
+		result.HASSH = sshFingerprint(result.HASSHString)
+	}
+	if server != nil {
+		result.HASSHServerString = strings.Join([]string{
+			strings.Join(server.kex, ","),
+			strings.Join(server.cipherS2C, ","),
+			strings.Join(server.macS2C, ","),
+			strings.Join(server.compressS2C, ","),
+		}, ";")
+		result.HASSHServer = sshFingerprint(result.HASSHServerString)
+	}
+	if client != nil && server != nil {
+		result.KexAlgorithm = sshNegotiate(client.kex, server.kex)
+		result.HostKeyAlgorithm = sshNegotiate(client.hostKey, server.hostKey)
+		result.Cipher = sshNegotiate(client.cipherC2S, server.cipherC2S)
+		result.MAC = sshNegotiate(client.macC2S, server.macC2S)
+		result.Compression = sshNegotiate(client.compressC2S, server.compressC2S)
+	}
+	return result, nil
+}
+
+// sshHandshake reads the identification line of one direction of a connection, skipping the lines
+// that a server may send before it, and the KEXINIT message that follows it, if it was captured.
+func sshHandshake(payload Payload) (banner string, kexInit *sshKexInit) {
+	r := bufio.NewReader(io.LimitReader(payload.Reader(), sshMaxHandshake))
+	for {
+		line, err := r.ReadSlice('\n')
+		if err != nil || len(line) > sshMaxBanner {
+			return "", nil
+		}
+		if bytes.HasPrefix(line, []byte("SSH-")) {
+			banner = strings.TrimRight(string(line), "\r\n")
+			break
+		}
+	}
+	return banner, sshReadKexInit(r)
+}
+
+// sshReadKexInit reads the first binary packet of a direction, if it is a KEXINIT message. The
+// packet is not encrypted yet, and has no MAC.
+func sshReadKexInit(r io.Reader) *sshKexInit {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil
+	}
+	length := int(binary.BigEndian.Uint32(header))
+	padding := int(header[4])
+	if length > sshMaxPacket || padding+1 > length {
+		return nil
+	}
+	packet := make([]byte, length-1)
+	if _, err := io.ReadFull(r, packet); err != nil {
+		return nil
+	}
+	payload := packet[:len(packet)-padding]
+	if len(payload) < 17 || payload[0] != sshMsgKexInit {
+		return nil
+	}
+	// the message type is followed by a random cookie of 16 bytes, and the name-lists are read like
+	// the vectors of TLS, with lengths of 4 bytes
+	lists := &tlsReader{b: payload[17:], ok: true}
+	kexInit := &sshKexInit{}
+	for _, list := range []*[]string{
+		&kexInit.kex, &kexInit.hostKey,
+		&kexInit.cipherC2S, &kexInit.cipherS2C,
+		&kexInit.macC2S, &kexInit.macS2C,
+		&kexInit.compressC2S, &kexInit.compressS2C,
+	} {
+		names := lists.vector(4)
+		if !names.ok {
+			return nil
+		}
+		if len(names.b) > 0 {
+			*list = strings.Split(string(names.b), ",")
+		}
+	}
+	return kexInit
+}
+
+// sshVersion returns the protocol version that the identification lines agree on. Servers that
+// still speak SSH 1 as well announce 1.99, which clients of SSH 2 treat as 2.0.
+func sshVersion(client, server string) string {
+	version := func(banner string) string {
+		fields := strings.SplitN(banner, "-", 3)
+		if len(fields) < 3 {
+			return ""
+		}
+		if fields[1] == "1.99" {
+			return "2.0"
+		}
+		return fields[1]
+	}
+	clientVersion, serverVersion := version(client), version(server)
+	if clientVersion == "" || (serverVersion != "" && serverVersion < clientVersion) {
+		return serverVersion
+	}
+	return clientVersion
+}
+
+// sshNegotiate returns the algorithm that RFC 4253 settles on, which is the first algorithm of the
+// client that the server supports as well.
+func sshNegotiate(client, server []string) string {
+	for _, c := range client {
+		for _, s := range server {
+			if c == s {
+				return c
+			}
+		}
+	}
+	return ""
+}
+
+func sshFingerprint(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,191 @@
+package gourmet
+
+import (
+	"container/heap"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"time"
+)
+
+// streamState describes one open TCP stream, or UDP or ICMP flow, in a connection table dump
+type streamState struct {
+	SourceIP        string
+	SourcePort      int
+	DestinationIP   string
+	DestinationPort int
+	Transport       string
+	State           string `json:",omitempty"`
+	StartTime       time.Time
+	Age             float64
+	Packets         uint64
+	BufferedBytes   int
+}
+
+// stateCollector gathers the states of a connection table dump. With a limit, it keeps only the
+// newest that many, in a heap with the oldest on top, so that listing a few connections of a large
+// table neither formats nor sorts all of them.
+type stateCollector struct {
+	// limit is how many states are kept, or -1 to keep all of them
+	limit  int
+	states stateHeap
+}
+
+// wants reports whether a connection that started at start would be kept.
+func (sc *stateCollector) wants(start time.Time) bool {
+	if sc.limit < 0 || len(sc.states) < sc.limit {
+		return true
+	}
+	return sc.limit > 0 && start.After(sc.states[0].StartTime)
+}
+
+func (sc *stateCollector) add(st streamState) {
+	switch {
+	case sc.limit < 0:
+		sc.states = append(sc.states, st)
+	case len(sc.states) < sc.limit:
+		heap.Push(&sc.states, st)
+	case sc.wants(st.StartTime):
+		sc.states[0] = st
+		heap.Fix(&sc.states, 0)
+	}
+}
+
+// sorted returns the states that were kept, oldest first.
+func (sc *stateCollector) sorted() []streamState {
+	sort.Stable(sc.states)
+	return sc.states
+}
+
+// stateHeap is a min-heap of connection states by start time
+type stateHeap []streamState
+
+func (h stateHeap) Len() int           { return len(h) }
+func (h stateHeap) Less(i, j int) bool { return h[i].StartTime.Before(h[j].StartTime) }
+func (h stateHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *stateHeap) Push(x interface{}) {
+	*h = append(*h, x.(streamState))
+}
+
+func (h *stateHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	st := old[n-1]
+	*h = old[:n-1]
+	return st
+}
+
+// collectStates adds the state of the open TCP streams. It holds the mutex of each shard while
+// copying its streams, which pauses TCP reassembly in that shard for as long as it takes.
+func (tsf *tcpStreamFactory) collectStates(sc *stateCollector, now time.Time) {
+	for _, sh := range tsf.shards {
+		sh.mutex.Lock()
+		sh.collectStates(sc, now)
+		sh.mutex.Unlock()
+	}
+}
+
+func (sh *tcpShard) collectStates(sc *stateCollector, now time.Time) {
+	for ts := range sh.streams {
+		if !sc.wants(ts.startTime) {
+			continue
+		}
+		srcIP, dstIP := processAddresses(ts.addresses)
+		srcPort, dstPort := processPorts(ts.transport)
+		sc.add(streamState{
+			SourceIP:        srcIP,
+			SourcePort:      srcPort,
+			DestinationIP:   dstIP,
+			DestinationPort: dstPort,
+			Transport:       "tcp",
+			State:           ts.tcpState.String(),
+			StartTime:       ts.startTime,
+			Age:             now.Sub(ts.startTime).Seconds(),
+			Packets:         ts.transportPackets,
+			BufferedBytes:   ts.payload.Len(),
+		})
+	}
+}
+
+// collectStates adds the state of the open flows. The mutex of the table is held while copying them.
+func (ft *flowTable) collectStates(sc *stateCollector, now time.Time) {
+	ft.mutex.Lock()
+	defer ft.mutex.Unlock()
+	for key, flow := range ft.flows {
+		if key != flow.keys[0] {
+			// every flow is held under the keys of both directions
+			continue
+		}
+		c := flow.connection
+		if !sc.wants(c.Timestamp) {
+			continue
+		}
+		sc.add(streamState{
+			SourceIP:        c.SourceIP,
+			SourcePort:      c.SourcePort,
+			DestinationIP:   c.DestinationIP,
+			DestinationPort: c.DestinationPort,
+			Transport:       c.TransportType,
+			StartTime:       c.Timestamp,
+			Age:             now.Sub(c.Timestamp).Seconds(),
+			Packets:         flow.origPkts + flow.respPkts,
+			BufferedBytes:   flow.payload.Len(),
+		})
+	}
+}
+
+// snapshot returns the state of every open TCP stream, and of every UDP and ICMP flow if they are
+// tracked, oldest first.
+func (s *sensor) snapshot() []streamState {
+	return s.newestStates(-1)
+}
+
+// newestStates returns the state of the limit newest connections of snapshot, or of all of them if
+// limit is -1, oldest first.
+func (s *sensor) newestStates(limit int) []streamState {
+	sc := &stateCollector{limit: limit}
+	now := time.Now()
+	s.streamFactory.collectStates(sc, now)
+	if s.flows != nil {
+		s.flows.collectStates(sc, now)
+	}
+	return sc.sorted()
+}
+
+// dumpStateOnSignal writes a snapshot of the connection table every time the process receives
+// SIGUSR1, to the state dump file if one is configured and to stderr otherwise, until quit is closed.
+// Windows has no SIGUSR1, so the state is never dumped there.
+func (s *sensor) dumpStateOnSignal(quit <-chan struct{}) {
+	if stateDumpSignal == nil {
+		return
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, stateDumpSignal)
+	defer signal.Stop(signals)
+	for {
+		select {
+		case <-quit:
+			return
+		case <-signals:
+		}
+		dump, err := json.MarshalIndent(s.snapshot(), "", "  ")
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		if s.config.StateDumpFile == "" {
+			os.Stderr.Write(append(dump, '\n'))
+			continue
+		}
+		err = ioutil.WriteFile(s.config.StateDumpFile, dump, 0644)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		log.Printf("[*] Wrote connection table to %s", s.config.StateDumpFile)
+	}
+}
@@ -0,0 +1,144 @@
+package gourmet
+
+import (
+	"log"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// SensorStats is a periodic record of the health of the sensor, written every stats_interval seconds
+// like the stats.log of Zeek. The counters cover the interval since the previous record, and the
+// gauges are taken at Timestamp. PacketsDropped counts the packets that the kernel dropped, summed
+// over the packet sources that report drops. ActiveConnections counts the TCP streams, and
+// ActiveFlows the UDP and ICMP flows, being tracked. With memory_budget_mb set, MemoryPressure is the
+// current pressure, and ShedPayloadBytes and ShedConnections count the load shed in the interval.
+type SensorStats struct {
+	Timestamp         time.Time
+	Interval          float64
+	PacketsCaptured   uint64
+	PacketsDropped    uint64
+	Connections       uint64
+	Evictions         uint64
+	AnalyzerErrors    uint64
+	ActiveConnections int
+	ActiveFlows       int
+	ActiveQUIC        int `json:",omitempty"`
+	InFlight          int64
+	HeapBytes         uint64
+	Goroutines        int
+	MemoryPressure    string `json:",omitempty"`
+	ShedPayloadBytes  uint64 `json:",omitempty"`
+	ShedConnections   uint64 `json:",omitempty"`
+}
+
+// statsWriter is implemented by the outputs that stats records are written to
+type statsWriter interface {
+	writeStats(*SensorStats) error
+}
+
+// takesStats reports whether any of the outputs takes stats records.
+func takesStats(outputs []configuredOutput) bool {
+	for _, o := range outputs {
+		if _, ok := o.output.(statsWriter); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// statsCounters are the cumulative counters of the sensor at the time of a stats record, which the
+// next record is the difference from
+type statsCounters struct {
+	at             time.Time
+	packets        uint64
+	drops          uint64
+	connections    uint64
+	evictions      uint64
+	analyzerErrors uint64
+	shedPayload    uint64
+	shedConns      uint64
+}
+
+// currentCounters reads the cumulative counters of the sensor.
+func (s *sensor) currentCounters() statsCounters {
+	sc := statsCounters{
+		at:             time.Now(),
+		packets:        atomic.LoadUint64(&s.summary.packets),
+		connections:    s.summary.connections(),
+		evictions:      atomic.LoadUint64(&s.summary.evictions),
+		analyzerErrors: atomic.LoadUint64(&s.summary.errors),
+		drops:          atomic.LoadUint64(&s.detachedDrops),
+	}
+	sc.shedPayload, sc.shedConns = s.streamFactory.budget.counters()
+	for _, src := range s.captureSources() {
+		if drops, err := sourceDrops(src.source); err == nil {
+			sc.drops += drops
+		}
+	}
+	return sc
+}
+
+// stats returns the record of the interval since previous.
+func (s *sensor) stats(previous, current statsCounters) *SensorStats {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	stats := &SensorStats{
+		Timestamp:         current.at,
+		Interval:          current.at.Sub(previous.at).Seconds(),
+		PacketsCaptured:   current.packets - previous.packets,
+		Connections:       current.connections - previous.connections,
+		Evictions:         current.evictions - previous.evictions,
+		AnalyzerErrors:    current.analyzerErrors - previous.analyzerErrors,
+		ActiveConnections: s.streamFactory.openStreams(),
+		InFlight:          atomic.LoadInt64(&s.inFlight),
+		HeapBytes:         mem.HeapAlloc,
+		Goroutines:        runtime.NumGoroutine(),
+	}
+	// drop counters of pcap handles are 32 bits, and wrap around on long runs
+	if current.drops >= previous.drops {
+		stats.PacketsDropped = current.drops - previous.drops
+	}
+	if s.flows != nil {
+		stats.ActiveFlows = s.flows.size()
+	}
+	if s.quic != nil {
+		stats.ActiveQUIC = s.quic.open()
+	}
+	if s.streamFactory.budget != nil {
+		stats.MemoryPressure = s.streamFactory.budget.pressure().String()
+		stats.ShedPayloadBytes = current.shedPayload - previous.shedPayload
+		stats.ShedConnections = current.shedConns - previous.shedConns
+	}
+	return stats
+}
+
+// writeStats writes a stats record every interval to the outputs that take them, until quit is
+// closed.
+func (s *sensor) writeStats(interval time.Duration, quit <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	previous := s.currentCounters()
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+		}
+		current := s.currentCounters()
+		stats := s.stats(previous, current)
+		previous = current
+		s.outputsMutex.RLock()
+		for _, o := range s.outputs {
+			sw, ok := o.output.(statsWriter)
+			if !ok {
+				continue
+			}
+			err := sw.writeStats(stats)
+			if err != nil {
+				log.Printf("[!] Failed to write stats to output %s: %s", o.name, err)
+			}
+		}
+		s.outputsMutex.RUnlock()
+	}
+}
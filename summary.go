@@ -0,0 +1,220 @@
+package gourmet
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket/pcap"
+)
+
+const summaryTopN = 10
+
+// runSummary keeps incremental counters over the lifetime of the sensor so that an end-of-run
+// summary can be produced without a second pass over the log.
+type runSummary struct {
+	start        time.Time
+	packets      uint64
+	overflows    uint64
+	unlogged     uint64
+	evictions    uint64
+	errors       uint64
+	mutex        sync.Mutex
+	transports   map[string]uint64
+	services     map[string]uint64
+	talkers      map[string]uint64
+	analyzerHits map[string]uint64
+}
+
+func newRunSummary() *runSummary {
+	return &runSummary{
+		start:        time.Now(),
+		transports:   make(map[string]uint64),
+		services:     make(map[string]uint64),
+		talkers:      make(map[string]uint64),
+		analyzerHits: make(map[string]uint64),
+	}
+}
+
+func (rs *runSummary) addPacket() {
+	atomic.AddUint64(&rs.packets, 1)
+}
+
+// addOverflow counts a connection that was logged without analysis because the analyzer queue was
+// full.
+func (rs *runSummary) addOverflow() {
+	atomic.AddUint64(&rs.overflows, 1)
+}
+
+// addUnlogged counts a connection that was not written to the outputs because of log sampling.
+func (rs *runSummary) addUnlogged() {
+	atomic.AddUint64(&rs.unlogged, 1)
+}
+
+// addEvictions counts connections evicted from a full connection table.
+func (rs *runSummary) addEvictions(n int) {
+	atomic.AddUint64(&rs.evictions, uint64(n))
+}
+
+// addAnalyzerError counts a connection that an analyzer returned an error for.
+func (rs *runSummary) addAnalyzerError() {
+	atomic.AddUint64(&rs.errors, 1)
+}
+
+// connections returns the number of connections counted so far.
+func (rs *runSummary) connections() (total uint64) {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	for _, count := range rs.transports {
+		total += count
+	}
+	return total
+}
+
+func (rs *runSummary) addConnection(c *Connection) {
+	rs.mutex.Lock()
+	rs.transports[c.TransportType]++
+	// connections whose service was neither detected nor set by port_protocols are not ranked
+	if c.Service != "" {
+		rs.services[c.Service]++
+	}
+	rs.talkers[c.SourceIP]++
+	rs.talkers[c.DestinationIP]++
+	for key, result := range c.Analyzers {
+		// namespaces are counted per result, in the form namespace.key
+		if namespace, ok := result.(map[string]interface{}); ok {
+			for nested := range namespace {
+				rs.analyzerHits[key+"."+nested]++
+			}
+			continue
+		}
+		rs.analyzerHits[key]++
+	}
+	rs.mutex.Unlock()
+}
+
+type summaryCount struct {
+	name  string
+	count uint64
+}
+
+// topCounts returns the n largest counts in m, ordered from largest to smallest.
+func topCounts(m map[string]uint64, n int) []summaryCount {
+	var counts []summaryCount
+	for name, count := range m {
+		counts = append(counts, summaryCount{name, count})
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].count == counts[j].count {
+			return counts[i].name < counts[j].name
+		}
+		return counts[i].count > counts[j].count
+	})
+	if len(counts) > n {
+		counts = counts[:n]
+	}
+	return counts
+}
+
+func (rs *runSummary) write(w io.Writer, drops string) {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	var total uint64
+	var transports []string
+	for _, t := range topCounts(rs.transports, len(rs.transports)) {
+		total += t.count
+		transports = append(transports, fmt.Sprintf("%s: %d", t.name, t.count))
+	}
+	fmt.Fprintln(w, "Gourmet summary")
+	fmt.Fprintf(w, "  Duration:    %s\n", time.Since(rs.start).Round(time.Second))
+	fmt.Fprintf(w, "  Packets:     %d (dropped: %s)\n", atomic.LoadUint64(&rs.packets), drops)
+	fmt.Fprintf(w, "  Connections: %d (%s)\n", total, strings.Join(transports, ", "))
+	if overflows := atomic.LoadUint64(&rs.overflows); overflows > 0 {
+		fmt.Fprintf(w, "  Unanalyzed:  %d (analyzer queue full)\n", overflows)
+	}
+	if unlogged := atomic.LoadUint64(&rs.unlogged); unlogged > 0 {
+		fmt.Fprintf(w, "  Unlogged:    %d (sampled out or rate limited)\n", unlogged)
+	}
+	if errors := atomic.LoadUint64(&rs.errors); errors > 0 {
+		fmt.Fprintf(w, "  Errors:      %d (analyzer errors)\n", errors)
+	}
+	if evictions := atomic.LoadUint64(&rs.evictions); evictions > 0 {
+		fmt.Fprintf(w, "  Evicted:     %d (connection table full)\n", evictions)
+	}
+	fmt.Fprintln(w, "  Top services:")
+	for _, s := range topCounts(rs.services, summaryTopN) {
+		fmt.Fprintf(w, "    %-40s %d\n", s.name, s.count)
+	}
+	fmt.Fprintln(w, "  Top talkers:")
+	for _, t := range topCounts(rs.talkers, summaryTopN) {
+		fmt.Fprintf(w, "    %-40s %d\n", t.name, t.count)
+	}
+	fmt.Fprintln(w, "  Analyzer hits:")
+	for _, a := range topCounts(rs.analyzerHits, len(rs.analyzerHits)) {
+		fmt.Fprintf(w, "    %-40s %d\n", a.name, a.count)
+	}
+}
+
+// errNoDrops is returned for packet sources that do not count the packets they drop
+var errNoDrops = errors.New("packet source does not report drops")
+
+// sourceDrops asks the packet source how many packets the kernel dropped.
+func sourceDrops(source interface{}) (uint64, error) {
+	switch src := source.(type) {
+	case *pcap.Handle:
+		stats, err := src.Stats()
+		if err != nil {
+			return 0, err
+		}
+		return uint64(stats.PacketsDropped + stats.PacketsIfDropped), nil
+	}
+	return ringDrops(source)
+}
+
+// captureDrops formats the drops of the packet source. Sources that cannot report drops yield
+// "unknown".
+func captureDrops(source interface{}) string {
+	drops, err := sourceDrops(source)
+	if err != nil {
+		return "unknown"
+	}
+	return fmt.Sprintf("%d", drops)
+}
+
+// summaryDrops formats the drops of every packet source for the summary. It must be called before
+// the packet sources are closed.
+func (s *sensor) summaryDrops() string {
+	var drops []string
+	sources := s.captureSources()
+	for _, src := range sources {
+		drops = append(drops, captureDrops(src.source))
+	}
+	if len(sources) > 1 {
+		for i, src := range sources {
+			drops[i] = fmt.Sprintf("%s on %s", drops[i], src.name)
+		}
+	}
+	return strings.Join(drops, ", ")
+}
+
+// writeSummary writes the end-of-run summary, with the drops of the packet sources, to the summary
+// file, or to stderr if no summary file is configured.
+func (s *sensor) writeSummary(summaryFile, drops string) error {
+	if summaryFile == "" {
+		s.summary.write(os.Stderr, drops)
+		return nil
+	}
+	f, err := os.Create(summaryFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	s.summary.write(f, drops)
+	return nil
+}
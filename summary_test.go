@@ -0,0 +1,73 @@
+package gourmet
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/gopacket/pcap"
+)
+
+func TestSummaryOfCaptureFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gourmet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pcapFile := filepath.Join(dir, "capture.pcap")
+	err = ioutil.WriteFile(pcapFile, vlanCapture(t, []uint16{10}), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handle, err := pcap.OpenOffline(pcapFile)
+	if err != nil {
+		t.Skipf("libpcap cannot read the capture: %s", err)
+	}
+	handle.Close()
+	config := Config{
+		InterfaceType: "pcapfile",
+		PcapFile:      pcapFile,
+		LogFile:       filepath.Join(dir, "gourmet.log"),
+		Summary:       true,
+		SummaryFile:   filepath.Join(dir, "summary.txt"),
+	}
+	config.SetDefaults()
+	// the drops of the pcap handle are read for the summary as the sensor stops
+	err = StartWithContext(context.Background(), &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	summary, err := ioutil.ReadFile(config.SummaryFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(summary), "Connections: 1 ") {
+		t.Errorf("expected the summary to count 1 connection, got:\n%s", summary)
+	}
+}
+
+func TestSummaryRanksServices(t *testing.T) {
+	rs := newRunSummary()
+	for _, service := range []string{"http", "dns", "http", ""} {
+		rs.addConnection(&Connection{
+			TransportType: "tcp",
+			SourceIP:      "10.0.0.1",
+			DestinationIP: "10.0.0.2",
+			Service:       service,
+		})
+	}
+	var buf bytes.Buffer
+	rs.write(&buf, "")
+	summary := buf.String()
+	services := summary[strings.Index(summary, "Top services:"):strings.Index(summary, "Top talkers:")]
+	if !strings.Contains(services, "http") || !strings.Contains(services, "dns") {
+		t.Errorf("expected http and dns to be ranked, got:\n%s", summary)
+	}
+	if strings.Index(services, "http") > strings.Index(services, "dns") {
+		t.Errorf("expected http to rank before dns, got:\n%s", summary)
+	}
+}
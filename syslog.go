@@ -0,0 +1,71 @@
+//go:build !windows
+// +build !windows
+
+package gourmet
+
+import (
+	"errors"
+	"log/syslog"
+	"sync"
+)
+
+// syslogOutput sends every connection as a message to syslog, either the local daemon or a remote
+// one if a network and address are given. Messages are JSON unless another encoding is set.
+type syslogOutput struct {
+	mutex   sync.Mutex
+	writer  *syslog.Writer
+	encoder logEncoder
+}
+
+func newSyslogOutput(args map[string]interface{}) (*syslogOutput, error) {
+	network, err := outputString(args, "network", "")
+	if err != nil {
+		return nil, err
+	}
+	address, err := outputString(args, "address", "")
+	if err != nil {
+		return nil, err
+	}
+	if (network == "") != (address == "") {
+		return nil, errors.New("network and address must be set together")
+	}
+	tag, err := outputString(args, "tag", "gourmet")
+	if err != nil {
+		return nil, err
+	}
+	encoding, err := outputString(args, "encoding", encodingNDJSON)
+	if err != nil {
+		return nil, err
+	}
+	if encoding == encodingMsgpack {
+		// syslog messages are text, and daemons mangle or drop binary ones
+		return nil, errors.New("invalid encoding. msgpack is binary and cannot be sent over syslog")
+	}
+	encoder, err := newLogEncoder(args, encodingNDJSON)
+	if err != nil {
+		return nil, err
+	}
+	writer, err := syslog.Dial(network, address, syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogOutput{
+		writer:  writer,
+		encoder: encoder,
+	}, nil
+}
+
+func (so *syslogOutput) Write(c *Connection) error {
+	message, err := encodeMessage(so.encoder, c)
+	if err != nil {
+		return err
+	}
+	so.mutex.Lock()
+	defer so.mutex.Unlock()
+	_, err = so.writer.Write(message)
+	return err
+}
+
+func (so *syslogOutput) Close() error {
+	return so.writer.Close()
+}
@@ -0,0 +1,8 @@
+package gourmet
+
+import "errors"
+
+// newSyslogOutput fails on Windows, which has no syslog daemon for log/syslog to write to.
+func newSyslogOutput(args map[string]interface{}) (Output, error) {
+	return nil, errors.New("syslog is not available on Windows. Use the file, stdout, or a network output instead")
+}
@@ -1,8 +1,8 @@
 package gourmet
 
 import (
-	"bytes"
-	"sync"
+	"errors"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/gopacket"
@@ -11,107 +11,481 @@ import (
 )
 
 type tcpStream struct {
+	// net and transport key the stream in the assembler, and addresses is the network flow of its
+	// packets, which differs from net for the streams of a zone
 	net, transport gopacket.Flow
-	payload        *bytes.Buffer
-	startTime      time.Time
-	duration       time.Duration
-	tcpState       *reassembly.TCPSimpleFSM
-	done           chan bool
-	packets        int
-	payloadPackets int
+	addresses      gopacket.Flow
+	payload        *payloadBuffer
+	// the data of each direction within payload
+	clientPayload, serverPayload directionPayload
+	startTime                    time.Time
+	duration                     time.Duration
+	tcpState                     *tcpConnState
+	done                         chan bool
+	packets                      int
+	payloadPackets               int
+	factory                      *tcpStreamFactory
+	// counters over every segment of the connection, in both directions
+	tcpFlags         uint8
+	transportBytes   uint64
+	transportPackets uint64
+	// segments seen per direction, a connection missing one direction was routed asymmetrically or
+	// only partially captured
+	origPackets uint64
+	respPackets uint64
+	origBytes   uint64
+	respBytes   uint64
+	// set when a segment was truncated by the snapshot length or reassembly skipped missing data
+	truncated bool
+	gaps      bool
+	// set when payload was discarded to stay within the memory budget
+	shed bool
+	// preliminary is set once a preliminary record was emitted, with the UID assigned to it. The
+	// record waits in preliminaryRecord for the goroutine of the stream, which sends it before the
+	// final record.
+	preliminary       bool
+	uid               uint64
+	preliminaryRecord chan *Connection
+	// the largest segment payload and the smallest MTU reported by ICMP, only tracked when path MTU
+	// tracking is enabled
+	maxPayload int
+	pathMTU    int
+	// inter-packet gaps per direction, only tracked when packet timing is enabled
+	packetTiming bool
+	origGaps     gapStats
+	respGaps     gapStats
+	directions   reassemblyDirections
+	// the first bytes sent by the server, only kept when content sniffing is enabled
+	sniffContentType bool
+	serverHead       []byte
+	// the byte values of the reassembled payload, only counted when payload entropy is enabled
+	entropy *byteHistogram
+	// ftp follows the stream if it is an FTP control connection and files are extracted from FTP
+	ftp   *ftpControl
+	shard *tcpShard
+	// ifIndex is the index of the interface the first packet of the stream was captured on, vlans
+	// are the VLAN IDs it was tagged with, and tunnel is the tunnel it was carried in
+	ifIndex int
+	vlans   []int
+	tunnel  *Tunnel
+	// lastSeen is the timestamp of the latest segment, and closing is set while the stream is closed
+	// through the assembler, for being evicted or idle longer than the half-open timeout
+	lastSeen time.Time
+	closing  bool
+	// completed is set once the stream was handed to its goroutine, which reads the stream from then
+	// on, while the assembler keeps it to see the segments that trail the end of the connection
+	completed bool
+	// held are the segments near the sequence number wrap that wait for the gap before them, and
+	// releasing is set while they are handed to the assembler again
+	held      []heldSegment
+	releasing bool
+}
+
+// sniffLen is the number of bytes http.DetectContentType considers
+const sniffLen = 512
+
+// reassemblyDirections selects which directions of a TCP stream are buffered into the payload.
+// Segments in the other directions are still counted, but their data is discarded.
+type reassemblyDirections struct {
+	client, server bool
+}
+
+// newReassemblyDirections parses the reassemble_directions config value. Both directions are
+// reassembled if it is empty.
+func newReassemblyDirections(directions string) (reassemblyDirections, error) {
+	switch directions {
+	case "", "both":
+		return reassemblyDirections{client: true, server: true}, nil
+	case "client":
+		return reassemblyDirections{client: true}, nil
+	case "server":
+		return reassemblyDirections{server: true}, nil
+	}
+	return reassemblyDirections{}, errors.New("invalid reassemble_directions. Must be client, server, or both")
+}
+
+func (rd reassemblyDirections) wants(dir reassembly.TCPFlowDirection) bool {
+	if dir == reassembly.TCPDirClientToServer {
+		return rd.client
+	}
+	return rd.server
 }
 
 func newConnectionFromTCP(ts *tcpStream) (c *Connection) {
+	srcIP, dstIP := processAddresses(ts.addresses)
 	srcPort, dstPort := processPorts(ts.transport)
 	return &Connection{
-		Timestamp:       ts.startTime,
-		UID:             ts.net.FastHash() + ts.transport.FastHash(),
-		SourceIP:        ts.net.Src().String(),
-		SourcePort:      srcPort,
-		DestinationIP:   ts.net.Dst().String(),
-		DestinationPort: dstPort,
-		TransportType:   "tcp",
-		Duration:        ts.duration.Seconds(),
-		State:           ts.tcpState.String(),
-		Payload:         ts.payload,
-		Analyzers:       make(map[string]interface{}),
+		Timestamp:        ts.startTime,
+		uid:              ts.net.FastHash() + ts.transport.FastHash(),
+		SourceIP:         srcIP,
+		SourcePort:       srcPort,
+		DestinationIP:    dstIP,
+		DestinationPort:  dstPort,
+		TransportType:    "tcp",
+		Duration:         ts.duration.Seconds(),
+		OrigBytes:        ts.origBytes,
+		RespBytes:        ts.respBytes,
+		OrigPackets:      ts.origPackets,
+		RespPackets:      ts.respPackets,
+		State:            ts.tcpState.String(),
+		ConnState:        ts.tcpState.zeekState(),
+		History:          ts.tcpState.History(),
+		Payload:          ts.payload,
+		ClientPayload:    &ts.clientPayload,
+		ServerPayload:    &ts.serverPayload,
+		Analyzers:        make(map[string]interface{}),
+		tcpFlags:         ts.tcpFlags,
+		transportBytes:   ts.transportBytes,
+		transportPackets: ts.transportPackets,
+		OrigTiming:       ts.origGaps.timing(),
+		RespTiming:       ts.respGaps.timing(),
+		ContentType:      sniffContentType(ts.serverHead),
+		Asymmetric:       ts.origPackets == 0 || ts.respPackets == 0,
+		PayloadComplete:  ts.payloadComplete(),
+		snapTruncated:    ts.truncated,
+		Handshake:        ts.tcpState.handshake(),
+		SYNData:          ts.tcpState.synData(),
+		ResetBy:          ts.tcpState.resetBy,
+		ResetAfter:       ts.tcpState.resetAfter.Seconds(),
+		ResetWithData:    ts.tcpState.resetWithData,
+		PayloadEntropy:   ts.entropy.entropy(),
+		MaxPayloadSize:   ts.maxPayload,
+		PathMTU:          ts.pathMTU,
+		InterfaceIndex:   ts.ifIndex,
+		VLANs:            ts.vlans,
+		Tunnel:           ts.tunnel,
+	}
+}
+
+// payloadComplete reports whether the stream was observed from its handshake to its close without
+// losing any data.
+func (ts *tcpStream) payloadComplete() bool {
+	const fin, syn, rst = 1 << 0, 1 << 1, 1 << 2
+	if ts.truncated || ts.gaps || ts.shed || ts.origPackets == 0 || ts.respPackets == 0 {
+		return false
+	}
+	return ts.tcpFlags&syn != 0 && ts.tcpFlags&(fin|rst) != 0
+}
+
+// tcpFlagBits returns the flags of a TCP segment as they appear in the TCP header
+func tcpFlagBits(tcp *layers.TCP) (flags uint8) {
+	for i, set := range []bool{tcp.FIN, tcp.SYN, tcp.RST, tcp.PSH, tcp.ACK, tcp.URG, tcp.ECE, tcp.CWR} {
+		if set {
+			flags |= 1 << uint(i)
+		}
 	}
+	return flags
 }
 
 func (ts *tcpStream) Accept(tcp *layers.TCP, ci gopacket.CaptureInfo, dir reassembly.TCPFlowDirection, nextSeq reassembly.Sequence, start *bool, ac reassembly.AssemblerContext) bool {
+	if ts.closing {
+		// the resets of closeStream end the stream where the assembler waits for data, or where it
+		// starts a direction that was never seen
+		if nextSeq >= 0 {
+			tcp.Seq = uint32(nextSeq)
+		} else {
+			*start = true
+		}
+		return true
+	}
+	if ts.completed {
+		// the connection was logged, so the trailing ACKs and FINs are ignored
+		return false
+	}
+	if ts.releasing {
+		// the segment was accounted for when it was captured
+		return ts.orderNearWrap(tcp, ci, dir, nextSeq)
+	}
+	netFlow := ts.net
+	if dir == reassembly.TCPDirServerToClient {
+		netFlow = ts.net.Reverse()
+	}
+	ts.shard.rebaseSeq(netFlow, tcp)
+	ts.lastSeen = ci.Timestamp
+	// timestamps within the tolerance of the factory may precede the start of the stream
+	if ci.Timestamp.Before(ts.startTime) {
+		ts.duration += ts.startTime.Sub(ci.Timestamp)
+		ts.startTime = ci.Timestamp
+	}
 	tempDuration := ci.Timestamp.Sub(ts.startTime)
 	if tempDuration.Seconds() > ts.duration.Seconds() {
 		ts.duration = tempDuration
 	}
-	ts.tcpState.CheckState(tcp, dir)
-	return true
+	ts.tcpState.observe(tcp, dir, ci.Timestamp.Sub(ts.startTime))
+	ts.tcpFlags |= tcpFlagBits(tcp)
+	segmentBytes := uint64(len(tcp.Contents) + len(tcp.Payload))
+	ts.transportBytes += segmentBytes
+	ts.transportPackets++
+	if ts.factory.trackPMTU && len(tcp.Payload) > ts.maxPayload {
+		ts.maxPayload = len(tcp.Payload)
+	}
+	if ci.CaptureLength < ci.Length {
+		ts.truncated = true
+	}
+	if dir == reassembly.TCPDirClientToServer {
+		ts.origPackets++
+		ts.origBytes += segmentBytes
+	} else {
+		ts.respPackets++
+		ts.respBytes += segmentBytes
+	}
+	if ts.packetTiming {
+		if dir == reassembly.TCPDirClientToServer {
+			ts.origGaps.add(ci.Timestamp)
+		} else {
+			ts.respGaps.add(ci.Timestamp)
+		}
+	}
+	return ts.orderNearWrap(tcp, ci, dir, nextSeq)
 }
 
 func (ts *tcpStream) ReassembledSG(sg reassembly.ScatterGather, ac reassembly.AssemblerContext) {
+	if ts.closing {
+		return
+	}
 	length, _ := sg.Lengths()
-	data := sg.Fetch(length)
-	if length > 0 {
-		ts.payload.Write(data)
+	dir, _, _, skip := sg.Info()
+	if skip != 0 && ts.directions.wants(dir) {
+		ts.gaps = true
+	}
+	if length > 0 && ts.directions.wants(dir) {
+		// the entropy is counted as the payload streams by, so it covers payload that is shed
+		if !ts.entropy.full() {
+			ts.entropy.add(sg.Fetch(length))
+		}
+		if ts.factory.budget.shedPayload(length) {
+			ts.shed = true
+		} else {
+			offset := ts.payload.Len()
+			n, _ := ts.payload.Write(sg.Fetch(length))
+			if dir == reassembly.TCPDirClientToServer {
+				ts.clientPayload.add(offset, n)
+			} else {
+				ts.serverPayload.add(offset, n)
+			}
+		}
+	}
+	if ts.sniffContentType && dir == reassembly.TCPDirServerToClient && len(ts.serverHead) < sniffLen && length > 0 {
+		n := sniffLen - len(ts.serverHead)
+		if n > length {
+			n = length
+		}
+		ts.serverHead = append(ts.serverHead, sg.Fetch(n)...)
+	}
+	if ts.ftp != nil && length > 0 {
+		ts.ftp.feed(dir, sg.Fetch(length), ts.lastSeen)
 	}
 	ts.packets++
+	if ts.factory.preliminaryBytes > 0 && !ts.preliminary && ts.payload.Len() >= ts.factory.preliminaryBytes {
+		ts.emitPreliminary()
+	}
 }
 
+// emitPreliminary emits a record of the connection as it is known so far, with a copy of the payload
+// reassembled up to now. The UID is assigned for it here, so that the final record can carry the same
+// UID whatever the UID mode. It runs within the assembler, so the record is handed to the goroutine
+// of the stream to avoid blocking reassembly on the analyzers, which keeps it ahead of the final
+// record.
+func (ts *tcpStream) emitPreliminary() {
+	ts.preliminary = true
+	c := newConnectionFromTCP(ts)
+	c.Payload = newMemoryPayload(append([]byte(nil), ts.payload.Bytes()...))
+	c.ClientPayload = newMemoryPayload(append([]byte(nil), ts.clientPayload.Bytes()...))
+	c.ServerPayload = newMemoryPayload(append([]byte(nil), ts.serverPayload.Bytes()...))
+	c.Preliminary = true
+	c.PayloadComplete = false
+	if ts.factory.uids != nil {
+		ts.factory.uids.assign(c)
+	}
+	c.uidAssigned = true
+	ts.uid = c.uid
+	atomic.AddInt64(ts.factory.inFlight, 1)
+	ts.preliminaryRecord <- c
+}
+
+// ReassemblyComplete logs the stream once both directions are closed. A stream closed by closeStream
+// is removed from the assembler at once, and is logged by closeStream.
 func (ts *tcpStream) ReassemblyComplete(ac reassembly.AssemblerContext) bool {
-	ts.done <- true
+	if ts.closing {
+		return true
+	}
+	ts.complete()
 	return false
 }
 
-// tcpStreamFactory contains channels to consume tcp streams and stream pairs. It also implements
-// the reassembly.StreamFactory interface. Each Sensor contains a tcpStreamFactory in order to
+// complete hands the stream to its goroutine to be logged, and removes it from its shard. It must be
+// called with the mutex of the shard held.
+func (ts *tcpStream) complete() {
+	// count the connection as in flight before signaling, so that a flush during shutdown is
+	// guaranteed to wait for it
+	if ts.packets > 0 {
+		atomic.AddInt64(ts.factory.inFlight, 1)
+	}
+	ts.shard.forgetSeq(ts.net, ts.transport)
+	// segments still held wait for data that never came, as the stream ends
+	delete(ts.shard.held, ts)
+	ts.held = nil
+	if ts.shard.pmtu != nil {
+		ts.pathMTU = ts.shard.takePMTU(ts.net, ts.transport)
+	}
+	delete(ts.shard.streams, ts)
+	atomic.AddInt64(&ts.factory.open, -1)
+	ts.completed = true
+	// done is buffered, as the goroutine may still be sending the preliminary record
+	ts.done <- true
+}
+
+// tcpStreamFactory contains channels to consume tcp streams and stream pairs. It creates the streams
+// of every shard of the connection table. Each Sensor contains a tcpStreamFactory in order to
 // easily consume packets, streams, and stream pairs.
 type tcpStreamFactory struct {
-	assembler      *reassembly.Assembler
-	assemblerMutex sync.Mutex
-	connTimeout    int
-	ticker         *time.Ticker
-	connections    chan *Connection
+	shards []*tcpShard
+	// streams are closed once idle for the established timeout, or the half-open timeout until
+	// their handshake completes
+	establishedTimeout time.Duration
+	halfOpenTimeout    time.Duration
+	ticker             *time.Ticker
+	connections        chan *Connection
+	inFlight           *int64
+	packetTiming       bool
+	directions         reassemblyDirections
+	tolerance          time.Duration
+	sniffContentType   bool
+	spillThreshold     int
+	spillDir           string
+	budget             *memoryBudget
+	limit              *connectionLimit
+	preliminaryBytes   int
+	uids               *uidGenerator
+	payloadEntropy     bool
+	entropyBytes       int
+	trackPMTU          bool
+	// open is the number of streams in the shards of the factory
+	open int64
+	// ftp is set when files are extracted from FTP, to follow the control connections
+	ftp *ftpExpectations
+	// now is the clock that idle streams are measured against
+	now func() time.Time
 }
 
-func (tsf *tcpStreamFactory) New(n, t gopacket.Flow, tcp *layers.TCP, ac reassembly.AssemblerContext) reassembly.Stream {
+func (tsf *tcpStreamFactory) newStream(sh *tcpShard, n, t gopacket.Flow, ac reassembly.AssemblerContext) reassembly.Stream {
 	ts := &tcpStream{
-		net:       n,
-		transport: t,
-		payload:   new(bytes.Buffer),
-		startTime: ac.GetCaptureInfo().Timestamp,
-		tcpState:  reassembly.NewTCPSimpleFSM(reassembly.TCPSimpleFSMOptions{}),
-		done:      make(chan bool),
+		net:              n,
+		transport:        t,
+		addresses:        streamAddresses(n, ac.GetCaptureInfo()),
+		payload:          newPayloadBuffer(tsf.spillThreshold, tsf.spillDir),
+		startTime:        ac.GetCaptureInfo().Timestamp,
+		tcpState:         newTCPConnState(),
+		done:             make(chan bool, 1),
+		factory:          tsf,
+		packetTiming:     tsf.packetTiming,
+		directions:       tsf.directions,
+		sniffContentType: tsf.sniffContentType,
+		entropy:          newByteHistogram(tsf.payloadEntropy, tsf.entropyBytes),
+		shard:            sh,
+		ifIndex:          ac.GetCaptureInfo().InterfaceIndex,
+		vlans:            captureVLANs(ac.GetCaptureInfo()),
+		tunnel:           captureTunnel(ac.GetCaptureInfo()),
+	}
+	if tsf.ftp != nil {
+		ts.ftp = newFTPControl(tsf.ftp, ts)
+	}
+	if tsf.preliminaryBytes > 0 {
+		ts.preliminaryRecord = make(chan *Connection, 1)
 	}
+	ts.clientPayload.stream = ts.payload
+	ts.serverPayload.stream = ts.payload
+	sh.streams[ts] = struct{}{}
+	atomic.AddInt64(&tsf.open, 1)
 	go func() {
-		// wait for reassembly to be done
-		<-ts.done
+		// wait for reassembly to be done, sending the preliminary record if one is emitted first
+		select {
+		case c := <-ts.preliminaryRecord:
+			tsf.connections <- c
+			<-ts.done
+		case <-ts.done:
+			// the preliminary record was emitted before the stream completed, if at all
+			select {
+			case c := <-ts.preliminaryRecord:
+				tsf.connections <- c
+			default:
+			}
+		}
 		// ignore empty streams
 		if ts.packets > 0 {
 			c := newConnectionFromTCP(ts)
+			if ts.preliminary {
+				c.uid = ts.uid
+				c.uidAssigned = true
+			}
 			tsf.connections <- c
 		}
 	}()
 	return ts
 }
 
-func (tsf *tcpStreamFactory) newPacket(netFlow gopacket.Flow, tcp *layers.TCP) {
+func (tsf *tcpStreamFactory) newPacket(netFlow gopacket.Flow, tcp *layers.TCP, ci gopacket.CaptureInfo) {
+	tsf.reapIdle()
+	if tcp.SYN && !tcp.ACK && tsf.budget.shedConnection(flowHash(netFlow, tcp.TransportFlow())) {
+		return
+	}
+	tsf.assemblePacket(netFlow, tcp, ci)
+	if tsf.limit != nil {
+		tsf.evictStreams()
+	}
+}
+
+// reapIdle flushes connections that have been idle for longer than the established timeout, and
+// drops stale path MTU reports, at most once per tick of the factory ticker.
+func (tsf *tcpStreamFactory) reapIdle() {
 	select {
 	case <-tsf.ticker.C:
-		tsf.assemblerMutex.Lock()
-		tsf.assembler.FlushCloseOlderThan(time.Now().Add(time.Second * time.Duration(-1*tsf.connTimeout)))
-		tsf.assemblerMutex.Unlock()
+		tsf.flushOlderThan(tsf.now().Add(-tsf.establishedTimeout))
+		tsf.expirePMTU(tsf.now().Add(-pmtuRetention))
 	default:
 		// pass through
 	}
-	tsf.assemblePacket(netFlow, tcp)
 }
 
-func (tsf *tcpStreamFactory) assemblePacket(netFlow gopacket.Flow, tcp *layers.TCP) {
-	tsf.assemblerMutex.Lock()
-	tsf.assembler.Assemble(netFlow, tcp)
-	tsf.assemblerMutex.Unlock()
+// captureContext passes the capture info of a packet through the assembler to its stream
+type captureContext gopacket.CaptureInfo
+
+func (cc *captureContext) GetCaptureInfo() gopacket.CaptureInfo {
+	return gopacket.CaptureInfo(*cc)
 }
 
-func (tsf *tcpStreamFactory) createAssembler() {
-	streamPool := reassembly.NewStreamPool(tsf)
-	tsf.assembler = reassembly.NewAssembler(streamPool)
+// clampTimestamp tolerates packets whose timestamps are slightly out of order, which happens
+// because packets are captured and processed concurrently. A timestamp up to the tolerance before
+// the latest one seen is kept as it is, and anything older is clamped to the latest timestamp, so
+// that a stray timestamp cannot stretch a connection back in time or make it look idle. The latest
+// timestamp is tracked per shard. It must be called with the mutex of the shard held.
+func (sh *tcpShard) clampTimestamp(t time.Time) time.Time {
+	if t.After(sh.latest) {
+		sh.latest = t
+		return t
+	}
+	if sh.latest.Sub(t) > sh.factory.tolerance {
+		return sh.latest
+	}
+	return t
+}
+
+func (tsf *tcpStreamFactory) assemblePacket(netFlow gopacket.Flow, tcp *layers.TCP, ci gopacket.CaptureInfo) {
+	sh := tsf.shardOf(netFlow, tcp.TransportFlow())
+	sh.mutex.Lock()
+	ci.Timestamp = sh.clampTimestamp(ci.Timestamp)
+	ctx := captureContext(ci)
+	sh.assembler.AssembleWithContext(netFlow, tcp, &ctx)
+	if len(sh.held) > 0 {
+		sh.releaseHeld()
+	}
+	sh.mutex.Unlock()
+}
+
+func (tsf *tcpStreamFactory) flushAll() {
+	for _, sh := range tsf.shards {
+		sh.mutex.Lock()
+		sh.assembler.FlushAll()
+		sh.mutex.Unlock()
+	}
 }
@@ -0,0 +1,307 @@
+package gourmet
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+var testStart = time.Date(2020, 5, 14, 9, 30, 0, 0, time.UTC)
+
+// newTestStreamFactory returns a factory with a single shard, whose streams are only flushed when a
+// test asks for it.
+func newTestStreamFactory() *tcpStreamFactory {
+	var inFlight int64
+	tsf := &tcpStreamFactory{
+		establishedTimeout: time.Hour,
+		halfOpenTimeout:    time.Hour,
+		ticker:             time.NewTicker(time.Hour),
+		connections:        make(chan *Connection, 64),
+		inFlight:           &inFlight,
+		directions:         reassemblyDirections{client: true, server: true},
+		now:                func() time.Time { return testStart },
+	}
+	tsf.createShards(1)
+	return tsf
+}
+
+// testSegment is a TCP segment between two endpoints. flags holds the letters of the flags that are
+// set: S, A, F, R, and P.
+type testSegment struct {
+	src, dst     string
+	sport, dport uint16
+	seq, ack     uint32
+	flags        string
+	payload      string
+	at           time.Duration
+}
+
+// feed decodes the segments as captured packets and hands them to the factory.
+func feed(t testing.TB, tsf *tcpStreamFactory, segments ...testSegment) {
+	t.Helper()
+	for _, s := range segments {
+		netFlow, tcp, ci, err := decodeSegment(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tsf.newPacket(netFlow, tcp, ci)
+	}
+}
+
+// decodeSegment serializes a segment and decodes it as a captured packet.
+func decodeSegment(s testSegment) (gopacket.Flow, *layers.TCP, gopacket.CaptureInfo, error) {
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolTCP,
+		SrcIP:    net.ParseIP(s.src).To4(),
+		DstIP:    net.ParseIP(s.dst).To4(),
+	}
+	tcp := &layers.TCP{
+		SrcPort: layers.TCPPort(s.sport),
+		DstPort: layers.TCPPort(s.dport),
+		Seq:     s.seq,
+		Ack:     s.ack,
+		Window:  65535,
+	}
+	for _, f := range s.flags {
+		switch f {
+		case 'S':
+			tcp.SYN = true
+		case 'A':
+			tcp.ACK = true
+		case 'F':
+			tcp.FIN = true
+		case 'R':
+			tcp.RST = true
+		case 'P':
+			tcp.PSH = true
+		}
+	}
+	tcp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	err := gopacket.SerializeLayers(buf, opts, ip, tcp, gopacket.Payload(s.payload))
+	if err != nil {
+		return gopacket.Flow{}, nil, gopacket.CaptureInfo{}, err
+	}
+	packet := gopacket.NewPacket(buf.Bytes(), layers.LayerTypeIPv4, gopacket.Default)
+	ci := gopacket.CaptureInfo{
+		Timestamp:     testStart.Add(s.at),
+		CaptureLength: len(buf.Bytes()),
+		Length:        len(buf.Bytes()),
+	}
+	return packet.NetworkLayer().NetworkFlow(), packet.TransportLayer().(*layers.TCP), ci, nil
+}
+
+// nextConnection returns the next connection logged by the factory.
+func nextConnection(t testing.TB, tsf *tcpStreamFactory) *Connection {
+	t.Helper()
+	select {
+	case c := <-tsf.connections:
+		return c
+	case <-time.After(time.Second):
+		t.Fatal("no connection was logged")
+	}
+	return nil
+}
+
+func TestExpireHalfOpenClosesStream(t *testing.T) {
+	tsf := newTestStreamFactory()
+	syn := testSegment{src: "10.0.0.1", dst: "10.0.0.2", sport: 40000, dport: 80, seq: 1000, flags: "S"}
+	feed(t, tsf, syn)
+	if open := tsf.openStreams(); open != 1 {
+		t.Fatalf("expected 1 open stream, got %d", open)
+	}
+	if expired := tsf.expireHalfOpen(testStart.Add(time.Minute)); expired != 1 {
+		t.Fatalf("expected 1 expired stream, got %d", expired)
+	}
+	c := nextConnection(t, tsf)
+	if c.OrigPackets != 1 || c.RespPackets != 0 {
+		t.Errorf("expected the SYN alone, got %d and %d packets", c.OrigPackets, c.RespPackets)
+	}
+	if open := tsf.openStreams(); open != 0 {
+		t.Fatalf("expected no open stream after expiry, got %d", open)
+	}
+	// the assembler forgot the stream, so the retransmitted SYN starts a new one
+	syn.at = 2 * time.Minute
+	feed(t, tsf, syn)
+	if open := tsf.openStreams(); open != 1 {
+		t.Fatalf("expected the flow to start a new stream, got %d open", open)
+	}
+	tsf.flushAll()
+	c = nextConnection(t, tsf)
+	if !c.Timestamp.Equal(testStart.Add(2 * time.Minute)) {
+		t.Errorf("expected the new stream to start at the retransmission, got %s", c.Timestamp)
+	}
+}
+
+func TestEvictOldestClosesStreams(t *testing.T) {
+	tsf := newTestStreamFactory()
+	tsf.limit = &connectionLimit{max: 2, oldest: true, batch: 1, summary: &runSummary{}}
+	for i := 0; i < 3; i++ {
+		feed(t, tsf,
+			testSegment{src: "10.0.0.1", dst: "10.0.0.2", sport: uint16(40000 + i), dport: 80, seq: 1000, flags: "S", at: time.Duration(i) * time.Second},
+			testSegment{src: "10.0.0.2", dst: "10.0.0.1", sport: 80, dport: uint16(40000 + i), seq: 5000, ack: 1001, flags: "SA", at: time.Duration(i) * time.Second},
+		)
+	}
+	// the third stream took the table past its limit, which evicts the two oldest
+	for i := 0; i < 2; i++ {
+		c := nextConnection(t, tsf)
+		if c.SourcePort != 40000 && c.SourcePort != 40001 {
+			t.Errorf("expected an oldest stream to be evicted, got source port %d", c.SourcePort)
+		}
+	}
+	if open := tsf.openStreams(); open != 1 {
+		t.Fatalf("expected 1 open stream after eviction, got %d", open)
+	}
+	// data of an evicted flow starts a new stream instead of being dropped
+	feed(t, tsf, testSegment{src: "10.0.0.1", dst: "10.0.0.2", sport: 40000, dport: 80, seq: 1001, ack: 5001, flags: "PA", payload: "GET / HTTP/1.1\r\n\r\n", at: 5 * time.Second})
+	if open := tsf.openStreams(); open != 2 {
+		t.Fatalf("expected the evicted flow to start a new stream, got %d open", open)
+	}
+}
+
+func TestPreliminaryRecordPrecedesFinal(t *testing.T) {
+	tsf := newTestStreamFactory()
+	tsf.preliminaryBytes = 8
+	feed(t, tsf,
+		testSegment{src: "10.0.0.1", dst: "10.0.0.2", sport: 40000, dport: 80, seq: 1000, flags: "S"},
+		testSegment{src: "10.0.0.2", dst: "10.0.0.1", sport: 80, dport: 40000, seq: 5000, ack: 1001, flags: "SA"},
+		testSegment{src: "10.0.0.1", dst: "10.0.0.2", sport: 40000, dport: 80, seq: 1001, ack: 5001, flags: "PA", payload: "GET / HTTP/1.1\r\n\r\n"},
+	)
+	tsf.flushAll()
+	if c := nextConnection(t, tsf); !c.Preliminary {
+		t.Fatal("expected the preliminary record first")
+	}
+	if c := nextConnection(t, tsf); c.Preliminary {
+		t.Fatal("expected the final record after the preliminary one")
+	}
+}
+
+// keepSeq makes the shard pass the sequence numbers of both directions of a flow to the assembler
+// as they are, instead of rebasing them away from the wrap.
+func keepSeq(tsf *tcpStreamFactory, s testSegment) {
+	netFlow := gopacket.NewFlow(layers.EndpointIPv4, net.ParseIP(s.src).To4(), net.ParseIP(s.dst).To4())
+	transport := gopacket.NewFlow(layers.EndpointTCPPort, []byte{byte(s.sport >> 8), byte(s.sport)},
+		[]byte{byte(s.dport >> 8), byte(s.dport)})
+	sh := tsf.shardOf(netFlow, transport)
+	sh.seqOffsets[flowKey{netFlow, transport}] = 0
+	sh.seqOffsets[flowKey{netFlow.Reverse(), transport.Reverse()}] = 0
+}
+
+// wrapSegments returns a handshake whose client sends data from four bytes before the 2^32 wrap
+// of its sequence numbers, and the segments of the data at offsets.
+func wrapSegments(data string, offsets ...int) (handshake, segments []testSegment) {
+	const isn = 1<<32 - 5
+	client := testSegment{src: "10.0.0.1", dst: "10.0.0.2", sport: 40000, dport: 80, ack: 5001}
+	server := testSegment{src: "10.0.0.2", dst: "10.0.0.1", sport: 80, dport: 40000}
+	syn, synAck, ack := client, server, client
+	syn.seq, syn.ack, syn.flags = isn, 0, "S"
+	synAck.seq, synAck.ack, synAck.flags = 5000, isn+1, "SA"
+	ack.seq, ack.flags = isn+1, "A"
+	handshake = []testSegment{syn, synAck, ack}
+	offsets = append(offsets, len(data))
+	for i := 0; i < len(offsets)-1; i++ {
+		s := client
+		s.seq = uint32(isn + 1 + offsets[i])
+		s.flags = "PA"
+		s.payload = data[offsets[i]:offsets[i+1]]
+		segments = append(segments, s)
+	}
+	return handshake, segments
+}
+
+func TestSequenceWrap(t *testing.T) {
+	const data = "0123456789abcdefghij"
+	for _, test := range []struct {
+		name  string
+		order []int
+	}{
+		{"in order", []int{0, 1, 2, 3}},
+		{"after the wrap first", []int{0, 2, 1, 3}},
+		{"across the wrap last", []int{0, 2, 3, 1}},
+		{"retransmitted across the wrap", []int{0, 1, 2, 1, 3}},
+		{"overlapping across the wrap", []int{0, 2, 4, 1, 3}},
+		{"in reverse", []int{3, 4, 2, 1, 0}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			tsf := newTestStreamFactory()
+			// the segments hold bytes 0-1, 2-5, which cross the wrap, 6-11, 12-19, and 3-8, which
+			// overlaps the second and third
+			handshake, segments := wrapSegments(data, 0, 2, 6, 12)
+			_, overlapping := wrapSegments(data, 3, 9)
+			segments = append(segments, overlapping[0])
+			keepSeq(tsf, handshake[0])
+			feed(t, tsf, handshake...)
+			for _, i := range test.order {
+				feed(t, tsf, segments[i])
+			}
+			tsf.flushAll()
+			c := nextConnection(t, tsf)
+			if got := string(c.ClientPayload.Bytes()); got != data {
+				t.Errorf("expected client payload %q, got %q", data, got)
+			}
+		})
+	}
+}
+
+func TestSequenceOffsetsForgotten(t *testing.T) {
+	const connections = 200
+	tsf := newTestStreamFactory()
+	for i := 0; i < connections; i++ {
+		client := testSegment{src: "10.0.0.1", dst: "10.0.0.2", sport: uint16(40000 + i), dport: 80}
+		server := testSegment{src: "10.0.0.2", dst: "10.0.0.1", sport: 80, dport: uint16(40000 + i)}
+		syn, synAck, ack, fin, finAck, last := client, server, client, client, server, client
+		syn.seq, syn.flags = 1000, "S"
+		synAck.seq, synAck.ack, synAck.flags = 5000, 1001, "SA"
+		ack.seq, ack.ack, ack.flags = 1001, 5001, "A"
+		fin.seq, fin.ack, fin.flags = 1001, 5001, "FA"
+		finAck.seq, finAck.ack, finAck.flags = 5001, 1002, "FA"
+		// the last ACK trails the completed stream
+		last.seq, last.ack, last.flags = 1002, 5002, "A"
+		feed(t, tsf, syn, synAck, ack, fin, finAck, last)
+		nextConnection(t, tsf)
+	}
+	tsf.flushAll()
+	for _, sh := range tsf.shards {
+		if len(sh.seqOffsets) != 0 {
+			t.Errorf("expected no sequence offsets after the flush, got %d", len(sh.seqOffsets))
+		}
+	}
+}
+
+func TestDisorderedTimestamps(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		tolerance time.Duration
+		start     time.Duration
+		duration  time.Duration
+	}{
+		// the SYN-ACK was processed before the SYN, and the ACK long before both
+		{"within the tolerance", 10 * time.Millisecond, 995 * time.Millisecond, 5 * time.Millisecond},
+		{"without a tolerance", 0, time.Second, 0},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			tsf := newTestStreamFactory()
+			tsf.tolerance = test.tolerance
+			syn := segment(handshakeClient, 1000, 0, "S", "")
+			syn.at = time.Second
+			synAck := segment(handshakeServer, 5000, 1001, "SA", "")
+			synAck.at = 995 * time.Millisecond
+			ack := segment(handshakeClient, 1001, 5001, "A", "")
+			feed(t, tsf, syn, synAck, ack)
+			tsf.flushAll()
+			c := nextConnection(t, tsf)
+			if start := testStart.Add(test.start); !c.Timestamp.Equal(start) {
+				t.Errorf("expected the connection to start at %s, got %s", start, c.Timestamp)
+			}
+			if c.Duration != test.duration.Seconds() {
+				t.Errorf("expected a duration of %gs, got %gs", test.duration.Seconds(), c.Duration)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package gourmet
+
+import (
+	"github.com/google/gopacket/layers"
+)
+
+// Handshakes of a TCP connection, as labeled in Connection.Handshake
+const (
+	HandshakeNormal           = "normal"
+	HandshakeSimultaneousOpen = "simultaneous_open"
+	HandshakeMissingSYNACK    = "missing_syn_ack"
+	HandshakeMissingSYN       = "missing_syn"
+	HandshakeSYNOnly          = "syn_only"
+	HandshakeRefused          = "refused"
+	HandshakeMidstream        = "midstream"
+)
+
+// observeHandshake records what a segment that is not a SYN or a SYN-ACK tells of the handshake.
+// Besides the SYN, SYN-ACK, ACK sequence, TCP allows both sides to open at once with crossing SYNs,
+// and captures regularly miss the SYN-ACK because of asymmetric routing or middleboxes, so the
+// handshake is labeled rather than assumed. A RST before any other segment but SYNs is kept apart,
+// as it refuses the connection.
+func (cs *tcpConnState) observeHandshake(tcp *layers.TCP, peer *tcpPeer) {
+	if tcp.SYN {
+		// data on a SYN is TCP Fast Open
+		if len(tcp.Payload) > 0 {
+			peer.synData = true
+		}
+		return
+	}
+	if tcp.RST && !cs.synAcked() && !cs.peers[0].other && !cs.peers[1].other {
+		peer.earlyRst = true
+		return
+	}
+	peer.other = true
+}
+
+func (cs *tcpConnState) synAcked() bool {
+	return cs.peers[0].synAck || cs.peers[1].synAck
+}
+
+// halfOpen reports whether a SYN was seen, but nothing else of the handshake but resets.
+func (cs *tcpConnState) halfOpen() bool {
+	orig, resp := cs.peers[0], cs.peers[1]
+	return (orig.syn || resp.syn) && !cs.synAcked() && !orig.other && !resp.other
+}
+
+// synData reports whether either side sent data on a SYN.
+func (cs *tcpConnState) synData() bool {
+	return cs.peers[0].synData || cs.peers[1].synData
+}
+
+// handshake labels the handshake of the connection.
+func (cs *tcpConnState) handshake() string {
+	orig, resp := cs.peers[0], cs.peers[1]
+	switch {
+	case orig.syn && resp.syn:
+		return HandshakeSimultaneousOpen
+	case orig.syn || resp.syn:
+		if cs.synAcked() {
+			return HandshakeNormal
+		}
+		if (orig.syn && resp.earlyRst) || (resp.syn && orig.earlyRst) {
+			return HandshakeRefused
+		}
+		if orig.other || resp.other {
+			return HandshakeMissingSYNACK
+		}
+		return HandshakeSYNOnly
+	case cs.synAcked():
+		return HandshakeMissingSYN
+	}
+	return HandshakeMidstream
+}
@@ -0,0 +1,178 @@
+package gourmet
+
+import (
+	"testing"
+	"time"
+)
+
+// handshakeClient and handshakeServer are the endpoints of the handshake tests.
+var (
+	handshakeClient = testSegment{src: "10.0.0.1", dst: "10.0.0.2", sport: 40000, dport: 80}
+	handshakeServer = testSegment{src: "10.0.0.2", dst: "10.0.0.1", sport: 80, dport: 40000}
+)
+
+// segment returns a segment of the endpoints with the sequence numbers, flags and payload.
+func segment(endpoints testSegment, seq, ack uint32, flags, payload string) testSegment {
+	endpoints.seq, endpoints.ack, endpoints.flags, endpoints.payload = seq, ack, flags, payload
+	return endpoints
+}
+
+func TestHandshake(t *testing.T) {
+	for _, test := range []struct {
+		name          string
+		segments      []testSegment
+		handshake     string
+		synData       bool
+		clientPayload string
+	}{
+		{
+			name: "normal",
+			segments: []testSegment{
+				segment(handshakeClient, 1000, 0, "S", ""),
+				segment(handshakeServer, 5000, 1001, "SA", ""),
+				segment(handshakeClient, 1001, 5001, "A", ""),
+				segment(handshakeClient, 1001, 5001, "PA", "GET / HTTP/1.1\r\n\r\n"),
+			},
+			handshake:     HandshakeNormal,
+			clientPayload: "GET / HTTP/1.1\r\n\r\n",
+		},
+		{
+			// both sides send a SYN before seeing that of the other, and acknowledge it with a SYN-ACK
+			name: "simultaneous open",
+			segments: []testSegment{
+				segment(handshakeClient, 1000, 0, "S", ""),
+				segment(handshakeServer, 5000, 0, "S", ""),
+				segment(handshakeClient, 1000, 5001, "SA", ""),
+				segment(handshakeServer, 5000, 1001, "SA", ""),
+				segment(handshakeClient, 1001, 5001, "PA", "GET / HTTP/1.1\r\n\r\n"),
+			},
+			handshake:     HandshakeSimultaneousOpen,
+			clientPayload: "GET / HTTP/1.1\r\n\r\n",
+		},
+		{
+			// TCP Fast Open sends the first request on the SYN
+			name: "SYN with data",
+			segments: []testSegment{
+				segment(handshakeClient, 1000, 0, "S", "GET / HTTP/1.1\r\n\r\n"),
+				segment(handshakeServer, 5000, 1019, "SA", ""),
+				segment(handshakeClient, 1019, 5001, "A", ""),
+			},
+			handshake:     HandshakeNormal,
+			synData:       true,
+			clientPayload: "GET / HTTP/1.1\r\n\r\n",
+		},
+		{
+			// the SYN-ACK took another route than the rest of the connection
+			name: "missing SYN-ACK",
+			segments: []testSegment{
+				segment(handshakeClient, 1000, 0, "S", ""),
+				segment(handshakeClient, 1001, 5001, "A", ""),
+				segment(handshakeClient, 1001, 5001, "PA", "GET / HTTP/1.1\r\n\r\n"),
+			},
+			handshake:     HandshakeMissingSYNACK,
+			clientPayload: "GET / HTTP/1.1\r\n\r\n",
+		},
+		{
+			name: "SYN only",
+			segments: []testSegment{
+				segment(handshakeClient, 1000, 0, "S", ""),
+				segment(handshakeClient, 1000, 0, "S", ""),
+			},
+			handshake: HandshakeSYNOnly,
+		},
+		{
+			name: "midstream",
+			segments: []testSegment{
+				segment(handshakeClient, 1001, 5001, "PA", "GET / HTTP/1.1\r\n\r\n"),
+			},
+			handshake: HandshakeMidstream,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			tsf := newTestStreamFactory()
+			feed(t, tsf, test.segments...)
+			tsf.flushAll()
+			c := nextConnection(t, tsf)
+			if c.Handshake != test.handshake {
+				t.Errorf("expected handshake %s, got %s", test.handshake, c.Handshake)
+			}
+			if c.SYNData != test.synData {
+				t.Errorf("expected SYNData %t, got %t", test.synData, c.SYNData)
+			}
+			if test.clientPayload != "" {
+				if got := string(c.ClientPayload.Bytes()); got != test.clientPayload {
+					t.Errorf("expected client payload %q, got %q", test.clientPayload, got)
+				}
+			}
+		})
+	}
+}
+
+func TestReset(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		segments  []testSegment
+		handshake string
+		resetBy   string
+		withData  bool
+	}{
+		{
+			// nothing listens on the port, so the server answers the SYN with a reset
+			name: "refused",
+			segments: []testSegment{
+				segment(handshakeClient, 1000, 0, "S", ""),
+				segment(handshakeServer, 0, 1001, "RA", ""),
+			},
+			handshake: HandshakeRefused,
+			resetBy:   "server",
+		},
+		{
+			// the client gives up on the connection after the handshake
+			name: "aborted",
+			segments: []testSegment{
+				segment(handshakeClient, 1000, 0, "S", ""),
+				segment(handshakeServer, 5000, 1001, "SA", ""),
+				segment(handshakeClient, 1001, 5001, "A", ""),
+				segment(handshakeClient, 1001, 5001, "PA", "GET / HTTP/1.1\r\n\r\n"),
+				segment(handshakeClient, 1019, 5001, "RA", ""),
+			},
+			handshake: HandshakeNormal,
+			resetBy:   "client",
+		},
+		{
+			// some stacks explain the reset in its payload
+			name: "aborted with data",
+			segments: []testSegment{
+				segment(handshakeClient, 1000, 0, "S", ""),
+				segment(handshakeServer, 5000, 1001, "SA", ""),
+				segment(handshakeClient, 1001, 5001, "A", ""),
+				segment(handshakeServer, 5001, 1001, "RA", "connection aborted"),
+			},
+			handshake: HandshakeNormal,
+			resetBy:   "server",
+			withData:  true,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			tsf := newTestStreamFactory()
+			for i, s := range test.segments {
+				s.at = time.Duration(i) * time.Second
+				feed(t, tsf, s)
+			}
+			tsf.flushAll()
+			c := nextConnection(t, tsf)
+			if c.Handshake != test.handshake {
+				t.Errorf("expected handshake %s, got %s", test.handshake, c.Handshake)
+			}
+			if c.ResetBy != test.resetBy {
+				t.Errorf("expected the reset by the %s, got %q", test.resetBy, c.ResetBy)
+			}
+			if after := float64(len(test.segments) - 1); c.ResetAfter != after {
+				t.Errorf("expected the reset after %gs, got %gs", after, c.ResetAfter)
+			}
+			if c.ResetWithData != test.withData {
+				t.Errorf("expected ResetWithData %t, got %t", test.withData, c.ResetWithData)
+			}
+		})
+	}
+}
@@ -0,0 +1,186 @@
+package gourmet
+
+import (
+	"encoding/binary"
+	"sort"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/reassembly"
+)
+
+// gopacket's reassembly.Sequence.Difference is off by one when the two sequence numbers it compares
+// straddle the 2^32 wrap, because it adds 2^32-1 instead of 2^32. Out-of-order and overlapping
+// segments around the wrap point then lose or duplicate a byte of payload. Two measures keep the
+// assembler from comparing sequence numbers across the wrap.
+//
+// The sequence numbers of each direction of a flow are rebased so that the first one seen becomes
+// seqBase. A direction then only wraps after it has carried about 3GB, rather than whenever its
+// random initial sequence number happens to sit near the top of the sequence space. seqBase leaves
+// 1GB below the first sequence number for retransmissions of earlier data.
+//
+// Directions that carry more than that still wrap, so segments within seqWrapZone of the wrap are
+// handed to the assembler strictly in order: a segment ahead of the data the assembler waits for is
+// held by the stream until the gap before it is filled, and a retransmission is cut down to its new
+// data. The assembler then never queues a segment near the wrap, and only ever compares the sequence
+// number it waits for with an equal one there. Positions are compared with serial number arithmetic
+// (RFC 1982), as the signed 32 bit difference of two sequence numbers, which is exact across the wrap
+// for segments less than 2GB apart.
+const (
+	seqBase = 1 << 30
+	// seqWrapZone is larger than any segment, so that the segments the assembler queues on either
+	// side of the zone are never adjacent across the wrap
+	seqWrapZone = 1 << 20
+)
+
+type flowKey struct {
+	net, transport gopacket.Flow
+}
+
+// rebaseSeq rewrites the sequence number of tcp relative to the first sequence number seen in its
+// direction. It is called from Accept, so the offsets are only kept for the flows of open streams,
+// and not for the segments that trail a completed stream or that the assembler has no stream for. It
+// must be called with the mutex of the shard held.
+func (sh *tcpShard) rebaseSeq(netFlow gopacket.Flow, tcp *layers.TCP) {
+	key := flowKey{netFlow, tcp.TransportFlow()}
+	offset, ok := sh.seqOffsets[key]
+	if !ok {
+		// uint32 arithmetic is modulo 2^32, so this maps the first sequence number to seqBase
+		offset = seqBase - tcp.Seq
+		sh.seqOffsets[key] = offset
+	}
+	tcp.Seq += offset
+}
+
+// forgetSeq drops the sequence offsets of both directions of a flow once its stream is complete. It
+// must be called with the mutex of the shard held.
+func (sh *tcpShard) forgetSeq(net, transport gopacket.Flow) {
+	delete(sh.seqOffsets, flowKey{net, transport})
+	delete(sh.seqOffsets, flowKey{net.Reverse(), transport.Reverse()})
+}
+
+// seqDiff returns how far b is ahead of a, or behind it if negative, in serial number arithmetic.
+func seqDiff(a, b uint32) int32 {
+	return int32(b - a)
+}
+
+// nearWrap reports whether a segment of n sequence numbers starting at seq comes within
+// seqWrapZone of the wrap.
+func nearWrap(seq uint32, n int) bool {
+	return seq >= 1<<32-seqWrapZone || seq < seqWrapZone || uint64(seq)+uint64(n) > 1<<32-seqWrapZone
+}
+
+// heldSegment is a segment near the wrap that arrived ahead of the data the assembler waits for
+type heldSegment struct {
+	dir     reassembly.TCPFlowDirection
+	seq     uint32
+	ack     uint32
+	flags   byte
+	payload []byte
+	ci      gopacket.CaptureInfo
+}
+
+// orderNearWrap hands the segments near the wrap to the assembler in order. It returns false if the
+// segment was held, in which case the assembler must ignore it, and otherwise cuts a retransmission
+// down to the data after nextSeq. It must be called from Accept.
+func (ts *tcpStream) orderNearWrap(tcp *layers.TCP, ci gopacket.CaptureInfo, dir reassembly.TCPFlowDirection, nextSeq reassembly.Sequence) bool {
+	n := len(tcp.Payload)
+	if tcp.FIN {
+		n++
+	}
+	if nextSeq < 0 || n == 0 || tcp.SYN || tcp.RST || !nearWrap(tcp.Seq, n) {
+		return true
+	}
+	diff := seqDiff(uint32(nextSeq), tcp.Seq)
+	if diff > 0 {
+		ts.hold(tcp, ci, dir)
+		return false
+	}
+	if diff < 0 {
+		cut := int(-diff)
+		if cut > len(tcp.Payload) {
+			cut = len(tcp.Payload)
+		}
+		tcp.Payload = tcp.Payload[cut:]
+		tcp.Seq = uint32(nextSeq)
+	}
+	return true
+}
+
+// hold keeps a copy of a segment until the assembler reaches it, ordered by sequence number.
+func (ts *tcpStream) hold(tcp *layers.TCP, ci gopacket.CaptureInfo, dir reassembly.TCPFlowDirection) {
+	var flags byte
+	if tcp.FIN {
+		flags |= 0x01
+	}
+	if tcp.PSH {
+		flags |= 0x08
+	}
+	if tcp.ACK {
+		flags |= 0x10
+	}
+	ts.held = append(ts.held, heldSegment{
+		dir:     dir,
+		seq:     tcp.Seq,
+		ack:     tcp.Ack,
+		flags:   flags,
+		payload: append([]byte(nil), tcp.Payload...),
+		ci:      ci,
+	})
+	sort.SliceStable(ts.held, func(i, j int) bool {
+		return seqDiff(ts.held[j].seq, ts.held[i].seq) < 0
+	})
+	ts.shard.held[ts] = struct{}{}
+}
+
+// releaseHeld hands the held segments of the streams of the shard to the assembler again, in order,
+// until one is held once more because the gap before it is still missing. It must be called with the
+// mutex of the shard held, after a segment was assembled.
+func (sh *tcpShard) releaseHeld() {
+	// streams whose segments are held again are added back to the map while it is released
+	streams := make([]*tcpStream, 0, len(sh.held))
+	for ts := range sh.held {
+		streams = append(streams, ts)
+	}
+	for _, ts := range streams {
+		delete(sh.held, ts)
+		segments := ts.held
+		ts.held = nil
+		ts.releasing = true
+		for i, s := range segments {
+			sh.assembleHeld(ts, s)
+			if _, open := sh.streams[ts]; !open {
+				// the segment ended the stream
+				break
+			}
+			if len(ts.held) > 0 {
+				// the segment was held again, and so are the ones after it
+				ts.held = append(ts.held, segments[i+1:]...)
+				break
+			}
+		}
+		ts.releasing = false
+	}
+}
+
+// assembleHeld hands a held segment to the assembler, rebuilt from its header fields.
+func (sh *tcpShard) assembleHeld(ts *tcpStream, s heldSegment) {
+	netFlow, src, dst := ts.net, ts.transport.Src().Raw(), ts.transport.Dst().Raw()
+	if s.dir == reassembly.TCPDirServerToClient {
+		netFlow, src, dst = ts.net.Reverse(), dst, src
+	}
+	data := make([]byte, 20+len(s.payload))
+	copy(data[0:2], src)
+	copy(data[2:4], dst)
+	binary.BigEndian.PutUint32(data[4:8], s.seq)
+	binary.BigEndian.PutUint32(data[8:12], s.ack)
+	data[12], data[13] = 5<<4, s.flags
+	copy(data[20:], s.payload)
+	tcp := &layers.TCP{}
+	err := tcp.DecodeFromBytes(data, gopacket.NilDecodeFeedback)
+	if err != nil {
+		return
+	}
+	ctx := captureContext(s.ci)
+	sh.assembler.AssembleWithContext(netFlow, tcp, &ctx)
+}
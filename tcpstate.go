@@ -0,0 +1,180 @@
+package gourmet
+
+import (
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/reassembly"
+)
+
+// States of a TCP connection, as logged in Connection.State
+const (
+	TCPStateSynSent     = "SYN_SENT"
+	TCPStateSynReceived = "SYN_RECEIVED"
+	TCPStateEstablished = "ESTABLISHED"
+	TCPStateFinWait     = "FIN_WAIT"
+	TCPStateClosed      = "CLOSED"
+	TCPStateReset       = "RESET"
+)
+
+// tcpPeer is what was seen of the segments sent by one side of a TCP connection. Besides the events
+// of the history, synData is set for data on a SYN, other for any segment but a SYN, a SYN-ACK, or a
+// RST before the handshake, and earlyRst for such a RST.
+type tcpPeer struct {
+	syn, synAck, ack, data, fin, rst bool
+	synData, other, earlyRst         bool
+}
+
+// tcpConnState tracks the state of a TCP connection from the flags of the segments of both
+// directions. Unlike a TCP endpoint, the sensor may miss segments or pick a connection up midway, so
+// the state only moves forward: a connection without a handshake is taken as established, and one
+// whose SYN-ACK was not captured is established by the segments that follow the SYN.
+//
+// The history is the order in which events were first seen, with the letters of Zeek: S for a SYN,
+// H for a SYN-ACK, A for a pure ACK, D for data, F for a FIN, and R for a RST. Letters are uppercase
+// for the client and lowercase for the server, and each is recorded once per direction.
+//
+// The first RST is kept as well. A reset by the server in answer to a SYN usually means the
+// connection was refused, while a reset by the client after the handshake is an abort. ResetBy on
+// the connection is client or server, ResetAfter is the time from the start of the connection to the
+// reset in seconds, and ResetWithData is set if the RST carried a payload.
+type tcpConnState struct {
+	state         string
+	peers         [2]tcpPeer
+	history       []byte
+	resetBy       string
+	resetAfter    time.Duration
+	resetWithData bool
+}
+
+func newTCPConnState() *tcpConnState {
+	return &tcpConnState{}
+}
+
+func dirIndex(dir reassembly.TCPFlowDirection) int {
+	if dir == reassembly.TCPDirClientToServer {
+		return 0
+	}
+	return 1
+}
+
+// observe advances the state of the connection with a segment sent after the start of the
+// connection.
+func (cs *tcpConnState) observe(tcp *layers.TCP, dir reassembly.TCPFlowDirection, after time.Duration) {
+	i := dirIndex(dir)
+	peer := &cs.peers[i]
+	cs.observeHandshake(tcp, peer)
+	switch {
+	case tcp.SYN && !tcp.ACK:
+		cs.record(&peer.syn, 'S', i)
+	case tcp.SYN && tcp.ACK:
+		cs.record(&peer.synAck, 'H', i)
+	case tcp.ACK && len(tcp.Payload) == 0 && !tcp.FIN && !tcp.RST:
+		cs.record(&peer.ack, 'A', i)
+	}
+	if len(tcp.Payload) > 0 {
+		cs.record(&peer.data, 'D', i)
+	}
+	if tcp.FIN {
+		cs.record(&peer.fin, 'F', i)
+	}
+	if tcp.RST {
+		cs.record(&peer.rst, 'R', i)
+		if cs.resetBy == "" {
+			cs.resetBy = "server"
+			if i == 0 {
+				cs.resetBy = "client"
+			}
+			cs.resetAfter = after
+			cs.resetWithData = len(tcp.Payload) > 0
+		}
+	}
+	cs.advance(tcp, i)
+}
+
+// record sets an event of a peer, and adds its letter to the history the first time it is seen.
+func (cs *tcpConnState) record(seen *bool, letter byte, dir int) {
+	if *seen {
+		return
+	}
+	*seen = true
+	if dir == 1 {
+		letter += 'a' - 'A'
+	}
+	cs.history = append(cs.history, letter)
+}
+
+func (cs *tcpConnState) advance(tcp *layers.TCP, dir int) {
+	if cs.state == TCPStateReset || cs.state == TCPStateClosed {
+		return
+	}
+	switch {
+	case tcp.RST:
+		cs.state = TCPStateReset
+	case cs.peers[0].fin && cs.peers[1].fin:
+		cs.state = TCPStateClosed
+	case tcp.FIN:
+		cs.state = TCPStateFinWait
+	case cs.state == TCPStateFinWait:
+	case tcp.SYN && !tcp.ACK:
+		if cs.state == "" {
+			cs.state = TCPStateSynSent
+		}
+	case tcp.SYN && tcp.ACK:
+		if cs.state == "" || cs.state == TCPStateSynSent {
+			cs.state = TCPStateSynReceived
+		}
+	default:
+		// any other segment completes the handshake, or shows that it happened before capture
+		cs.state = TCPStateEstablished
+	}
+}
+
+// String returns the state of the connection, or an empty string before its first segment.
+func (cs *tcpConnState) String() string {
+	return cs.state
+}
+
+// History returns the history of the connection.
+func (cs *tcpConnState) History() string {
+	return string(cs.history)
+}
+
+// zeekState summarizes the connection as a conn_state of Zeek.
+func (cs *tcpConnState) zeekState() string {
+	orig, resp := cs.peers[0], cs.peers[1]
+	established := orig.syn && resp.synAck
+	switch {
+	case !orig.syn && !resp.synAck:
+		return "OTH"
+	case orig.syn && !resp.synAck && !resp.rst:
+		if orig.rst {
+			return "RSTOS0"
+		}
+		if orig.fin {
+			return "SH"
+		}
+		return "S0"
+	case orig.syn && !resp.synAck && resp.rst:
+		return "REJ"
+	case !orig.syn && resp.synAck:
+		if resp.rst {
+			return "RSTRH"
+		}
+		if resp.fin {
+			return "SHR"
+		}
+		return "OTH"
+	case established && orig.rst:
+		return "RSTO"
+	case established && resp.rst:
+		return "RSTR"
+	case established && orig.fin && resp.fin:
+		return "SF"
+	case established && orig.fin:
+		return "S2"
+	case established && resp.fin:
+		return "S3"
+	}
+	return "S1"
+}
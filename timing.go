@@ -0,0 +1,84 @@
+package gourmet
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type pipelineStage int
+
+const (
+	decodeStage pipelineStage = iota
+	trackStage
+	analyzeStage
+	logStage
+	numStages
+)
+
+var stageNames = [numStages]string{"decode", "track", "analyze", "log"}
+
+const stageTimingInterval = time.Minute
+
+// stageTimer attributes processing time to each stage of the packet pipeline. It only records
+// anything when stage timing is enabled in the Config, so the capture path pays for a single
+// boolean check otherwise.
+type stageTimer struct {
+	enabled bool
+	nanos   [numStages]int64
+	counts  [numStages]int64
+}
+
+func newStageTimer(enabled bool) *stageTimer {
+	return &stageTimer{
+		enabled: enabled,
+	}
+}
+
+func (st *stageTimer) start() time.Time {
+	if !st.enabled {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+func (st *stageTimer) stop(stage pipelineStage, start time.Time) {
+	if !st.enabled {
+		return
+	}
+	atomic.AddInt64(&st.nanos[stage], int64(time.Since(start)))
+	atomic.AddInt64(&st.counts[stage], 1)
+}
+
+func (st *stageTimer) String() string {
+	var stages []string
+	for stage := pipelineStage(0); stage < numStages; stage++ {
+		count := atomic.LoadInt64(&st.counts[stage])
+		total := time.Duration(atomic.LoadInt64(&st.nanos[stage]))
+		var avg time.Duration
+		if count > 0 {
+			avg = total / time.Duration(count)
+		}
+		stages = append(stages, fmt.Sprintf("%s: %d calls, %s total, %s avg", stageNames[stage], count, total, avg))
+	}
+	return strings.Join(stages, "; ")
+}
+
+// report periodically logs the accumulated stage timings until quit is closed.
+func (st *stageTimer) report(quit <-chan struct{}) {
+	if !st.enabled {
+		return
+	}
+	ticker := time.NewTicker(stageTimingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+		}
+		log.Printf("[*] Stage timing: %s", st)
+	}
+}
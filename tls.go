@@ -0,0 +1,292 @@
+package gourmet
+
+import (
+	"crypto/md5"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	tlsAnalyzerName = "tls"
+	// tlsMaxHandshake bounds how much of each direction is read looking for handshake messages
+	tlsMaxHandshake = 65536
+
+	tlsRecordHandshake = 22
+	tlsClientHello     = 1
+	tlsServerHello     = 2
+	tlsCertificate     = 11
+
+	tlsExtServerName        = 0
+	tlsExtSupportedGroups   = 10
+	tlsExtECPointFormats    = 11
+	tlsExtSupportedVersions = 43
+)
+
+// tlsAnalyzer is the built-in TLS analyzer. It reads the plaintext handshake at the start of a TLS
+// connection on any port: the ClientHello, the ServerHello, and before TLS 1.3 the certificate of
+// the server, and computes the JA3 and JA3S fingerprints of the hellos. The result is logged under
+// the tls key, and the server name is also set as the ServerName of the connection. The
+// certificates of TLS 1.3 are encrypted, so they are not logged for it.
+type tlsAnalyzer struct{}
+
+// TLSResult is the result of the built-in TLS analyzer. Version is the negotiated version, such as
+// TLSv12, and CipherSuite the name of the negotiated cipher suite. Subject, Issuer, NotBefore, and
+// NotAfter describe the certificate of the server. JA3 and JA3S are the MD5 fingerprints of the
+// ClientHello and the ServerHello, and JA3String and JA3SString the strings they are computed from.
+type TLSResult struct {
+	Version     string     `json:",omitempty"`
+	CipherSuite string     `json:",omitempty"`
+	ServerName  string     `json:",omitempty"`
+	JA3         string     `json:",omitempty"`
+	JA3String   string     `json:",omitempty"`
+	JA3S        string     `json:",omitempty"`
+	JA3SString  string     `json:",omitempty"`
+	Subject     string     `json:",omitempty"`
+	Issuer      string     `json:",omitempty"`
+	NotBefore   *time.Time `json:",omitempty"`
+	NotAfter    *time.Time `json:",omitempty"`
+}
+
+// Key implements Result.
+func (r *TLSResult) Key() string {
+	return tlsAnalyzerName
+}
+
+// Filter accepts TCP connections whose service is tls, as detected from the handshake record the
+// client opened with or as set by port_protocols, and those whose client opened with a handshake
+// record anyway.
+func (ta *tlsAnalyzer) Filter(c *Connection) bool {
+	if c.TransportType != "tcp" || c.ClientPayload == nil || c.ClientPayload.Len() < 3 {
+		return false
+	}
+	return c.Service == tlsAnalyzerName || c.hasSignature(tlsAnalyzerName)
+}
+
+func (ta *tlsAnalyzer) Analyze(c *Connection) (Result, error) {
+	result := &TLSResult{}
+	for _, msg := range tlsHandshakeMessages(c.ClientPayload) {
+		if msg[0] == tlsClientHello {
+			result.addClientHello(msg[4:])
+			break
+		}
+	}
+	if c.ServerPayload != nil {
+		for _, msg := range tlsHandshakeMessages(c.ServerPayload) {
+			switch msg[0] {
+			case tlsServerHello:
+				result.addServerHello(msg[4:])
+			case tlsCertificate:
+				result.addCertificate(msg[4:])
+			}
+		}
+	}
+	if result.JA3 == "" && result.JA3S == "" {
+		return nil, nil
+	}
+	if c.ServerName == "" {
+		c.ServerName = result.ServerName
+	}
+	return result, nil
+}
+
+// tlsHandshakeMessages returns the handshake messages at the start of one direction of a TLS
+// connection, each with its header of type and length. The handshake protocol can split a message
+// across records, so the records are joined up to the first record of another protocol, after which
+// the handshake is encrypted.
+func tlsHandshakeMessages(payload Payload) (messages [][]byte) {
+	data, _ := ioutil.ReadAll(io.LimitReader(payload.Reader(), tlsMaxHandshake))
+	var handshake []byte
+	for len(data) >= 5 && data[0] == tlsRecordHandshake {
+		n := int(data[3])<<8 | int(data[4])
+		if len(data) < 5+n {
+			handshake = append(handshake, data[5:]...)
+			break
+		}
+		handshake = append(handshake, data[5:5+n]...)
+		data = data[5+n:]
+	}
+	for len(handshake) >= 4 {
+		n := int(handshake[1])<<16 | int(handshake[2])<<8 | int(handshake[3])
+		if len(handshake) < 4+n {
+			break
+		}
+		messages = append(messages, handshake[:4+n])
+		handshake = handshake[4+n:]
+	}
+	return messages
+}
+
+// tlsReader reads the fields of a handshake message. Once a read runs past the end of the message,
+// every later read fails as well.
+type tlsReader struct {
+	b  []byte
+	ok bool
+}
+
+func (r *tlsReader) uint(n int) (v int) {
+	b := r.bytes(n)
+	for _, x := range b {
+		v = v<<8 | int(x)
+	}
+	return v
+}
+
+func (r *tlsReader) bytes(n int) []byte {
+	if !r.ok || len(r.b) < n {
+		r.ok = false
+		return nil
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+// vector reads a vector with a length of lenBytes bytes.
+func (r *tlsReader) vector(lenBytes int) *tlsReader {
+	n := r.uint(lenBytes)
+	b := r.bytes(n)
+	return &tlsReader{b: b, ok: r.ok}
+}
+
+// uints reads the values of size bytes each until the end of the vector, skipping GREASE values.
+func (r *tlsReader) uints(size int) (values []int) {
+	for r.ok && len(r.b) >= size {
+		if v := r.uint(size); !tlsGREASE(v) {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// tlsGREASE reports whether a value is one of the reserved GREASE values of RFC 8701, which JA3
+// ignores.
+func tlsGREASE(v int) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// tlsExtensions reads the extensions of a hello message, in the order they appear.
+func tlsExtensions(r *tlsReader) (types []int, bodies map[int]*tlsReader) {
+	bodies = make(map[int]*tlsReader)
+	if len(r.b) == 0 {
+		return nil, bodies
+	}
+	extensions := r.vector(2)
+	for extensions.ok && len(extensions.b) >= 4 {
+		extType := extensions.uint(2)
+		body := extensions.vector(2)
+		if tlsGREASE(extType) {
+			continue
+		}
+		types = append(types, extType)
+		bodies[extType] = body
+	}
+	return types, bodies
+}
+
+func (result *TLSResult) addClientHello(msg []byte) {
+	r := &tlsReader{b: msg, ok: true}
+	version := r.uint(2)
+	r.bytes(32)
+	r.vector(1)
+	ciphers := r.vector(2).uints(2)
+	r.vector(1)
+	if !r.ok {
+		return
+	}
+	types, bodies := tlsExtensions(r)
+	var groups, pointFormats []int
+	if body, ok := bodies[tlsExtSupportedGroups]; ok {
+		groups = body.vector(2).uints(2)
+	}
+	if body, ok := bodies[tlsExtECPointFormats]; ok {
+		pointFormats = body.vector(1).uints(1)
+	}
+	if body, ok := bodies[tlsExtServerName]; ok {
+		names := body.vector(2)
+		if names.uint(1) == 0 {
+			if name := names.vector(2); name.ok {
+				result.ServerName = string(name.b)
+			}
+		}
+	}
+	result.JA3String = strings.Join([]string{
+		strconv.Itoa(version), tlsJoin(ciphers), tlsJoin(types), tlsJoin(groups), tlsJoin(pointFormats),
+	}, ",")
+	result.JA3 = tlsFingerprint(result.JA3String)
+}
+
+func (result *TLSResult) addServerHello(msg []byte) {
+	r := &tlsReader{b: msg, ok: true}
+	version := r.uint(2)
+	r.bytes(32)
+	r.vector(1)
+	cipher := r.uint(2)
+	r.uint(1)
+	if !r.ok {
+		return
+	}
+	types, bodies := tlsExtensions(r)
+	negotiated := version
+	if body, ok := bodies[tlsExtSupportedVersions]; ok {
+		if v := body.uint(2); body.ok {
+			negotiated = v
+		}
+	}
+	result.Version = tlsVersionName(negotiated)
+	result.CipherSuite = tls.CipherSuiteName(uint16(cipher))
+	result.JA3SString = strings.Join([]string{strconv.Itoa(version), strconv.Itoa(cipher), tlsJoin(types)}, ",")
+	result.JA3S = tlsFingerprint(result.JA3SString)
+}
+
+// addCertificate records the leaf certificate of a Certificate message before TLS 1.3.
+func (result *TLSResult) addCertificate(msg []byte) {
+	r := &tlsReader{b: msg, ok: true}
+	leaf := r.vector(3).vector(3)
+	if !leaf.ok {
+		return
+	}
+	cert, err := x509.ParseCertificate(leaf.b)
+	if err != nil {
+		return
+	}
+	result.Subject = cert.Subject.String()
+	result.Issuer = cert.Issuer.String()
+	notBefore, notAfter := cert.NotBefore, cert.NotAfter
+	result.NotBefore, result.NotAfter = &notBefore, &notAfter
+}
+
+func tlsJoin(values []int) string {
+	s := make([]string, len(values))
+	for i, v := range values {
+		s[i] = strconv.Itoa(v)
+	}
+	return strings.Join(s, "-")
+}
+
+func tlsFingerprint(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func tlsVersionName(version int) string {
+	switch version {
+	case 0x0300:
+		return "SSLv3"
+	case 0x0301:
+		return "TLSv10"
+	case 0x0302:
+		return "TLSv11"
+	case 0x0303:
+		return "TLSv12"
+	case 0x0304:
+		return "TLSv13"
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
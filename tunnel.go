@@ -0,0 +1,81 @@
+package gourmet
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Tunnel protocols that packets are decapsulated from
+const (
+	tunnelGRE    = "gre"
+	tunnelVXLAN  = "vxlan"
+	tunnelGeneve = "geneve"
+)
+
+// Tunnel describes the tunnel that the packets of a connection were carried in when
+// decapsulate_tunnels is set. SourceIP and DestinationIP are the outer endpoints of the tunnel, and
+// ID is the VXLAN or Geneve network identifier, or the GRE key.
+type Tunnel struct {
+	Type          string
+	SourceIP      string
+	DestinationIP string
+	ID            uint32 `json:",omitempty"`
+}
+
+// nextLayerer is implemented by the tunnel layers of gopacket, whose payload is the inner packet
+type nextLayerer interface {
+	NextLayerType() gopacket.LayerType
+}
+
+// decapsulate returns the packet carried in the innermost GRE, VXLAN, or Geneve tunnel of a packet,
+// and adds the endpoints of the tunnel to its capture info, so that the inner flow is tracked instead
+// of the tunnel. gopacket decodes the inner layers already, but the network and transport layers
+// of the packet are the outer ones. A packet that is not tunneled, or whose tunnel does not carry IP,
+// is returned as it is.
+func decapsulate(packet gopacket.Packet, ci gopacket.CaptureInfo) (gopacket.Packet, gopacket.CaptureInfo) {
+	var tunnel *Tunnel
+	var payload gopacket.Layer
+	var outer gopacket.NetworkLayer
+	for _, layer := range packet.Layers() {
+		var t *Tunnel
+		switch l := layer.(type) {
+		case gopacket.NetworkLayer:
+			outer = l
+			continue
+		case *layers.GRE:
+			t = &Tunnel{Type: tunnelGRE, ID: l.Key}
+		case *layers.VXLAN:
+			t = &Tunnel{Type: tunnelVXLAN, ID: l.VNI}
+		case *layers.Geneve:
+			t = &Tunnel{Type: tunnelGeneve, ID: l.VNI}
+		default:
+			continue
+		}
+		if outer == nil {
+			continue
+		}
+		t.SourceIP, t.DestinationIP = processAddresses(outer.NetworkFlow())
+		tunnel, payload = t, layer
+	}
+	if tunnel == nil {
+		return packet, ci
+	}
+	inner := gopacket.NewPacket(payload.LayerPayload(), payload.(nextLayerer).NextLayerType(), gopacket.DecodeStreamsAsDatagrams)
+	if inner.NetworkLayer() == nil {
+		return packet, ci
+	}
+	inner.Metadata().CaptureInfo = ci
+	inner.Metadata().Truncated = packet.Metadata().Truncated
+	ci.AncillaryData = append(ci.AncillaryData, tunnel)
+	return inner, ci
+}
+
+// captureTunnel returns the tunnel that decapsulate took a packet out of, or nil.
+func captureTunnel(ci gopacket.CaptureInfo) *Tunnel {
+	for _, data := range ci.AncillaryData {
+		if tunnel, ok := data.(*Tunnel); ok {
+			return tunnel
+		}
+	}
+	return nil
+}
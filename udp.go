@@ -1,22 +1,80 @@
 package gourmet
 
 import (
-	"bytes"
+	"sync"
+	"time"
 
 	"github.com/google/gopacket"
 )
 
+// datagramWindow is how long the directions of a UDP flow are remembered while its datagrams are
+// logged on their own
+const datagramWindow = time.Minute
+
+// datagramDirections remembers which directions the UDP flows were seen in, when udp_timeout is not
+// set and every datagram is logged on its own. A datagram is logged before its answer arrives, if one
+// does, so it is flagged as asymmetric when its flow already sent a datagram in the same direction
+// within the window, and none in the opposite one. The first datagram of a flow is not flagged.
+type datagramDirections struct {
+	mutex sync.Mutex
+	// seen holds the time of the latest datagram of every flow key
+	seen  map[string]time.Time
+	swept time.Time
+}
+
+func newDatagramDirections(config *Config) *datagramDirections {
+	if config.UDPTimeout > 0 {
+		return nil
+	}
+	return &datagramDirections{seen: make(map[string]time.Time)}
+}
+
+// observe flags the connection of a datagram as asymmetric if its flow was only seen in its
+// direction.
+func (dd *datagramDirections) observe(c *Connection) {
+	forward, reverse := flowKeys(c)
+	at := c.Timestamp
+	dd.mutex.Lock()
+	defer dd.mutex.Unlock()
+	if at.Sub(dd.swept) > datagramWindow {
+		for key, t := range dd.seen {
+			if at.Sub(t) > datagramWindow {
+				delete(dd.seen, key)
+			}
+		}
+		dd.swept = at
+	}
+	last, sent := dd.seen[forward]
+	_, answered := dd.seen[reverse]
+	c.Asymmetric = sent && at.Sub(last) <= datagramWindow && !answered
+	dd.seen[forward] = at
+}
+
 func processUDPPacket(packet gopacket.Packet, ci gopacket.CaptureInfo) *Connection {
+	srcIP, dstIP := processAddresses(packet.NetworkLayer().NetworkFlow())
 	srcPort, dstPort := processPorts(packet.TransportLayer().TransportFlow())
+	payload := newMemoryPayload(packet.TransportLayer().LayerPayload())
+	transportBytes := uint64(len(packet.TransportLayer().LayerContents()) + len(packet.TransportLayer().LayerPayload()))
 	return &Connection{
-		Timestamp:       ci.Timestamp,
-		UID:             packet.NetworkLayer().NetworkFlow().FastHash() + packet.TransportLayer().TransportFlow().FastHash(),
-		SourceIP:        packet.NetworkLayer().NetworkFlow().Src().String(),
-		SourcePort:      srcPort,
-		DestinationIP:   packet.NetworkLayer().NetworkFlow().Dst().String(),
-		DestinationPort: dstPort,
-		TransportType:   "udp",
-		Payload:         bytes.NewBuffer(packet.TransportLayer().LayerPayload()),
-		Analyzers:       make(map[string]interface{}),
+		Timestamp:        ci.Timestamp,
+		uid:              packet.NetworkLayer().NetworkFlow().FastHash() + packet.TransportLayer().TransportFlow().FastHash(),
+		SourceIP:         srcIP,
+		SourcePort:       srcPort,
+		DestinationIP:    dstIP,
+		DestinationPort:  dstPort,
+		TransportType:    "udp",
+		Payload:          payload,
+		ClientPayload:    payload,
+		ServerPayload:    newMemoryPayload(nil),
+		Analyzers:        make(map[string]interface{}),
+		OrigBytes:        transportBytes,
+		OrigPackets:      1,
+		transportBytes:   transportBytes,
+		transportPackets: 1,
+		PayloadComplete:  !packet.Metadata().Truncated && ci.CaptureLength >= ci.Length,
+		snapTruncated:    packet.Metadata().Truncated || ci.CaptureLength < ci.Length,
+		InterfaceIndex:   ci.InterfaceIndex,
+		VLANs:            captureVLANs(ci),
+		Tunnel:           captureTunnel(ci),
 	}
 }
@@ -0,0 +1,98 @@
+package gourmet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"sync/atomic"
+)
+
+// UID modes select how Connection UIDs are assigned.
+//
+// The default hash mode derives the UID from the connection's endpoints, so reconnections between
+// the same endpoints share a UID. The seeded mode hashes the endpoints, transport, and start time of
+// the connection together with a seed, which makes UIDs unique per connection and identical on
+// every replay of the same capture. The counter mode numbers connections sequentially from the seed
+// in the order they are logged, which is only reproducible when connections are logged in a
+// deterministic order.
+const (
+	uidModeHash    = "hash"
+	uidModeSeeded  = "seeded"
+	uidModeCounter = "counter"
+)
+
+type uidGenerator struct {
+	mode string
+	seed uint64
+	next uint64
+}
+
+func newUIDGenerator(mode string, seed uint64) (*uidGenerator, error) {
+	switch mode {
+	case "", uidModeHash:
+		return nil, nil
+	case uidModeSeeded, uidModeCounter:
+		return &uidGenerator{
+			mode: mode,
+			seed: seed,
+			next: seed,
+		}, nil
+	}
+	return nil, fmt.Errorf("invalid uid_mode %s. Must be hash, seeded, or counter", mode)
+}
+
+func (ug *uidGenerator) assign(c *Connection) {
+	if ug.mode == uidModeCounter {
+		c.uid = atomic.AddUint64(&ug.next, 1) - 1
+		return
+	}
+	h := fnv.New64a()
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, ug.seed)
+	h.Write(b)
+	fmt.Fprintf(h, "%s|%s|%d|%s|%d|", c.TransportType, c.SourceIP, c.SourcePort, c.DestinationIP, c.DestinationPort)
+	binary.BigEndian.PutUint64(b, uint64(c.Timestamp.UnixNano()))
+	h.Write(b)
+	c.uid = h.Sum64()
+}
+
+// UID formats select how the UID of a connection is written to the log, as a decimal number or as a
+// Zeek-style string of a C followed by the base62 digits of the number.
+const (
+	uidFormatUint64 = "uint64"
+	uidFormatBase62 = "base62"
+)
+
+const base62Digits = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+func validateUIDFormat(format string) error {
+	switch format {
+	case "", uidFormatUint64, uidFormatBase62:
+		return nil
+	}
+	return fmt.Errorf("invalid uid_format %s. Must be uint64 or base62", format)
+}
+
+// formatUID returns the UID of a connection as it is written to the log in the UID format.
+func formatUID(uid uint64, format string) string {
+	if format == uidFormatBase62 {
+		return base62UID(uid)
+	}
+	return strconv.FormatUint(uid, 10)
+}
+
+// base62UID returns the Zeek-style form of the UID
+func base62UID(uid uint64) string {
+	var digits [12]byte
+	i := len(digits)
+	for {
+		i--
+		digits[i] = base62Digits[uid%62]
+		uid /= 62
+		if uid == 0 {
+			break
+		}
+	}
+	return "C" + string(digits[i:])
+}
@@ -2,10 +2,12 @@ package gourmet
 
 import (
 	"errors"
+	"fmt"
 	"log"
 	"net"
 	"os"
 	"strconv"
+	"strings"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/pcap"
@@ -26,6 +28,12 @@ func checkIfInterfaceExists(iface string) error {
 
 func getInterfaceAddresses(interfaceName string) (addresses []string) {
 	i, err := net.InterfaceByName(interfaceName)
+	if err != nil {
+		// libpcap devices are not named after their interface on Windows
+		if device, lookupErr := findCaptureDevice(interfaceName); lookupErr == nil && device.iface != nil {
+			i, err = device.iface, nil
+		}
+	}
 	if err != nil {
 		// this should never happen. If it does, our sensor is broken and needs to die...
 		panic("interface invalid")
@@ -40,6 +48,48 @@ func getInterfaceAddresses(interfaceName string) (addresses []string) {
 	return addresses
 }
 
+// IP formats select how addresses are written on connections. The canonical format is the
+// compressed lowercase form of RFC 5952 for IPv6 and the dotted decimal form without leading zeros
+// for IPv4, with IPv4-mapped IPv6 addresses written as IPv4. The expanded format writes every IPv6
+// address as eight zero padded lowercase groups, which some stores prefer for fixed-width keys.
+const (
+	ipFormatCanonical = "canonical"
+	ipFormatExpanded  = "expanded"
+)
+
+// ipExpanded is set when IPv6 addresses are written in the expanded format
+var ipExpanded bool
+
+func setIPFormat(format string) error {
+	switch format {
+	case "", ipFormatCanonical:
+		ipExpanded = false
+	case ipFormatExpanded:
+		ipExpanded = true
+	default:
+		return fmt.Errorf("invalid ip_format %s. Must be canonical or expanded", format)
+	}
+	return nil
+}
+
+// formatIP returns the string representation of an address in the configured IP format. It is used
+// wherever an address is set on a connection or event, so the same address is always written the
+// same way.
+func formatIP(ip net.IP) string {
+	if !ipExpanded || ip.To4() != nil || len(ip) != net.IPv6len {
+		return ip.String()
+	}
+	groups := make([]string, 0, 8)
+	for i := 0; i < net.IPv6len; i += 2 {
+		groups = append(groups, fmt.Sprintf("%02x%02x", ip[i], ip[i+1]))
+	}
+	return strings.Join(groups, ":")
+}
+
+func processAddresses(network gopacket.Flow) (srcIP, dstIP string) {
+	return formatIP(net.IP(network.Src().Raw())), formatIP(net.IP(network.Dst().Raw()))
+}
+
 func processPorts(transport gopacket.Flow) (srcPort, dstPort int) {
 	srcPort, _ = strconv.Atoi(transport.Src().String())
 	dstPort, _ = strconv.Atoi(transport.Dst().String())
@@ -0,0 +1,83 @@
+package gourmet
+
+import (
+	"fmt"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// ethernetTypeQinQLegacy is the ethertype of the outer tag of QinQ frames from switches that predate
+// 802.1ad
+const ethernetTypeQinQLegacy layers.EthernetType = 0x9100
+
+// decodeEthernet decodes an Ethernet frame like gopacket does, and also decodes the tags of the older
+// QinQ ethertype, which gopacket does not know but which are laid out like those of 802.1ad. The
+// ethertype is not registered with gopacket, which would change the decoding of every program that
+// embeds the sensor.
+var decodeEthernet = gopacket.DecodeFunc(func(data []byte, p gopacket.PacketBuilder) error {
+	eth := &layers.Ethernet{}
+	err := eth.DecodeFromBytes(data, p)
+	if err != nil {
+		return err
+	}
+	p.AddLayer(eth)
+	p.SetLinkLayer(eth)
+	if eth.EthernetType == ethernetTypeQinQLegacy && eth.Length == 0 {
+		return p.NextDecoder(layers.LayerTypeDot1Q)
+	}
+	return p.NextDecoder(eth.NextLayerType())
+})
+
+// frameDecoder returns the decoder of the packets of a source, which is decodeEthernet for Ethernet
+// links.
+func frameDecoder(decoder gopacket.Decoder) gopacket.Decoder {
+	if decoder == layers.LinkTypeEthernet || decoder == layers.LayerTypeEthernet {
+		return decodeEthernet
+	}
+	return decoder
+}
+
+// vlanIDs are the VLAN IDs of a packet, outermost first. They are carried in the ancillary data of
+// the capture info of the packet, so they reach the TCP stream the packet starts through the
+// assembler.
+type vlanIDs []int
+
+// tagVLANs adds the VLAN IDs of a packet to its capture info. The NIC may have stripped the outer tag
+// of a frame captured with afpacket, in which case its ID is only in the ancillary data of the
+// capture, and the tags left in the frame are inner ones. Tags are read before defragmentation, as
+// the reassembled datagram starts at the IP layer.
+func tagVLANs(packet gopacket.Packet, ci gopacket.CaptureInfo) gopacket.CaptureInfo {
+	var vlans vlanIDs
+	for _, data := range ci.AncillaryData {
+		if vlan, ok := strippedVLAN(data); ok {
+			vlans = append(vlans, vlan)
+		}
+	}
+	for _, layer := range packet.Layers() {
+		if tag, ok := layer.(*layers.Dot1Q); ok {
+			vlans = append(vlans, int(tag.VLANIdentifier))
+		}
+	}
+	if len(vlans) > 0 {
+		ci.AncillaryData = append(ci.AncillaryData, vlans)
+	}
+	return ci
+}
+
+// captureVLANs returns the VLAN IDs that tagVLANs found for a packet, or nil if it was not tagged.
+func captureVLANs(ci gopacket.CaptureInfo) []int {
+	for _, data := range ci.AncillaryData {
+		if vlans, ok := data.(vlanIDs); ok {
+			return vlans
+		}
+	}
+	return nil
+}
+
+// vlanFilter extends a BPF filter to frames with one or two VLAN tags. Every vlan primitive moves
+// the offsets of the rest of the filter past a tag, so the tagged alternatives are nested rather than
+// listed side by side.
+func vlanFilter(bpf string) string {
+	return fmt.Sprintf("(%[1]s) or (vlan and ((%[1]s) or (vlan and (%[1]s))))", bpf)
+}
@@ -0,0 +1,102 @@
+package gourmet
+
+import (
+	"bytes"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// vlanCapture returns a capture of the same connection on every VLAN of tags, each being the tags of
+// a frame outermost first. A frame with two tags has an outer tag of the older QinQ ethertype.
+func vlanCapture(t *testing.T, tags ...[]uint16) []byte {
+	var buf bytes.Buffer
+	w := pcapgo.NewWriter(&buf)
+	err := w.WriteFileHeader(65536, layers.LinkTypeEthernet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := testStart
+	for _, vlans := range tags {
+		for _, s := range []testSegment{
+			segment(handshakeClient, 1000, 0, "S", ""),
+			segment(handshakeServer, 5000, 1001, "SA", ""),
+			segment(handshakeClient, 1001, 5001, "PA", "GET / HTTP/1.1\r\n\r\n"),
+			segment(handshakeServer, 5001, 1019, "FA", ""),
+			segment(handshakeClient, 1019, 5002, "FA", ""),
+		} {
+			ip := &layers.IPv4{
+				Version:  4,
+				TTL:      64,
+				Protocol: layers.IPProtocolTCP,
+				SrcIP:    net.ParseIP(s.src).To4(),
+				DstIP:    net.ParseIP(s.dst).To4(),
+			}
+			_, tcp, _, err := decodeSegment(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tcp.SetNetworkLayerForChecksum(ip)
+			frame := []gopacket.SerializableLayer{&layers.Ethernet{
+				SrcMAC:       net.HardwareAddr{0, 0, 0, 0, 0, 1},
+				DstMAC:       net.HardwareAddr{0, 0, 0, 0, 0, 2},
+				EthernetType: layers.EthernetTypeDot1Q,
+			}}
+			if len(vlans) > 1 {
+				frame[0].(*layers.Ethernet).EthernetType = ethernetTypeQinQLegacy
+			}
+			for i, vlan := range vlans {
+				next := layers.EthernetTypeDot1Q
+				if i == len(vlans)-1 {
+					next = layers.EthernetTypeIPv4
+				}
+				frame = append(frame, &layers.Dot1Q{VLANIdentifier: vlan, Type: next})
+			}
+			frame = append(frame, ip, tcp, gopacket.Payload(s.payload))
+			data := gopacket.NewSerializeBuffer()
+			opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+			err = gopacket.SerializeLayers(data, opts, frame...)
+			if err == nil {
+				at = at.Add(time.Millisecond)
+				err = w.WritePacket(gopacket.CaptureInfo{
+					Timestamp:     at,
+					CaptureLength: len(data.Bytes()),
+					Length:        len(data.Bytes()),
+				}, data.Bytes())
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestVLANsKeepFlowsApart(t *testing.T) {
+	capture := vlanCapture(t, []uint16{10}, []uint16{100, 20})
+	config := Config{InterfaceType: "pcapfile"}
+	config.SetDefaults()
+	output := &recordingOutput{}
+	replay(t, &config, capture, output)
+	if len(output.connections) != 2 {
+		t.Fatalf("expected a connection per VLAN, got %d", len(output.connections))
+	}
+	sort.Slice(output.connections, func(i, j int) bool {
+		return len(output.connections[i].VLANs) < len(output.connections[j].VLANs)
+	})
+	for i, vlans := range [][]int{{10}, {100, 20}} {
+		c := output.connections[i]
+		if len(c.VLANs) != len(vlans) || c.VLANs[0] != vlans[0] || c.VLANs[len(vlans)-1] != vlans[len(vlans)-1] {
+			t.Errorf("expected VLANs %v, got %v", vlans, c.VLANs)
+		}
+		if c.SourceIP != handshakeClient.src || c.OrigPackets != 3 || c.RespPackets != 2 {
+			t.Errorf("expected both directions of %s on VLANs %v, got %s with %d and %d packets",
+				handshakeClient.src, vlans, c.SourceIP, c.OrigPackets, c.RespPackets)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package gourmet
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// overflowReportInterval is the least time between two warnings about a full analyzer queue
+const overflowReportInterval = time.Minute
+
+// analyzerPool runs the analyzers on a fixed number of workers, which take connections from a
+// bounded queue. Without a pool, connections are analyzed one at a time, and a slow analyzer holds
+// up every connection behind it until the capture path blocks on handing over new ones. A connection
+// that finds the queue full is logged right away without analyzer results instead, and counted as an
+// overflow, so that analysis is shed before packets are. With more than one worker, connections are
+// analyzed concurrently, so analyzers must be safe for concurrent use, and connections may be logged
+// in a different order than they were emitted.
+type analyzerPool struct {
+	queue chan *Connection
+	// block is set when a capture file is replayed, which waits for room in the queue rather than
+	// shedding analysis, as there are no packets to drop
+	block      bool
+	lastReport int64
+}
+
+// newAnalyzerPool returns nil if workers is not positive, which analyzes connections in the
+// goroutine that receives them.
+func newAnalyzerPool(workers, queueSize int, block bool) *analyzerPool {
+	if workers <= 0 {
+		return nil
+	}
+	return &analyzerPool{queue: make(chan *Connection, queueSize), block: block}
+}
+
+// submit queues a connection for analysis, and reports false if the queue is full.
+func (ap *analyzerPool) submit(c *Connection) bool {
+	if ap.block {
+		ap.queue <- c
+		return true
+	}
+	select {
+	case ap.queue <- c:
+		return true
+	default:
+	}
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&ap.lastReport)
+	if now-last >= int64(overflowReportInterval) && atomic.CompareAndSwapInt64(&ap.lastReport, last, now) {
+		log.Println("[!] Analyzer queue is full, logging connections without analysis")
+	}
+	return false
+}
+
+// runAnalyzers starts the workers of the pool, which analyze and log queued connections until quit
+// is closed.
+func (s *sensor) runAnalyzers(workers int, quit <-chan struct{}) {
+	for i := 0; i < workers; i++ {
+		go func() {
+			for {
+				select {
+				case <-quit:
+					return
+				case c := <-s.analyzers.queue:
+					s.analyzeConnection(c)
+					s.finishConnection(c)
+				}
+			}
+		}()
+	}
+}
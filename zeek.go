@@ -0,0 +1,361 @@
+package gourmet
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// zeekTimeFormat is the format of the #open and #close lines of a Zeek log
+const zeekTimeFormat = "2006-01-02-15-04-05"
+
+// zeekField is a column of a Zeek log, with its Zeek type
+type zeekField struct {
+	name string
+	kind string
+}
+
+var zeekIDFields = []zeekField{
+	{"ts", "time"},
+	{"uid", "string"},
+	{"id.orig_h", "addr"},
+	{"id.orig_p", "port"},
+	{"id.resp_h", "addr"},
+	{"id.resp_p", "port"},
+}
+
+var zeekConnFields = append(append([]zeekField{}, zeekIDFields...),
+	zeekField{"proto", "enum"},
+	zeekField{"service", "string"},
+	zeekField{"duration", "interval"},
+	zeekField{"orig_bytes", "count"},
+	zeekField{"resp_bytes", "count"},
+	zeekField{"conn_state", "string"},
+	zeekField{"local_orig", "bool"},
+	zeekField{"local_resp", "bool"},
+	zeekField{"history", "string"},
+	zeekField{"orig_pkts", "count"},
+	zeekField{"resp_pkts", "count"},
+)
+
+var zeekDNSFields = append(append([]zeekField{}, zeekIDFields...),
+	zeekField{"proto", "enum"},
+	zeekField{"trans_id", "count"},
+	zeekField{"query", "string"},
+	zeekField{"qtype_name", "string"},
+	zeekField{"rcode_name", "string"},
+	zeekField{"answers", "vector[string]"},
+	zeekField{"TTLs", "vector[interval]"},
+)
+
+var zeekHTTPFields = append(append([]zeekField{}, zeekIDFields...),
+	zeekField{"trans_depth", "count"},
+	zeekField{"method", "string"},
+	zeekField{"host", "string"},
+	zeekField{"uri", "string"},
+	zeekField{"version", "string"},
+	zeekField{"user_agent", "string"},
+	zeekField{"request_body_len", "count"},
+	zeekField{"response_body_len", "count"},
+	zeekField{"status_code", "count"},
+	zeekField{"resp_mime_types", "vector[string]"},
+)
+
+var zeekStatsFields = []zeekField{
+	{"ts", "time"},
+	{"peer", "string"},
+	{"mem", "count"},
+	{"pkts_proc", "count"},
+	{"pkts_dropped", "count"},
+	{"conns", "count"},
+	{"active_tcp_conns", "count"},
+	{"active_flows", "count"},
+	{"analyzer_errors", "count"},
+}
+
+// zeekOutput writes connections as Zeek tab-separated logs in a directory, so that tools built for
+// Zeek, such as zeek-cut, can read them. Every connection is written to conn.log, and the results of
+// the built-in DNS and HTTP analyzers to dns.log and http.log, one line per transaction, and stats
+// records to stats.log. Each log starts with the standard Zeek header, and is given a #close line
+// when the sensor shuts down. Preliminary records are not written, as Zeek logs a connection once.
+type zeekOutput struct {
+	dir   string
+	mutex sync.Mutex
+	logs  map[string]*zeekLog
+}
+
+// zeekLog is one log file of a zeekOutput, which is created with its header on its first line
+type zeekLog struct {
+	file   *os.File
+	fields []zeekField
+}
+
+func newZeekOutput(args map[string]interface{}) (*zeekOutput, error) {
+	dir, err := outputString(args, "dir", ".")
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &zeekOutput{
+		dir:  dir,
+		logs: make(map[string]*zeekLog),
+	}, nil
+}
+
+func (zo *zeekOutput) Write(c *Connection) error {
+	if c.Preliminary {
+		return nil
+	}
+	zo.mutex.Lock()
+	defer zo.mutex.Unlock()
+	err := zo.writeLine("conn", zeekConnFields, zeekConnLine(c))
+	if err != nil {
+		return err
+	}
+	if dns, ok := findResult(c, dnsAnalyzerName).(*DNSResult); ok {
+		for _, t := range dns.Transactions {
+			err = zo.writeLine("dns", zeekDNSFields, zeekDNSLine(c, t))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if http, ok := findResult(c, httpAnalyzerName).(*HTTPResult); ok {
+		for i, t := range http.Transactions {
+			err = zo.writeLine("http", zeekHTTPFields, zeekHTTPLine(c, i+1, t))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeStats writes a stats record to stats.log. The peer is the sensor, and mem is in megabytes as
+// in Zeek.
+func (zo *zeekOutput) writeStats(stats *SensorStats) error {
+	zo.mutex.Lock()
+	defer zo.mutex.Unlock()
+	return zo.writeLine("stats", zeekStatsFields, []string{
+		zeekTime(stats.Timestamp),
+		"gourmet",
+		strconv.FormatUint(stats.HeapBytes>>20, 10),
+		strconv.FormatUint(stats.PacketsCaptured, 10),
+		strconv.FormatUint(stats.PacketsDropped, 10),
+		strconv.FormatUint(stats.Connections, 10),
+		strconv.Itoa(stats.ActiveConnections),
+		strconv.Itoa(stats.ActiveFlows),
+		strconv.FormatUint(stats.AnalyzerErrors, 10),
+	})
+}
+
+// writeLine writes the values as a line of the log at path, creating the log if needed.
+func (zo *zeekOutput) writeLine(path string, fields []zeekField, values []string) error {
+	zl, ok := zo.logs[path]
+	if !ok {
+		// logs are appended to, so that a reload does not truncate them; Zeek tools read the header
+		// that each opening of the log writes
+		f, err := os.OpenFile(filepath.Join(zo.dir, path+".log"), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		zl = &zeekLog{file: f, fields: fields}
+		zo.logs[path] = zl
+		_, err = f.WriteString(zeekHeader(path, fields, time.Now()))
+		if err != nil {
+			return err
+		}
+	}
+	_, err := zl.file.WriteString(strings.Join(values, "\t") + "\n")
+	return err
+}
+
+func (zo *zeekOutput) Close() error {
+	zo.mutex.Lock()
+	defer zo.mutex.Unlock()
+	var firstErr error
+	for _, zl := range zo.logs {
+		_, err := fmt.Fprintf(zl.file, "#close\t%s\n", time.Now().Format(zeekTimeFormat))
+		if closeErr := zl.file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func zeekHeader(path string, fields []zeekField, open time.Time) string {
+	var names, kinds []string
+	for _, f := range fields {
+		names = append(names, f.name)
+		kinds = append(kinds, f.kind)
+	}
+	return "#separator \\x09\n" +
+		"#set_separator\t,\n" +
+		"#empty_field\t(empty)\n" +
+		"#unset_field\t-\n" +
+		"#path\t" + path + "\n" +
+		"#open\t" + open.Format(zeekTimeFormat) + "\n" +
+		"#fields\t" + strings.Join(names, "\t") + "\n" +
+		"#types\t" + strings.Join(kinds, "\t") + "\n"
+}
+
+// findResult returns the result stored under key in the Analyzers map of the connection, at its top
+// level or in a namespace, or nil if there is none.
+func findResult(c *Connection, key string) interface{} {
+	if result, ok := c.Analyzers[key]; ok {
+		return result
+	}
+	for _, value := range c.Analyzers {
+		if namespace, ok := value.(map[string]interface{}); ok {
+			if result, ok := namespace[key]; ok {
+				return result
+			}
+		}
+	}
+	return nil
+}
+
+func zeekIDValues(c *Connection) []string {
+	return []string{
+		zeekTime(c.Timestamp),
+		base62UID(c.uid),
+		zeekString(c.SourceIP),
+		strconv.Itoa(c.SourcePort),
+		zeekString(c.DestinationIP),
+		strconv.Itoa(c.DestinationPort),
+	}
+}
+
+func zeekConnLine(c *Connection) []string {
+	localOrig, localResp := zeekLocality(c.Locality)
+	return append(zeekIDValues(c),
+		zeekString(c.TransportType),
+		zeekOptional(c.Service),
+		strconv.FormatFloat(c.Duration, 'f', 6, 64),
+		zeekPayloadLen(c.ClientPayload),
+		zeekPayloadLen(c.ServerPayload),
+		zeekOptional(c.ConnState),
+		localOrig,
+		localResp,
+		zeekOptional(c.History),
+		strconv.FormatUint(c.OrigPackets, 10),
+		strconv.FormatUint(c.RespPackets, 10),
+	)
+}
+
+func zeekDNSLine(c *Connection, t *DNSTransaction) []string {
+	var answers, ttls []string
+	for _, a := range t.Answers {
+		answers = append(answers, a.Data)
+		ttls = append(ttls, strconv.FormatFloat(float64(a.TTL), 'f', 6, 64))
+	}
+	return append(zeekIDValues(c),
+		zeekString(c.TransportType),
+		strconv.Itoa(int(t.ID)),
+		zeekString(t.Query),
+		zeekOptional(t.QueryType),
+		zeekOptional(t.RCode),
+		zeekVector(answers),
+		zeekVector(ttls),
+	)
+}
+
+func zeekHTTPLine(c *Connection, depth int, t *HTTPTransaction) []string {
+	status, responseLen, mimeTypes := "-", "-", "-"
+	if t.StatusCode != 0 {
+		status = strconv.Itoa(t.StatusCode)
+		responseLen = strconv.FormatInt(t.ResponseBodyLength, 10)
+		if t.ContentType != "" {
+			mimeTypes = zeekString(t.ContentType)
+		}
+	}
+	return append(zeekIDValues(c),
+		strconv.Itoa(depth),
+		zeekString(t.Method),
+		zeekOptional(t.Host),
+		zeekString(t.URI),
+		zeekOptional(strings.TrimPrefix(t.Version, "HTTP/")),
+		zeekOptional(t.UserAgent),
+		strconv.FormatInt(t.RequestBodyLength, 10),
+		responseLen,
+		status,
+		mimeTypes,
+	)
+}
+
+// zeekLocality returns the local_orig and local_resp values of a locality, which are unset if no
+// local networks are configured.
+func zeekLocality(locality string) (string, string) {
+	switch locality {
+	case LocalityInternal:
+		return "T", "T"
+	case LocalityExternal:
+		return "F", "F"
+	case LocalityOutbound:
+		return "T", "F"
+	case LocalityInbound:
+		return "F", "T"
+	}
+	return "-", "-"
+}
+
+func zeekTime(t time.Time) string {
+	return strconv.FormatFloat(float64(t.UnixNano())/float64(time.Second), 'f', 6, 64)
+}
+
+func zeekPayloadLen(p Payload) string {
+	if p == nil {
+		return "-"
+	}
+	return strconv.Itoa(p.Len())
+}
+
+// zeekOptional returns the escaped string, or the unset field if it is empty.
+func zeekOptional(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return zeekString(s)
+}
+
+func zeekVector(values []string) string {
+	if len(values) == 0 {
+		return "-"
+	}
+	escaped := make([]string, len(values))
+	for i, v := range values {
+		escaped[i] = strings.Replace(zeekString(v), ",", "\\x2c", -1)
+	}
+	return strings.Join(escaped, ",")
+}
+
+// zeekString escapes a string the way Zeek does, so that it cannot break the columns of a line or be
+// read as the empty or unset field.
+func zeekString(s string) string {
+	switch s {
+	case "":
+		return "(empty)"
+	case "-":
+		return "\\x2d"
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if ch == '\\' || ch < 0x20 || ch >= 0x7f {
+			fmt.Fprintf(&b, "\\x%02x", ch)
+			continue
+		}
+		b.WriteByte(ch)
+	}
+	return b.String()
+}
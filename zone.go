@@ -0,0 +1,100 @@
+package gourmet
+
+import (
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket"
+)
+
+// Networks behind different VLANs, or carried in different tunnels, may reuse the same addresses, so
+// flows are told apart by their zone as well as by their addresses and ports. The zone of a packet is
+// the list of VLAN IDs it was tagged with, and the type, network identifier, and endpoints of the
+// tunnel it was taken out of. It is empty for untagged traffic outside of tunnels, whose flows are
+// keyed as they always were.
+
+// endpointZoned is the endpoint type of the network flows that key the TCP streams of a zone. Numbers
+// below 1000 are reserved for gopacket.
+var endpointZoned = gopacket.RegisterEndpointType(1000, gopacket.EndpointTypeMetadata{
+	Name:      "Zoned",
+	Formatter: hex.EncodeToString,
+})
+
+// zoneOf returns the zone of traffic tagged with the VLAN IDs and carried in the tunnel, either of
+// which may be missing.
+func zoneOf(vlans []int, tunnel *Tunnel) string {
+	if len(vlans) == 0 && tunnel == nil {
+		return ""
+	}
+	var zone strings.Builder
+	if len(vlans) > 0 {
+		zone.WriteString("vlan")
+		for _, vlan := range vlans {
+			zone.WriteByte('.')
+			zone.WriteString(strconv.Itoa(vlan))
+		}
+	}
+	if tunnel != nil {
+		// both directions of a flow are carried between the same endpoints, in opposite directions
+		a, b := tunnel.SourceIP, tunnel.DestinationIP
+		if b < a {
+			a, b = b, a
+		}
+		fmt.Fprintf(&zone, "|%s.%d.%s.%s", tunnel.Type, tunnel.ID, a, b)
+	}
+	return zone.String()
+}
+
+// captureZone returns the zone of a packet, from the VLAN IDs that tagVLANs and the tunnel that
+// decapsulate added to its capture info.
+func captureZone(ci gopacket.CaptureInfo) string {
+	return zoneOf(captureVLANs(ci), captureTunnel(ci))
+}
+
+// zonedAddresses is the network flow of a packet whose TCP stream is keyed by a zoned flow. It is
+// carried in the ancillary data of the capture info, so that the stream the packet starts knows its
+// addresses.
+type zonedAddresses gopacket.Flow
+
+// zonedFlow returns the network flow that keys the TCP streams of a zone, which is the flow itself
+// outside of any zone. An endpoint has no room for both an IPv6 address and a zone, so the endpoints
+// of a zoned flow are hashes of the zone and of their address.
+func zonedFlow(netFlow gopacket.Flow, zone string) gopacket.Flow {
+	if zone == "" {
+		return netFlow
+	}
+	return gopacket.NewFlow(endpointZoned, zoneEndpoint(zone, netFlow.Src()), zoneEndpoint(zone, netFlow.Dst()))
+}
+
+func zoneEndpoint(zone string, endpoint gopacket.Endpoint) []byte {
+	h := fnv.New128a()
+	h.Write([]byte(zone))
+	h.Write([]byte{0})
+	h.Write(endpoint.Raw())
+	return h.Sum(nil)
+}
+
+// zoneTCP returns the flow that keys a TCP segment in the connection table, and its capture info with
+// the addresses of the segment if the flow is zoned.
+func zoneTCP(netFlow gopacket.Flow, ci gopacket.CaptureInfo) (gopacket.Flow, gopacket.CaptureInfo) {
+	zone := captureZone(ci)
+	if zone == "" {
+		return netFlow, ci
+	}
+	ci.AncillaryData = append(ci.AncillaryData, zonedAddresses(netFlow))
+	return zonedFlow(netFlow, zone), ci
+}
+
+// streamAddresses returns the addresses of the TCP stream that the packet of the capture info
+// starts, whose key is netFlow.
+func streamAddresses(netFlow gopacket.Flow, ci gopacket.CaptureInfo) gopacket.Flow {
+	for _, data := range ci.AncillaryData {
+		if addresses, ok := data.(zonedAddresses); ok {
+			return gopacket.Flow(addresses)
+		}
+	}
+	return netFlow
+}